@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writeJSON writes a value as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
+
+// writeJSONError writes an error message as a JSON response
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// extendWriteDeadline lets a handler that legitimately runs long, such as a long poll,
+// outlive the server's write timeout. A zero duration removes the deadline.
+func extendWriteDeadline(w http.ResponseWriter, d time.Duration) {
+	var deadline time.Time
+	if d > 0 {
+		deadline = time.Now().Add(d)
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("Failed to extend write deadline: %v", err)
+	}
+}
+
+// apiCheckHandler reports whether a host port is safe to use,
+// e.g. GET /api/check?port=8080&proto=tcp
+func (app *Application) apiCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	port, err := strconv.Atoi(r.URL.Query().Get("port"))
+	if err != nil || port < 1 || port > 65535 {
+		writeJSONError(w, http.StatusBadRequest, "port must be a number between 1 and 65535")
+		return
+	}
+
+	protocol := strings.ToLower(r.URL.Query().Get("proto"))
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		writeJSONError(w, http.StatusBadRequest, "proto must be tcp or udp")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, app.containerStore.CheckPort(port, protocol))
+}
+
+// apiContainersHandler lists the containers and their port mappings, optionally only
+// those of one project or started recently, and newest first,
+// e.g. GET /api/containers?project=app1&since=10m&sort=newest
+func (app *Application) apiContainersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	since, err := parseSince(r.URL.Query().Get("since"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy != "" && sortBy != "name" && sortBy != "newest" {
+		writeJSONError(w, http.StatusBadRequest, "sort must be name or newest")
+		return
+	}
+
+	var containers []Container
+	if project := r.URL.Query().Get("project"); project != "" {
+		containers = app.containerStore.GetContainersForProject(project)
+	} else {
+		containers = app.containerStore.GetContainers()
+	}
+	containers = sortContainers(startedWithin(containers, since, time.Now()), sortBy)
+	if containers == nil {
+		containers = []Container{}
+	}
+	writeJSON(w, http.StatusOK, containers)
+}
+
+// authorized reports whether a request carries the configured auth token, as
+// "Authorization: Bearer <token>". Requests are always authorized when no token is set.
+func (app *Application) authorized(r *http.Request) bool {
+	if app.authToken == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(app.authToken)) == 1
+}
+
+// crossSite reports whether a browser sent a request on behalf of another site, e.g.
+// a form on some page the operator visits posting to the API. Browsers say so in
+// Sec-Fetch-Site, or else in an Origin that isn't ours; other clients send neither.
+func crossSite(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site != "same-origin" && site != "none"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || !strings.EqualFold(u.Host, r.Host)
+}
+
+// allowChange checks that a request changing containers or the instance is neither
+// cross-site nor missing the auth token, writing the error response if it is
+func (app *Application) allowChange(w http.ResponseWriter, r *http.Request) bool {
+	if crossSite(r) {
+		writeJSONError(w, http.StatusForbidden, "cross-site requests can't change containers")
+		return false
+	}
+	if !app.authorized(r) {
+		writeJSONError(w, http.StatusUnauthorized, "missing or invalid auth token")
+		return false
+	}
+	return true
+}
+
+// apiRemapHandler recreates a container with newly allocated host ports and returns
+// the updated container, e.g. POST /api/container/{id}/remap
+func (app *Application) apiRemapHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.allowChange(w, r) {
+		return
+	}
+
+	// Recreating a container includes waiting for it to become ready, which may
+	// take longer than the server's write timeout
+	extendWriteDeadline(w, 0)
+	container, err := app.containerStore.ForceRemap(r.PathValue("id"))
+	switch {
+	case errors.Is(err, errContainerNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errAmbiguousID):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errRemapDisabled), errors.Is(err, errContainerExcluded):
+		writeJSONError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, errPortExhausted), errors.Is(err, errDockerUnavailable):
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+	case err != nil:
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, container)
+	}
+}
+
+// apiForgetHandler drops a container from the store without touching Docker and
+// returns the forgotten container, e.g. POST /api/container/{id}/forget
+func (app *Application) apiForgetHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.allowChange(w, r) {
+		return
+	}
+
+	container, err := app.containerStore.Forget(r.PathValue("id"))
+	switch {
+	case errors.Is(err, errContainerNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errAmbiguousID):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	case err != nil:
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, container)
+	}
+}
+
+// apiPauseHandler stops remapping started containers until resumed, e.g. during
+// maintenance, and returns the new state, e.g. POST /api/pause
+func (app *Application) apiPauseHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.allowChange(w, r) {
+		return
+	}
+
+	app.containerStore.Pause()
+	writeJSON(w, http.StatusOK, pauseState{Paused: true})
+}
+
+// apiResumeHandler resumes remapping started containers and returns the new state,
+// e.g. POST /api/resume
+func (app *Application) apiResumeHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.allowChange(w, r) {
+		return
+	}
+
+	app.containerStore.Resume()
+	writeJSON(w, http.StatusOK, pauseState{Paused: false})
+}
+
+// maxWaitTimeout bounds how long a long-poll request may block
+const maxWaitTimeout = 5 * time.Minute
+
+// apiWaitHandler long-polls for remaps: it blocks until a remap newer than the given
+// cursor completes or the timeout passes, then returns the new events and the cursor
+// to pass next time, e.g. GET /api/wait?since=12&timeout=30s. Without since, only
+// remaps from now on are returned.
+func (app *Application) apiWaitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	cursor := app.containerStore.RemapCursor()
+	if value := r.URL.Query().Get("since"); value != "" {
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "since must be a cursor returned by a previous call")
+			return
+		}
+		cursor = n
+	}
+
+	timeout := 30 * time.Second
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 || d > maxWaitTimeout {
+			writeJSONError(w, http.StatusBadRequest, "timeout must be a positive duration of at most 5m")
+			return
+		}
+		timeout = d
+	}
+
+	// The request context ends the wait early when the client goes away
+	extendWriteDeadline(w, timeout+5*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	events, next := app.containerStore.WaitForRemaps(ctx, cursor)
+	writeJSON(w, http.StatusOK, struct {
+		Events []RemapEvent `json:"events"`
+		Cursor uint64       `json:"cursor"`
+	}{events, next})
+}
+
+// apiHistoryHandler returns the chronological remap history of a service, which spans
+// the successive containers it was recreated as, e.g. GET /api/history?service=web
+func (app *Application) apiHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, app.containerStore.RemapHistory(r.URL.Query().Get("service")))
+}
+
+// apiSlowRemapsHandler lists the slowest recent remaps with their phase timings,
+// e.g. GET /api/remaps/slowest?limit=5
+func (app *Application) apiSlowRemapsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	limit := 10
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+
+	writeJSON(w, http.StatusOK, app.containerStore.SlowestRemaps(limit))
+}
+
+// apiDebugPortsHandler dumps the allocator's view of the host ports, to find out why
+// a port was picked. It is only registered with -debug.
+func (app *Application) apiDebugPortsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, app.containerStore.AllocatorState())
+}
+
+// healthStatus is the response body of the health endpoint
+type healthStatus struct {
+	Status         string `json:"status"`
+	Error          string `json:"error,omitempty"`
+	RangeExhausted bool   `json:"rangeExhausted"`
+	Paused         bool   `json:"paused"`
+}
+
+// healthzHandler reports whether the application can currently reach Docker,
+// and whether the dynamic port range has run out of free ports
+func (app *Application) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{
+		Status:         "ok",
+		RangeExhausted: app.containerStore.RangeExhausted(),
+		Paused:         app.containerStore.Paused(),
+	}
+	if err := app.containerStore.Healthy(); err != nil {
+		status.Status = "unhealthy"
+		status.Error = err.Error()
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
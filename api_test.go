@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAllowChange(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		headers map[string]string
+		want    int
+	}{
+		{"no token, plain client", "", nil, http.StatusOK},
+		{"no token, same origin", "", map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "http://localhost:5000"}, http.StatusOK},
+		{"no token, cross-site fetch", "", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"no token, foreign origin", "", map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+		{"token, bearer", "secret", map[string]string{"Authorization": "Bearer secret"}, http.StatusOK},
+		{"token, bare token", "secret", map[string]string{"Authorization": "secret"}, http.StatusUnauthorized},
+		{"token, wrong token", "secret", map[string]string{"Authorization": "Bearer nope"}, http.StatusUnauthorized},
+		{"token, cross-site with token", "secret", map[string]string{"Authorization": "Bearer secret", "Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &Application{authToken: tt.token}
+			r := httptest.NewRequest(http.MethodPost, "http://localhost:5000/api/pause", nil)
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+			status := http.StatusOK
+			if !app.allowChange(w, r) {
+				status = w.Code
+			}
+			if status != tt.want {
+				t.Errorf("status = %d, want %d", status, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIContainersProject(t *testing.T) {
+	store := NewContainerStore(StoreOptions{})
+	store.containers["a"] = Container{ID: "a", Names: "app1_web_1", ComposeProject: "app1", Status: "Up 1 minute"}
+	store.containers["b"] = Container{ID: "b", Names: "app2_web_1", ComposeProject: "app2", Status: "Up 1 minute"}
+	store.containers["c"] = Container{ID: "c", Names: "redis", Status: "Up 1 minute"}
+	app := &Application{containerStore: store}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"a", "b", "c"}},
+		{"?project=app1", []string{"a"}},
+		{"?project=standalone", []string{"c"}},
+		{"?project=missing", []string{}},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		app.apiContainersHandler(w, httptest.NewRequest(http.MethodGet, "/api/containers"+tt.query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /api/containers%s returned status %d", tt.query, w.Code)
+		}
+		var containers []Container
+		if err := json.Unmarshal(w.Body.Bytes(), &containers); err != nil {
+			t.Fatalf("GET /api/containers%s returned invalid JSON: %v", tt.query, err)
+		}
+		ids := []string{}
+		for _, container := range containers {
+			ids = append(ids, container.ID)
+		}
+		if !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("GET /api/containers%s listed %v, want %v", tt.query, ids, tt.want)
+		}
+	}
+}
+
+func TestAPICheck(t *testing.T) {
+	store := NewContainerStore(StoreOptions{})
+	store.containers["a"] = Container{ID: "a", Names: "web", Status: "Up 1 minute", PortMappings: []PortMapping{{ContainerPort: "80", HostPort: "20005", Protocol: "tcp"}}}
+	app := &Application{containerStore: store}
+
+	// A port held by a process outside Docker, and one nothing holds
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	hostPort := listener.Addr().(*net.TCPAddr).Port
+	closed, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freePort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	tests := []struct {
+		query string
+		want  PortStatus
+	}{
+		{fmt.Sprintf("port=%d", freePort), PortStatus{Port: freePort, Protocol: "tcp", Status: PortStatusFree}},
+		{"port=20005&proto=tcp", PortStatus{Port: 20005, Protocol: "tcp", Status: PortStatusContainer, ContainerID: "a", ContainerName: "web"}},
+		{fmt.Sprintf("port=%d&proto=tcp", hostPort), PortStatus{Port: hostPort, Protocol: "tcp", Status: PortStatusHost}},
+		{fmt.Sprintf("port=%d&proto=udp", hostPort), PortStatus{Port: hostPort, Protocol: "udp", Status: PortStatusFree}},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		app.apiCheckHandler(w, httptest.NewRequest(http.MethodGet, "/api/check?"+tt.query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /api/check?%s returned status %d", tt.query, w.Code)
+		}
+		var got PortStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("GET /api/check?%s returned invalid JSON: %v", tt.query, err)
+		}
+		if got != tt.want {
+			t.Errorf("GET /api/check?%s = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+
+	for _, query := range []string{"", "port=0", "port=70000", "port=80&proto=sctp"} {
+		w := httptest.NewRecorder()
+		app.apiCheckHandler(w, httptest.NewRequest(http.MethodGet, "/api/check?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET /api/check?%s returned status %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAPIForget(t *testing.T) {
+	store := NewContainerStore(StoreOptions{})
+	const id = "abc123def456"
+	store.containers[id] = Container{ID: id, Names: "web"}
+	store.portMappings[id] = map[string]string{portMappingKey("", "80", "tcp"): "20005"}
+	store.processedContainers[id] = true
+	store.conflicts[id] = map[string]bool{"80/tcp": true}
+	store.portReasons[id] = map[string]string{"80/tcp": reasonOutOfRange}
+	store.containers["other"] = Container{ID: "other", Names: "api"}
+	app := &Application{containerStore: store}
+
+	forget := func(ref string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/container/"+ref+"/forget", nil)
+		r.SetPathValue("id", ref)
+		w := httptest.NewRecorder()
+		app.apiForgetHandler(w, r)
+		return w
+	}
+
+	w := forget("abc")
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /api/container/abc/forget returned status %d: %s", w.Code, w.Body)
+	}
+	var forgotten Container
+	if err := json.Unmarshal(w.Body.Bytes(), &forgotten); err != nil || forgotten.ID != id {
+		t.Errorf("forget returned %s, want container %s", w.Body, id)
+	}
+	_, inContainers := store.containers[id]
+	_, inMappings := store.portMappings[id]
+	_, inProcessed := store.processedContainers[id]
+	_, inConflicts := store.conflicts[id]
+	_, inReasons := store.portReasons[id]
+	if inContainers || inMappings || inProcessed || inConflicts || inReasons {
+		t.Errorf("container is still in containers %v, portMappings %v, processedContainers %v, conflicts %v, portReasons %v",
+			inContainers, inMappings, inProcessed, inConflicts, inReasons)
+	}
+	if _, kept := store.containers["other"]; !kept {
+		t.Error("another container was forgotten too")
+	}
+
+	if w := forget(id); w.Code != http.StatusNotFound {
+		t.Errorf("forgetting it again returned status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAPIRemap(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	store := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	if err := store.refreshContainers(); err != nil {
+		t.Fatal(err)
+	}
+
+	app := &Application{containerStore: store}
+	r := httptest.NewRequest(http.MethodPost, "/api/container/aaaa/remap", nil)
+	r.SetPathValue("id", "aaaa")
+	w := httptest.NewRecorder()
+	app.apiRemapHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /api/container/aaaa/remap returned status %d: %s", w.Code, w.Body)
+	}
+	if got := callNames(docker.changes()); !reflect.DeepEqual(got, []string{"stop", "rename", "run", "rm"}) {
+		t.Errorf("docker was called with %v, want the container recreated", got)
+	}
+
+	var container Container
+	if err := json.Unmarshal(w.Body.Bytes(), &container); err != nil {
+		t.Fatalf("invalid response %s: %v", w.Body, err)
+	}
+	if container.ID == "aaaa" || len(container.PortMappings) != 1 {
+		t.Fatalf("response holds %+v, want the recreated container", container)
+	}
+	mapping := container.PortMappings[0]
+	if port, _ := strconv.Atoi(mapping.HostPort); port < 20000 || port > 20999 || mapping.OriginalPort != "8080" {
+		t.Errorf("port 80 is published on %s (originally %s), want a port in 20000-20999 (originally 8080)", mapping.HostPort, mapping.OriginalPort)
+	}
+}
+
+func TestAPIRemapErrorStatus(t *testing.T) {
+	web := Container{ID: "abc123def456", Names: "web", Image: "nginx", PortMappings: []PortMapping{{ContainerPort: "80", HostPort: "8080", Protocol: "tcp"}}}
+	tests := []struct {
+		name    string
+		opts    StoreOptions
+		ref     string
+		wantErr error
+		want    int
+	}{
+		{"unknown container", StoreOptions{}, "fff", errContainerNotFound, http.StatusNotFound},
+		{"read-only", StoreOptions{ReadOnly: true}, "abc", errRemapDisabled, http.StatusConflict},
+		{"excluded image", StoreOptions{NoRecreateImages: imagePatterns{"nginx"}}, "abc", errContainerExcluded, http.StatusConflict},
+		{"exhausted range", StoreOptions{PortRangeMin: 20000, PortRangeMax: 20000, ReservedPorts: []int{20000}}, "abc", errPortExhausted, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewContainerStore(tt.opts)
+			store.containers[web.ID] = web
+			if _, err := store.ForceRemap(tt.ref); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ForceRemap(%q) = %v, want an error wrapping %v", tt.ref, err, tt.wantErr)
+			}
+
+			app := &Application{containerStore: store}
+			r := httptest.NewRequest(http.MethodPost, "/api/container/"+tt.ref+"/remap", nil)
+			r.SetPathValue("id", tt.ref)
+			w := httptest.NewRecorder()
+			app.apiRemapHandler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("POST /api/container/%s/remap returned status %d, want %d: %s", tt.ref, w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestAPIWaitUnblocksOnRemap(t *testing.T) {
+	store := NewContainerStore(StoreOptions{})
+	app := &Application{containerStore: store}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		app.apiWaitHandler(w, httptest.NewRequest(http.MethodGet, "/api/wait?since=0&timeout=10s", nil))
+		done <- w
+	}()
+	select {
+	case w := <-done:
+		t.Fatalf("wait returned before any remap: %s", w.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	store.publishRemapEvent(RemapEvent{ContainerID: "aaaa", NewContainerID: "bbbb", ContainerName: "web", ContainerPort: "80", Protocol: "tcp", OldHostPort: "8080", NewHostPort: "20005"})
+	var w *httptest.ResponseRecorder
+	select {
+	case w = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait is still blocked after a remap")
+	}
+	var response struct {
+		Events []RemapEvent `json:"events"`
+		Cursor uint64       `json:"cursor"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %s: %v", w.Body, err)
+	}
+	if response.Cursor != 1 || len(response.Events) != 1 {
+		t.Fatalf("wait returned %s, want the one remap and cursor 1", w.Body)
+	}
+	if event := response.Events[0]; event.Seq != 1 || event.ContainerName != "web" || event.OldHostPort != "8080" || event.NewHostPort != "20005" {
+		t.Errorf("wait returned event %+v, want web moving from 8080 to 20005", event)
+	}
+
+	// Waiting from the returned cursor times out with no events
+	w = httptest.NewRecorder()
+	app.apiWaitHandler(w, httptest.NewRequest(http.MethodGet, "/api/wait?since=1&timeout=50ms", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"events":[]`) {
+		t.Errorf("wait from the latest cursor returned %d %s, want no events", w.Code, w.Body)
+	}
+}
+
+func TestAPIDebugPorts(t *testing.T) {
+	store := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20009, ReservedPorts: []int{20001}})
+	store.containers["a"] = Container{ID: "a", Names: "web", PortMappings: []PortMapping{{ContainerPort: "80", HostPort: "20002", Protocol: "tcp"}}}
+	allocated, err := store.allocateRandomPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.releasePort(allocated)
+
+	get := func(debug bool) *httptest.ResponseRecorder {
+		app, err := NewApplication(store, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.debug = debug
+		mux := http.NewServeMux()
+		app.registerRoutes(mux)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/debug/ports", nil))
+		return w
+	}
+	if w := get(false); w.Code != http.StatusNotFound {
+		t.Errorf("GET /api/debug/ports without -debug returned status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	w := get(true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/debug/ports returned status %d: %s", w.Code, w.Body)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &fields); err != nil {
+		t.Fatalf("invalid response %s: %v", w.Body, err)
+	}
+	for _, key := range []string{"rangeMin", "rangeMax", "reservedPorts", "usedPorts", "claimedPorts", "freeInRange", "rangeExhausted", "recentAllocations"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("response lacks %s: %s", key, w.Body)
+		}
+	}
+
+	var state AllocatorState
+	if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.RangeMin != 20000 || state.RangeMax != 20009 {
+		t.Errorf("range = %d-%d, want 20000-20009", state.RangeMin, state.RangeMax)
+	}
+	if !reflect.DeepEqual(state.ReservedPorts, []int{20001}) || !reflect.DeepEqual(state.UsedPorts, []int{20002}) || !reflect.DeepEqual(state.ClaimedPorts, []int{allocated}) {
+		t.Errorf("reserved %v, used %v, claimed %v, want [20001], [20002] and [%d]", state.ReservedPorts, state.UsedPorts, state.ClaimedPorts, allocated)
+	}
+	if state.FreeInRange > 7 {
+		t.Errorf("%d ports are free, but only 7 of the 10 in range are neither reserved, used nor claimed", state.FreeInRange)
+	}
+	if len(state.RecentAllocations) != 1 || state.RecentAllocations[0].Port != allocated || state.RecentAllocations[0].Range != "20000-20009" {
+		t.Errorf("recent allocations = %+v, want only %d from 20000-20009", state.RecentAllocations, allocated)
+	}
+}
+
+func TestAPIHistoryAccumulatesRemaps(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "shop-web-1", Ports: []string{"8080:80/tcp"},
+		Labels: map[string]string{"com.docker.compose.project": "shop", "com.docker.compose.service": "web"}})
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	store := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, StateFile: stateFile})
+
+	// Remapped once out of 8080, then again by hand under its new ID
+	store.evaluateContainer("aaaa")
+	first := fmt.Sprintf("%064x", 0xf00001)
+	if _, err := store.ForceRemap(first); err != nil {
+		t.Fatalf("ForceRemap failed: %v", err)
+	}
+
+	app := &Application{containerStore: store}
+	w := httptest.NewRecorder()
+	app.apiHistoryHandler(w, httptest.NewRequest(http.MethodGet, "/api/history?service=web", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/history returned status %d: %s", w.Code, w.Body)
+	}
+	var history []RemapHistoryEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil {
+		t.Fatalf("invalid response %s: %v", w.Body, err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("history has %d entries, want both remaps: %s", len(history), w.Body)
+	}
+	if history[0].Service != "shop/web" || history[0].From != "8080" || history[1].From != history[0].To || history[1].To == history[0].To {
+		t.Errorf("history = %+v, want shop/web moving from 8080 and then on from there", history)
+	}
+	if history[1].Time.Before(history[0].Time) {
+		t.Errorf("history isn't in chronological order: %+v", history)
+	}
+
+	// The history outlives the process
+	restarted := NewContainerStore(StoreOptions{StateFile: stateFile})
+	if err := restarted.loadState(); err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+	if got := restarted.RemapHistory("shop/web"); len(got) != 2 {
+		t.Errorf("restored history has %d entries, want 2", len(got))
+	}
+}
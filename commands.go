@@ -0,0 +1,889 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+// errConflictsFound is returned by commands that check for port conflicts when they
+// found some, after reporting them, so main can exit with a failure status
+var errConflictsFound = errors.New("port conflicts found")
+
+// renderOutput writes data in the requested output format. Table output is produced
+// by the given function; json and yaml serialize data directly.
+func renderOutput(w io.Writer, format string, data interface{}, table func(w io.Writer)) error {
+	switch format {
+	case "", "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		table(tw)
+		return tw.Flush()
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(data)
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(data); err != nil {
+			return err
+		}
+		return encoder.Close()
+	default:
+		return fmt.Errorf("unknown output format %q, must be table, json or yaml", format)
+	}
+}
+
+// addOutputFlag registers the --output flag shared by reporting subcommands
+func addOutputFlag(flags *flag.FlagSet) *string {
+	return flags.String("output", "table", "Output format: table, json or yaml")
+}
+
+// formatPortMappings renders a container's port mappings for table output
+func formatPortMappings(mappings []PortMapping) string {
+	var parts []string
+	for _, mapping := range mappings {
+		part := fmt.Sprintf("%s->%s/%s", mapping.HostPort, mapping.ContainerPort, mapping.Protocol)
+		if mapping.OriginalPort != "" && mapping.OriginalPort != mapping.HostPort {
+			part += fmt.Sprintf(" (was %s)", mapping.OriginalPort)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// stringListFlag collects the values of a flag that may be repeated
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// parsePortList parses a comma-separated list of ports and MIN-MAX ranges
+func parsePortList(value string) ([]int, error) {
+	var ports []int
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, "-") {
+			minPort, maxPort, err := parsePortRange(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port range %q: %v", item, err)
+			}
+			for port := minPort; port <= maxPort; port++ {
+				ports = append(ports, port)
+			}
+			continue
+		}
+		port, err := strconv.Atoi(item)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// parseNameSet parses a comma-separated list of names into a set
+func parseNameSet(value string) map[string]bool {
+	names := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			names[item] = true
+		}
+	}
+	return names
+}
+
+// extractReportPath removes the --report flag from the compose arguments and returns
+// its value along with the remaining arguments
+func extractReportPath(args []string) (string, []string) {
+	var reportPath string
+	var remaining []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--report" && i+1 < len(args):
+			reportPath = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "--report="):
+			reportPath = strings.TrimPrefix(arg, "--report=")
+		default:
+			remaining = append(remaining, arg)
+		}
+	}
+	return reportPath, remaining
+}
+
+// extractNoSummary removes our --no-summary flag from the compose arguments
+func extractNoSummary(args []string) (bool, []string) {
+	noSummary := false
+	var remaining []string
+	for _, arg := range args {
+		if arg == "--no-summary" {
+			noSummary = true
+			continue
+		}
+		remaining = append(remaining, arg)
+	}
+	return noSummary, remaining
+}
+
+// composeSubcommand returns the docker-compose subcommand in the arguments, e.g. "up"
+func composeSubcommand(args []string) string {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return arg
+		}
+	}
+	return ""
+}
+
+// ComposeSummaryEntry is the host port a compose service ended up published on
+type ComposeSummaryEntry struct {
+	Service       string
+	ContainerPort string
+	Protocol      string
+	HostPort      string
+	OriginalPort  string // The port declared in the compose file, if it was remapped
+}
+
+// composeSummary lists the final host port of every published service port, given
+// the remappings applied to the compose file
+func composeSummary(services map[string]interface{}, remappings map[string]string) []ComposeSummaryEntry {
+	var entries []ComposeSummaryEntry
+	for serviceName, serviceConfig := range services {
+		serviceMap, ok := serviceConfig.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ports, _ := serviceMap["ports"].([]interface{})
+		for _, port := range ports {
+			hostPort, containerPort, protocol, ok := parseComposePort(port)
+			if !ok {
+				continue
+			}
+			entry := ComposeSummaryEntry{Service: serviceName, ContainerPort: containerPort, Protocol: protocol, HostPort: hostPort}
+			if newPort, remapped := remappings[serviceName+":"+hostPort]; remapped {
+				entry.HostPort, entry.OriginalPort = newPort, hostPort
+			}
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.ContainerPort != b.ContainerPort {
+			return a.ContainerPort < b.ContainerPort
+		}
+		return a.Protocol < b.Protocol
+	})
+	return entries
+}
+
+// printComposeSummary prints where each service of a compose run can be reached
+func printComposeSummary(w io.Writer, entries []ComposeSummaryEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tCONTAINER PORT\tHOST PORT\t")
+	for _, entry := range entries {
+		note := ""
+		if entry.OriginalPort != "" {
+			note = fmt.Sprintf("(remapped from %s)", entry.OriginalPort)
+		}
+		fmt.Fprintf(tw, "%s\t%s/%s\t%s\t%s\n", entry.Service, entry.ContainerPort, entry.Protocol, entry.HostPort, note)
+	}
+	return tw.Flush()
+}
+
+// finishComposeRun reports the outcome of a successful compose run: a summary of every
+// service's host ports after commands that start services, unless turned off, and the
+// --report file if one was asked for
+func finishComposeRun(composeFile string, profiles, args []string, remappings map[string]string, reportPath string, noSummary bool) error {
+	switch composeSubcommand(args) {
+	case "up", "start", "restart":
+		if noSummary {
+			break
+		}
+		services, err := loadComposeServices(composeFile, profiles, false)
+		if err != nil {
+			log.Printf("Warning: Failed to summarize service ports: %v", err)
+			break
+		}
+		if entries := composeSummary(services, remappings); len(entries) > 0 {
+			fmt.Println()
+			if err := printComposeSummary(os.Stdout, entries); err != nil {
+				return err
+			}
+		}
+	}
+	return writeComposeReport(reportPath, composeFile, profiles, remappings)
+}
+
+// ComposeReport describes the ports a compose run was remapped to, for CI pipelines
+type ComposeReport struct {
+	ComposeFile string               `json:"composeFile"`
+	Remappings  []ComposeReportEntry `json:"remappings"`
+}
+
+// ComposeReportEntry is a single remapped service port
+type ComposeReportEntry struct {
+	Service      string `json:"service"`
+	OriginalPort string `json:"originalPort"`
+	NewPort      string `json:"newPort"`
+	Protocol     string `json:"protocol"`
+}
+
+// writeComposeReport writes the remappings of a compose run as JSON. It does nothing
+// when no report path was given. The remappings don't record protocols, so they are
+// looked up in the resolved compose file.
+func writeComposeReport(reportPath, composeFile string, profiles []string, remappings map[string]string) error {
+	if reportPath == "" {
+		return nil
+	}
+
+	report := ComposeReport{ComposeFile: composeFile, Remappings: []ComposeReportEntry{}}
+	var services map[string]interface{}
+	if len(remappings) > 0 {
+		var err error
+		if services, err = loadComposeServices(composeFile, profiles, false); err != nil {
+			return fmt.Errorf("failed to build compose report: %v", err)
+		}
+	}
+	for servicePort, newPort := range remappings {
+		service, originalPort, ok := strings.Cut(servicePort, ":")
+		if !ok {
+			continue
+		}
+		entry := ComposeReportEntry{Service: service, OriginalPort: originalPort, NewPort: newPort, Protocol: "tcp"}
+		if serviceMap, ok := services[service].(map[string]interface{}); ok {
+			ports, _ := serviceMap["ports"].([]interface{})
+			for _, port := range ports {
+				if hostPort, _, protocol, ok := parseComposePort(port); ok && hostPort == originalPort {
+					entry.Protocol = protocol
+					break
+				}
+			}
+		}
+		report.Remappings = append(report.Remappings, entry)
+	}
+	sort.Slice(report.Remappings, func(i, j int) bool {
+		a, b := report.Remappings[i], report.Remappings[j]
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		return a.OriginalPort < b.OriginalPort
+	})
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(reportPath, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write compose report: %v", err)
+	}
+	log.Printf("Wrote compose remap report to %s", reportPath)
+	return nil
+}
+
+// runPlanCommand reports which containers would be remapped without touching them
+func runPlanCommand(store *ContainerStore, args []string) error {
+	planFlags := flag.NewFlagSet("plan", flag.ExitOnError)
+	output := addOutputFlag(planFlags)
+	jsonOutput := planFlags.Bool("json", false, "Output the plan as JSON (same as --output json)")
+	planFlags.Parse(args)
+	if *jsonOutput {
+		*output = "json"
+	}
+
+	// Load the current containers without remapping anything
+	if err := store.refreshContainers(); err != nil {
+		return err
+	}
+	return renderPlan(*output, store.PlanRemaps())
+}
+
+// renderPlan prints planned remaps in the given output format
+func renderPlan(output string, plan []PlannedRemap) error {
+	if plan == nil {
+		plan = []PlannedRemap{}
+	}
+
+	return renderOutput(os.Stdout, output, plan, func(w io.Writer) {
+		if len(plan) == 0 {
+			fmt.Fprintln(w, "No containers would be remapped.")
+			return
+		}
+		fmt.Fprintln(w, "CONTAINER\tCONTAINER PORT\tHOST PORT\tNEW HOST PORT\tREASON")
+		for _, remap := range plan {
+			fmt.Fprintf(w, "%s\t%s/%s\t%s\t%s\t%s\n",
+				remap.ContainerName, remap.ContainerPort, remap.Protocol, remap.HostPort, remap.NewHostPort, remap.Reason)
+		}
+	})
+}
+
+// runListCommand lists the running containers and their port mappings
+func runListCommand(store *ContainerStore, args []string) error {
+	listFlags := flag.NewFlagSet("list", flag.ExitOnError)
+	output := addOutputFlag(listFlags)
+	project := listFlags.String("project", "", "Only list the containers of this Compose project")
+	listFlags.Parse(args)
+
+	if err := store.refreshContainers(); err != nil {
+		return err
+	}
+	var containers []Container
+	if *project != "" {
+		containers = store.GetContainersForProject(*project)
+	} else {
+		containers = store.GetContainers()
+	}
+	containers = sortedContainers(containers)
+
+	return renderOutput(os.Stdout, *output, containers, func(w io.Writer) {
+		fmt.Fprintln(w, "CONTAINER ID\tNAME\tIMAGE\tPROJECT\tSERVICE\tPORTS")
+		for _, container := range containers {
+			fmt.Fprintf(w, "%.12s\t%s\t%s\t%s\t%s\t%s\n",
+				container.ID, container.Names, container.Image, container.ComposeProject,
+				container.ComposeService, formatPortMappings(container.PortMappings))
+		}
+	})
+}
+
+// statusSummary summarizes the state of the managed containers
+type statusSummary struct {
+	Healthy            bool   `json:"healthy" yaml:"healthy"`
+	Error              string `json:"error,omitempty" yaml:"error,omitempty"`
+	Containers         int    `json:"containers" yaml:"containers"`
+	Projects           int    `json:"projects" yaml:"projects"`
+	RemappedContainers int    `json:"remappedContainers" yaml:"remappedContainers"`
+	RemappedPorts      int    `json:"remappedPorts" yaml:"remappedPorts"`
+	PortRangeMin       int    `json:"portRangeMin" yaml:"portRangeMin"`
+	PortRangeMax       int    `json:"portRangeMax" yaml:"portRangeMax"`
+}
+
+// runStatusCommand prints a summary of the managed containers
+func runStatusCommand(store *ContainerStore, args []string) error {
+	statusFlags := flag.NewFlagSet("status", flag.ExitOnError)
+	output := addOutputFlag(statusFlags)
+	statusFlags.Parse(args)
+
+	summary := statusSummary{
+		PortRangeMin: store.portRangeMin,
+		PortRangeMax: store.portRangeMax,
+	}
+	if err := store.refreshContainers(); err != nil {
+		summary.Error = err.Error()
+	} else {
+		summary.Healthy = true
+	}
+
+	snapshot := store.Snapshot()
+	containers := snapshot.Containers
+	summary.Containers = len(containers)
+	summary.Projects = len(snapshot.ByProject)
+	for _, container := range containers {
+		remapped := 0
+		for _, mapping := range container.PortMappings {
+			if mapping.OriginalPort != "" && mapping.OriginalPort != mapping.HostPort {
+				remapped++
+			}
+		}
+		if remapped > 0 {
+			summary.RemappedContainers++
+			summary.RemappedPorts += remapped
+		}
+	}
+
+	return renderOutput(os.Stdout, *output, summary, func(w io.Writer) {
+		fmt.Fprintf(w, "Healthy:\t%t\n", summary.Healthy)
+		if summary.Error != "" {
+			fmt.Fprintf(w, "Error:\t%s\n", summary.Error)
+		}
+		fmt.Fprintf(w, "Containers:\t%d\n", summary.Containers)
+		fmt.Fprintf(w, "Projects:\t%d\n", summary.Projects)
+		fmt.Fprintf(w, "Remapped containers:\t%d\n", summary.RemappedContainers)
+		fmt.Fprintf(w, "Remapped ports:\t%d\n", summary.RemappedPorts)
+		fmt.Fprintf(w, "Port range:\t%d-%d\n", summary.PortRangeMin, summary.PortRangeMax)
+	})
+}
+
+// PortDiff is a difference between the host port a compose file declares for a service
+// and what its running container publishes. Kind is "added" for ports only in the
+// file, "removed" for ports only on the container, and "changed" for both.
+type PortDiff struct {
+	Service       string `json:"service" yaml:"service"`
+	ContainerPort string `json:"containerPort" yaml:"containerPort"`
+	Protocol      string `json:"protocol" yaml:"protocol"`
+	Kind          string `json:"kind" yaml:"kind"`
+	DeclaredPort  string `json:"declaredPort,omitempty" yaml:"declaredPort,omitempty"`
+	RunningPort   string `json:"runningPort,omitempty" yaml:"runningPort,omitempty"`
+}
+
+// defaultComposeProject returns the project name docker-compose uses for a file when
+// none is given: COMPOSE_PROJECT_NAME, or else the name of the file's directory
+func defaultComposeProject(composeFile string) string {
+	if name := os.Getenv("COMPOSE_PROJECT_NAME"); name != "" {
+		return name
+	}
+	dir, err := filepath.Abs(filepath.Dir(composeFile))
+	if err != nil {
+		dir = filepath.Dir(composeFile)
+	}
+	var name strings.Builder
+	for _, r := range strings.ToLower(filepath.Base(dir)) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			name.WriteRune(r)
+		}
+	}
+	return name.String()
+}
+
+// remappedProjectName returns the project name for running a remapped compose file:
+// the top-level name the resolved configuration carries, or else the one docker-compose
+// derives for the original file
+func remappedProjectName(composeFile, remappedFile string) string {
+	var top struct {
+		Name string `yaml:"name"`
+	}
+	if data, err := os.ReadFile(remappedFile); err == nil && yaml.Unmarshal(data, &top) == nil && top.Name != "" {
+		return top.Name
+	}
+	return defaultComposeProject(composeFile)
+}
+
+// diffComposePorts compares the host ports declared by compose services against the
+// project's running containers, matched by service label. A running port that this
+// tool remapped from the declared one is not reported.
+func diffComposePorts(services map[string]interface{}, containers []Container) []PortDiff {
+	type portKey struct{ service, containerPort, protocol string }
+	declared := make(map[portKey]string)
+	for name, service := range services {
+		serviceMap, ok := service.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ports, _ := serviceMap["ports"].([]interface{})
+		for _, port := range ports {
+			if hostPort, containerPort, protocol, ok := parseComposePort(port); ok {
+				declared[portKey{name, containerPort, protocol}] = hostPort
+			}
+		}
+	}
+
+	diffs := []PortDiff{}
+	running := make(map[portKey]bool)
+	for _, container := range containers {
+		if container.ComposeService == "" {
+			continue
+		}
+		for _, mapping := range container.PortMappings {
+			if mapping.HostPort == "" {
+				continue
+			}
+			// Ports bound on both IPv4 and IPv6 are listed twice
+			key := portKey{container.ComposeService, mapping.ContainerPort, mapping.Protocol}
+			if running[key] {
+				continue
+			}
+			running[key] = true
+			declaredPort, ok := declared[key]
+			switch {
+			case !ok:
+				diffs = append(diffs, PortDiff{Service: key.service, ContainerPort: key.containerPort,
+					Protocol: key.protocol, Kind: "removed", RunningPort: mapping.HostPort})
+			case declaredPort != mapping.HostPort && declaredPort != mapping.OriginalPort:
+				diffs = append(diffs, PortDiff{Service: key.service, ContainerPort: key.containerPort,
+					Protocol: key.protocol, Kind: "changed", DeclaredPort: declaredPort, RunningPort: mapping.HostPort})
+			}
+		}
+	}
+	for key, declaredPort := range declared {
+		if !running[key] {
+			diffs = append(diffs, PortDiff{Service: key.service, ContainerPort: key.containerPort,
+				Protocol: key.protocol, Kind: "added", DeclaredPort: declaredPort})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		a, b := diffs[i], diffs[j]
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.ContainerPort != b.ContainerPort {
+			return a.ContainerPort < b.ContainerPort
+		}
+		return a.Protocol < b.Protocol
+	})
+	return diffs
+}
+
+// runDiffCommand shows how the ports declared in a compose file differ from those of
+// the project's running containers, to tell whether the project needs to be re-upped
+func runDiffCommand(store *ContainerStore, args []string) error {
+	diffFlags := flag.NewFlagSet("diff", flag.ExitOnError)
+	output := addOutputFlag(diffFlags)
+	project := diffFlags.String("project", "", "Compose project name (defaults to the compose file's directory name)")
+	offline := diffFlags.Bool("offline", false, "Read the compose file directly instead of through docker-compose config")
+	var profiles stringListFlag
+	diffFlags.Var(&profiles, "profile", "Compose profile to enable (may be repeated)")
+
+	// Allow the compose file before or after the flags
+	var composeFile string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		composeFile = args[0]
+		args = args[1:]
+	}
+	diffFlags.Parse(args)
+	if composeFile == "" {
+		composeFile = diffFlags.Arg(0)
+	}
+	if composeFile == "" {
+		return fmt.Errorf("missing compose file. Usage: dynamic-port-mapper diff <file> [--project name]")
+	}
+	if *project == "" {
+		*project = defaultComposeProject(composeFile)
+	}
+
+	services, err := loadComposeServices(composeFile, profiles, *offline)
+	if err != nil {
+		return err
+	}
+	if err := store.refreshContainers(); err != nil {
+		return err
+	}
+	diffs := diffComposePorts(services, store.GetContainersForProject(*project))
+
+	return renderOutput(os.Stdout, *output, diffs, func(w io.Writer) {
+		if len(diffs) == 0 {
+			fmt.Fprintf(w, "Ports of project %s match %s.\n", *project, composeFile)
+			return
+		}
+		fmt.Fprintln(w, "SERVICE\tCONTAINER PORT\tCHANGE\tDECLARED\tRUNNING")
+		for _, diff := range diffs {
+			fmt.Fprintf(w, "%s\t%s/%s\t%s\t%s\t%s\n",
+				diff.Service, diff.ContainerPort, diff.Protocol, diff.Kind, diff.DeclaredPort, diff.RunningPort)
+		}
+	})
+}
+
+// ScanConflict is a host port of a compose service that is already taken, either by
+// a running container or host process, or by a project found earlier in the scan
+type ScanConflict struct {
+	ComposeFile   string `json:"composeFile" yaml:"composeFile"`
+	Service       string `json:"service" yaml:"service"`
+	HostPort      string `json:"hostPort" yaml:"hostPort"`
+	NewPort       string `json:"newPort" yaml:"newPort"`
+	ConflictsWith string `json:"conflictsWith" yaml:"conflictsWith"`
+}
+
+// findComposeFiles returns the docker-compose.yml and docker-compose.yaml files under
+// a directory, skipping hidden directories
+func findComposeFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path != dir && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.Name() == "docker-compose.yml" || entry.Name() == "docker-compose.yaml" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// runScanCommand checks every compose project under a directory for port conflicts,
+// with the running containers and with each other. Projects are checked in path
+// order as if brought up one after another, so the ports each one ends up with are
+// taken for the ones after it. It exits with status 1 when conflicts are found.
+func runScanCommand(store *ContainerStore, args []string) error {
+	scanFlags := flag.NewFlagSet("scan", flag.ExitOnError)
+	output := addOutputFlag(scanFlags)
+	var profiles stringListFlag
+	scanFlags.Var(&profiles, "profile", "Compose profile to enable (may be repeated)")
+
+	// Allow the directory before or after the flags
+	var dir string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		dir = args[0]
+		args = args[1:]
+	}
+	scanFlags.Parse(args)
+	if dir == "" {
+		dir = scanFlags.Arg(0)
+	}
+	if dir == "" {
+		return fmt.Errorf("missing directory. Usage: dynamic-port-mapper scan <dir>")
+	}
+
+	composeFiles, err := findComposeFiles(dir)
+	if err != nil {
+		return fmt.Errorf("failed to search %s for compose files: %v", dir, err)
+	}
+	if len(composeFiles) == 0 {
+		return fmt.Errorf("no docker-compose.yml files found under %s", dir)
+	}
+
+	if err := store.refreshContainers(); err != nil {
+		return err
+	}
+
+	conflicts := []ScanConflict{}
+	claimedBy := make(map[int]string) // Host port -> compose file that will use it
+	// Keep the new ports claimed while the other files are checked, so no two get the
+	// same one, but not beyond the scan
+	allocated := make(map[string]string) // Compose file and service:port -> new port
+	defer store.releaseComposePorts(allocated)
+	for _, composeFile := range composeFiles {
+		remappings, err := store.CheckComposePortConflicts(composeFile, profiles)
+		if err != nil {
+			return fmt.Errorf("%s: %w", composeFile, err)
+		}
+		for key, newPort := range remappings {
+			allocated[composeFile+" "+key] = newPort
+		}
+		services, err := loadComposeServices(composeFile, profiles, false)
+		if err != nil {
+			return fmt.Errorf("%s: %w", composeFile, err)
+		}
+
+		// Record the conflicts, then claim the ports this project will end up using
+		var claimed []int
+		for serviceName, serviceConfig := range services {
+			serviceMap, ok := serviceConfig.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ports, _ := serviceMap["ports"].([]interface{})
+			for _, port := range ports {
+				hostPort, _, _, ok := parseComposePort(port)
+				if !ok {
+					continue
+				}
+				finalPort := hostPort
+				if newPort, remapped := remappings[serviceName+":"+hostPort]; remapped {
+					finalPort = newPort
+					portInt, _ := strconv.Atoi(hostPort)
+					conflictsWith := claimedBy[portInt]
+					if conflictsWith == "" {
+						conflictsWith = "running container or host process"
+					}
+					conflicts = append(conflicts, ScanConflict{ComposeFile: composeFile, Service: serviceName,
+						HostPort: hostPort, NewPort: newPort, ConflictsWith: conflictsWith})
+					// A pair published for tcp and udp is reported once
+					delete(remappings, serviceName+":"+hostPort)
+				}
+				if portInt, err := strconv.Atoi(finalPort); err == nil {
+					claimed = append(claimed, portInt)
+				}
+			}
+		}
+		for _, port := range claimed {
+			if _, exists := claimedBy[port]; !exists {
+				claimedBy[port] = composeFile
+			}
+			store.ReservePort(port)
+		}
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		a, b := conflicts[i], conflicts[j]
+		if a.ComposeFile != b.ComposeFile {
+			return a.ComposeFile < b.ComposeFile
+		}
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		return a.HostPort < b.HostPort
+	})
+
+	err = renderOutput(os.Stdout, *output, conflicts, func(w io.Writer) {
+		if len(conflicts) == 0 {
+			fmt.Fprintf(w, "No port conflicts found in %d compose files.\n", len(composeFiles))
+			return
+		}
+		fmt.Fprintln(w, "COMPOSE FILE\tSERVICE\tHOST PORT\tNEW PORT\tCONFLICTS WITH")
+		for _, conflict := range conflicts {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				conflict.ComposeFile, conflict.Service, conflict.HostPort, conflict.NewPort, conflict.ConflictsWith)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return errConflictsFound
+	}
+	return nil
+}
+
+// runRestoreCommand moves a remapped container's ports back to their original host
+// ports, e.g. dynamic-port-mapper restore app1_web_1
+func runRestoreCommand(store *ContainerStore, args []string) error {
+	restoreFlags := flag.NewFlagSet("restore", flag.ExitOnError)
+	output := addOutputFlag(restoreFlags)
+
+	// Allow the container before or after the flags
+	var name string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name = args[0]
+		args = args[1:]
+	}
+	restoreFlags.Parse(args)
+	if name == "" {
+		name = restoreFlags.Arg(0)
+	}
+	if name == "" {
+		return fmt.Errorf("missing container. Usage: dynamic-port-mapper restore <container>")
+	}
+
+	if err := store.refreshContainers(); err != nil {
+		return err
+	}
+	container, err := store.RestoreOriginal(name)
+	if err != nil {
+		return err
+	}
+
+	return renderOutput(os.Stdout, *output, container, func(w io.Writer) {
+		fmt.Fprintln(w, "CONTAINER ID\tNAME\tPORTS")
+		fmt.Fprintf(w, "%.12s\t%s\t%s\n", container.ID, container.Names, formatPortMappings(container.PortMappings))
+	})
+}
+
+// runLintCommand checks a compose file for host ports that would conflict with a list of
+// ports known to be in use. It exits with status 1 when conflicts are found so it can gate CI.
+func runLintCommand(args []string) error {
+	lintFlags := flag.NewFlagSet("lint", flag.ExitOnError)
+	usedFlag := lintFlags.String("used", "", "Comma-separated ports or ranges already in use, e.g. 8080,5432,9000-9010")
+	offline := lintFlags.Bool("offline", false, "Read the compose file directly instead of through docker-compose config")
+	output := addOutputFlag(lintFlags)
+	var profiles stringListFlag
+	lintFlags.Var(&profiles, "profile", "Compose profile to enable (may be repeated)")
+
+	// Allow the compose file before or after the flags
+	var composeFile string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		composeFile = args[0]
+		args = args[1:]
+	}
+	lintFlags.Parse(args)
+	if composeFile == "" {
+		composeFile = lintFlags.Arg(0)
+	}
+	if composeFile == "" {
+		return fmt.Errorf("missing compose file. Usage: dynamic-port-mapper lint <file> [--used ports] [--offline] [--output format]")
+	}
+
+	usedPorts, err := parsePortList(*usedFlag)
+	if err != nil {
+		return err
+	}
+
+	issues, err := LintComposePorts(composeFile, usedPorts, profiles, *offline)
+	if err != nil {
+		return err
+	}
+
+	if issues == nil {
+		issues = []LintIssue{}
+	}
+	err = renderOutput(os.Stdout, *output, issues, func(w io.Writer) {
+		if len(issues) == 0 {
+			fmt.Fprintf(w, "%s: no port conflicts found\n", composeFile)
+			return
+		}
+		fmt.Fprintln(w, "SERVICE\tHOST PORT\tREASON")
+		for _, issue := range issues {
+			fmt.Fprintf(w, "%s\t%s/%s\t%s\n", issue.Service, issue.HostPort, issue.Protocol, issue.Reason)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(issues) > 0 {
+		return errConflictsFound
+	}
+	return nil
+}
+
+// runRemapCommand moves every published port of a container to a newly allocated
+// host port, like the dashboard's Remap button, e.g. dynamic-port-mapper remap app1_web_1.
+// With --dry-run it only shows the ports it would move the container to. The store
+// is built from options once the flags are parsed, so a dry run never writes to Docker.
+func runRemapCommand(options StoreOptions, args []string) error {
+	remapFlags := flag.NewFlagSet("remap", flag.ExitOnError)
+	output := addOutputFlag(remapFlags)
+	dryRun := remapFlags.Bool("dry-run", false, "Show the new host ports without recreating the container")
+
+	// Allow the container before or after the flags
+	var name string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name = args[0]
+		args = args[1:]
+	}
+	remapFlags.Parse(args)
+	if name == "" {
+		name = remapFlags.Arg(0)
+	}
+	if name == "" {
+		return fmt.Errorf("missing container. Usage: dynamic-port-mapper remap <container> [--dry-run]")
+	}
+
+	options.DryRun = options.DryRun || *dryRun
+	store := NewContainerStore(options)
+	// Stopping releases the claims on ports allocated only to be shown
+	defer store.Stop()
+	if err := store.refreshContainers(); err != nil {
+		return err
+	}
+	containerID, err := store.resolveContainerRef(name)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		plan, err := store.PlanForceRemap(containerID)
+		if err != nil {
+			return err
+		}
+		return renderPlan(*output, plan)
+	}
+
+	container, err := store.ForceRemap(containerID)
+	if err != nil {
+		return err
+	}
+	return renderOutput(os.Stdout, *output, container, func(w io.Writer) {
+		fmt.Fprintln(w, "CONTAINER ID\tNAME\tPORTS")
+		fmt.Fprintf(w, "%.12s\t%s\t%s\n", container.ID, container.Names, formatPortMappings(container.PortMappings))
+	})
+}
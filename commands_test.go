@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestRenderOutput(t *testing.T) {
+	summary := statusSummary{Healthy: true, Containers: 2, PortRangeMin: 10000, PortRangeMax: 10999}
+	table := func(w io.Writer) {
+		fmt.Fprintln(w, "NAME\tPORTS")
+		fmt.Fprintln(w, "web\t8080->80/tcp")
+		fmt.Fprintln(w, "database\t5432->5432/tcp")
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"table", "NAME      PORTS\nweb       8080->80/tcp\ndatabase  5432->5432/tcp\n"},
+		{"json", `{
+  "healthy": true,
+  "containers": 2,
+  "projects": 0,
+  "remappedContainers": 0,
+  "remappedPorts": 0,
+  "portRangeMin": 10000,
+  "portRangeMax": 10999
+}
+`},
+		{"yaml", `healthy: true
+containers: 2
+projects: 0
+remappedContainers: 0
+remappedPorts: 0
+portRangeMin: 10000
+portRangeMax: 10999
+`},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := renderOutput(&out, tt.format, summary, table); err != nil {
+			t.Errorf("%s: renderOutput failed: %v", tt.format, err)
+			continue
+		}
+		if out.String() != tt.want {
+			t.Errorf("%s output is\n%s\nwant\n%s", tt.format, out.String(), tt.want)
+		}
+	}
+
+	if err := renderOutput(io.Discard, "xml", summary, table); err == nil {
+		t.Error("unknown output format was accepted")
+	}
+}
+
+func TestRemappedProjectName(t *testing.T) {
+	t.Setenv("COMPOSE_PROJECT_NAME", "")
+	dir := filepath.Join(t.TempDir(), "My_App")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	composeFile := filepath.Join(dir, "docker-compose.yml")
+	remapped := filepath.Join(t.TempDir(), "docker-compose.remapped.yml")
+
+	// Compose v1 resolves configurations without a name
+	if err := os.WriteFile(remapped, []byte("services:\n  web:\n    image: nginx\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := remappedProjectName(composeFile, remapped); got != "my_app" {
+		t.Errorf("without a name got %q, want the directory's name my_app", got)
+	}
+
+	if err := os.WriteFile(remapped, []byte("name: shop\nservices:\n  web:\n    image: nginx\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := remappedProjectName(composeFile, remapped); got != "shop" {
+		t.Errorf("with a name got %q, want shop", got)
+	}
+}
+
+func TestWriteComposeReport(t *testing.T) {
+	newFakeDocker(t)
+	dir := t.TempDir()
+	composeFile := filepath.Join(dir, "docker-compose.yml")
+	compose := "services:\n" +
+		"  web:\n    ports: [\"8080:80\"]\n" +
+		"  dns:\n    ports: [\"5353:53/udp\"]\n"
+	if err := os.WriteFile(composeFile, []byte(compose), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reportPath, args := extractReportPath([]string{"up", "--report", filepath.Join(dir, "report.json"), "-d"})
+	if !reflect.DeepEqual(args, []string{"up", "-d"}) {
+		t.Errorf("compose is passed %q, want the --report flag removed", args)
+	}
+
+	remappings := map[string]string{"web:8080": "20001", "dns:5353": "20002"}
+	if err := writeComposeReport(reportPath, composeFile, nil, remappings); err != nil {
+		t.Fatalf("writeComposeReport failed: %v", err)
+	}
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report ComposeReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("report isn't valid JSON: %v\n%s", err, data)
+	}
+	want := ComposeReport{ComposeFile: composeFile, Remappings: []ComposeReportEntry{
+		{Service: "dns", OriginalPort: "5353", NewPort: "20002", Protocol: "udp"},
+		{Service: "web", OriginalPort: "8080", NewPort: "20001", Protocol: "tcp"},
+	}}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("report is %+v, want %+v", report, want)
+	}
+
+	// Without remappings, the report still lists them, as an empty array
+	if err := writeComposeReport(reportPath, composeFile, nil, nil); err != nil {
+		t.Fatalf("writeComposeReport failed: %v", err)
+	}
+	if data, _ := os.ReadFile(reportPath); !bytes.Contains(data, []byte(`"remappings": []`)) {
+		t.Errorf("report without remappings is\n%s", data)
+	}
+}
+
+func TestComposeSummary(t *testing.T) {
+	var services map[string]interface{}
+	err := yaml.Unmarshal([]byte(`
+web:
+  ports: ["8080:80"]
+api:
+  ports: ["9000:9000", "5353:53/udp"]
+worker:
+  image: busybox
+`), &services)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := composeSummary(services, map[string]string{"web:8080": "20005", "api:5353": "20006"})
+	want := []ComposeSummaryEntry{
+		{Service: "api", ContainerPort: "53", Protocol: "udp", HostPort: "20006", OriginalPort: "5353"},
+		{Service: "api", ContainerPort: "9000", Protocol: "tcp", HostPort: "9000"},
+		{Service: "web", ContainerPort: "80", Protocol: "tcp", HostPort: "20005", OriginalPort: "8080"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("composeSummary = %+v, want %+v", entries, want)
+	}
+
+	var out bytes.Buffer
+	if err := printComposeSummary(&out, entries); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("summary has %d lines, want a header and 3 ports:\n%s", len(lines), out.String())
+	}
+	for i, want := range [][]string{
+		{"SERVICE", "CONTAINER PORT", "HOST PORT"},
+		{"api", "53/udp", "20006", "(remapped from 5353)"},
+		{"api", "9000/tcp", "9000"},
+		{"web", "80/tcp", "20005", "(remapped from 8080)"},
+	} {
+		for _, field := range want {
+			if !strings.Contains(lines[i], field) {
+				t.Errorf("summary line %q lacks %q", lines[i], field)
+			}
+		}
+	}
+	if strings.Contains(lines[2], "remapped") {
+		t.Errorf("unchanged port is shown as remapped: %q", lines[2])
+	}
+}
+
+func TestExtractNoSummary(t *testing.T) {
+	noSummary, args := extractNoSummary([]string{"up", "--no-summary", "-d"})
+	if !noSummary || !reflect.DeepEqual(args, []string{"up", "-d"}) {
+		t.Errorf("extractNoSummary = %v, %q, want true and the other arguments", noSummary, args)
+	}
+	if noSummary, _ := extractNoSummary([]string{"up", "-d"}); noSummary {
+		t.Error("summary turned off without --no-summary")
+	}
+}
+
+func TestDiffComposePorts(t *testing.T) {
+	var compose map[string]interface{}
+	err := yaml.Unmarshal([]byte(`services:
+  web:
+    ports: ["8080:80"]
+  api:
+    ports: ["8081:80"]
+  db:
+    ports: ["5432:5432"]
+  worker:
+    image: worker
+`), &compose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	containers := []Container{
+		// web was started with another port than the file now declares
+		{Names: "shop-web-1", ComposeService: "web", PortMappings: []PortMapping{
+			{ContainerPort: "80", Protocol: "tcp", HostIP: "0.0.0.0", HostPort: "9090", OriginalPort: "9090"},
+			{ContainerPort: "80", Protocol: "tcp", HostIP: "::", HostPort: "9090", OriginalPort: "9090"},
+		}},
+		// api was remapped by us, which isn't drift
+		{Names: "shop-api-1", ComposeService: "api", PortMappings: []PortMapping{
+			{ContainerPort: "80", Protocol: "tcp", HostPort: "20005", OriginalPort: "8081"},
+		}},
+		// worker no longer publishes a port, and db isn't running
+		{Names: "shop-worker-1", ComposeService: "worker", PortMappings: []PortMapping{
+			{ContainerPort: "6000", Protocol: "tcp", HostPort: "6000", OriginalPort: "6000"},
+		}},
+	}
+
+	want := []PortDiff{
+		{Service: "db", ContainerPort: "5432", Protocol: "tcp", Kind: "added", DeclaredPort: "5432"},
+		{Service: "web", ContainerPort: "80", Protocol: "tcp", Kind: "changed", DeclaredPort: "8080", RunningPort: "9090"},
+		{Service: "worker", ContainerPort: "6000", Protocol: "tcp", Kind: "removed", RunningPort: "6000"},
+	}
+	store := NewContainerStore(StoreOptions{})
+	for i, container := range containers {
+		container.ID, container.ComposeProject = fmt.Sprint(i), "shop"
+		store.containers[container.ID] = container
+	}
+	store.containers["other"] = Container{ID: "other", Names: "blog-web-1", ComposeProject: "blog", ComposeService: "web"}
+	services, _ := compose["services"].(map[string]interface{})
+	if got := diffComposePorts(services, store.GetContainersForProject("shop")); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffComposePorts = %+v, want %+v", got, want)
+	}
+}
+
+// captureStdout returns what run writes to standard output
+func captureStdout(t *testing.T, run func()) []byte {
+	t.Helper()
+	stdout, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	realStdout := os.Stdout
+	os.Stdout = stdout
+	defer func() { os.Stdout = realStdout }()
+
+	run()
+
+	data, err := os.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRunLintCommandOutput(t *testing.T) {
+	composeFile := filepath.Join(t.TempDir(), "docker-compose.yml")
+	compose := "services:\n  web:\n    image: nginx\n    ports: [\"8080:80\"]\n"
+	if err := os.WriteFile(composeFile, []byte(compose), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	data := captureStdout(t, func() {
+		err := runLintCommand([]string{composeFile, "--used", "8080", "--offline", "--output", "json"})
+		if !errors.Is(err, errConflictsFound) {
+			t.Errorf("runLintCommand returned %v, want %v", err, errConflictsFound)
+		}
+	})
+
+	var issues []LintIssue
+	if err := json.Unmarshal(data, &issues); err != nil {
+		t.Fatalf("lint output isn't valid JSON: %v\n%s", err, data)
+	}
+	if len(issues) != 1 || issues[0].Service != "web" || issues[0].HostPort != "8080" {
+		t.Errorf("lint found %+v, want web's port 8080", issues)
+	}
+}
+
+func TestRunScanCommand(t *testing.T) {
+	newFakeDocker(t)
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+
+	// Two projects publish the same free port; the hidden one is skipped
+	dir := t.TempDir()
+	for _, project := range []string{"blog", "shop", ".old"} {
+		compose := "services:\n  web:\n    image: nginx\n    ports: [\"" + port + ":80\"]\n"
+		if err := os.Mkdir(filepath.Join(dir, project), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, project, "docker-compose.yml"), []byte(compose), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	data := captureStdout(t, func() {
+		err := runScanCommand(store, []string{dir, "--output", "json"})
+		if !errors.Is(err, errConflictsFound) {
+			t.Errorf("runScanCommand returned %v, want %v", err, errConflictsFound)
+		}
+	})
+
+	var conflicts []ScanConflict
+	if err := json.Unmarshal(data, &conflicts); err != nil {
+		t.Fatalf("scan output isn't valid JSON: %v\n%s", err, data)
+	}
+	blog, shop := filepath.Join(dir, "blog", "docker-compose.yml"), filepath.Join(dir, "shop", "docker-compose.yml")
+	if len(conflicts) != 1 || conflicts[0].ComposeFile != shop || conflicts[0].HostPort != port || conflicts[0].ConflictsWith != blog {
+		t.Errorf("scan found %+v, want shop's port %s conflicting with blog", conflicts, port)
+	}
+	// The ports picked for the conflicts are only claimed for the scan
+	store.claimMu.Lock()
+	defer store.claimMu.Unlock()
+	if len(store.portClaims) > 0 {
+		t.Errorf("ports %v are still claimed after the scan", store.portClaims)
+	}
+}
+
+func TestRunListCommandProject(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "shop-web-1", Ports: []string{"8080:80/tcp"},
+		Labels: map[string]string{"com.docker.compose.project": "shop", "com.docker.compose.service": "web"}})
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "shop_db_1", Ports: []string{"5432:5432/tcp"}})
+	docker.addContainer(fakeContainer{ID: "cccc", Name: "blog-web-1", Ports: []string{"8081:80/tcp"},
+		Labels: map[string]string{"com.docker.compose.project": "blog"}})
+	store := NewContainerStore(StoreOptions{})
+
+	data := captureStdout(t, func() {
+		if err := runListCommand(store, []string{"--project", "shop", "--output", "json"}); err != nil {
+			t.Errorf("runListCommand returned %v", err)
+		}
+	})
+
+	var containers []Container
+	if err := json.Unmarshal(data, &containers); err != nil {
+		t.Fatalf("list output isn't valid JSON: %v\n%s", err, data)
+	}
+	var got []string
+	for _, container := range containers {
+		got = append(got, container.ID)
+	}
+	// The labelled container and the one inferred from its name, sorted by name
+	if want := []string{"aaaa", "bbbb"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("list --project shop listed %v, want %v", got, want)
+	}
+}
+
+func TestRunRemapCommandDryRun(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	options := StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, KeepStateFile: true}
+	data := captureStdout(t, func() {
+		if err := runRemapCommand(options, []string{"web", "--dry-run", "--output", "json"}); err != nil {
+			t.Errorf("runRemapCommand failed: %v", err)
+		}
+	})
+
+	if changes := docker.changes(); len(changes) > 0 {
+		t.Errorf("dry run changed containers with %v", changes)
+	}
+	var plan []PlannedRemap
+	if err := json.Unmarshal(data, &plan); err != nil {
+		t.Fatalf("remap output isn't valid JSON: %v\n%s", err, data)
+	}
+	if len(plan) != 1 || plan[0].HostPort != "8080" || plan[0].NewHostPort == "" {
+		t.Errorf("dry run planned %+v, want port 8080 moved", plan)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// programName is the command completion scripts are registered for
+const programName = "dynamic-port-mapper"
+
+// cliSubcommand describes a subcommand for the usage text, completion scripts and
+// --help-json
+type cliSubcommand struct {
+	Name        string `json:"name"`
+	Args        string `json:"args,omitempty"`
+	Description string `json:"description"`
+}
+
+// subcommands lists the subcommands main dispatches, in the order they're shown
+var subcommands = []cliSubcommand{
+	{"compose", "[file] [--report path] [--no-summary] [commands]", "Run a Docker Compose project with automatic port remapping"},
+	{"list", "[--project name] [--output format]", "List running containers and their port mappings"},
+	{"status", "[--output format]", "Show a summary of managed containers"},
+	{"plan", "[--output format]", "Show which running containers would be remapped, without changing anything"},
+	{"diff", "<file> [--project name]", "Show how a compose file's ports differ from its running containers"},
+	{"scan", "<dir>", "Check all compose projects under a directory for port conflicts with each other"},
+	{"export-k8s", "<project>", "Print Kubernetes NodePort Services keeping a project's current host ports"},
+	{"snapshot", "--out <file>", "Write the containers and their port mappings to a JSON file"},
+	{"pause", "", "Stop remapping by the running instance on -port, e.g. during maintenance"},
+	{"resume", "", "Resume remapping by the running instance on -port"},
+	{"remap", "<container> [--dry-run]", "Move a container's ports to new host ports, or only show where to"},
+	{"restore", "<container>", "Recreate a remapped container on its original host ports"},
+	{"lint", "[file] [--used ports] [--offline] [--output format]", "Check a compose file for port conflicts, e.g. in CI"},
+	{"completion", "bash|zsh|fish", "Print a shell completion script"},
+}
+
+// completionShells are the shells completion scripts can be generated for
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// cliFlag describes a command line flag for completion scripts and --help-json
+type cliFlag struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Default string `json:"default"`
+	Usage   string `json:"usage"`
+}
+
+// takesValue reports whether the flag needs a value, unlike -flag for a bool
+func (f cliFlag) takesValue() bool {
+	return f.Type != "bool"
+}
+
+// cliFlags returns the flags defined on the given flag set, sorted by name, so the
+// completion scripts and --help-json always match the flags main defines
+func cliFlags(fs *flag.FlagSet) []cliFlag {
+	var flags []cliFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		typeName, usage := flag.UnquoteUsage(f)
+		if typeName == "" {
+			typeName = "bool"
+		}
+		flags = append(flags, cliFlag{Name: f.Name, Type: typeName, Default: f.DefValue, Usage: usage})
+	})
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags
+}
+
+// helpSchema is the output of --help-json
+type helpSchema struct {
+	Program     string          `json:"program"`
+	Flags       []cliFlag       `json:"flags"`
+	Subcommands []cliSubcommand `json:"subcommands"`
+}
+
+// printHelpJSON writes the flags and subcommands as JSON, for tools that wrap the CLI
+func printHelpJSON(fs *flag.FlagSet) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(helpSchema{Program: programName, Flags: cliFlags(fs), Subcommands: subcommands})
+}
+
+// runCompletionCommand prints the completion script for the given shell
+func runCompletionCommand(fs *flag.FlagSet, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s completion %s", programName, strings.Join(completionShells, "|"))
+	}
+	script, err := completionScript(args[0], cliFlags(fs))
+	if err != nil {
+		return err
+	}
+	fmt.Print(script)
+	return nil
+}
+
+// completionScript generates the completion script for a shell
+func completionScript(shell string, flags []cliFlag) (string, error) {
+	switch shell {
+	case "bash":
+		return bashCompletion(flags), nil
+	case "zsh":
+		return zshCompletion(flags), nil
+	case "fish":
+		return fishCompletion(flags), nil
+	}
+	return "", fmt.Errorf("unsupported shell %q, expected one of %s", shell, strings.Join(completionShells, ", "))
+}
+
+// shellQuote quotes a string for bash, zsh and fish alike
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// completionFunction is the shell function name the bash and zsh scripts define
+var completionFunction = "_" + strings.ReplaceAll(programName, "-", "_")
+
+func bashCompletion(flags []cliFlag) string {
+	var names, valueFlags, commands []string
+	for _, f := range flags {
+		names = append(names, "-"+f.Name)
+		if f.takesValue() {
+			valueFlags = append(valueFlags, "-"+f.Name, "--"+f.Name)
+		}
+	}
+	for _, command := range subcommands {
+		commands = append(commands, command.Name)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# bash completion for %s\n", programName)
+	fmt.Fprintf(&b, "%s() {\n", completionFunction)
+	b.WriteString("\tlocal cur prev\n")
+	b.WriteString("\tcur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	b.WriteString("\tprev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	b.WriteString("\tcase \"$prev\" in\n")
+	fmt.Fprintf(&b, "\t\tcompletion)\n\t\t\tCOMPREPLY=($(compgen -W %s -- \"$cur\"))\n\t\t\treturn\n\t\t\t;;\n",
+		shellQuote(strings.Join(completionShells, " ")))
+	if len(valueFlags) > 0 {
+		fmt.Fprintf(&b, "\t\t%s)\n\t\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n\t\t\treturn\n\t\t\t;;\n",
+			strings.Join(valueFlags, "|"))
+	}
+	b.WriteString("\tesac\n")
+	b.WriteString("\tif [[ \"$cur\" == -* ]]; then\n")
+	fmt.Fprintf(&b, "\t\tCOMPREPLY=($(compgen -W %s -- \"$cur\"))\n", shellQuote(strings.Join(names, " ")))
+	b.WriteString("\telse\n")
+	fmt.Fprintf(&b, "\t\tCOMPREPLY=($(compgen -W %s -- \"$cur\"))\n", shellQuote(strings.Join(commands, " ")))
+	b.WriteString("\tfi\n")
+	b.WriteString("}\n")
+	fmt.Fprintf(&b, "complete -o default -F %s %s\n", completionFunction, programName)
+	return b.String()
+}
+
+func zshCompletion(flags []cliFlag) string {
+	// _describe splits its entries on the first unescaped colon
+	describe := func(name, description string) string {
+		return shellQuote(strings.ReplaceAll(name, ":", `\:`) + ":" + description)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#compdef %s\n\n", programName)
+	fmt.Fprintf(&b, "%s() {\n", completionFunction)
+	b.WriteString("\tlocal -a commands flags\n")
+	b.WriteString("\tcommands=(\n")
+	for _, command := range subcommands {
+		fmt.Fprintf(&b, "\t\t%s\n", describe(command.Name, command.Description))
+	}
+	b.WriteString("\t)\n")
+	b.WriteString("\tflags=(\n")
+	for _, f := range flags {
+		fmt.Fprintf(&b, "\t\t%s\n", describe("-"+f.Name, f.Usage))
+	}
+	b.WriteString("\t)\n")
+	b.WriteString("\tif [[ ${words[CURRENT-1]} == completion ]]; then\n")
+	fmt.Fprintf(&b, "\t\tcompadd %s\n", strings.Join(completionShells, " "))
+	b.WriteString("\telif [[ $PREFIX == -* ]]; then\n")
+	b.WriteString("\t\t_describe 'flag' flags\n")
+	b.WriteString("\telse\n")
+	b.WriteString("\t\t_describe 'command' commands\n")
+	b.WriteString("\t\t_files\n")
+	b.WriteString("\tfi\n")
+	b.WriteString("}\n\n")
+	fmt.Fprintf(&b, "compdef %s %s\n", completionFunction, programName)
+	return b.String()
+}
+
+func fishCompletion(flags []cliFlag) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# fish completion for %s\n", programName)
+	for _, command := range subcommands {
+		fmt.Fprintf(&b, "complete -c %s -n __fish_use_subcommand -f -a %s -d %s\n",
+			programName, command.Name, shellQuote(command.Description))
+	}
+	fmt.Fprintf(&b, "complete -c %s -n '__fish_seen_subcommand_from completion' -f -a %s\n",
+		programName, shellQuote(strings.Join(completionShells, " ")))
+	for _, f := range flags {
+		// Go flags are single-dash long options, which fish calls old-style options
+		required := ""
+		if f.takesValue() {
+			required = " -r"
+		}
+		fmt.Fprintf(&b, "complete -c %s -o %s%s -d %s\n", programName, f.Name, required, shellQuote(f.Usage))
+	}
+	return b.String()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testFlags() []cliFlag {
+	fs := flag.NewFlagSet(programName, flag.ContinueOnError)
+	fs.Int("port", 8080, "Port to listen on")
+	fs.Bool("dry-run", false, "Only report what would be remapped")
+	fs.String("state-file", "", "File to keep the state in, e.g. 'state.json'")
+	return cliFlags(fs)
+}
+
+func TestCompletionScript(t *testing.T) {
+	flags := testFlags()
+	syntaxCheck := map[string][]string{
+		"bash": {"bash", "-n"},
+		"zsh":  {"zsh", "-n"},
+		"fish": {"fish", "--no-execute"},
+	}
+	for _, shell := range completionShells {
+		t.Run(shell, func(t *testing.T) {
+			script, err := completionScript(shell, flags)
+			if err != nil {
+				t.Fatalf("completionScript failed: %v", err)
+			}
+			for _, command := range subcommands {
+				if !strings.Contains(script, command.Name) {
+					t.Errorf("script doesn't complete the %s subcommand", command.Name)
+				}
+			}
+			for _, f := range flags {
+				if !strings.Contains(script, f.Name) {
+					t.Errorf("script doesn't complete the -%s flag", f.Name)
+				}
+			}
+
+			check := syntaxCheck[shell]
+			if _, err := exec.LookPath(check[0]); err != nil {
+				t.Skipf("%s isn't installed, not checking the script's syntax", shell)
+			}
+			cmd := exec.Command(check[0], check[1:]...)
+			cmd.Stdin = strings.NewReader(script)
+			if output, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("%s rejects the script: %v\n%s", shell, err, output)
+			}
+		})
+	}
+
+	if _, err := completionScript("powershell", flags); err == nil {
+		t.Errorf("completionScript accepted an unsupported shell")
+	}
+}
+
+func TestBashCompletion(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash isn't installed")
+	}
+	script := bashCompletion(testFlags())
+
+	tests := []struct {
+		words []string
+		want  string
+	}{
+		{[]string{programName, "re"}, "resume remap restore"},
+		{[]string{programName, "-st"}, "-state-file"},
+		{[]string{programName, "completion", "z"}, "zsh"},
+		{[]string{programName, "-port", "x"}, ""},
+	}
+	for _, tt := range tests {
+		words := make([]string, len(tt.words))
+		for i, word := range tt.words {
+			words[i] = shellQuote(word)
+		}
+		cmd := exec.Command("bash", "-c", script+
+			"COMP_WORDS=("+strings.Join(words, " ")+")\n"+
+			"COMP_CWORD="+strconv.Itoa(len(words)-1)+"\n"+
+			completionFunction+"\n"+
+			"echo \"${COMPREPLY[*]}\"\n")
+		output, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("running the bash completion failed: %v", err)
+		}
+		if got := strings.TrimSpace(string(output)); got != tt.want {
+			t.Errorf("completing %q offers %q, want %q", tt.words, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// composeOwner identifies the Compose service a container was created for, as
+// recorded by docker compose in the container's com.docker.compose.* labels
+type composeOwner struct {
+	Project     string
+	Service     string
+	WorkingDir  string
+	ConfigFiles []string
+}
+
+// composeOwnerFromLabels returns the Compose service that owns a container, or false
+// if its labels don't name the project, service and compose files needed to run
+// docker compose for it again
+func composeOwnerFromLabels(labels map[string]interface{}) (composeOwner, bool) {
+	label := func(key string) string {
+		value, _ := labels[key].(string)
+		return strings.TrimSpace(value)
+	}
+	owner := composeOwner{
+		Project:    label("com.docker.compose.project"),
+		Service:    label("com.docker.compose.service"),
+		WorkingDir: label("com.docker.compose.project.working_dir"),
+	}
+	for _, file := range strings.Split(label("com.docker.compose.project.config_files"), ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			owner.ConfigFiles = append(owner.ConfigFiles, file)
+		}
+	}
+	if owner.Project == "" || owner.Service == "" || len(owner.ConfigFiles) == 0 {
+		return composeOwner{}, false
+	}
+	return owner, true
+}
+
+// command returns a docker-compose command for the owner's project, its compose files
+// followed by the given override file, running in the directory of the first file
+func (o composeOwner) command(override string, args ...string) *exec.Cmd {
+	var fileArgs []string
+	for _, file := range append(append([]string{}, o.ConfigFiles[1:]...), override) {
+		fileArgs = append(fileArgs, "-f", file)
+	}
+	return composeCommand(o.ConfigFiles[0], []string{"-p", o.Project}, append(fileArgs, args...)...)
+}
+
+// minOverrideComposeVersion is the first Compose release that understands the
+// !override tag port overrides rely on
+var minOverrideComposeVersion = [3]int{2, 24, 4}
+
+// parseComposeVersion parses a version as printed by docker-compose version --short,
+// e.g. 2.24.5, v2.27.0 or 2.29.1-desktop.1
+func parseComposeVersion(version string) ([3]int, bool) {
+	var parsed [3]int
+	parts := strings.SplitN(strings.TrimPrefix(strings.TrimSpace(version), "v"), ".", 3)
+	if len(parts) != 3 {
+		return parsed, false
+	}
+	for i, part := range parts {
+		if end := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' }); end >= 0 {
+			part = part[:end]
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
+
+// checkComposeOverrideSupport fails if the installed Compose is too old for the port
+// overrides remapViaCompose writes. Older releases would merge the ports into the
+// original list instead of replacing them, or reject the file.
+func checkComposeOverrideSupport() error {
+	output, err := composeExec("version", "--short").Output()
+	if err != nil {
+		return fmt.Errorf("failed to get the docker-compose version: %v", err)
+	}
+	version := strings.TrimSpace(string(output))
+	parsed, ok := parseComposeVersion(version)
+	if !ok {
+		return fmt.Errorf("can't parse docker-compose version %q", version)
+	}
+	for i := range parsed {
+		if parsed[i] != minOverrideComposeVersion[i] {
+			if parsed[i] < minOverrideComposeVersion[i] {
+				return fmt.Errorf("docker-compose %s is too old to recreate services with -compose-delegate, which needs 2.24.4 or later", version)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// writePortOverride writes a compose override file that replaces the service's ports
+// with the given bindings and adds our labels. The ports are tagged !override, so
+// they replace the list from the original files instead of being merged into it.
+func writePortOverride(owner composeOwner, portBindings map[string][]map[string]string, labels map[string]string) (string, error) {
+	dir, err := runTempDir()
+	if err != nil {
+		return "", err
+	}
+
+	scalar := func(value string) *yaml.Node {
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+	}
+	quoted := func(value string) *yaml.Node {
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: value, Style: yaml.DoubleQuotedStyle}
+	}
+
+	containerPorts := make([]string, 0, len(portBindings))
+	for port := range portBindings {
+		containerPorts = append(containerPorts, port)
+	}
+	sort.Strings(containerPorts)
+
+	ports := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!override"}
+	for _, port := range containerPorts {
+		for _, binding := range portBindings[port] {
+			hostIP, hostPort := binding["HostIp"], binding["HostPort"]
+			switch {
+			case hostIP == "" || hostIP == "0.0.0.0":
+				ports.Content = append(ports.Content, quoted(fmt.Sprintf("%s:%s", hostPort, port)))
+			case strings.Contains(hostIP, ":"):
+				ports.Content = append(ports.Content, quoted(fmt.Sprintf("[%s]:%s:%s", hostIP, hostPort, port)))
+			default:
+				ports.Content = append(ports.Content, quoted(fmt.Sprintf("%s:%s:%s", hostIP, hostPort, port)))
+			}
+		}
+	}
+
+	labelKeys := make([]string, 0, len(labels))
+	for key := range labels {
+		labelKeys = append(labelKeys, key)
+	}
+	sort.Strings(labelKeys)
+	labelNode := &yaml.Node{Kind: yaml.MappingNode}
+	for _, key := range labelKeys {
+		labelNode.Content = append(labelNode.Content, scalar(key), quoted(labels[key]))
+	}
+
+	service := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{scalar("ports"), ports}}
+	if len(labelKeys) > 0 {
+		service.Content = append(service.Content, scalar("labels"), labelNode)
+	}
+	doc := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+		scalar("services"),
+		{Kind: yaml.MappingNode, Content: []*yaml.Node{scalar(owner.Service), service}},
+	}}
+
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate port override: %v", err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.ports.yml", owner.Project, owner.Service))
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return "", fmt.Errorf("failed to write port override: %v", err)
+	}
+	return path, nil
+}
+
+// remapViaCompose remaps a Compose-managed container by running docker compose up for
+// just its service with a port override, so the replacement still belongs to the
+// project and is stopped by a later docker compose down. Compose removes the original
+// itself, so unlike a docker run remap a failure can't be rolled back.
+func (s *ContainerStore) remapViaCompose(containerID, containerName string, owner composeOwner, portBindings map[string][]map[string]string, labels map[string]string, timing *RemapTiming) (string, error) {
+	if err := checkComposeOverrideSupport(); err != nil {
+		return "", err
+	}
+	override, err := writePortOverride(owner, portBindings, labels)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(override)
+
+	phaseStart := time.Now()
+	upCmd := owner.command(override, "up", "-d", "--no-deps", owner.Service)
+	log.Printf("Recreating service %s of Compose project %s: %s",
+		owner.Service, owner.Project, strings.Join(upCmd.Args, " "))
+	if output, err := upCmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to recreate service %s with docker-compose: %v, output: %s",
+			owner.Service, err, string(output))
+	}
+	timing.CreateMs = time.Since(phaseStart).Milliseconds()
+	phaseStart = time.Now()
+
+	psCmd := owner.command(override, "ps", "-q", owner.Service)
+	psOutput, err := psCmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the recreated container of service %s: %v", owner.Service, err)
+	}
+	newContainerID := ""
+	if fields := strings.Fields(string(psOutput)); len(fields) > 0 {
+		newContainerID = fields[0]
+	}
+	if newContainerID == "" {
+		return "", fmt.Errorf("docker-compose reported no container for service %s", owner.Service)
+	}
+	log.Printf("Successfully remapped port for container %s (%s) through docker-compose (new ID: %s): %s -> %s",
+		containerName, containerID, newContainerID, timing.OldHostPort, timing.NewHostPort)
+
+	s.mu.Lock()
+	s.processedContainers[newContainerID] = true
+	s.mu.Unlock()
+	s.saveState()
+
+	err = waitForContainerReady(s.context(), newContainerID, s.readyTimeout)
+	timing.StartMs = time.Since(phaseStart).Milliseconds()
+	if err != nil {
+		return "", fmt.Errorf("container %s recreated by docker-compose is not ready: %v", newContainerID, err)
+	}
+	timing.Completed = true
+	return newContainerID, nil
+}
+
+// dynamicPortLabels returns the labels this tool adds to containers, to be set on
+// containers that docker compose recreates
+func dynamicPortLabels(labels map[string]interface{}) map[string]string {
+	result := make(map[string]string)
+	for key, value := range labels {
+		if strings.HasPrefix(key, "com.dynamic-port-mapper.") {
+			result[key], _ = value.(string)
+		}
+	}
+	return result
+}
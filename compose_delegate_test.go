@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseComposeVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    [3]int
+		ok      bool
+	}{
+		{"2.24.5", [3]int{2, 24, 5}, true},
+		{"v2.27.0\n", [3]int{2, 27, 0}, true},
+		{"2.29.1-desktop.1", [3]int{2, 29, 1}, true},
+		{"1.29.2", [3]int{1, 29, 2}, true},
+		{"unknown", [3]int{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseComposeVersion(tt.version)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("parseComposeVersion(%q) = %v, %v, want %v, %v", tt.version, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestComposeOwnerCommand(t *testing.T) {
+	owner := composeOwner{
+		Project:     "shop",
+		Service:     "web",
+		ConfigFiles: []string{"/srv/shop/compose.yml", "/srv/shop/compose.prod.yml"},
+	}
+	cmd := owner.command("/tmp/override.yml", "up", "-d")
+	if cmd.Dir != "/srv/shop/" {
+		t.Errorf("Dir = %q, want the first compose file's directory", cmd.Dir)
+	}
+	// The command is docker-compose, or docker compose without it installed
+	want := []string{"-p", "shop", "-f", "compose.yml", "-f", "/srv/shop/compose.prod.yml", "-f", "/tmp/override.yml", "up", "-d"}
+	if len(cmd.Args) < len(want) || !reflect.DeepEqual(cmd.Args[len(cmd.Args)-len(want):], want) {
+		t.Errorf("args = %q, want them to end in %q", cmd.Args, want)
+	}
+}
+
+func TestComposeOwnerFromLabels(t *testing.T) {
+	complete := map[string]interface{}{
+		"com.docker.compose.project":              "shop",
+		"com.docker.compose.service":              "web",
+		"com.docker.compose.project.working_dir":  "/srv/shop",
+		"com.docker.compose.project.config_files": "/srv/shop/compose.yml, /srv/shop/compose.prod.yml",
+	}
+	owner, ok := composeOwnerFromLabels(complete)
+	want := composeOwner{Project: "shop", Service: "web", WorkingDir: "/srv/shop", ConfigFiles: []string{"/srv/shop/compose.yml", "/srv/shop/compose.prod.yml"}}
+	if !ok || !reflect.DeepEqual(owner, want) {
+		t.Errorf("composeOwnerFromLabels = %+v, %v, want %+v delegated to docker-compose", owner, ok, want)
+	}
+
+	// Without any of these, the remap falls back to docker run
+	for _, key := range []string{"com.docker.compose.project", "com.docker.compose.service", "com.docker.compose.project.config_files"} {
+		labels := make(map[string]interface{})
+		for k, v := range complete {
+			if k != key {
+				labels[k] = v
+			}
+		}
+		if owner, ok := composeOwnerFromLabels(labels); ok {
+			t.Errorf("without %s composeOwnerFromLabels = %+v, want the docker run path", key, owner)
+		}
+	}
+}
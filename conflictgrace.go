@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// conflictRecheckInterval is how often a conflict is checked again during the grace period
+const conflictRecheckInterval = 250 * time.Millisecond
+
+// conflictPersists checks a conflict again over the -conflict-grace period and reports
+// whether it lasted. A port can be unavailable for a moment while the container
+// holding it is torn down, which shouldn't cost the new container its port. Once the
+// store stops, the conflict is taken as lasting rather than waited out.
+func (s *ContainerStore) conflictPersists(what string, stillConflicts func() bool) bool {
+	if s.conflictGrace <= 0 {
+		return true
+	}
+	deadline := time.Now().Add(s.conflictGrace)
+	for time.Now().Before(deadline) {
+		select {
+		case <-s.context().Done():
+			return true
+		case <-time.After(conflictRecheckInterval):
+		}
+		if !stillConflicts() {
+			log.Printf("Conflict on %s cleared within %v", what, s.conflictGrace)
+			return false
+		}
+	}
+	return true
+}
+
+// preferredPortAvailable checks if a preferred port is available like isPortAvailableFor,
+// but gives one that only the host bind test turns down the -conflict-grace period to
+// free up, as a container being torn down may hold it for a moment. Ports our containers
+// publish stay taken, and dry runs never wait.
+func (s *ContainerStore) preferredPortAvailable(hostIP string, port int, protocols []string) bool {
+	if s.isPortAvailableFor(hostIP, port, protocols) {
+		return true
+	}
+	if s.dryRun || s.reservedPorts[port] || (s.avoidMax > 0 && port >= s.avoidMin && port <= s.avoidMax) {
+		return false
+	}
+	if s.isPortPublished(hostIP, port, "") {
+		return false
+	}
+	return !s.conflictPersists(fmt.Sprintf("preferred port %d", port), func() bool {
+		return !s.isPortAvailableFor(hostIP, port, protocols)
+	})
+}
+
+// containerIsRunning reports whether a container, given by name or ID, is running.
+// A container that no longer exists isn't.
+func containerIsRunning(ctx context.Context, container string) bool {
+	output, err := exec.CommandContext(ctx, "docker", "inspect", "--format", "{{.State.Running}}", container).Output()
+	return err == nil && strings.TrimSpace(string(output)) == "true"
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestConflictPersists(t *testing.T) {
+	if s := NewContainerStore(StoreOptions{}); !s.conflictPersists("port 8080", func() bool { return false }) {
+		t.Error("without a grace period a conflict isn't taken at face value")
+	}
+
+	s := NewContainerStore(StoreOptions{ConflictGrace: time.Second})
+	checks := 0
+	if s.conflictPersists("port 8080", func() bool { checks++; return checks < 2 }) {
+		t.Error("conflict that cleared within the grace period persisted")
+	}
+	start := time.Now()
+	if !s.conflictPersists("port 8080", func() bool { return true }) {
+		t.Error("lasting conflict didn't persist")
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("lasting conflict was given up on after %v, before the grace period ended", elapsed)
+	}
+}
+
+func TestConflictPersistsStopsWithStore(t *testing.T) {
+	newFakeDocker(t)
+	s := NewContainerStore(StoreOptions{ConflictGrace: time.Minute})
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	time.AfterFunc(300*time.Millisecond, s.Stop)
+
+	start := time.Now()
+	if !s.conflictPersists("port 8080", func() bool { return true }) {
+		t.Error("conflict cut short by Stop didn't persist")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Stop took %v to end the grace period", elapsed)
+	}
+}
+
+func TestBrieflyUnbindablePreferredPortIsKept(t *testing.T) {
+	for _, freed := range []bool{true, false} {
+		busy, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := busy.Addr().(*net.TCPAddr).Port
+		if freed {
+			// Whatever holds the port is on its way out
+			time.AfterFunc(300*time.Millisecond, func() { busy.Close() })
+		} else {
+			defer busy.Close()
+		}
+
+		s := NewContainerStore(StoreOptions{PortRangeMin: port, PortRangeMax: port, PreferredPorts: []int{port}, ConflictGrace: 2 * time.Second})
+		allocated, err := s.allocateRandomPort()
+		if freed && (err != nil || allocated != port) {
+			t.Errorf("allocateRandomPort = %d, %v, want the preferred port %d once it freed up", allocated, err, port)
+		}
+		if !freed && err == nil {
+			t.Errorf("allocateRandomPort = %d, want no port while %d stays bound", allocated, port)
+		}
+	}
+}
+
+func TestBrieflyBusyComposePortIsKept(t *testing.T) {
+	newFakeDocker(t)
+	for _, freed := range []bool{true, false} {
+		busy, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := strconv.Itoa(busy.Addr().(*net.TCPAddr).Port)
+		if freed {
+			// The container holding the port is on its way out
+			time.AfterFunc(300*time.Millisecond, func() { busy.Close() })
+		} else {
+			defer busy.Close()
+		}
+
+		composeFile := filepath.Join(t.TempDir(), "docker-compose.yml")
+		compose := "services:\n  web:\n    image: nginx\n    ports:\n      - \"" + port + ":80\"\n"
+		if err := os.WriteFile(composeFile, []byte(compose), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, ConflictGrace: 2 * time.Second})
+		remappings, err := s.CheckComposePortConflicts(composeFile, nil)
+		if err != nil {
+			t.Fatalf("CheckComposePortConflicts failed: %v", err)
+		}
+		if _, remapped := remappings["web:"+port]; remapped == freed {
+			t.Errorf("port freed within the grace period: %v, remapped: %v", freed, remapped)
+		}
+	}
+}
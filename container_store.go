@@ -2,7 +2,9 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,7 +12,9 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -40,73 +44,310 @@ type DockerActor struct {
 
 // ContainerStore maintains the state of all containers and port mappings
 type ContainerStore struct {
-	containers           map[string]Container
-	portMappings         map[string]map[string]string // containerID -> containerPort:hostPort mapping
-	processedContainers  map[string]bool              // In-memory tracking of containers with dynamic ports
-	mu                   sync.RWMutex
-	eventCmd             *exec.Cmd
-	done                 chan struct{}
-	portRangeMin         int
-	portRangeMax         int
+	containers               map[string]Container
+	portMappings             map[string]map[string]string // containerID -> hostIP:containerPort/protocol -> hostPort
+	processedContainers      map[string]bool              // In-memory tracking of containers with dynamic ports
+	portlessContainers       map[string]bool              // Containers that started without port bindings, so restarts needn't be inspected
+	paused                   bool                         // Whether started containers are left alone, e.g. during maintenance
+	resolvingDuplicates      bool                         // Whether resolveDuplicatePorts is running, so refreshes don't start another
+	mu                       sync.RWMutex
+	eventCmd                 *exec.Cmd
+	done                     chan struct{}
+	portRangeMin             int
+	portRangeMax             int
+	managePublishAll         bool                         // Whether to pin Docker-assigned --publish-all ports under our management
+	readyTimeout             time.Duration                // How long to wait for a recreated container to become ready
+	dryRun                   bool                         // Never mutate Docker state (used for planning)
+	lastRefreshErr           error                        // Result of the most recent refresh, used for health reporting
+	probeDial                bool                         // Also try connecting to a port before considering it available
+	lastEventTime            int64                        // Timestamp (ns) of the newest processed event, to resume after reconnects
+	seenEvents               map[string]int64             // Recently processed event keys -> timestamp (ns), to skip replays
+	reservedPorts            map[int]bool                 // Host ports the allocator must never hand out (e.g. our web server)
+	readOnly                 bool                         // Only detect and display conflicts, never recreate containers
+	conflicts                map[string]map[string]bool   // containerID -> containerPort/protocol with a detected conflict (read-only mode)
+	stateFile                string                       // Path to persist tracking state to, empty to keep it in memory only
+	keepStateFile            bool                         // Never write the state file, as it belongs to another instance
+	noLabel                  bool                         // Track processed containers in the state file only, never via Docker labels
+	preferredPorts           []int                        // Ports tried in order before random allocation
+	planOnly                 bool                         // Record intended remaps instead of recreating containers
+	remapIntents             []RemapIntent                // Remaps decided on in plan-only mode
+	rangeExhausted           bool                         // Whether the last allocation found no free port in the dynamic range
+	avoidMin                 int                          // Start of a port range never to allocate from (e.g. the ephemeral range)
+	avoidMax                 int                          // End of a port range never to allocate from
+	remapTimings             []RemapTiming                // Phase timings of the most recent remaps
+	slowRemapThreshold       time.Duration                // Remaps taking longer than this are logged as slow (0 disables)
+	excludedProjects         map[string]bool              // Compose projects whose containers are never remapped
+	portReasons              map[string]map[string]string // Container ID -> "port/proto" -> why its host port was (not) remapped
+	remoteDocker             bool                         // Whether the Docker daemon runs on another machine
+	selector                 labelSelector                // Only containers matching this are managed (empty manages all)
+	showUnselected           bool                         // Whether to display containers not matching the selector
+	labelOnce                sync.Once                    // Guards detecting labelMode
+	labelMode                string                       // How to add labels to existing containers, "" if unsupported
+	remapOnStart             bool                         // Whether to remap already running containers during startup
+	ctx                      context.Context              // Cancelled when the store stops, set by Start
+	cancel                   context.CancelFunc
+	started                  bool                           // Whether Start has succeeded
+	stopOnce                 sync.Once                      // Guards closing done
+	pollInterval             time.Duration                  // How often to poll when docker events is unavailable (0 never polls)
+	eventFailures            int                            // Consecutive times the events stream died shortly after starting
+	polling                  bool                           // Whether containers are being polled instead of followed through events
+	nameSuffix               bool                           // Whether recreated containers are named after their new host port, e.g. web-dpm10342
+	states                   containerStates                // Container states to list and manage
+	remapEvents              []RemapEvent                   // The most recent completed remaps, for long-polling clients
+	remapSeq                 uint64                         // Sequence number of the latest remap event
+	remapNotify              chan struct{}                  // Closed and replaced whenever a remap event is published
+	remapHistory             map[string][]RemapHistoryEntry // Remaps of each service, keyed as by remapHistoryKey
+	claimMu                  sync.Mutex                     // Guards portClaims
+	portClaims               map[int]time.Time              // Allocated ports not yet bound by their remap -> when they were claimed
+	allocations              []PortAllocation               // The most recently allocated ports, guarded by claimMu
+	composeDelegate          bool                           // Whether Compose-managed containers are recreated through docker-compose
+	noRecreateImages         imagePatterns                  // Images whose containers are never recreated, only warned about
+	pullOnRecreate           bool                           // Whether a container's image is pulled if it's gone when the container is recreated
+	bindHostIP               string                         // Host IP remapped ports are published on, "" to keep the one each port had
+	allocateFromComposeRange bool                           // Whether compose ports are remapped within the band of the original port
+	conflictGrace            time.Duration                  // How long a conflict must last to count, so ports being released aren't remapped
+	remapLimiter             *remapLimiter                  // Bounds how many containers are recreated per minute, nil if unlimited
+	projectSettler           *projectSettler                // Holds back started Compose containers until their project settles, nil if not
+	keepRanges               bool                           // Remap a published range as a whole block or not at all, never partially
+	lockDir                  string                         // Directory where port claims are shared with other instances, if any
 }
 
-// portRegex matches port mappings in the format [IP:]PORT->PORT/PROTO
-var portRegex = regexp.MustCompile(`(?:(\d+\.\d+\.\d+\.\d+):)?(\d+)->(\d+)\/(\w+)`)
+// eventDedupWindow is how long processed event keys are remembered for deduplication
+const eventDedupWindow = time.Minute
 
-// NewContainerStore creates a new container store
-func NewContainerStore() (*ContainerStore, error) {
+// maxEventFailures is how many times in a row the events stream may die shortly after
+// starting before falling back to polling
+const maxEventFailures = 3
+
+// eventStreamMinUptime is how long the events stream must run to count as working
+const eventStreamMinUptime = 30 * time.Second
+
+// dialProbeTimeout bounds each connection attempt made when probing a port
+const dialProbeTimeout = 200 * time.Millisecond
+
+// portRegex matches port mappings in the format [IP:]PORT->PORT/PROTO, where IP may
+// also be "::" or a bracketed IPv6 address
+var portRegex = regexp.MustCompile(`(?:(\d+\.\d+\.\d+\.\d+|\[[0-9a-fA-F:]+\]|::):)?(\d+)->(\d+)\/(\w+)`)
+
+// Errors wrapped by store operations so callers can tell the kind of failure apart
+// with errors.Is
+var (
+	errDockerUnavailable = errors.New("can't access Docker")
+	errPortExhausted     = errors.New("no free ports left")
+	errComposeParse      = errors.New("failed to parse compose file")
+	errStoreStopped      = errors.New("container store was stopped")
+)
+
+// StoreOptions configures a container store. Zero values select the defaults.
+type StoreOptions struct {
+	PortRangeMin             int             // Start of the dynamic port range (default 10000)
+	PortRangeMax             int             // End of the dynamic port range (default 65000)
+	ManagePublishAll         bool            // Pin Docker-assigned --publish-all ports under our management
+	ReadyTimeout             time.Duration   // How long to wait for a recreated container (default 30s)
+	ProbeDial                bool            // Also try connecting to a port before considering it available
+	ReadOnly                 bool            // Only detect and display conflicts
+	DryRun                   bool            // Never mutate Docker state
+	StateFile                string          // Path to persist tracking state to
+	KeepStateFile            bool            // Never write the state file, e.g. in one-off commands while a daemon owns it
+	NoLabel                  bool            // Never add tracking labels to containers
+	PreferredPorts           []int           // Ports tried in order before random allocation
+	PlanOnly                 bool            // Record intended remaps instead of performing them
+	AvoidMin, AvoidMax       int             // A port range never to allocate from
+	SlowRemapThreshold       time.Duration   // Remaps taking longer than this are logged as slow
+	ExcludedProjects         map[string]bool // Compose projects whose containers are never remapped
+	RemoteDocker             bool            // The Docker daemon runs on another machine
+	Selector                 labelSelector   // Only manage containers matching this
+	ShowUnselected           bool            // Display containers not matching the selector
+	RemapOnStart             bool            // Remap already running containers during Start
+	PollInterval             time.Duration   // Poll this often when docker events is unavailable (0 never polls)
+	NameSuffix               bool            // Append the new host port to the names of recreated containers
+	States                   containerStates // Only list containers in these states (empty lists running ones)
+	LockDir                  string          // Directory to claim allocated ports in, shared with other instances
+	ComposeDelegate          bool            // Recreate Compose-managed containers through docker-compose instead of docker run
+	MaxRemapsPerMinute       int             // Recreate at most this many containers a minute, delaying the rest (0 is unlimited)
+	RemapDelay               time.Duration   // Wait until a Compose project has had no new starts for this long before remapping it
+	KeepRanges               bool            // Remap a published range as a whole block or not at all, never partially
+	NoRecreateImages         imagePatterns   // Never recreate containers of these images, e.g. postgres*
+	PullOnRecreate           bool            // Pull a container's image if it's no longer present when recreating the container
+	BindHostIP               string          // Publish remapped ports on this host IP only, e.g. 127.0.0.1 ("" keeps each port's own)
+	AllocateFromComposeRange bool            // Remap compose ports within the band of the original, e.g. 8080 within 8000-8999
+	ConflictGrace            time.Duration   // Only treat a port as conflicting if it is still in use after this long
+	ReservedPorts            []int           // Host ports never to hand out
+}
+
+// NewContainerStore builds a container store from the given options. It doesn't
+// load containers or listen for events until Start is called.
+func NewContainerStore(opts StoreOptions) *ContainerStore {
+	s := newContainerStore()
+	if opts.PortRangeMin > 0 {
+		s.portRangeMin = opts.PortRangeMin
+	}
+	if opts.PortRangeMax > 0 {
+		s.portRangeMax = opts.PortRangeMax
+	}
+	if opts.ReadyTimeout > 0 {
+		s.readyTimeout = opts.ReadyTimeout
+	}
+	s.managePublishAll = opts.ManagePublishAll
+	s.probeDial = opts.ProbeDial
+	s.readOnly = opts.ReadOnly
+	s.dryRun = opts.DryRun
+	s.stateFile = opts.StateFile
+	s.keepStateFile = opts.KeepStateFile
+	s.noLabel = opts.NoLabel
+	s.preferredPorts = opts.PreferredPorts
+	s.planOnly = opts.PlanOnly
+	s.avoidMin, s.avoidMax = opts.AvoidMin, opts.AvoidMax
+	s.slowRemapThreshold = opts.SlowRemapThreshold
+	s.excludedProjects = opts.ExcludedProjects
+	s.remoteDocker = opts.RemoteDocker
+	s.selector = opts.Selector
+	s.showUnselected = opts.ShowUnselected
+	s.remapOnStart = opts.RemapOnStart
+	s.pollInterval = opts.PollInterval
+	s.nameSuffix = opts.NameSuffix
+	s.states = opts.States
+	s.lockDir = opts.LockDir
+	s.composeDelegate = opts.ComposeDelegate
+	s.remapLimiter = newRemapLimiter(opts.MaxRemapsPerMinute)
+	s.projectSettler = newProjectSettler(opts.RemapDelay)
+	s.keepRanges = opts.KeepRanges
+	s.noRecreateImages = opts.NoRecreateImages
+	s.pullOnRecreate = opts.PullOnRecreate
+	s.bindHostIP = opts.BindHostIP
+	s.allocateFromComposeRange = opts.AllocateFromComposeRange
+	s.conflictGrace = opts.ConflictGrace
+	for _, port := range opts.ReservedPorts {
+		s.ReservePort(port)
+	}
+	return s
+}
+
+// Start loads any persisted state and the current containers, then begins listening
+// for Docker events until ctx is cancelled or Stop is called. Calling it again once
+// it has succeeded does nothing. A stopped store can't be started again, since its
+// goroutines would exit right away; build a new one instead.
+func (s *ContainerStore) Start(ctx context.Context) error {
+	select {
+	case <-s.done:
+		return errStoreStopped
+	default:
+	}
+
+	s.mu.Lock()
+	if s.started {
+		s.mu.Unlock()
+		return nil
+	}
+	s.started = true
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.mu.Unlock()
+
+	if err := s.start(); err != nil {
+		s.mu.Lock()
+		s.started = false
+		s.mu.Unlock()
+		s.cancel()
+		return err
+	}
+
+	// Cancelling the caller's context stops the store like Stop does
+	go func() {
+		<-s.ctx.Done()
+		s.Stop()
+	}()
+	return nil
+}
+
+// start does the work of Start
+func (s *ContainerStore) start() error {
+	// Fail early with a helpful message if we can't talk to Docker at all
+	if err := checkDockerAccess(s.context()); err != nil {
+		return err
+	}
+
+	if err := s.loadState(); err != nil {
+		return err
+	}
+
+	// Find out once whether containers can be labelled, before any are processed
+	if !s.noLabel {
+		s.labelMethod()
+	}
+
+	// Initialize the container list
+	if err := s.refreshContainers(); err != nil {
+		return err
+	}
+	
+	// Fix conflicts among the containers that are already running before
+	// listening for new ones
+	if s.remapOnStart {
+		s.remapExistingContainers()
+	}
+
+	// Start listening for Docker events
+	go s.listenForEvents()
+
+	return nil
+}
+
+// newContainerStore builds an empty container store with the default configuration
+func newContainerStore() *ContainerStore {
 	// Seed the random number generator for port allocation
 	rand.Seed(time.Now().UnixNano())
 
-	store := &ContainerStore{
+	return &ContainerStore{
 		containers:          make(map[string]Container),
 		portMappings:        make(map[string]map[string]string),
 		processedContainers: make(map[string]bool),
+		portlessContainers:  make(map[string]bool),
+		seenEvents:          make(map[string]int64),
+		reservedPorts:       make(map[int]bool),
+		conflicts:           make(map[string]map[string]bool),
+		portReasons:         make(map[string]map[string]string),
 		done:                make(chan struct{}),
+		remapNotify:         make(chan struct{}),
+		portClaims:          make(map[int]time.Time),
 		portRangeMin:        10000,  // Default port range
 		portRangeMax:        65000,
+		readyTimeout:        30 * time.Second,
 	}
-
-	// Initialize the container list
-	if err := store.refreshContainers(); err != nil {
-		return nil, err
-	}
-
-	// Start listening for Docker events
-	go store.listenForEvents()
-
-	return store, nil
 }
 
 // refreshContainers loads all current containers from Docker
 func (s *ContainerStore) refreshContainers() error {
-	// List all running containers using docker ps with additional name and label info
-	cmd := exec.Command("docker", "ps", "--format", "{{json .}}", "--no-trunc")
-	output, err := cmd.Output()
-	if err != nil {
-		return fmt.Errorf("error listing containers: %v", err)
+	// List the containers in the configured states (running ones by default) using
+	// docker ps. Containers outside the label selector aren't listed unless asked for.
+	psArgs := []string{"ps", "--format", "{{json .}}", "--no-trunc"}
+	psArgs = append(psArgs, s.states.filterArgs()...)
+	if !s.showUnselected {
+		psArgs = append(psArgs, s.selector.filterArgs()...)
 	}
 
-	// Store current state of port mappings before lock
+	// Only containers processed before the listing is taken can be judged missing
+	// from it, as one remapped meanwhile has an ID docker ps may not have seen
 	s.mu.RLock()
-	currentPortMappings := make(map[string]map[string]string)
-	for id, mappings := range s.portMappings {
-		currentPortMappings[id] = make(map[string]string)
-		for k, v := range mappings {
-			currentPortMappings[id][k] = v
-		}
-	}
-	// Also store processed containers
-	processedContainers := make(map[string]bool)
-	for id, processed := range s.processedContainers {
-		processedContainers[id] = processed
+	processedBefore := make(map[string]bool, len(s.processedContainers))
+	for id := range s.processedContainers {
+		processedBefore[id] = true
 	}
 	s.mu.RUnlock()
 
+	cmd := exec.CommandContext(s.context(), "docker", psArgs...)
+	output, err := cmd.Output()
+	if err != nil {
+		err = fmt.Errorf("%w: error listing containers: %v", errDockerUnavailable, err)
+		s.mu.Lock()
+		s.lastRefreshErr = err
+		s.mu.Unlock()
+		return err
+	}
+
 	// Create temporary structures to hold the new state
 	newContainers := make(map[string]Container)
 	newPortMappings := make(map[string]map[string]string)
-	newProcessedContainers := make(map[string]bool)
+	listed := make(map[string]bool)
 
 	// Parse the output
 	scanner := bufio.NewScanner(strings.NewReader(string(output)))
@@ -120,24 +361,29 @@ func (s *ContainerStore) refreshContainers() error {
 			Status     string `json:"Status"`
 			Ports      string `json:"Ports"`
 			Names      string `json:"Names"`
+			Networks   string `json:"Networks"`
 		}
 
 		if err := json.Unmarshal([]byte(line), &dockerContainer); err != nil {
 			log.Printf("Error parsing container JSON: %v", err)
 			continue
 		}
+		listed[dockerContainer.ID] = true
 
 		// Make sure we can still look up this container before proceeding
 		// Sometimes Docker CLI output can lag behind actual state
-		checkCmd := exec.Command("docker", "inspect", "--format", "{{.ID}}", dockerContainer.ID)
-		if err := checkCmd.Run(); err != nil {
+		checkCmd := exec.CommandContext(s.context(), "docker", "inspect", "--format", "{{.Created}} {{.State.StartedAt}} {{.RestartCount}}", dockerContainer.ID)
+		timesOutput, err := checkCmd.Output()
+		if err != nil {
 			log.Printf("Container %s appears to no longer exist, skipping", dockerContainer.ID)
 			continue
 		}
+		createdAt, startedAt := parseContainerTimes(string(timesOutput))
+		restartCount := parseRestartCount(string(timesOutput))
 
 		// Look up the compose project and service labels directly
-		composeProject := extractLabel(dockerContainer.ID, "com.docker.compose.project")
-		composeService := extractLabel(dockerContainer.ID, "com.docker.compose.service")
+		composeProject := extractLabel(s.context(), dockerContainer.ID, "com.docker.compose.project")
+		composeService := extractLabel(s.context(), dockerContainer.ID, "com.docker.compose.service")
 		
 		// Try additional labels if the standard ones don't work
 		if composeProject == "" {
@@ -150,7 +396,7 @@ func (s *ContainerStore) refreshContainers() error {
 			}
 			
 			for _, altLabel := range alternativeLabels {
-				composeProject = extractLabel(dockerContainer.ID, altLabel)
+				composeProject = extractLabel(s.context(), dockerContainer.ID, altLabel)
 				if composeProject != "" {
 					log.Printf("Found compose project '%s' for container %s using alternative label: %s", 
 						composeProject, dockerContainer.Names, altLabel)
@@ -160,31 +406,10 @@ func (s *ContainerStore) refreshContainers() error {
 			
 			// If still no project but we have a compose service, use the container's name to infer project
 			if composeProject == "" {
-				// Extract project name from container name
-				containerName := dockerContainer.Names
-				// Remove any leading slash
-				containerName = strings.TrimPrefix(containerName, "/")
-				
-				// Many compose-created containers follow naming patterns:
-				// 1. project_service_1 (most common)
-				// 2. project-service-1
-				// Try to extract project name
-				
-				// First try underscore pattern
-				parts := strings.Split(containerName, "_")
-				if len(parts) >= 2 && parts[0] != "" {
-					composeProject = parts[0]
-					log.Printf("Inferred compose project '%s' from container name (underscore pattern): %s", 
-						composeProject, containerName)
-				} else {
-					// Try hyphen pattern
-					parts = strings.Split(containerName, "-")
-					if len(parts) >= 3 && parts[0] != "" {
-						// In "project-service-1" pattern, first part is project
-						composeProject = parts[0]
-						log.Printf("Inferred compose project '%s' from container name (hyphen pattern): %s", 
-							composeProject, containerName)
-					}
+				composeProject = inferComposeProject(dockerContainer.Names, composeService)
+				if composeProject != "" {
+					log.Printf("Inferred compose project '%s' from container name: %s", 
+						composeProject, dockerContainer.Names)
 				}
 			}
 		}
@@ -200,7 +425,7 @@ func (s *ContainerStore) refreshContainers() error {
 			}
 			
 			for _, altLabel := range alternativeLabels {
-				composeService = extractLabel(dockerContainer.ID, altLabel)
+				composeService = extractLabel(s.context(), dockerContainer.ID, altLabel)
 				if composeService != "" {
 					break
 				}
@@ -209,11 +434,7 @@ func (s *ContainerStore) refreshContainers() error {
 			// If still no service but we have a project, infer from name
 			if composeService == "" {
 				// Extract from name pattern like project_service_1
-				parts := strings.Split(dockerContainer.Names, "_")
-				if len(parts) >= 2 {
-					// Service is often the middle part
-					composeService = parts[1]
-				}
+				composeService = inferComposeService(dockerContainer.Names, composeProject)
 			}
 		}
 
@@ -225,16 +446,30 @@ func (s *ContainerStore) refreshContainers() error {
 			Created:        dockerContainer.RunningFor,
 			Status:         dockerContainer.Status,
 			Ports:          dockerContainer.Ports,
-			Names:          dockerContainer.Names,
+			Names:          primaryContainerName(dockerContainer.Names),
 			ComposeProject: composeProject,
 			ComposeService: composeService,
+			Networks:       dockerContainer.Networks,
 			PortMappings:   []PortMapping{},
 			DynamicPorts:   false,
+			StartedAt:      startedAt,
+			RestartCount:   restartCount,
+			CreatedAt:      createdAt,
 		}
 
 		// First just parse the port mappings without remapping
 		// If remapping is needed, we'll collect them to handle after releasing the lock
-		container.PortMappings, container.DynamicPorts = s.parsePortsWithoutRemapping(dockerContainer.ID, dockerContainer.Ports, currentPortMappings)
+		container.PortMappings, container.DynamicPorts = s.parsePortsWithoutRemapping(dockerContainer.ID, dockerContainer.Ports)
+
+		// Flag any conflicts detected in read-only mode
+		s.mu.RLock()
+		for i, pm := range container.PortMappings {
+			if s.conflicts[dockerContainer.ID][fmt.Sprintf("%s/%s", pm.ContainerPort, pm.Protocol)] {
+				container.PortMappings[i].ConflictDetected = true
+			}
+		}
+		s.mu.RUnlock()
+		s.applyPortReasons(dockerContainer.ID, container.PortMappings)
 
 		// Store container
 		newContainers[dockerContainer.ID] = container
@@ -243,16 +478,10 @@ func (s *ContainerStore) refreshContainers() error {
 		if len(container.PortMappings) > 0 {
 			mappings := make(map[string]string)
 			for _, pm := range container.PortMappings {
-				key := fmt.Sprintf("%s/%s", pm.ContainerPort, pm.Protocol)
-				mappings[key] = pm.HostPort
+				mappings[portMappingKey(pm.HostIP, pm.ContainerPort, pm.Protocol)] = pm.HostPort
 			}
 			newPortMappings[dockerContainer.ID] = mappings
 		}
-
-		// Keep track of processed containers
-		if processed, exists := processedContainers[dockerContainer.ID]; exists && processed {
-			newProcessedContainers[dockerContainer.ID] = true
-		}
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -263,17 +492,172 @@ func (s *ContainerStore) refreshContainers() error {
 	s.mu.Lock()
 	s.containers = newContainers
 	s.portMappings = newPortMappings
-	s.processedContainers = newProcessedContainers
+	pruned := s.pruneProcessedContainers(processedBefore, listed)
+	s.lastRefreshErr = nil
 	s.mu.Unlock()
+	if pruned > 0 {
+		log.Printf("Pruned %d processed containers that no longer exist", pruned)
+	}
+
+	// Persist the processed set, which now only contains running containers
+	s.saveState()
+
+	// Move containers that somehow ended up sharing a host port apart
+	s.mu.RLock()
+	started := s.started
+	s.mu.RUnlock()
+	if started {
+		go s.resolveDuplicatePorts()
+	}
 
 	return nil
 }
 
+// pruneProcessedContainers drops processed entries for containers missing from the
+// listing, such as ones whose stop or destroy event was missed, so the set can't
+// grow without bound over long runs. Only the containers that were processed before
+// the listing was taken are considered, and listed ones are kept even if they
+// couldn't be inspected. It returns how many were dropped, and must be called with
+// s.mu held for writing.
+func (s *ContainerStore) pruneProcessedContainers(processedBefore, listed map[string]bool) int {
+	pruned := 0
+	for id := range s.processedContainers {
+		if processedBefore[id] && !listed[id] {
+			delete(s.processedContainers, id)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// containerNames splits the Names field of docker ps, which lists every name of a
+// container separated by commas (e.g. when it is linked under an alias)
+func containerNames(names string) []string {
+	var result []string
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimPrefix(strings.TrimSpace(name), "/")
+		if name != "" {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// primaryContainerName returns the name a container is displayed under, which is
+// the first of the names docker ps reports for it
+func primaryContainerName(names string) string {
+	if all := containerNames(names); len(all) > 0 {
+		return all[0]
+	}
+	return names
+}
+
+// inferComposeProject guesses a container's Compose project from its names, for
+// containers that lack the project label. Each of a container's comma-separated
+// names is tried in turn. The service, if known from its label, must match too.
+func inferComposeProject(names, service string) string {
+	for _, name := range containerNames(names) {
+		if project, _, ok := splitComposeName(name, "", service); ok {
+			return project
+		}
+	}
+	return ""
+}
+
+// inferComposeService guesses a container's Compose service from its names, for
+// containers that have a project but lack the service label
+func inferComposeService(names, project string) string {
+	for _, name := range containerNames(names) {
+		if _, service, ok := splitComposeName(name, project, ""); ok {
+			return service
+		}
+	}
+	return ""
+}
+
+// splitComposeName splits a container name of the form Compose generates,
+// project_service_1 or project-service-1, into its project and service. Parts that
+// are already known must match. Other names, such as those set with container_name,
+// are not split at all, since any underscores or hyphens in them mean nothing.
+func splitComposeName(name, project, service string) (string, string, bool) {
+	name = strings.TrimPrefix(name, "/")
+	for _, sep := range []string{"_", "-"} {
+		// The name must end in the container number
+		at := strings.LastIndex(name, sep)
+		if at <= 0 {
+			continue
+		}
+		if _, err := strconv.Atoi(name[at+1:]); err != nil {
+			continue
+		}
+		rest := name[:at]
+		
+		switch {
+		case project != "" && service != "":
+			if rest == project+sep+service {
+				return project, service, true
+			}
+		case project != "":
+			if svc := strings.TrimPrefix(rest, project+sep); svc != rest && svc != "" {
+				return project, svc, true
+			}
+		case service != "":
+			if proj := strings.TrimSuffix(rest, sep+service); proj != rest && proj != "" {
+				return proj, service, true
+			}
+		default:
+			// Without labels to go by, the project is taken to end at the first separator
+			if first := strings.Index(rest, sep); first > 0 && first < len(rest)-1 {
+				return rest[:first], rest[first+1:], true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// shouldManage reports whether a container may be remapped, which is not the case
+// for containers in an excluded Compose project or not matching the label selector.
+// The project is inferred from the container's name when it has no project label.
+func (s *ContainerStore) shouldManage(containerID, containerName, composeProject string) bool {
+	if len(s.excludedProjects) > 0 {
+		if composeProject == "" {
+			composeProject = inferComposeProject(containerName, "")
+		}
+		if s.excludedProjects[composeProject] {
+			return false
+		}
+	}
+	
+	if len(s.selector) > 0 {
+		labels, err := containerLabels(s.context(), containerID)
+		if err != nil || !s.selector.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// storedPortMappings returns the port mappings recorded for a container during a previous refresh.
+// The returned map is replaced rather than mutated on refresh, so it is safe to read without the lock.
+func (s *ContainerStore) storedPortMappings(containerID string) (map[string]string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	mappings, exists := s.portMappings[containerID]
+	return mappings, exists
+}
+
 // parsePortsWithoutRemapping parses port mappings without doing any remapping
-func (s *ContainerStore) parsePortsWithoutRemapping(containerID, portsStr string, existingMappings map[string]map[string]string) ([]PortMapping, bool) {
+func (s *ContainerStore) parsePortsWithoutRemapping(containerID, portsStr string) ([]PortMapping, bool) {
 	// If container already had mappings, restore them
-	if mappings, exists := existingMappings[containerID]; exists {
-		return s.restorePortMappings(portsStr, mappings)
+	if mappings, exists := s.storedPortMappings(containerID); exists {
+		restored, dynamicPorts := s.restorePortMappings(portsStr, mappings)
+		if applyOriginalPortLabels(s.context(), containerID, restored) {
+			dynamicPorts = true
+		}
+		if !dynamicPorts {
+			s.recordReadOnlyConflicts(containerID, restored)
+		}
+		return restored, dynamicPorts
 	}
 
 	var mappings []PortMapping
@@ -290,14 +674,16 @@ func (s *ContainerStore) parsePortsWithoutRemapping(containerID, portsStr string
 		protocol := match[4]
 		mappings = append(mappings, PortMapping{
 			ContainerPort: containerPort,
+			HostIP:        match[1],
 			HostPort:      hostPort,
 			Protocol:      protocol,
 			OriginalPort:  hostPort, // Since we're not remapping, original = current
 		})
 	}
 	
-	// If container is already processed, just return the mappings
+	// If container is already processed, recover the original ports we recorded when remapping it
 	if processed {
+		applyOriginalPortLabels(s.context(), containerID, mappings)
 		return mappings, true
 	}
 	
@@ -313,20 +699,115 @@ func (s *ContainerStore) parsePortsWithoutRemapping(containerID, portsStr string
 			}
 		}
 		
-		if allPortsInDynamicRange {
+		// Ports Docker assigned for --publish-all often land in our range too,
+		// so don't mistake them for ports we allocated
+		if allPortsInDynamicRange && !hasPublishAllPorts(s.context(), containerID) {
 			dynamicPorts = true
 			// Add to our processed tracking to avoid future rechecks
 			s.addDynamicPortLabel(containerID)
 		}
 	}
+	if !dynamicPorts {
+		s.recordReadOnlyConflicts(containerID, mappings)
+	}
 	
 	return mappings, dynamicPorts
 }
 
+// recordReadOnlyConflicts flags, in read-only mode, the ports of a container that
+// collide with another container, as they are never remapped
+func (s *ContainerStore) recordReadOnlyConflicts(containerID string, mappings []PortMapping) {
+	if !s.readOnly {
+		return
+	}
+	for _, mapping := range mappings {
+		s.recordConflict(containerID, mapping.HostPort, mapping.ContainerPort, mapping.Protocol)
+	}
+}
+
+// originalPortLabelPrefix prefixes the labels recording a remapped port's original host port,
+// e.g. com.dynamic-port-mapper.original-port.80-tcp=8080
+const originalPortLabelPrefix = "com.dynamic-port-mapper.original-port."
+
+// originalPortLabel returns the label key recording the original host port for a container port
+func originalPortLabel(containerPort, protocol string) string {
+	return fmt.Sprintf("%s%s-%s", originalPortLabelPrefix, containerPort, protocol)
+}
+
+// originalHostIPLabelPrefix prefixes the labels recording the host IP a remapped port was
+// originally published on, if it was a specific one, e.g.
+// com.dynamic-port-mapper.original-host-ip.80-tcp=127.0.0.1
+const originalHostIPLabelPrefix = "com.dynamic-port-mapper.original-host-ip."
+
+// originalHostIPLabel returns the label key recording the original host IP for a container port
+func originalHostIPLabel(containerPort, protocol string) string {
+	return fmt.Sprintf("%s%s-%s", originalHostIPLabelPrefix, containerPort, protocol)
+}
+
+// restoredLabel marks a container restored to its original host ports by restore, so
+// it isn't moved straight back into the dynamic range when it starts
+const restoredLabel = "com.dynamic-port-mapper.restored"
+
+// isRestored reports whether a container was restored to its original host ports and
+// is to be left alone from then on
+func (s *ContainerStore) isRestored(containerID string) bool {
+	return extractLabel(s.context(), containerID, restoredLabel) == "true"
+}
+
+// applyOriginalPortLabels sets OriginalPort on each mapping from the original-port labels we
+// stored on the container when remapping it, so the history survives restarts of this tool.
+// It returns true if any mapping's original port differs from its current one.
+func applyOriginalPortLabels(ctx context.Context, containerID string, mappings []PortMapping) bool {
+	if len(mappings) == 0 {
+		return false
+	}
+	
+	labels, err := containerLabels(ctx, containerID)
+	if err != nil {
+		return false
+	}
+	
+	remapped := false
+	for i, mapping := range mappings {
+		if original, ok := labels[originalPortLabel(mapping.ContainerPort, mapping.Protocol)]; ok && original != "" {
+			mappings[i].OriginalPort = original
+			if original != mapping.HostPort {
+				remapped = true
+			}
+		}
+	}
+	return remapped
+}
+
+// containerLabels returns all labels of a container
+func containerLabels(ctx context.Context, containerID string) (map[string]string, error) {
+	cmd := exec.CommandContext(ctx, "docker", "inspect", "--format", "{{json .Config.Labels}}", containerID)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	var labels map[string]string
+	if err := json.Unmarshal(output, &labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// hasPublishAllPorts checks if a container was started with --publish-all (-P),
+// meaning its host ports were picked by Docker from the ephemeral range rather than by us
+func hasPublishAllPorts(ctx context.Context, containerID string) bool {
+	cmd := exec.CommandContext(ctx, "docker", "inspect", "--format", "{{.HostConfig.PublishAllPorts}}", containerID)
+	output, err := cmd.Output()
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(output)) == "true"
+}
+
 // extractLabel retrieves a specific Docker label from a container
-func extractLabel(containerID string, label string) string {
+func extractLabel(ctx context.Context, containerID string, label string) string {
 	// First try the more specific format template
-	cmd := exec.Command("docker", "inspect", "--format", fmt.Sprintf("{{index .Config.Labels \"%s\"}}", label), containerID)
+	cmd := exec.CommandContext(ctx, "docker", "inspect", "--format", fmt.Sprintf("{{index .Config.Labels \"%s\"}}", label), containerID)
 	output, err := cmd.Output()
 	if err == nil {
 		// Trim whitespace and check for empty string
@@ -337,7 +818,7 @@ func extractLabel(containerID string, label string) string {
 	}
 	
 	// Try the alternate format as a fallback
-	cmd = exec.Command("docker", "inspect", "--format", fmt.Sprintf("{{.Config.Labels.%s}}", label), containerID)
+	cmd = exec.CommandContext(ctx, "docker", "inspect", "--format", fmt.Sprintf("{{.Config.Labels.%s}}", label), containerID)
 	output, err = cmd.Output()
 	if err != nil {
 		return ""
@@ -351,113 +832,6 @@ func extractLabel(containerID string, label string) string {
 	return value
 }
 
-// parsePortMappings extracts port mapping details from the port string
-// It also handles remapping ports for containers that need dynamic port allocation
-func (s *ContainerStore) parsePortMappings(containerID, portsStr string, existingMappings map[string]map[string]string) ([]PortMapping, bool) {
-	// If container already had mappings, restore them
-	if mappings, exists := existingMappings[containerID]; exists {
-		return s.restorePortMappings(portsStr, mappings)
-	}
-
-	var mappings []PortMapping
-	dynamicPorts := false
-
-	// Check if this container has already been processed
-	if s.isContainerProcessed(containerID) {
-		log.Printf("Container %s has already been processed, skipping port remapping", containerID)
-		// Parse the ports without remapping
-		matches := portRegex.FindAllStringSubmatch(portsStr, -1)
-		for _, match := range matches {
-			hostPort := match[2]
-			containerPort := match[3]
-			protocol := match[4]
-			mappings = append(mappings, PortMapping{
-				ContainerPort: containerPort,
-				HostPort:      hostPort,
-				Protocol:      protocol,
-				OriginalPort:  hostPort, // Since we're not remapping, original = current
-			})
-		}
-		return mappings, true
-	}
-
-	// Check if this is a port in our dynamic range already
-	// If so, it was likely already assigned by us during a previous run
-	matches := portRegex.FindAllStringSubmatch(portsStr, -1)
-	allPortsInDynamicRange := true
-	
-	for _, match := range matches {
-		hostPort := match[2]
-		portInt, err := strconv.Atoi(hostPort)
-		if err != nil || portInt < s.portRangeMin || portInt > s.portRangeMax {
-			allPortsInDynamicRange = false
-			break
-		}
-	}
-	
-	// If all ports are already in our dynamic range and the container is running,
-	// consider them already remapped
-	if allPortsInDynamicRange && len(matches) > 0 {
-		log.Printf("Container %s has all ports in dynamic range, considering already processed", containerID)
-		// Parse the ports without remapping but mark as dynamic
-		for _, match := range matches {
-			hostPort := match[2]
-			containerPort := match[3]
-			protocol := match[4]
-			mappings = append(mappings, PortMapping{
-				ContainerPort: containerPort,
-				HostPort:      hostPort,
-				Protocol:      protocol,
-				OriginalPort:  hostPort, // We don't know the original, so use current
-			})
-		}
-		
-		// Add to our processed tracking to avoid future rechecks
-		s.addDynamicPortLabel(containerID)
-		
-		return mappings, true
-	}
-
-	// First, parse the port string to extract all mappings
-	for _, match := range matches {
-		hostPort := match[2]
-		containerPort := match[3]
-		protocol := match[4]
-		originalPort := hostPort
-
-		// Always check if a dynamic port remap is needed
-		needsRemap, newPort := s.checkPortCollision(containerID, hostPort, protocol)
-		if needsRemap {
-			// Remember that we changed this port from its original value
-			dynamicPorts = true
-			
-			// Execute the port remap
-			if err := s.remapContainerPort(containerID, hostPort, newPort, containerPort, protocol); err != nil {
-				log.Printf("Failed to remap port %s->%s for container %s: %v", 
-					hostPort, newPort, containerID, err)
-				continue
-			}
-			
-			// Update the host port to the new one
-			hostPort = newPort
-		}
-
-		mappings = append(mappings, PortMapping{
-			ContainerPort: containerPort,
-			HostPort:      hostPort,
-			Protocol:      protocol,
-			OriginalPort:  originalPort,
-		})
-	}
-
-	// If we've remapped ports, add a label to the container to mark it as processed
-	if dynamicPorts {
-		s.addDynamicPortLabel(containerID)
-	}
-
-	return mappings, dynamicPorts
-}
-
 // addDynamicPortLabel adds a label to the container indicating it has dynamically assigned ports
 func (s *ContainerStore) addDynamicPortLabel(containerID string) {
 	// First record it in our in-memory tracking map
@@ -466,36 +840,68 @@ func (s *ContainerStore) addDynamicPortLabel(containerID string) {
 	s.mu.Unlock()
 	
 	log.Printf("Added container %s to in-memory tracking of processed containers", containerID)
+	s.saveState()
+	
+	// Don't touch the container itself when we're only planning, or when
+	// the user asked us to keep our tracking out of their containers
+	if s.dryRun || s.noLabel {
+		return
+	}
+	
+	// Still try to add the Docker label as a backup, but don't rely on it.
+	// If the Docker CLI can't change labels at all, quietly rely on our own tracking.
+	method := s.labelMethod()
+	if method == "" {
+		return
+	}
 	
-	// Still try to add the Docker label as a backup, but don't rely on it
 	// First, check if the container still exists before trying to add a label
-	checkCmd := exec.Command("docker", "inspect", "--format", "{{.ID}}", containerID)
+	checkCmd := exec.CommandContext(s.context(), "docker", "inspect", "--format", "{{.ID}}", containerID)
 	if err := checkCmd.Run(); err != nil {
 		log.Printf("Container %s no longer exists, can't add label", containerID)
 		return
 	}
 	
-	// Try to add the label in a more reliable way using docker container update
-	cmd := exec.Command("docker", "container", "update", "--label", "com.dynamic-port-mapper.has-dynamic-ports=true", containerID)
-	if err := cmd.Run(); err != nil {
-		log.Printf("Failed to add dynamic port label to container %s via update: %v", containerID, err)
-		
-		// As a fallback, try the original method
-		fallbackCmd := exec.Command("docker", "container", "label", containerID, "com.dynamic-port-mapper.has-dynamic-ports=true")
-		if err := fallbackCmd.Run(); err != nil {
-			log.Printf("Failed to add dynamic port label to container %s via label: %v", containerID, err)
-			// If both methods fail, we'll rely on our in-memory tracking
-		} else {
-			log.Printf("Added dynamic port label to container %s via label command", containerID)
-		}
+	var cmd *exec.Cmd
+	if method == "update" {
+		cmd = exec.CommandContext(s.context(), "docker", "container", "update", "--label", "com.dynamic-port-mapper.has-dynamic-ports=true", containerID)
 	} else {
-		log.Printf("Added dynamic port label to container %s via update command", containerID)
+		cmd = exec.CommandContext(s.context(), "docker", "container", "label", containerID, "com.dynamic-port-mapper.has-dynamic-ports=true")
+	}
+	if err := cmd.Run(); err != nil {
+		log.Printf("Failed to add dynamic port label to container %s via %s: %v", containerID, method, err)
+		return
 	}
+	log.Printf("Added dynamic port label to container %s via %s command", containerID, method)
 }
 
-// isContainerProcessed checks if a container has already been processed by checking
-// both in-memory tracking and Docker labels
-func (s *ContainerStore) isContainerProcessed(containerID string) bool {
+// labelMethod returns how labels can be added to existing containers with this Docker
+// CLI: "update" for docker container update --label, "label" for docker container label,
+// or "" if neither is supported. It is only detected once, so unsupported or denied
+// label commands don't produce errors for every container.
+func (s *ContainerStore) labelMethod() string {
+	s.labelOnce.Do(func() {
+		if output, err := exec.CommandContext(s.context(), "docker", "container", "update", "--help").CombinedOutput(); err == nil &&
+			strings.Contains(string(output), "--label") {
+			s.labelMode = "update"
+			return
+		}
+		if err := exec.CommandContext(s.context(), "docker", "container", "label", "--help").Run(); err == nil {
+			s.labelMode = "label"
+			return
+		}
+		if s.stateFile != "" {
+			log.Printf("Docker can't add labels to existing containers, tracking processed containers in the state file only")
+		} else {
+			log.Printf("Docker can't add labels to existing containers, tracking processed containers in memory only")
+		}
+	})
+	return s.labelMode
+}
+
+// isContainerProcessed checks if a container has already been processed by checking
+// both in-memory tracking and Docker labels
+func (s *ContainerStore) isContainerProcessed(containerID string) bool {
 	// First check our in-memory tracking
 	s.mu.RLock()
 	processed, exists := s.processedContainers[containerID]
@@ -505,8 +911,13 @@ func (s *ContainerStore) isContainerProcessed(containerID string) bool {
 		return true
 	}
 	
+	// Without labels, the in-memory state (restored from the state file) is all we have
+	if s.noLabel {
+		return false
+	}
+	
 	// As a fallback, check the Docker label
-	hasDynamicPorts := extractLabel(containerID, "com.dynamic-port-mapper.has-dynamic-ports")
+	hasDynamicPorts := extractLabel(s.context(), containerID, "com.dynamic-port-mapper.has-dynamic-ports")
 	if hasDynamicPorts == "true" {
 		// Add to our in-memory tracking for future checks
 		s.mu.Lock()
@@ -518,6 +929,12 @@ func (s *ContainerStore) isContainerProcessed(containerID string) bool {
 	return false
 }
 
+// portMappingKey identifies a port binding in stored mappings. The host IP is part of
+// the key so a container port bound on several interfaces keeps each of its bindings.
+func portMappingKey(hostIP, containerPort, protocol string) string {
+	return fmt.Sprintf("%s:%s/%s", hostIP, containerPort, protocol)
+}
+
 // restorePortMappings recreates the port mappings from previously stored data
 func (s *ContainerStore) restorePortMappings(portsStr string, storedMappings map[string]string) ([]PortMapping, bool) {
 	var mappings []PortMapping
@@ -531,12 +948,13 @@ func (s *ContainerStore) restorePortMappings(portsStr string, storedMappings map
 		protocol := match[4]
 
 		// Look up if we have a stored mapping for this port
-		key := fmt.Sprintf("%s/%s", containerPort, protocol)
+		key := portMappingKey(match[1], containerPort, protocol)
 		if storedPort, exists := storedMappings[key]; exists && storedPort != originalHostPort {
 			// We had previously remapped this port
 			dynamicPorts = true
 			mappings = append(mappings, PortMapping{
 				ContainerPort: containerPort,
+				HostIP:        match[1],
 				HostPort:      storedPort,
 				Protocol:      protocol,
 				OriginalPort:  originalHostPort,
@@ -545,6 +963,7 @@ func (s *ContainerStore) restorePortMappings(portsStr string, storedMappings map
 			// This port wasn't remapped
 			mappings = append(mappings, PortMapping{
 				ContainerPort: containerPort,
+				HostIP:        match[1],
 				HostPort:      originalHostPort,
 				Protocol:      protocol,
 				OriginalPort:  originalHostPort,
@@ -556,40 +975,73 @@ func (s *ContainerStore) restorePortMappings(portsStr string, storedMappings map
 }
 
 // checkPortCollision determines if a port needs to be remapped
-func (s *ContainerStore) checkPortCollision(containerID, hostPort, protocol string) (bool, string) {
+// It also returns the reason for the decision, which is shown alongside the port.
+// With grace, a collision only counts if it lasts through -conflict-grace, which is
+// left out when only planning so a plan doesn't wait on every conflict. Only ports
+// published on an overlapping host IP collide, and a new port is allocated on the host
+// IP it will be published on.
+func (s *ContainerStore) checkPortCollision(containerID, hostIP, hostPort, protocol string, grace bool) (bool, string, string) {
 	portInt, err := strconv.Atoi(hostPort)
 	if err != nil {
 		log.Printf("Invalid port number: %s", hostPort)
-		return false, hostPort
+		return false, hostPort, ""
 	}
 
 	// Check if the port is already in our managed port range
 	// If it is, this likely means it was previously dynamically allocated by us
 	// So we don't need to remap it again
 	if portInt >= s.portRangeMin && portInt <= s.portRangeMax {
-		// Check if the port is already in use by another container
-		if s.isPortUsedByOtherContainer(containerID, portInt, protocol) {
+		// Check if the port is already in use by another container that keeps running.
+		// One that is just being stopped hasn't been forgotten yet, but frees the port.
+		var owner string
+		stillUsed := func() bool {
+			var used bool
+			owner, used = s.otherContainerUsingPort(containerID, hostIP, portInt, protocol)
+			return used && containerIsRunning(s.context(), owner)
+		}
+		used := stillUsed()
+		if used && grace {
+			used = s.conflictPersists("port "+hostPort+"/"+protocol, stillUsed)
+		}
+		if used {
 			// Only in this case do we need to remap it
-			newPort := s.allocateRandomPort()
+			newPort, err := s.allocateRandomPortOn(s.remapHostIP(hostIP), []string{protocol})
+			if err != nil {
+				log.Printf("Can't remap port %s: %v", hostPort, err)
+				return false, hostPort, ""
+			}
 			log.Printf("Port %s is in our dynamic range but used by another container, remapping to %d", 
 				hostPort, newPort)
-			return true, strconv.Itoa(newPort)
+			return true, strconv.Itoa(newPort), reasonCollision(owner)
 		}
 		
 		// If the port is in our range and not used by another container, keep using it
 		log.Printf("Port %s is in our dynamic range and available, no need to remap", hostPort)
-		return false, hostPort
+		return false, hostPort, reasonUnchanged
 	}
 
 	// Port is outside our managed range - always remap it to our dynamic range
-	newPort := s.allocateRandomPort()
+	newPort, err := s.allocateRandomPortOn(s.remapHostIP(hostIP), []string{protocol})
+	if err != nil {
+		log.Printf("Can't remap port %s: %v", hostPort, err)
+		return false, hostPort, ""
+	}
 	log.Printf("Port %s is outside our dynamic range (%d-%d), automatically remapping to %d", 
 		hostPort, s.portRangeMin, s.portRangeMax, newPort)
-	return true, strconv.Itoa(newPort)
+	return true, strconv.Itoa(newPort), reasonOutOfRange
 }
 
 // isPortUsedByOtherContainer checks if a port is used by a container other than the specified one
 func (s *ContainerStore) isPortUsedByOtherContainer(containerID string, port int, protocol string) bool {
+	_, used := s.otherContainerUsingPort(containerID, "", port, protocol)
+	return used
+}
+
+// otherContainerUsingPort returns the name of a container other than the specified one
+// that uses a port on a host IP overlapping the given one, if there is one
+func (s *ContainerStore) otherContainerUsingPort(containerID, hostIP string, port int, protocol string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	for id, container := range s.containers {
 		if id == containerID {
 			continue // Skip the container we're checking for
@@ -597,44 +1049,257 @@ func (s *ContainerStore) isPortUsedByOtherContainer(containerID string, port int
 		
 		for _, mapping := range container.PortMappings {
 			existingPort, _ := strconv.Atoi(mapping.HostPort)
-			if existingPort == port && mapping.Protocol == protocol {
-				return true // Port is used by another container
+			if existingPort == port && mapping.Protocol == protocol && hostIPsOverlap(mapping.HostIP, hostIP) {
+				return container.Names, true // Port is used by another container
 			}
 		}
 	}
 	
-	return false
+	return "", false
+}
+
+// Reasons recorded for why a port was or wasn't remapped
+const (
+	reasonUnchanged        = "unchanged (in range, free)"
+	reasonUnmanaged        = "unchanged (out of range)"
+	reasonOutOfRange       = "remapped (out of range)"
+	reasonRestored         = "restored from state"
+	reasonForced           = "remapped (on request)"
+	reasonRestoredOriginal = "restored (on request)"
+	reasonPublishAllPinned = "pinned (publish-all)"
+)
+
+// reasonCollision is the reason for remapping a port another container was using
+func reasonCollision(owner string) string {
+	return fmt.Sprintf("remapped (collision with %s)", owner)
 }
 
-// allocateRandomPort finds a free port in the configured range
-func (s *ContainerStore) allocateRandomPort() int {
+// recordPortReason remembers why a container's port ended up with its host port
+func (s *ContainerStore) recordPortReason(containerID, containerPort, protocol, reason string) {
+	if reason == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.portReasons[containerID] == nil {
+		s.portReasons[containerID] = make(map[string]string)
+	}
+	s.portReasons[containerID][fmt.Sprintf("%s/%s", containerPort, protocol)] = reason
+}
+
+// applyPortReasons fills in the reason of each port mapping. Decisions made by this
+// process are kept as recorded; otherwise a port that differs from its original was
+// remapped earlier and its original port restored from labels or the state file.
+func (s *ContainerStore) applyPortReasons(containerID string, mappings []PortMapping) {
+	s.mu.RLock()
+	reasons := s.portReasons[containerID]
+	s.mu.RUnlock()
+	
+	for i, mapping := range mappings {
+		if reason, ok := reasons[fmt.Sprintf("%s/%s", mapping.ContainerPort, mapping.Protocol)]; ok {
+			mappings[i].Reason = reason
+			continue
+		}
+		
+		portInt, _ := strconv.Atoi(mapping.HostPort)
+		switch {
+		case mapping.OriginalPort != "" && mapping.OriginalPort != mapping.HostPort:
+			mappings[i].Reason = reasonRestored
+		case portInt >= s.portRangeMin && portInt <= s.portRangeMax:
+			mappings[i].Reason = reasonUnchanged
+		default:
+			mappings[i].Reason = reasonUnmanaged
+		}
+	}
+}
+
+// allocateRandomPort finds a port in the configured range that is free on all
+// interfaces, and tracks whether the range has run out of free ports
+func (s *ContainerStore) allocateRandomPort() (int, error) {
+	return s.allocateRandomPortOn("", nil)
+}
+
+// allocateRandomPortOn is allocateRandomPort for a port to be published on the given
+// host IP, where "" means all interfaces, under the given protocols. Without any
+// protocols the port is checked as for tcp.
+func (s *ContainerStore) allocateRandomPortOn(hostIP string, protocols []string) (int, error) {
+	port, err := s.allocatePortInRange(hostIP, protocols, s.portRangeMin, s.portRangeMax)
+	
+	s.mu.Lock()
+	wasExhausted := s.rangeExhausted
+	s.rangeExhausted = err != nil
+	s.mu.Unlock()
+	
+	if err != nil && !wasExhausted {
+		log.Printf("Error: %v. Remapping is paused until ports free up; consider widening the range with -min/-max", err)
+	} else if err == nil && wasExhausted {
+		log.Printf("Ports are available in the dynamic range again, resuming remapping")
+	}
+	return port, err
+}
+
+// allocatePortInRange finds a port in the given inclusive range that is free on the
+// given host IP under the given protocols
+func (s *ContainerStore) allocatePortInRange(hostIP string, protocols []string, minPort, maxPort int) (int, error) {
+	// Try the operator's preferred ports first
+	for _, port := range s.preferredPorts {
+		if port >= minPort && port <= maxPort && s.preferredPortAvailable(hostIP, port, protocols) && s.claimPort(port) {
+			s.recordAllocation(port, minPort, maxPort, "preferred")
+			return port, nil
+		}
+	}
+	
 	for i := 0; i < 100; i++ { // Try up to 100 times to find an available port
-		port := rand.Intn(s.portRangeMax-s.portRangeMin) + s.portRangeMin
+		port := rand.Intn(maxPort-minPort+1) + minPort
 		
-		// Check if port is available
-		if s.isPortAvailable(port) {
-			return port
+		// Check if port is available, and not claimed by a remap still in progress
+		if s.isPortAvailableFor(hostIP, port, protocols) && s.claimPort(port) {
+			s.recordAllocation(port, minPort, maxPort, "random")
+			return port, nil
+		}
+	}
+
+	// Random probing failed, so the range is nearly full. Scan it before giving up.
+	for port := minPort; port <= maxPort; port++ {
+		if s.isPortAvailableFor(hostIP, port, protocols) && s.claimPort(port) {
+			s.recordAllocation(port, minPort, maxPort, "scan")
+			return port, nil
 		}
 	}
+	return 0, fmt.Errorf("%w in range %d-%d", errPortExhausted, minPort, maxPort)
+}
+
+// RangeExhausted reports whether the dynamic port range had no free ports
+// the last time we tried to allocate from it
+func (s *ContainerStore) RangeExhausted() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rangeExhausted
+}
 
-	// If we couldn't find a port, return a random one as a fallback
-	return rand.Intn(s.portRangeMax-s.portRangeMin) + s.portRangeMin
+// ReservePort prevents the allocator from ever handing out a host port
+func (s *ContainerStore) ReservePort(port int) {
+	s.reservedPorts[port] = true
 }
 
-// isPortAvailable checks if a port is available on the host
+// isPortAvailable checks if a port is available on all of the host's interfaces
 func (s *ContainerStore) isPortAvailable(port int) bool {
+	return s.isPortAvailableOn("", port)
+}
+
+// isPortAvailableOn checks if a port is available for publishing on the given host IP,
+// where "" means all interfaces. A port bound on one specific address doesn't block
+// publishing it on another.
+func (s *ContainerStore) isPortAvailableOn(hostIP string, port int) bool {
+	// Reserved ports are never available, even if nothing is bound to them yet
+	if s.reservedPorts[port] {
+		return false
+	}
+	
+	// Neither are ports in the avoided range, which the kernel may hand out at any time
+	if s.avoidMax > 0 && port >= s.avoidMin && port <= s.avoidMax {
+		return false
+	}
+	
 	// First check if any of our tracked containers are using this port
-	for _, container := range s.containers {
-		for _, mapping := range container.PortMappings {
-			existingPort, _ := strconv.Atoi(mapping.HostPort)
-			if existingPort == port {
-				return false
+	if s.isPortPublished(hostIP, port, "") {
+		return false
+	}
+
+	// Then check if the port is actually available on the host
+	return s.isHostPortFree(hostIP, port)
+}
+
+// isPortAvailableFor checks if a port is available for publishing on the given host
+// IP under every one of the given protocols, so a UDP port is judged by a UDP bind
+// test and by the containers publishing it for UDP. Without any protocols it is
+// checked as by isPortAvailableOn.
+func (s *ContainerStore) isPortAvailableFor(hostIP string, port int, protocols []string) bool {
+	if len(protocols) == 0 {
+		return s.isPortAvailableOn(hostIP, port)
+	}
+	if s.reservedPorts[port] {
+		return false
+	}
+	if s.avoidMax > 0 && port >= s.avoidMin && port <= s.avoidMax {
+		return false
+	}
+	for _, protocol := range protocols {
+		if s.isHostPortInUse(hostIP, port, protocol) {
+			return false
+		}
+	}
+	return true
+}
+
+// isWildcardHostIP reports whether a host IP stands for all interfaces
+func isWildcardHostIP(hostIP string) bool {
+	return hostIP == "" || hostIP == "0.0.0.0" || hostIP == "::"
+}
+
+// hostIPsOverlap reports whether ports published on two host IPs would clash, which
+// they do unless both are distinct specific addresses. IPv6 addresses may be given in
+// brackets, as docker ps shows them.
+func hostIPsOverlap(a, b string) bool {
+	a, b = strings.Trim(a, "[]"), strings.Trim(b, "[]")
+	return isWildcardHostIP(a) || isWildcardHostIP(b) || a == b
+}
+
+// bindAddress returns the address to bind test a port on, for the given host IP
+func bindAddress(hostIP string, port int) string {
+	if isWildcardHostIP(hostIP) {
+		return fmt.Sprintf(":%d", port)
+	}
+	return net.JoinHostPort(hostIP, strconv.Itoa(port))
+}
+
+// isHostPortFree checks if nothing on the host is using a port on the given host IP,
+// using a bind test and, when probing is enabled, a connection attempt as well
+func (s *ContainerStore) isHostPortFree(hostIP string, port int) bool {
+	// Ports on a remote daemon's machine can't be tested from here, so only the
+	// ports of the containers we know about count as used
+	if s.remoteDocker {
+		return true
+	}
+	
+	if !isHostPortAvailable(hostIP, port) {
+		return false
+	}
+	
+	// A listener on a specific interface may not block our bind, but it will accept connections
+	if s.probeDial && isPortDialable(port) {
+		log.Printf("Port %d can be bound but accepts connections, treating it as in use", port)
+		return false
+	}
+	return true
+}
+
+// isPortDialable checks if anything accepts TCP connections on a port on the loopback
+// address or any of the host's interface addresses
+func isPortDialable(port int) bool {
+	hosts := []string{"127.0.0.1", "::1"}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+				hosts = append(hosts, ipNet.IP.String())
 			}
 		}
 	}
+	
+	for _, host := range hosts {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), dialProbeTimeout)
+		if err == nil {
+			conn.Close()
+			return true
+		}
+	}
+	return false
+}
 
-	// Then check if the port is actually available on the host
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+// isHostPortAvailable checks if a port can be bound on the host IP, or on all
+// interfaces for ""
+func isHostPortAvailable(hostIP string, port int) bool {
+	ln, err := net.Listen("tcp", bindAddress(hostIP, port))
 	if err != nil {
 		return false
 	}
@@ -642,177 +1307,525 @@ func (s *ContainerStore) isPortAvailable(port int) bool {
 	return true
 }
 
-// remapContainerPort changes a container's port mapping
-func (s *ContainerStore) remapContainerPort(containerID, oldHostPort, newHostPort, containerPort, protocol string) error {
-	log.Printf("Remapping port for container %s: %s->%s:%s/%s", 
-		containerID, oldHostPort, newHostPort, containerPort, protocol)
+// Port status values reported by CheckPort
+const (
+	PortStatusFree      = "free"      // Nothing is using the port
+	PortStatusContainer = "container" // A container we track publishes the port
+	PortStatusHost      = "host"      // A non-Docker process has the port bound
+)
+
+// PortStatus describes who, if anyone, is currently using a host port
+type PortStatus struct {
+	Port          int    `json:"port"`
+	Protocol      string `json:"protocol"`
+	Status        string `json:"status"`
+	ContainerID   string `json:"containerId,omitempty"`
+	ContainerName string `json:"containerName,omitempty"`
+}
+
+// CheckPort reports whether a host port is free, published by a tracked container,
+// or bound by some other process on the host
+func (s *ContainerStore) CheckPort(port int, protocol string) PortStatus {
+	status := PortStatus{
+		Port:     port,
+		Protocol: protocol,
+		Status:   PortStatusFree,
+	}
+
+	// Check the containers we know about first so we can name the owner
+	s.mu.RLock()
+	for id, container := range s.containers {
+		for _, mapping := range container.PortMappings {
+			existingPort, _ := strconv.Atoi(mapping.HostPort)
+			if existingPort == port && mapping.Protocol == protocol {
+				status.Status = PortStatusContainer
+				status.ContainerID = id
+				status.ContainerName = container.Names
+				break
+			}
+		}
+		if status.Status == PortStatusContainer {
+			break
+		}
+	}
+	s.mu.RUnlock()
+
+	// A UDP port is only taken if a UDP socket holds it, whatever listens on TCP
+	if status.Status == PortStatusFree {
+		hostBusy := !s.isHostPortFree("", port)
+		if protocol == "udp" {
+			hostBusy = !s.remoteDocker && !isHostUDPPortAvailable("", port)
+		}
+		if hostBusy {
+			status.Status = PortStatusHost
+		}
+	}
+	return status
+}
+
+// portMove is one published port of a container moving to a new host port
+type portMove struct {
+	ContainerPort string
+	Protocol      string
+	HostIP        string // Host IP the port is published on, or for a restore the one it originally was
+	OldHostPort   string
+	NewHostPort   string
+	Reason        string
+	Fixed         bool // Part of a block, so the new port can't be swapped for another
+}
+
+// key returns the port as containerPort/protocol, as in HostConfig.PortBindings
+func (m portMove) key() string {
+	return fmt.Sprintf("%s/%s", m.ContainerPort, m.Protocol)
+}
+
+// describePortMoves lists moves for log messages, e.g. 8080->10034:80/tcp
+func describePortMoves(moves []portMove) string {
+	descriptions := make([]string, len(moves))
+	for i, move := range moves {
+		descriptions[i] = fmt.Sprintf("%s->%s:%s", move.OldHostPort, move.NewHostPort, move.key())
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// remapContainerPort changes a container's port mapping by recreating the container,
+// for the given reason. It returns the ID of the new container once one has been created.
+func (s *ContainerStore) remapContainerPort(containerID, hostIP, oldHostPort, newHostPort, containerPort, protocol, reason string) (string, error) {
+	return s.remapContainerPorts(containerID, []portMove{{
+		ContainerPort: containerPort,
+		Protocol:      protocol,
+		HostIP:        hostIP,
+		OldHostPort:   oldHostPort,
+		NewHostPort:   newHostPort,
+		Reason:        reason,
+	}})
+}
+
+// remapContainerPorts is remapContainerPort for several ports at once. The container
+// is recreated a single time, so a failure leaves all of its ports as they were.
+func (s *ContainerStore) remapContainerPorts(containerID string, moves []portMove) (string, error) {
+	return s.recreateContainerPorts(containerID, moves, false)
+}
+
+// remapHostIP returns the host IP a port published on hostIP is published on once it
+// is remapped: the same one, unless -bind-host-ip says otherwise. IPv6 addresses are
+// returned without the brackets docker ps shows them in.
+func (s *ContainerStore) remapHostIP(hostIP string) string {
+	if s.bindHostIP != "" {
+		return s.bindHostIP
+	}
+	return strings.Trim(hostIP, "[]")
+}
+
+// recreateContainerPorts recreates a container with some of its ports published on
+// new host ports. When restoring remapped ports to their originals, the replacement
+// is recreated without the labels that mark it as remapped.
+func (s *ContainerStore) recreateContainerPorts(containerID string, moves []portMove, restoring bool) (string, error) {
+	if len(moves) == 0 {
+		return "", fmt.Errorf("no ports to remap for container %s", containerID)
+	}
+
+	// A remapped port stays on the host IP it was published on, unless -bind-host-ip
+	// says otherwise, and a restored one goes back to the host IP it had originally
+	publishIP := func(move portMove) string {
+		if restoring {
+			return strings.Trim(move.HostIP, "[]")
+		}
+		return s.remapHostIP(move.HostIP)
+	}
+	log.Printf("Remapping ports for container %s: %s", containerID, describePortMoves(moves))
 	
-	// Mark this container as processed before we do anything
-	// This way, even if something fails during the remap process,
-	// we won't get into an infinite restart loop
-	s.addDynamicPortLabel(containerID)
+	// Once the remap is over the new ports are either bound or abandoned, so they no
+	// longer need to be claimed
+	defer func() {
+		for _, move := range moves {
+			s.releasePortString(move.NewHostPort)
+		}
+	}()
 	
-	// 1. Inspect the container to get its configuration
-	inspectCmd := exec.Command("docker", "inspect", containerID)
-	inspectOutput, err := inspectCmd.Output()
+	// Protect the daemon from a storm of recreations, e.g. by a flapping container. The
+	// new ports were allocated before waiting, so make sure they're still ours afterwards.
+	waited, err := s.waitForRemapSlot(containerID)
 	if err != nil {
-		return fmt.Errorf("failed to inspect container %s: %v", containerID, err)
+		return "", err
 	}
-	
-	var containerData []map[string]interface{}
-	if err := json.Unmarshal(inspectOutput, &containerData); err != nil {
-		return fmt.Errorf("failed to parse container inspection data: %v", err)
+	if waited {
+		for i, move := range moves {
+			if move.NewHostPort == move.OldHostPort {
+				continue // Pinned in place, so held by the container itself
+			}
+			newHostPort, err := s.reclaimAfterWait(publishIP(move), move.NewHostPort, move.Protocol, restoring || move.Fixed)
+			moves[i].NewHostPort = newHostPort
+			if err != nil {
+				return "", err
+			}
+		}
 	}
-	
-	if len(containerData) == 0 {
-		return fmt.Errorf("no inspection data found for container %s", containerID)
+	oldHostPorts := make([]string, len(moves))
+	newHostPorts := make([]string, len(moves))
+	for i, move := range moves {
+		oldHostPorts[i], newHostPorts[i] = move.OldHostPort, move.NewHostPort
 	}
 	
-	// Extract container information
-	containerInfo := containerData[0]
+	// Mark this container as processed before we do anything
+	// This way, even if something fails during the remap process,
+	// we won't get into an infinite restart loop
+	if !restoring {
+		s.addDynamicPortLabel(containerID)
+	}
 	
-	// 2. Extract essential information from inspection data
-	containerName := containerInfo["Name"].(string)
-	if containerName[0] == '/' {
-		containerName = containerName[1:] // Remove leading slash
+	// 1. Inspect the container to get its configuration
+	containerInfo, err := s.inspectContainer(containerID)
+	if err != nil {
+		return "", err
+	}
+
+	// 2. Extract essential information from inspection data. Some container states and
+	// runtimes leave fields out or null, so every one of them is optional here.
+	config := inspectSection(containerInfo, "Config")
+	containerName := strings.TrimPrefix(inspectString(containerInfo, "Name"), "/") // Remove leading slash
+	if containerName == "" {
+		return "", fmt.Errorf("container %s has no name in its inspection data", containerID)
 	}
 
 	// Check if this is a Docker Compose container
-	composeProject := extractLabel(containerID, "com.docker.compose.project")
-	if composeProject != "" {
-		log.Printf("Container %s belongs to Compose project %s - consider using docker-compose to manage it", 
+	composeProject := extractLabel(s.context(), containerID, "com.docker.compose.project")
+	if composeProject != "" && !s.composeDelegate {
+		log.Printf("Container %s belongs to Compose project %s - consider -compose-delegate to recreate it through docker-compose", 
 			containerID, composeProject)
 	}
 	
 	// Get image
-	image := containerInfo["Config"].(map[string]interface{})["Image"].(string)
-	
-	// Get network mode
-	hostConfig := containerInfo["HostConfig"].(map[string]interface{})
-	networkMode := hostConfig["NetworkMode"].(string)
+	image := inspectString(config, "Image")
+	if image == "" {
+		return "", fmt.Errorf("container %s has no image in its inspection data", containerID)
+	}
 	
-	// Get environment variables
-	env := containerInfo["Config"].(map[string]interface{})["Env"].([]interface{})
-	envVars := make([]string, len(env))
-	for i, e := range env {
-		envVars[i] = e.(string)
+	// Make sure the image is still there before anything is torn down, or the container
+	// would be removed with nothing to recreate it from
+	if err := ensureImage(s.context(), image, s.pullOnRecreate); err != nil {
+		return "", fmt.Errorf("not recreating container %s: %w", containerName, err)
+	}
+
+	portBindings := remapPortBindings(containerInfo, moves, publishIP)
+	labels := s.remapLabels(config, moves, restoring)
+
+	// Time each phase from here on, recording whatever completed even if the remap fails
+	timing := RemapTiming{
+		ContainerID:   containerID,
+		ContainerName: containerName,
+		OldHostPort:   strings.Join(oldHostPorts, ","),
+		NewHostPort:   strings.Join(newHostPorts, ","),
+		StartedAt:     time.Now(),
 	}
+	defer func() { s.recordRemapTiming(timing) }()
 	
-	// Get volumes
-	var volumeArgs []string
-	if mounts, ok := containerInfo["Mounts"].([]interface{}); ok {
-		for _, m := range mounts {
-			mount := m.(map[string]interface{})
-			src := mount["Source"].(string)
-			dst := mount["Destination"].(string)
-			volumeArgs = append(volumeArgs, "-v", fmt.Sprintf("%s:%s", src, dst))
+	// Describe the remaps for clients waiting on remaps and for the service's history
+	publishEvents := func(newContainerID, newName string) {
+		for _, move := range moves {
+			s.publishRemapEvent(RemapEvent{
+				ContainerID:    containerID,
+				NewContainerID: newContainerID,
+				ContainerName:  newName,
+				Service:        remapHistoryKey(labels, containerName),
+				ContainerPort:  move.ContainerPort,
+				Protocol:       move.Protocol,
+				OldHostPort:    move.OldHostPort,
+				NewHostPort:    move.NewHostPort,
+				Reason:         move.Reason,
+			})
 		}
 	}
-	
-	// Get existing port bindings
-	portBindings := make(map[string][]map[string]string)
-	if pb, ok := hostConfig["PortBindings"].(map[string]interface{}); ok {
-		for port, bindings := range pb {
-			if port == fmt.Sprintf("%s/%s", containerPort, protocol) {
-				// This is the port we're remapping, skip it
-				continue
-			}
-			
-			bindingsArray := bindings.([]interface{})
-			portBindings[port] = make([]map[string]string, len(bindingsArray))
-			
-			for i, b := range bindingsArray {
-				binding := b.(map[string]interface{})
-				hostIP := ""
-				if ip, ok := binding["HostIp"]; ok {
-					hostIP = ip.(string)
-				}
-				hostPort := ""
-				if hp, ok := binding["HostPort"]; ok {
-					hostPort = hp.(string)
-				}
-				
-				portBindings[port][i] = map[string]string{
-					"HostIp":   hostIP,
-					"HostPort": hostPort,
-				}
+
+	// Let docker compose recreate containers it created, so they stay part of their project
+	if s.composeDelegate {
+		if owner, ok := composeOwnerFromLabels(labels); ok {
+			newContainerID, err := s.remapViaCompose(containerID, containerName, owner, portBindings, dynamicPortLabels(labels), &timing)
+			if err != nil {
+				return "", err
 			}
+			publishEvents(newContainerID, containerName)
+			return newContainerID, nil
 		}
+		log.Printf("Container %s lacks the Compose labels needed to delegate its remap, recreating it with docker run", containerID)
 	}
+
+	phaseStart := time.Now()
+
+	// 3. Stop the container, with a timeout to ensure it stops gracefully
+	if err := s.stopForRemap(containerID); err != nil {
+		return "", err
+	}
+	timing.StopMs = time.Since(phaseStart).Milliseconds()
+	phaseStart = time.Now()
 	
-	// Add our new port mapping
-	portToRemap := fmt.Sprintf("%s/%s", containerPort, protocol)
-	portBindings[portToRemap] = []map[string]string{
-		{
-			"HostIp":   "",  // Default to all interfaces
-			"HostPort": newHostPort,
-		},
+	// 4. Move the original container out of the way under a temporary name. It is only
+	// removed once its replacement is running, so the name is never lost.
+	tempName, err := s.setAsideForRemap(containerID, containerName)
+	if err != nil {
+		return "", err
 	}
 	
-	// Get restart policy
-	restartPolicy := ""
-	if policy, ok := hostConfig["RestartPolicy"].(map[string]interface{}); ok {
-		if name, ok := policy["Name"].(string); ok && name != "" {
-			restartPolicy = name
-			if name == "on-failure" {
-				if maxRetry, ok := policy["MaximumRetryCount"].(float64); ok {
-					restartPolicy = fmt.Sprintf("%s:%d", restartPolicy, int(maxRetry))
-				}
-			}
-		}
+	// 5. Reconstruct the docker run command with the new port mapping, tagging the
+	// name with the new port if configured
+	newName := containerName
+	if restoring {
+		newName = portSuffixRegex.ReplaceAllString(containerName, "")
+	} else if s.nameSuffix {
+		newName = withPortSuffix(containerName, moves[0].NewHostPort)
+	}
+	// Another container may already have that name, e.g. one left behind by an earlier
+	// remap, so fall back to the original's name, which it has just given up
+	if newName != containerName && s.containerNameTaken(newName) {
+		log.Printf("Container name %s is already taken, keeping the name %s", newName, containerName)
+		newName = containerName
 	}
+	createArgs := recreateArgs(containerInfo, newName, portBindings, labels)
 	
-	// Get labels
-	labels := containerInfo["Config"].(map[string]interface{})["Labels"].(map[string]interface{})
+	// Have docker run record the ID of the container it creates, so a rollback only
+	// ever removes that one and not another container holding the name
+	tempDir, err := runTempDir()
+	if err != nil {
+		s.rollbackRemap(containerID, containerName, "")
+		return "", err
+	}
+	cidFile := filepath.Join(tempDir, containerID+".cid")
+	os.Remove(cidFile) // docker run refuses to overwrite it
+	defer os.Remove(cidFile)
+	createArgs = append([]string{createArgs[0], "--cidfile", cidFile}, createArgs[1:]...)
 	
-	// Add our dynamic port mapper label to indicate this container has been processed
-	labels["com.dynamic-port-mapper.has-dynamic-ports"] = "true"
+	// 6. Create and start the new container
+	log.Printf("Creating new container with remapped ports: %s -> %s",
+		strings.Join(oldHostPorts, ","), strings.Join(newHostPorts, ","))
+	log.Printf("Running: docker %s", strings.Join(createArgs, " "))
 	
-	labelArgs := []string{}
-	for k, v := range labels {
-		labelArgs = append(labelArgs, "--label", fmt.Sprintf("%s=%s", k, v.(string)))
-	}
-
-	// 3. Stop the container, with a timeout to ensure it stops gracefully
-	log.Printf("Stopping container %s to remap ports", containerID)
-	stopCmd := exec.Command("docker", "stop", "--time", "10", containerID)
-	if err := stopCmd.Run(); err != nil {
-		log.Printf("Warning: Failed to stop container %s gracefully: %v", containerID, err)
-		// Try to kill it forcefully if stop failed
-		killCmd := exec.Command("docker", "kill", containerID)
-		if err := killCmd.Run(); err != nil {
-			return fmt.Errorf("failed to stop/kill container %s: %v", containerID, err)
-		}
+	createCmd := exec.CommandContext(s.context(), "docker", createArgs...)
+	createOutput, err := createCmd.CombinedOutput()
+	if err != nil {
+		log.Printf("Command failed: docker %s", strings.Join(createArgs, " "))
+		// docker run may have created the container before failing to start it
+		created, _ := os.ReadFile(cidFile)
+		s.rollbackRemap(containerID, containerName, strings.TrimSpace(string(created)))
+		return "", fmt.Errorf("failed to create new container with remapped port: %v, output: %s", 
+			err, string(createOutput))
 	}
+	timing.CreateMs = time.Since(phaseStart).Milliseconds()
+	phaseStart = time.Now()
 	
-	// Wait a bit to ensure everything is settled
-	time.Sleep(1 * time.Second)
+	// Get the new container ID from the output
+	newContainerID := strings.TrimSpace(string(createOutput))
 	
-	// 4. Remove the container but keep its volumes
-	log.Printf("Removing container %s to recreate with new port mapping", containerID)
-	removeCmd := exec.Command("docker", "rm", containerID)
-	if err := removeCmd.Run(); err != nil {
-		return fmt.Errorf("failed to remove container %s: %v", containerID, err)
+	// Attach it to the original's other networks, so services there still resolve it
+	networkMode := inspectString(inspectSection(containerInfo, "HostConfig"), "NetworkMode")
+	if err := connectNetworks(s.context(), newContainerID, networkMode, networkAliases(containerInfo)); err != nil {
+		s.rollbackRemap(containerID, containerName, newContainerID)
+		return "", err
 	}
+	log.Printf("Successfully remapped ports for container %s (new ID: %s): %s",
+		containerID, newContainerID, describePortMoves(moves))
 	
-	// 5. Reconstruct the docker run command with the new port mapping
-	createArgs := []string{"run", "-d"}
-	
-	// Add name
-	createArgs = append(createArgs, "--name", containerName)
+	// Make sure to mark the new container as processed right away
+	s.mu.Lock()
+	s.processedContainers[newContainerID] = true
+	s.mu.Unlock()
+	s.saveState()
 	
-	// Add network mode
-	if networkMode != "" && networkMode != "default" {
-		createArgs = append(createArgs, "--network", networkMode)
+	// 7. Wait for the container to start (and pass its healthcheck, if it has one)
+	err = waitForContainerReady(s.context(), newContainerID, s.readyTimeout)
+	timing.StartMs = time.Since(phaseStart).Milliseconds()
+	if err != nil {
+		log.Printf("Warning: Container %s was recreated with remapped port but is not ready, restoring the original: %v", newContainerID, err)
+		s.rollbackRemap(containerID, containerName, newContainerID)
+		return "", fmt.Errorf("recreated container %s is not ready: %v", newContainerID, err)
 	}
+	phaseStart = time.Now()
 	
-	// Add restart policy
-	if restartPolicy != "" {
-		createArgs = append(createArgs, "--restart", restartPolicy)
+	// 8. The replacement is running, so the original can go, keeping its volumes
+	log.Printf("Removing original container %s", containerID)
+	removeCmd := exec.CommandContext(s.context(), "docker", "rm", containerID)
+	if err := removeCmd.Run(); err != nil {
+		log.Printf("Warning: Failed to remove original container %s (%s): %v", containerID, tempName, err)
 	}
+	timing.RemoveMs = time.Since(phaseStart).Milliseconds()
+	timing.Completed = true
 	
-	// Add volume mounts
-	createArgs = append(createArgs, volumeArgs...)
+	publishEvents(newContainerID, newName)
+	return newContainerID, nil
+}
+
+// inspectContainer returns the inspection data of a container
+func (s *ContainerStore) inspectContainer(containerID string) (map[string]interface{}, error) {
+	inspectOutput, err := exec.CommandContext(s.context(), "docker", "inspect", containerID).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect container %s: %v", containerID, err)
+	}
+	
+	var containerData []map[string]interface{}
+	if err := json.Unmarshal(inspectOutput, &containerData); err != nil {
+		return nil, fmt.Errorf("failed to parse container inspection data: %v", err)
+	}
+	
+	if len(containerData) == 0 {
+		return nil, fmt.Errorf("no inspection data found for container %s", containerID)
+	}
+	return containerData[0], nil
+}
+
+// remapPortBindings returns the port bindings of a recreated container: the original
+// ones, with those of the moved ports replaced by their new host ports
+func remapPortBindings(containerInfo map[string]interface{}, moves []portMove, publishIP func(portMove) string) map[string][]map[string]string {
+	moving := make(map[string]bool, len(moves))
+	for _, move := range moves {
+		moving[move.key()] = true
+	}
+
+	hostConfig := inspectSection(containerInfo, "HostConfig")
+	portBindings := make(map[string][]map[string]string)
+	pb, _ := hostConfig["PortBindings"].(map[string]interface{})
+	if publishAll, _ := hostConfig["PublishAllPorts"].(bool); publishAll {
+		// Pin the ports Docker picked so they're kept as explicit bindings
+		pb = publishedPorts(containerInfo)
+	}
+	for port, bindings := range pb {
+		if moving[port] {
+			// This is a port we're remapping, skip it
+			continue
+		}
+		
+		bindingsArray, _ := bindings.([]interface{})
+		for _, b := range bindingsArray {
+			binding, ok := b.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			portBindings[port] = append(portBindings[port], map[string]string{
+				"HostIp":   inspectString(binding, "HostIp"),
+				"HostPort": inspectString(binding, "HostPort"),
+			})
+		}
+	}
+	
+	// Add our new port mappings
+	for _, move := range moves {
+		portBindings[move.key()] = []map[string]string{
+			{
+				"HostIp":   publishIP(move),
+				"HostPort": move.NewHostPort,
+			},
+		}
+	}
+	return portBindings
+}
+
+// remapLabels returns the labels of a recreated container: the original ones, marked
+// as remapped and recording the original host ports, or cleared of both and marked as
+// restored when restoring
+func (s *ContainerStore) remapLabels(config map[string]interface{}, moves []portMove, restoring bool) map[string]interface{} {
+	labels, _ := config["Labels"].(map[string]interface{})
+	if labels == nil {
+		labels = make(map[string]interface{})
+	}
+	
+	// Add our dynamic port mapper label to indicate this container has been processed,
+	// unless tracking is kept in the state file only
+	if s.noLabel || restoring {
+		delete(labels, "com.dynamic-port-mapper.has-dynamic-ports")
+	} else {
+		labels["com.dynamic-port-mapper.has-dynamic-ports"] = "true"
+	}
+	
+	// A restored container keeps its original ports until it is remapped on request
+	if restoring {
+		labels[restoredLabel] = "true"
+	} else {
+		delete(labels, restoredLabel)
+	}
+	
+	// Record the original host ports and the specific host IPs they were published on,
+	// keeping the first ones if a port was remapped before. A port back on its original
+	// needs no record.
+	for _, move := range moves {
+		originalLabel := originalPortLabel(move.ContainerPort, move.Protocol)
+		originalIPLabel := originalHostIPLabel(move.ContainerPort, move.Protocol)
+		if restoring {
+			delete(labels, originalLabel)
+			delete(labels, originalIPLabel)
+		} else if _, exists := labels[originalLabel]; !exists {
+			labels[originalLabel] = move.OldHostPort
+			if !isWildcardHostIP(move.HostIP) {
+				labels[originalIPLabel] = move.HostIP
+			}
+		}
+	}
+	return labels
+}
+
+// recreateArgs builds the docker run arguments that recreate an inspected container
+// under a new name, with the given port bindings and labels
+func recreateArgs(containerInfo map[string]interface{}, newName string, portBindings map[string][]map[string]string, labels map[string]interface{}) []string {
+	config := inspectSection(containerInfo, "Config")
+	hostConfig := inspectSection(containerInfo, "HostConfig")
+	createArgs := []string{"run", "-d", "--name", newName}
+	
+	// Add network mode, with the container's DNS aliases on that network
+	if networkMode := inspectString(hostConfig, "NetworkMode"); networkMode != "" && networkMode != "default" {
+		createArgs = append(createArgs, "--network", networkMode)
+		createArgs = append(createArgs, networkAliasArgs(networkAliases(containerInfo)[networkMode])...)
+	}
+	
+	// Add restart policy
+	if policy, ok := hostConfig["RestartPolicy"].(map[string]interface{}); ok {
+		if name, ok := policy["Name"].(string); ok && name != "" {
+			restartPolicy := name
+			if name == "on-failure" {
+				if maxRetry, ok := policy["MaximumRetryCount"].(float64); ok {
+					restartPolicy = fmt.Sprintf("%s:%d", restartPolicy, int(maxRetry))
+				}
+			}
+			createArgs = append(createArgs, "--restart", restartPolicy)
+		}
+	}
+	
+	// Add runtime flags that would otherwise silently revert to their defaults.
+	// Init is null unless --init was given explicitly.
+	if initProcess, _ := hostConfig["Init"].(bool); initProcess {
+		createArgs = append(createArgs, "--init")
+	}
+	if readOnly, _ := hostConfig["ReadonlyRootfs"].(bool); readOnly {
+		createArgs = append(createArgs, "--read-only")
+	}
+	if tty, _ := config["Tty"].(bool); tty {
+		createArgs = append(createArgs, "-t")
+	}
+	if openStdin, _ := config["OpenStdin"].(bool); openStdin {
+		createArgs = append(createArgs, "-i")
+	}
+	
+	// Add extra hosts, kept verbatim so special values such as the host-gateway in
+	// "host.docker.internal:host-gateway" are resolved again by Docker
+	if hosts, ok := hostConfig["ExtraHosts"].([]interface{}); ok {
+		for _, h := range hosts {
+			if host, ok := h.(string); ok && host != "" {
+				createArgs = append(createArgs, "--add-host", host)
+			}
+		}
+	}
+	
+	// Add volume mounts
+	if mounts, ok := containerInfo["Mounts"].([]interface{}); ok {
+		for _, m := range mounts {
+			mount, ok := m.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			src := inspectString(mount, "Source")
+			dst := inspectString(mount, "Destination")
+			if src == "" || dst == "" {
+				continue
+			}
+			createArgs = append(createArgs, "-v", fmt.Sprintf("%s:%s", src, dst))
+		}
+	}
 	
 	// Add port mappings
 	for port, bindings := range portBindings {
@@ -820,7 +1833,10 @@ func (s *ContainerStore) remapContainerPort(containerID, oldHostPort, newHostPor
 			hostPort := binding["HostPort"]
 			hostIP := binding["HostIp"]
 			
-			if hostIP != "" && hostIP != "0.0.0.0" {
+			if strings.Contains(hostIP, ":") {
+				// An IPv6 host IP needs brackets to tell it apart from the ports
+				createArgs = append(createArgs, "-p", fmt.Sprintf("[%s]:%s:%s", hostIP, hostPort, port))
+			} else if hostIP != "" && hostIP != "0.0.0.0" {
 				createArgs = append(createArgs, "-p", fmt.Sprintf("%s:%s:%s", hostIP, hostPort, port))
 			} else {
 				createArgs = append(createArgs, "-p", fmt.Sprintf("%s:%s", hostPort, port))
@@ -829,62 +1845,236 @@ func (s *ContainerStore) remapContainerPort(containerID, oldHostPort, newHostPor
 	}
 	
 	// Add environment variables
-	for _, env := range envVars {
-		createArgs = append(createArgs, "-e", env)
+	env, _ := config["Env"].([]interface{})
+	for _, e := range env {
+		if value, ok := e.(string); ok {
+			createArgs = append(createArgs, "-e", value)
+		}
 	}
 	
 	// Add labels
-	createArgs = append(createArgs, labelArgs...)
+	for k, v := range labels {
+		value, _ := v.(string)
+		createArgs = append(createArgs, "--label", fmt.Sprintf("%s=%s", k, value))
+	}
 	
 	// Finally, add the image name
-	createArgs = append(createArgs, image)
-	
-	// 6. Create and start the new container
-	log.Printf("Creating new container with remapped port: %s -> %s", oldHostPort, newHostPort)
-	log.Printf("Running: docker %s", strings.Join(createArgs, " "))
+	return append(createArgs, inspectString(config, "Image"))
+}
+
+// stopForRemap stops a container about to be recreated, killing it if it doesn't stop
+// gracefully
+func (s *ContainerStore) stopForRemap(containerID string) error {
+	log.Printf("Stopping container %s to remap ports", containerID)
+	stopCmd := exec.CommandContext(s.context(), "docker", "stop", "--time", "10", containerID)
+	if err := stopCmd.Run(); err != nil {
+		// Nothing has been changed yet, so a shutdown can simply abandon the remap
+		if ctxErr := s.context().Err(); ctxErr != nil {
+			return fmt.Errorf("remap of container %s interrupted: %w", containerID, ctxErr)
+		}
+		log.Printf("Warning: Failed to stop container %s gracefully: %v", containerID, err)
+		// Try to kill it forcefully if stop failed
+		killCmd := exec.CommandContext(s.context(), "docker", "kill", containerID)
+		if err := killCmd.Run(); err != nil {
+			return fmt.Errorf("failed to stop/kill container %s: %v", containerID, err)
+		}
+	}
 	
-	createCmd := exec.Command("docker", createArgs...)
-	createOutput, err := createCmd.CombinedOutput()
-	if err != nil {
-		log.Printf("Command failed: docker %s", strings.Join(createArgs, " "))
-		return fmt.Errorf("failed to create new container with remapped port: %v, output: %s", 
-			err, string(createOutput))
+	// Wait a bit to ensure everything is settled
+	time.Sleep(1 * time.Second)
+	return nil
+}
+
+// setAsideForRemap renames a stopped container out of the way of its replacement,
+// returning its temporary name. If it can't be renamed, it is started again.
+func (s *ContainerStore) setAsideForRemap(containerID, containerName string) (string, error) {
+	tempName := containerName + "-dpm-old"
+	log.Printf("Renaming container %s to %s while it is recreated", containerName, tempName)
+	renameCmd := exec.CommandContext(s.context(), "docker", "rename", containerID, tempName)
+	if err := renameCmd.Run(); err != nil {
+		if startErr := exec.CommandContext(context.WithoutCancel(s.context()), "docker", "start", containerID).Run(); startErr != nil {
+			log.Printf("Warning: Failed to restart container %s: %v", containerID, startErr)
+		}
+		return "", fmt.Errorf("failed to rename container %s: %v", containerID, err)
+	}
+	return tempName, nil
+}
+
+// containerNameTaken reports whether a container with exactly the given name exists
+func (s *ContainerStore) containerNameTaken(name string) bool {
+	output, err := exec.CommandContext(s.context(), "docker", "inspect", "--format", "{{.Name}}", name).Output()
+	return err == nil && strings.TrimSpace(string(output)) == "/"+name
+}
+
+// portSuffixRegex matches the port suffix added to the names of recreated containers
+var portSuffixRegex = regexp.MustCompile(`-dpm\d+$`)
+
+// withPortSuffix tags a container name with a host port, e.g. web -> web-dpm10342,
+// replacing the suffix of an earlier remap rather than adding another
+func withPortSuffix(name, hostPort string) string {
+	return portSuffixRegex.ReplaceAllString(name, "") + "-dpm" + hostPort
+}
+
+// rollbackRemap restores the original container after a failed remap: it removes the
+// replacement, given by ID, gives the original back its name and starts it again. The
+// replacement is "" if docker run failed before creating one. It runs to the end even
+// if the store is stopping, as an interrupted remap must not lose the original.
+func (s *ContainerStore) rollbackRemap(originalID, originalName, replacement string) {
+	ctx := context.WithoutCancel(s.context())
+	if replacement != "" {
+		exec.CommandContext(ctx, "docker", "rm", "-f", replacement).Run()
 	}
 	
-	// Get the new container ID from the output
-	newContainerID := strings.TrimSpace(string(createOutput))
-	log.Printf("Successfully remapped port for container %s (new ID: %s): %s -> %s", 
-		containerID, newContainerID, oldHostPort, newHostPort)
+	if err := exec.CommandContext(ctx, "docker", "rename", originalID, originalName).Run(); err != nil {
+		log.Printf("Warning: Failed to restore name %s of container %s: %v", originalName, originalID, err)
+	}
+	if err := exec.CommandContext(ctx, "docker", "start", originalID).Run(); err != nil {
+		log.Printf("Warning: Failed to restart original container %s: %v", originalID, err)
+	}
 	
-	// Make sure to mark the new container as processed right away
+	// A replacement that was already marked as processed is gone, so forget it
 	s.mu.Lock()
-	s.processedContainers[newContainerID] = true
+	_, tracked := s.processedContainers[replacement]
+	delete(s.processedContainers, replacement)
 	s.mu.Unlock()
+	if tracked {
+		s.saveState()
+	}
+}
+
+// maxRemapTimings is how many recent remap timings are kept
+const maxRemapTimings = 50
+
+// RemapTiming records how long each phase of recreating a container took, in milliseconds.
+// The start phase covers waiting for the new container to be running and healthy. The
+// host ports of a remap moving several ports at once are listed comma-separated.
+type RemapTiming struct {
+	ContainerID   string    `json:"containerId"`
+	ContainerName string    `json:"containerName"`
+	OldHostPort   string    `json:"oldHostPort"`
+	NewHostPort   string    `json:"newHostPort"`
+	StartedAt     time.Time `json:"startedAt"`
+	StopMs        int64     `json:"stopMs"`
+	RemoveMs      int64     `json:"removeMs"`
+	CreateMs      int64     `json:"createMs"`
+	StartMs       int64     `json:"startMs"`
+	TotalMs       int64     `json:"totalMs"`
+	Completed     bool      `json:"completed"`
+}
+
+// recordRemapTiming logs a remap's phase timings, warning if it was slow, and keeps it
+// among the most recent remaps
+func (s *ContainerStore) recordRemapTiming(timing RemapTiming) {
+	total := time.Since(timing.StartedAt)
+	timing.TotalMs = total.Milliseconds()
 	
-	// 7. Wait a bit for the container to start
-	time.Sleep(1 * time.Second)
+	log.Printf("Remap of container %s took %v (stop %dms, remove %dms, create %dms, start %dms)",
+		timing.ContainerID, total.Round(time.Millisecond), timing.StopMs, timing.RemoveMs, timing.CreateMs, timing.StartMs)
+	if s.slowRemapThreshold > 0 && total > s.slowRemapThreshold {
+		log.Printf("Warning: Remap of container %s took %v, longer than %v; the Docker daemon may be under pressure",
+			timing.ContainerID, total.Round(time.Millisecond), s.slowRemapThreshold)
+	}
 	
-	return nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remapTimings = append(s.remapTimings, timing)
+	if len(s.remapTimings) > maxRemapTimings {
+		s.remapTimings = s.remapTimings[len(s.remapTimings)-maxRemapTimings:]
+	}
+}
+
+// SlowestRemaps returns up to limit of the recent remaps, slowest first
+func (s *ContainerStore) SlowestRemaps(limit int) []RemapTiming {
+	s.mu.RLock()
+	timings := make([]RemapTiming, len(s.remapTimings))
+	copy(timings, s.remapTimings)
+	s.mu.RUnlock()
+	
+	sort.SliceStable(timings, func(i, j int) bool {
+		return timings[i].TotalMs > timings[j].TotalMs
+	})
+	if limit > 0 && len(timings) > limit {
+		timings = timings[:limit]
+	}
+	return timings
+}
+
+// waitForContainerReady polls a container's state until it is running and, if it defines
+// a healthcheck, healthy. It returns an error describing the last seen state on timeout,
+// or as soon as ctx is cancelled.
+func waitForContainerReady(ctx context.Context, containerID string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	lastState := "unknown"
+	
+	for {
+		cmd := exec.CommandContext(ctx, "docker", "inspect", "--format",
+			"{{.State.Status}} {{if .State.Health}}{{.State.Health.Status}}{{end}}", containerID)
+		output, err := cmd.Output()
+		if err == nil {
+			fields := strings.Fields(string(output))
+			if len(fields) > 0 {
+				lastState = strings.Join(fields, "/")
+				running := fields[0] == "running"
+				// Containers without a healthcheck only report their status
+				healthy := len(fields) < 2 || fields[1] == "healthy"
+				if running && healthy {
+					return nil
+				}
+			}
+		} else {
+			lastState = fmt.Sprintf("inspect failed: %v", err)
+		}
+		
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not ready after %s (state: %s)", timeout, lastState)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting (state: %s): %w", lastState, ctx.Err())
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
 }
 
 // listenForEvents starts listening for Docker events
 func (s *ContainerStore) listenForEvents() {
 	// Use docker events command to listen for events
-	s.eventCmd = exec.Command("docker", "events", "--format", "{{json .}}", "--filter", "type=container")
+	args := []string{"events", "--format", "{{json .}}", "--filter", "type=container"}
+	
+	// After a reconnect, replay anything that happened while we were disconnected.
+	// No --until is passed so the stream continues live after the replay.
+	s.mu.RLock()
+	since := s.lastEventTime
+	s.mu.RUnlock()
+	if since > 0 {
+		sinceArg := fmt.Sprintf("%d.%09d", since/int64(time.Second), since%int64(time.Second))
+		log.Printf("Resuming docker events from %s", sinceArg)
+		args = append(args, "--since", sinceArg)
+	}
+	
+	cmd := exec.CommandContext(s.context(), "docker", args...)
+	s.mu.Lock()
+	s.eventCmd = cmd
+	s.mu.Unlock()
 	
-	stdout, err := s.eventCmd.StdoutPipe()
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		log.Printf("Error creating pipe for docker events: %v", err)
+		s.fallBackToPolling()
 		return
 	}
 
-	if err := s.eventCmd.Start(); err != nil {
+	if err := cmd.Start(); err != nil {
 		log.Printf("Error starting docker events: %v", err)
+		s.fallBackToPolling()
 		return
 	}
+	startedAt := time.Now()
 
 	// Process events
+	processed := make(chan struct{})
 	go func() {
+		defer close(processed)
 		defer func() {
 			if r := recover(); r != nil {
 				log.Printf("Recovered from panic in processEvents: %v", r)
@@ -896,9 +2086,11 @@ func (s *ContainerStore) listenForEvents() {
 		s.processEvents(stdout)
 	}()
 
-	// Wait for command to finish and restart if needed
+	// Wait for command to finish and restart if needed. Wait closes the pipe, so it
+	// has to wait for the last events to be read first.
 	go func() {
-		err := s.eventCmd.Wait()
+		<-processed
+		err := cmd.Wait()
 		log.Printf("Docker events command exited: %v", err)
 		
 		select {
@@ -906,13 +2098,101 @@ func (s *ContainerStore) listenForEvents() {
 			// We're shutting down, don't restart
 			return
 		default:
-			// Command exited unexpectedly, restart after a delay
-			time.Sleep(5 * time.Second)
+		}
+		
+		// Give up on a stream that keeps dying right after it starts
+		s.mu.Lock()
+		if time.Since(startedAt) < eventStreamMinUptime {
+			s.eventFailures++
+		} else {
+			s.eventFailures = 0
+		}
+		failures := s.eventFailures
+		s.mu.Unlock()
+		if failures >= maxEventFailures && s.fallBackToPolling() {
+			return
+		}
+		
+		// Command exited unexpectedly, restart after a delay
+		select {
+		case <-s.done:
+		case <-time.After(5 * time.Second):
 			go s.listenForEvents()
 		}
 	}()
 }
 
+// fallBackToPolling starts polling for container changes in place of the events
+// stream. It returns false if polling is disabled.
+func (s *ContainerStore) fallBackToPolling() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pollInterval <= 0 {
+		return false
+	}
+	if !s.polling {
+		log.Printf("Docker events are unavailable, polling for container changes every %s instead", s.pollInterval)
+		s.polling = true
+		go s.pollContainers()
+	}
+	return true
+}
+
+// pollContainers periodically refreshes the containers and handles any that started
+// or went away since the last poll, as the events stream would have
+func (s *ContainerStore) pollContainers() {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	known := startTimes(s.GetContainers())
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		// Both may be ready at once, and a stopped store must not act on a tick
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		if err := s.refreshContainers(); err != nil {
+			log.Printf("Error polling containers: %v", err)
+			continue
+		}
+		current := startTimes(s.GetContainers())
+		for id := range known {
+			if _, ok := current[id]; !ok {
+				log.Printf("Container %s is gone", id)
+				s.forgetContainer(id)
+			}
+		}
+		for id, startedAt := range current {
+			// A container seen before but with a new start time was restarted
+			if previous, ok := known[id]; !ok || !previous.Equal(startedAt) {
+				log.Printf("Container started: %s", id)
+				if s.Paused() {
+					log.Printf("Management is paused, not checking started container %s", id)
+					continue
+				}
+				s.evaluateContainer(id)
+			}
+		}
+		known = current
+	}
+}
+
+// startTimes maps container IDs to when the containers were started
+func startTimes(containers []Container) map[string]time.Time {
+	times := make(map[string]time.Time, len(containers))
+	for _, container := range containers {
+		times[container.ID] = container.StartedAt
+	}
+	return times
+}
+
 // processEvents reads and processes Docker events
 func (s *ContainerStore) processEvents(r io.Reader) {
 	scanner := bufio.NewScanner(r)
@@ -929,10 +2209,21 @@ func (s *ContainerStore) processEvents(r io.Reader) {
 			continue
 		}
 
+		// Skip events replayed after a reconnect that we already handled
+		if !s.recordEvent(event) {
+			continue
+		}
+
 		// Don't hold the lock during this whole function
 		// Handle specific container actions for port remapping
 		switch event.Status {
 		case "start":
+			// While paused, only keep the display up to date
+			if s.Paused() {
+				log.Printf("Management is paused, not checking started container %s", event.ID)
+				go s.refreshContainers()
+				continue
+			}
 			// Handle container start in a separate goroutine
 			go s.handleContainerStart(event.ID)
 			
@@ -960,6 +2251,38 @@ func (s *ContainerStore) processEvents(r io.Reader) {
 	}
 }
 
+// recordEvent remembers an event as processed and advances the resume timestamp.
+// It returns false if the event was already processed before.
+func (s *ContainerStore) recordEvent(event DockerEvent) bool {
+	eventTime := event.TimeNano
+	if eventTime == 0 {
+		// Older daemons only report second precision
+		eventTime = event.Time * int64(time.Second)
+	}
+	key := fmt.Sprintf("%s/%s/%d", event.ID, event.Action, eventTime)
+	
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	if _, seen := s.seenEvents[key]; seen {
+		return false
+	}
+	s.seenEvents[key] = eventTime
+	
+	if eventTime > s.lastEventTime {
+		s.lastEventTime = eventTime
+		
+		// Forget events too old to be replayed again
+		cutoff := s.lastEventTime - int64(eventDedupWindow)
+		for k, t := range s.seenEvents {
+			if t < cutoff {
+				delete(s.seenEvents, k)
+			}
+		}
+	}
+	return true
+}
+
 // handleContainerStart processes a container start event
 func (s *ContainerStore) handleContainerStart(containerID string) {
 	// Add a small delay to ensure docker has fully initialized the container
@@ -967,8 +2290,65 @@ func (s *ContainerStore) handleContainerStart(containerID string) {
 
 	log.Printf("Container started: %s", containerID)
 	
+	// Let a Compose project finish starting before remapping any of its containers
+	if s.evaluateWhenSettled(containerID) {
+		return
+	}
+	s.evaluateContainer(containerID)
+}
+
+// recordBindingConflicts records which of a container's port bindings conflict with
+// other containers so they can be displayed, warning about each, for containers
+// that are not remapped. The reason they aren't prefixes the warnings.
+func (s *ContainerStore) recordBindingConflicts(containerID string, hostConfig map[string]interface{}, reason string) {
+	portBindings, ok := hostConfig["PortBindings"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	for containerPortProto, bindings := range portBindings {
+		bindingsArray, ok := bindings.([]interface{})
+		if !ok || len(bindingsArray) == 0 {
+			continue
+		}
+		binding, ok := bindingsArray[0].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		hostPort, _ := binding["HostPort"].(string)
+		parts := strings.Split(containerPortProto, "/")
+		if hostPort == "" || len(parts) != 2 {
+			continue
+		}
+		if s.recordConflict(containerID, hostPort, parts[0], parts[1]) {
+			log.Printf("%s: port %s/%s of container %s conflicts with another container, not remapping",
+				reason, hostPort, parts[1], containerID)
+		}
+	}
+}
+
+// remapExistingContainers checks the containers that were already running when we
+// started, remapping conflicting ones just as if they had been started now
+func (s *ContainerStore) remapExistingContainers() {
+	containers := sortedContainers(s.GetContainers())
+	log.Printf("Checking %d running containers for port conflicts", len(containers))
+	for _, container := range containers {
+		s.evaluateContainer(container.ID)
+	}
+}
+
+// evaluateContainer checks a running container's ports and remaps them if needed
+func (s *ContainerStore) evaluateContainer(containerID string) {
+	// Port bindings can't be added to a container without recreating it under a new
+	// ID, so a container that had none before still has none
+	s.mu.RLock()
+	portless := s.portlessContainers[containerID]
+	s.mu.RUnlock()
+	if portless {
+		return
+	}
+	
 	// Check if this is a Docker Compose container
-	composeProject := extractLabel(containerID, "com.docker.compose.project")
+	composeProject := extractLabel(s.context(), containerID, "com.docker.compose.project")
 	if composeProject != "" {
 		log.Printf("Container belongs to Compose project: %s", composeProject)
 	}
@@ -988,7 +2368,7 @@ func (s *ContainerStore) handleContainerStart(containerID string) {
 	// that weren't initially started via our tool
 	
 	// Get container details
-	cmd := exec.Command("docker", "inspect", "--format", "{{json .}}", containerID)
+	cmd := exec.CommandContext(s.context(), "docker", "inspect", "--format", "{{json .}}", containerID)
 	output, err := cmd.Output()
 	if err != nil {
 		log.Printf("Error inspecting container %s: %v", containerID, err)
@@ -1007,25 +2387,77 @@ func (s *ContainerStore) handleContainerStart(containerID string) {
 		return
 	}
 	
-	portBindings, ok := hostConfig["PortBindings"].(map[string]interface{})
-	if !ok || len(portBindings) == 0 {
-		// No port bindings to manage
+	// In read-only mode we only record conflicts so they can be displayed
+	if s.readOnly {
+		s.recordBindingConflicts(containerID, hostConfig, "Read-only mode")
+		if err := s.refreshContainers(); err != nil {
+			log.Printf("Error refreshing containers: %v", err)
+		}
 		return
 	}
 	
-	log.Printf("Container %s has port bindings, checking for conflicts", containerID)
+	// Neither are containers of stateful images listed in -no-recreate-images recreated
+	image := inspectString(inspectSection(containerData, "Config"), "Image")
+	if s.noRecreateImages.Matches(image) {
+		s.recordBindingConflicts(containerID, hostConfig, fmt.Sprintf("Image %s is never recreated", image))
+		if err := s.refreshContainers(); err != nil {
+			log.Printf("Error refreshing containers: %v", err)
+		}
+		return
+	}
+	
+	// Containers in excluded projects are displayed but never remapped
+	containerName, _ := containerData["Name"].(string)
+	if !s.shouldManage(containerID, containerName, composeProject) {
+		log.Printf("Container %s is excluded from management, not remapping it", containerID)
+		if err := s.refreshContainers(); err != nil {
+			log.Printf("Error refreshing containers: %v", err)
+		}
+		return
+	}
+	
+	// Nor are containers that were restored to their original ports moved back
+	if labels, _ := inspectSection(containerData, "Config")["Labels"].(map[string]interface{}); labels[restoredLabel] == "true" {
+		log.Printf("Container %s was restored to its original ports, not remapping it", containerID)
+		if err := s.refreshContainers(); err != nil {
+			log.Printf("Error refreshing containers: %v", err)
+		}
+		return
+	}
+	
+	// Containers started with --publish-all get ephemeral ports picked by Docker,
+	// which aren't recorded in HostConfig.PortBindings
+	publishAll, _ := hostConfig["PublishAllPorts"].(bool)
+	if publishAll {
+		if !s.managePublishAll {
+			log.Printf("Container %s uses --publish-all, leaving Docker-assigned ports alone", containerID)
+			if err := s.refreshContainers(); err != nil {
+				log.Printf("Error refreshing containers: %v", err)
+			}
+			return
+		}
+		log.Printf("Container %s uses --publish-all, bringing its ports under stable management", containerID)
+	}
+	
+	portBindings, _ := hostConfig["PortBindings"].(map[string]interface{})
+	if publishAll {
+		portBindings = publishedPorts(containerData)
+	}
+	if len(portBindings) == 0 {
+		// No port bindings to manage, now or on later restarts
+		s.mu.Lock()
+		s.portlessContainers[containerID] = true
+		s.mu.Unlock()
+		return
+	}
+	
+	log.Printf("Container %s has port bindings, checking for conflicts", containerID)
 	
 	// Check if all ports are in our dynamic range
 	allInDynamicRange := true
 	for _, bindings := range portBindings {
-		bindingsArray, ok := bindings.([]interface{})
-		if !ok || len(bindingsArray) == 0 {
-			continue
-		}
-		
-		binding := bindingsArray[0].(map[string]interface{})
-		hostPort, ok := binding["HostPort"].(string)
-		if !ok || hostPort == "" {
+		_, hostPort, ok := firstPortBinding(bindings)
+		if !ok {
 			continue
 		}
 		
@@ -1037,7 +2469,7 @@ func (s *ContainerStore) handleContainerStart(containerID string) {
 	}
 	
 	// If all ports are already in our dynamic range, just mark as processed
-	if allInDynamicRange && len(portBindings) > 0 {
+	if allInDynamicRange && len(portBindings) > 0 && !publishAll {
 		log.Printf("Container %s already has all ports in dynamic range, marking as processed", containerID)
 		s.addDynamicPortLabel(containerID)
 		// Refresh containers to update our view
@@ -1047,21 +2479,30 @@ func (s *ContainerStore) handleContainerStart(containerID string) {
 		return
 	}
 	
+	// Don't keep trying to remap while the dynamic range is full; a container
+	// stopping frees its ports and lets us try again
+	if s.RangeExhausted() {
+		log.Printf("Dynamic port range is exhausted, skipping remap checks for container %s", containerID)
+		if err := s.refreshContainers(); err != nil {
+			log.Printf("Error refreshing containers: %v", err)
+		}
+		return
+	}
+	
 	// If container is already running with port bindings, check each port
 	needsRestart := false
 	portsToRemap := make(map[string]string)  // containerPort:protocol -> newHostPort
+	remapReasons := make(map[string]string)  // containerPort:protocol -> why it is remapped
+	oldHostPorts := make(map[string]string)  // containerPort:protocol -> current host port
+	oldHostIPs := make(map[string]string)    // containerPort:protocol -> current host IP
 	
 	for containerPortProto, bindings := range portBindings {
-		bindingsArray, ok := bindings.([]interface{})
-		if !ok || len(bindingsArray) == 0 {
-			continue
-		}
-		
-		binding := bindingsArray[0].(map[string]interface{})
-		hostPort, ok := binding["HostPort"].(string)
-		if !ok || hostPort == "" {
+		hostIP, hostPort, ok := firstPortBinding(bindings)
+		if !ok {
 			continue
 		}
+		oldHostPorts[containerPortProto] = hostPort
+		oldHostIPs[containerPortProto] = hostIP
 		
 		// Split containerPort:protocol
 		parts := strings.Split(containerPortProto, "/")
@@ -1072,32 +2513,78 @@ func (s *ContainerStore) handleContainerStart(containerID string) {
 		protocol := parts[1]
 		
 		// Always check if we need to remap
-		needsRemap, newPort := s.checkPortCollision(containerID, hostPort, protocol)
+		needsRemap, newPort, reason := s.checkPortCollision(containerID, hostIP, hostPort, protocol, true)
 		if needsRemap {
 			log.Printf("Found port conflict for %s: %s/%s -> %s", 
 				containerID, hostPort, protocol, newPort)
 			portsToRemap[containerPortProto] = newPort
+			remapReasons[containerPortProto] = reason
+			needsRestart = true
+		} else if publishAll {
+			// Pin the Docker-assigned port explicitly so it survives recreation
+			portsToRemap[containerPortProto] = hostPort
+			remapReasons[containerPortProto] = reasonPublishAllPinned
 			needsRestart = true
 		}
 	}
 	
+	// With -keep-ranges a published range is moved as a whole block or not at all
+	var blocks map[string]bool
+	if s.keepRanges && !publishAll && needsRestart {
+		blocks = s.keepRangesTogether(containerID, portBindingRanges(portBindings), portsToRemap, remapReasons)
+		needsRestart = len(portsToRemap) > 0
+	}
+
 	// If we need to remap any ports, restart the container
 	if needsRestart {
-		log.Printf("Restarting container %s with remapped ports", containerID)
+		if s.planOnly {
+			log.Printf("Plan-only mode: recording remaps for container %s instead of restarting it", containerID)
+		} else {
+			log.Printf("Restarting container %s with remapped ports", containerID)
+		}
 		
-		// For each port that needs remapping, call remapContainerPort
-		for containerPortProto, newHostPort := range portsToRemap {
+		// Move every port in a single recreation, so a failure rolls all of them back
+		keys := make([]string, 0, len(portsToRemap))
+		for containerPortProto := range portsToRemap {
+			keys = append(keys, containerPortProto)
+		}
+		sort.Strings(keys)
+		var moves []portMove
+		for _, containerPortProto := range keys {
 			parts := strings.Split(containerPortProto, "/")
-			containerPort := parts[0]
-			protocol := parts[1]
-			
-			// Get current host port from port bindings
-			bindings := portBindings[containerPortProto].([]interface{})
-			binding := bindings[0].(map[string]interface{})
-			oldHostPort := binding["HostPort"].(string)
-			
-			if err := s.remapContainerPort(containerID, oldHostPort, newHostPort, containerPort, protocol); err != nil {
-				log.Printf("Failed to remap port for container %s: %v", containerID, err)
+			moves = append(moves, portMove{
+				ContainerPort: parts[0],
+				Protocol:      parts[1],
+				HostIP:        oldHostIPs[containerPortProto],
+				OldHostPort:   oldHostPorts[containerPortProto],
+				NewHostPort:   portsToRemap[containerPortProto],
+				Reason:        remapReasons[containerPortProto],
+				Fixed:         blocks[containerPortProto],
+			})
+		}
+
+		if s.planOnly {
+			for _, move := range moves {
+				s.recordRemapIntent(PlannedRemap{
+					ContainerID:   containerID,
+					ContainerName: strings.TrimPrefix(containerName, "/"),
+					ContainerPort: move.ContainerPort,
+					Protocol:      move.Protocol,
+					HostPort:      move.OldHostPort,
+					NewHostPort:   move.NewHostPort,
+					Reason:        move.Reason,
+				})
+				// The new port is only recorded, so don't keep it from actual remaps
+				if move.Reason != reasonPublishAllPinned {
+					s.releasePortString(move.NewHostPort)
+				}
+			}
+		} else if newContainerID, err := s.remapContainerPorts(containerID, moves); err != nil {
+			log.Printf("Failed to remap ports for container %s: %v", containerID, err)
+		} else {
+			// Remember why the ports were remapped, under the new container's ID
+			for _, move := range moves {
+				s.recordPortReason(newContainerID, move.ContainerPort, move.Protocol, move.Reason)
 			}
 		}
 	} else {
@@ -1112,341 +2599,1708 @@ func (s *ContainerStore) handleContainerStart(containerID string) {
 	}
 }
 
-// handleContainerStop processes a container stop event
-func (s *ContainerStore) handleContainerStop(containerID string) {
-	log.Printf("Container stop/remove event for: %s", containerID)
-	
-	// First check if container still exists before doing cleanup
-	// This helps distinguish between stop (container still exists) and remove (container gone)
-	checkCmd := exec.Command("docker", "inspect", "--format", "{{.ID}}", containerID)
-	containerExists := checkCmd.Run() == nil
-	
-	// Removing container from all maps immediately
-	s.mu.Lock()
-	delete(s.portMappings, containerID)
-	delete(s.containers, containerID)
-	delete(s.processedContainers, containerID)
-	s.mu.Unlock()
-	
-	// If the container still exists (just stopped), we'll pick it up again in refresh
-	// If it's gone (removed), we've already deleted it from our state
-	
-	// Always refresh containers to update our state with what Docker now has
-	if err := s.refreshContainers(); err != nil {
-		log.Printf("Error refreshing containers: %v", err)
+// firstPortBinding returns the host IP and port of the first binding of a port in
+// HostConfig.PortBindings, or false if there is none or it isn't shaped as expected,
+// e.g. a null entry for a port that is exposed but not published
+func firstPortBinding(bindings interface{}) (string, string, bool) {
+	bindingsArray, ok := bindings.([]interface{})
+	if !ok || len(bindingsArray) == 0 {
+		return "", "", false
 	}
-	
-	// If container was actually removed, log a confirmation of cleanup
-	if !containerExists {
-		log.Printf("Container %s was removed, cleaned up from all state maps", containerID)
+	binding, ok := bindingsArray[0].(map[string]interface{})
+	if !ok {
+		return "", "", false
 	}
+	hostIP, _ := binding["HostIp"].(string)
+	hostPort, _ := binding["HostPort"].(string)
+	return hostIP, hostPort, hostPort != ""
 }
 
-// GetContainers returns a copy of all containers
-func (s *ContainerStore) GetContainers() []Container {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	containers := make([]Container, 0, len(s.containers))
-	for _, c := range s.containers {
-		containers = append(containers, c)
+// publishedPorts returns the port bindings Docker actually published for a container,
+// including ephemeral ports assigned for --publish-all
+func publishedPorts(containerData map[string]interface{}) map[string]interface{} {
+	published := make(map[string]interface{})
+	networkSettings, ok := containerData["NetworkSettings"].(map[string]interface{})
+	if !ok {
+		return published
 	}
-
-	return containers
-}
-
-// GetContainersByComposeProject groups containers by their Docker Compose project
-func (s *ContainerStore) GetContainersByComposeProject() map[string][]Container {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	
-	// First pass: build a map to group containers by their actual projects
-	projectsByID := make(map[string]string)
-	
-	// Find actual project names first and map container IDs to them
-	for id, container := range s.containers {
-		// Skip containers with no project
-		if container.ComposeProject != "" && container.ComposeProject != "<no value>" {
-			projectsByID[id] = container.ComposeProject
-		}
+	ports, ok := networkSettings["Ports"].(map[string]interface{})
+	if !ok {
+		return published
 	}
-	
-	// Second pass: try to infer missing projects from names, network connect events, etc.
-	for id, container := range s.containers {
-		// If this container already has a project assigned, skip it
-		if _, exists := projectsByID[id]; exists {
-			continue
-		}
-		
-		// Try to infer project from container name
-		name := container.Names
-		// Remove any leading slash
-		name = strings.TrimPrefix(name, "/")
-		
-		// Pattern for docker-compose containers: project_service_1
-		parts := strings.Split(name, "_")
-		if len(parts) >= 2 {
-			// First part is likely the project name
-			projectName := parts[0]
-			if projectName != "" {
-				projectsByID[id] = projectName
-				continue
-			}
+	for port, bindings := range ports {
+		// Exposed but unpublished ports have null bindings. Docker publishes the same
+		// host port on both IPv4 and IPv6, so the first binding is enough to pin it.
+		if bindingsArray, ok := bindings.([]interface{}); ok && len(bindingsArray) > 0 {
+			published[port] = bindingsArray[:1]
 		}
 	}
-	
-	// Final pass: build the actual projects map
-	projects := make(map[string][]Container)
-	
-	for id, container := range s.containers {
-		var projectName string
-		
-		// Get project from our mapping if it exists
-		if project, exists := projectsByID[id]; exists {
-			projectName = project
-		} else {
-			// Fallback to standalone
-			projectName = "standalone"
-		}
-		
-		// Create project slice if it doesn't exist
-		if _, exists := projects[projectName]; !exists {
-			projects[projectName] = make([]Container, 0)
-		}
-		
-		projects[projectName] = append(projects[projectName], container)
+	return published
+}
+
+// inspectSection returns a nested object of docker inspect output, or an empty one
+// when the field is missing or null
+func inspectSection(info map[string]interface{}, key string) map[string]interface{} {
+	if section, ok := info[key].(map[string]interface{}); ok {
+		return section
 	}
-	
-	return projects
+	return map[string]interface{}{}
 }
 
-// RefreshContainers forces a refresh of all containers
-func (s *ContainerStore) RefreshContainers() error {
-	return s.refreshContainers()
+// inspectString returns a string field of docker inspect output, or "" when the
+// field is missing, null or not a string
+func inspectString(info map[string]interface{}, key string) string {
+	value, _ := info[key].(string)
+	return value
 }
 
-// Close stops the event listener and cleans up resources
-func (s *ContainerStore) Close() {
-	close(s.done)
-	if s.eventCmd != nil && s.eventCmd.Process != nil {
-		s.eventCmd.Process.Kill()
-	}
+// PlannedRemap describes a port remap the tool would perform for a container
+type PlannedRemap struct {
+	ContainerID   string `json:"containerId" yaml:"containerId"`
+	ContainerName string `json:"containerName" yaml:"containerName"`
+	ContainerPort string `json:"containerPort" yaml:"containerPort"`
+	Protocol      string `json:"protocol" yaml:"protocol"`
+	HostPort      string `json:"hostPort" yaml:"hostPort"`
+	NewHostPort   string `json:"newHostPort" yaml:"newHostPort"`
+	Reason        string `json:"reason,omitempty" yaml:"reason,omitempty"`
 }
 
-// CheckComposePortConflicts checks for port conflicts within a Docker Compose project
-// before containers are started, so we can remap them proactively
-func (s *ContainerStore) CheckComposePortConflicts(composeFile string) (map[string]string, error) {
-	// Parse the compose file to extract port mappings
-	cmd := exec.Command("docker-compose", "-f", composeFile, "config")
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse compose file: %v", err)
-	}
+// RemapIntent is a remap that plan-only mode decided on but did not perform
+type RemapIntent struct {
+	PlannedRemap `yaml:",inline"`
+	PlannedAt    time.Time `json:"plannedAt" yaml:"plannedAt"`
+}
 
-	// Parse YAML output
-	var composeConfig map[string]interface{}
-	if err := yaml.Unmarshal(output, &composeConfig); err != nil {
-		return nil, fmt.Errorf("failed to parse compose config: %v", err)
+// recordRemapIntent logs a remap plan-only mode would have performed and saves it to the
+// state file. A newer intent for the same container port replaces the older one.
+func (s *ContainerStore) recordRemapIntent(remap PlannedRemap) {
+	log.Printf("Plan-only mode: would remap container %s port %s/%s from %s to %s",
+		remap.ContainerID, remap.ContainerPort, remap.Protocol, remap.HostPort, remap.NewHostPort)
+	
+	intent := RemapIntent{PlannedRemap: remap, PlannedAt: time.Now()}
+	
+	s.mu.Lock()
+	replaced := false
+	for i, existing := range s.remapIntents {
+		if existing.ContainerID == remap.ContainerID && existing.ContainerPort == remap.ContainerPort &&
+			existing.Protocol == remap.Protocol {
+			s.remapIntents[i] = intent
+			replaced = true
+			break
+		}
 	}
-
-	// Extract services
-	services, ok := composeConfig["services"].(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("invalid compose file format: no services defined")
+	if !replaced {
+		s.remapIntents = append(s.remapIntents, intent)
 	}
+	s.mu.Unlock()
+	
+	s.saveState()
+}
 
-	// Map to store port remappings: "service:port" -> "new port"
-	portRemappings := make(map[string]string)
+// GetRemapIntents returns the remaps recorded in plan-only mode
+func (s *ContainerStore) GetRemapIntents() []RemapIntent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	
+	intents := make([]RemapIntent, len(s.remapIntents))
+	copy(intents, s.remapIntents)
+	return intents
+}
 
-	// Check each service for port mappings
-	for serviceName, serviceConfig := range services {
-		serviceMap, ok := serviceConfig.(map[string]interface{})
-		if !ok {
+// PlanRemaps reports which ports of the current containers would be remapped, and to
+// which host ports, following the same decisions as handleContainerStart. Nothing is
+// changed in Docker; the allocated ports are only proposals.
+func (s *ContainerStore) PlanRemaps() []PlannedRemap {
+	var plan []PlannedRemap
+	planned := make(map[string]bool) // New host ports already proposed, to avoid handing one out twice
+
+	for _, container := range s.GetContainers() {
+		if len(container.PortMappings) == 0 || s.isContainerProcessed(container.ID) {
 			continue
 		}
-
-		ports, ok := serviceMap["ports"].([]interface{})
-		if !ok {
+		if !s.shouldManage(container.ID, container.Names, container.ComposeProject) || s.noRecreateImages.Matches(container.Image) {
+			continue
+		}
+		if s.isRestored(container.ID) {
 			continue
 		}
 
-		// Check each port mapping
-		for _, portMapping := range ports {
-			var hostPort, containerPort, protocol string
-
-			// Handle different port mapping formats
-			switch pm := portMapping.(type) {
-			case string:
-				// Format: "8080:80" or "8080:80/tcp"
-				parts := strings.Split(pm, ":")
-				if len(parts) == 2 {
-					hostPort = parts[0]
-					containerPortProto := strings.Split(parts[1], "/")
-					containerPort = containerPortProto[0]
-					if len(containerPortProto) > 1 {
-						protocol = containerPortProto[1]
-					} else {
-						protocol = "tcp" // Default protocol
-					}
-				}
-			case map[string]interface{}:
-				// Format: {published: 8080, target: 80, protocol: tcp}
-				if published, ok := pm["published"].(string); ok {
-					hostPort = published
-				} else if published, ok := pm["published"].(int); ok {
-					hostPort = strconv.Itoa(published)
-				}
+		publishAll := hasPublishAllPorts(s.context(), container.ID)
+		if publishAll && !s.managePublishAll {
+			continue
+		}
 
-				if target, ok := pm["target"].(string); ok {
-					containerPort = target
-				} else if target, ok := pm["target"].(int); ok {
-					containerPort = strconv.Itoa(target)
-				}
+		// Containers with all ports in our range are treated as already managed
+		allInDynamicRange := true
+		for _, mapping := range container.PortMappings {
+			portInt, err := strconv.Atoi(mapping.HostPort)
+			if err != nil || portInt < s.portRangeMin || portInt > s.portRangeMax {
+				allInDynamicRange = false
+				break
+			}
+		}
+		if allInDynamicRange && !publishAll {
+			continue
+		}
 
-				if proto, ok := pm["protocol"].(string); ok {
-					protocol = proto
+		portsToRemap := make(map[string]string)
+		remapReasons := make(map[string]string)
+		for _, mapping := range container.PortMappings {
+			needsRemap, newPort, reason := s.checkPortCollision(container.ID, mapping.HostIP, mapping.HostPort, mapping.Protocol, false)
+			if !needsRemap {
+				// --publish-all ports would be pinned in place rather than moved
+				if publishAll {
+					newPort = mapping.HostPort
+					reason = reasonPublishAllPinned
 				} else {
-					protocol = "tcp" // Default protocol
+					continue
 				}
 			}
-
-			if hostPort == "" || containerPort == "" {
-				continue
-			}
-
-			// Check for collisions
-			portInt, err := strconv.Atoi(hostPort)
-			if err != nil {
-				continue
-			}
-
-			// Check if this port is already in use
-			inUse := false
-			for _, container := range s.containers {
-				for _, mapping := range container.PortMappings {
-					existingPort, _ := strconv.Atoi(mapping.HostPort)
-					if existingPort == portInt && mapping.Protocol == protocol {
-						inUse = true
-						break
-					}
-				}
-				if inUse {
+			for i := 0; i < 10 && needsRemap && planned[newPort]; i++ {
+				port, err := s.allocateRandomPortOn(s.remapHostIP(mapping.HostIP), []string{mapping.Protocol})
+				if err != nil {
 					break
 				}
+				newPort = strconv.Itoa(port)
 			}
+			planned[newPort] = true
 
-			// Also check if the port is in use by non-Docker processes
-			if !inUse && !s.isPortAvailable(portInt) {
-				inUse = true
-			}
+			key := fmt.Sprintf("%s/%s", mapping.ContainerPort, mapping.Protocol)
+			portsToRemap[key] = newPort
+			remapReasons[key] = reason
+		}
 
-			// If port is in use, allocate a new one
-			if inUse {
-				newPort := s.allocateRandomPort()
-				portRemappings[fmt.Sprintf("%s:%s", serviceName, hostPort)] = strconv.Itoa(newPort)
-				log.Printf("Port conflict detected for service %s: %s -> %d", 
-					serviceName, hostPort, newPort)
+		// Show ranges moving as a whole, as evaluateContainer would move them
+		if s.keepRanges && !publishAll && len(portsToRemap) > 0 {
+			s.keepRangesTogether(container.ID, mappingRanges(container.PortMappings), portsToRemap, remapReasons)
+		}
+		for _, mapping := range container.PortMappings {
+			key := fmt.Sprintf("%s/%s", mapping.ContainerPort, mapping.Protocol)
+			newPort, ok := portsToRemap[key]
+			if !ok {
+				continue
 			}
+			plan = append(plan, PlannedRemap{
+				ContainerID:   container.ID,
+				ContainerName: container.Names,
+				ContainerPort: mapping.ContainerPort,
+				Protocol:      mapping.Protocol,
+				HostPort:      mapping.HostPort,
+				NewHostPort:   newPort,
+				Reason:        remapReasons[key],
+			})
 		}
 	}
 
-	return portRemappings, nil
+	// The new ports are only shown, so don't keep them from actual remaps. They stay
+	// claimed until every container is planned, so no two containers get the same one.
+	for _, remap := range plan {
+		if remap.Reason != reasonPublishAllPinned {
+			s.releasePortString(remap.NewHostPort)
+		}
+	}
+
+	// Keep the output stable between runs
+	sort.Slice(plan, func(i, j int) bool {
+		if plan[i].ContainerName != plan[j].ContainerName {
+			return plan[i].ContainerName < plan[j].ContainerName
+		}
+		return plan[i].ContainerPort < plan[j].ContainerPort
+	})
+	return plan
 }
 
-// GenerateRemappedComposeFile creates a new Docker Compose file with remapped ports
-func (s *ContainerStore) GenerateRemappedComposeFile(originalFile string, remappings map[string]string) (string, error) {
-	// Read the original compose file
-	origContent, err := os.ReadFile(originalFile)
+// forceRemapTarget looks up a container to force a remap of, given by a unique ID
+// prefix, and checks that it may be recreated
+func (s *ContainerStore) forceRemapTarget(containerID string) (Container, error) {
+	containerID, err := s.ResolveContainerID(containerID)
 	if err != nil {
-		return "", fmt.Errorf("failed to read compose file: %v", err)
+		return Container{}, err
 	}
 
-	// Parse YAML
-	var composeConfig map[string]interface{}
-	if err := yaml.Unmarshal(origContent, &composeConfig); err != nil {
-		return "", fmt.Errorf("failed to parse compose file: %v", err)
+	s.mu.RLock()
+	container, exists := s.containers[containerID]
+	s.mu.RUnlock()
+	if !exists {
+		return Container{}, errContainerNotFound
 	}
+	if !s.shouldManage(container.ID, container.Names, container.ComposeProject) {
+		return Container{}, errContainerExcluded
+	}
+	if s.noRecreateImages.Matches(container.Image) {
+		return Container{}, fmt.Errorf("%w: image %s is listed in -no-recreate-images", errContainerExcluded, container.Image)
+	}
+	return container, nil
+}
 
-	// Get services
-	services, ok := composeConfig["services"].(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("invalid compose file format: no services defined")
+// PlanForceRemap reports the remaps ForceRemap would perform for a container without
+// performing them. The proposed ports are allocated as ForceRemap would, then released.
+func (s *ContainerStore) PlanForceRemap(containerID string) ([]PlannedRemap, error) {
+	container, err := s.forceRemapTarget(containerID)
+	if err != nil {
+		return nil, err
 	}
 
-	// Apply port remappings
-	for servicePortKey, newPort := range remappings {
-		parts := strings.Split(servicePortKey, ":")
-		if len(parts) != 2 {
-			continue
-		}
-		serviceName := parts[0]
-		oldPort := parts[1]
+	moves, err := s.forceRemapMoves(container)
+	if err != nil {
+		return nil, err
+	}
+	var plan []PlannedRemap
+	for _, move := range moves {
+		s.releasePortString(move.NewHostPort)
+		plan = append(plan, PlannedRemap{
+			ContainerID:   container.ID,
+			ContainerName: container.Names,
+			ContainerPort: move.ContainerPort,
+			Protocol:      move.Protocol,
+			HostPort:      move.OldHostPort,
+			NewHostPort:   move.NewHostPort,
+			Reason:        move.Reason,
+		})
+	}
+	return plan, nil
+}
 
-		// Get the service
-		serviceConfig, ok := services[serviceName].(map[string]interface{})
-		if !ok {
-			continue
+// forceRemapMoves allocates a new host port for every published port of a container,
+// moving published ranges as whole blocks under -keep-ranges. The new ports are left
+// claimed.
+func (s *ContainerStore) forceRemapMoves(container Container) ([]portMove, error) {
+	portsToRemap := make(map[string]string)
+	remapReasons := make(map[string]string)
+	for _, mapping := range container.PortMappings {
+		key := fmt.Sprintf("%s/%s", mapping.ContainerPort, mapping.Protocol)
+		if _, ok := portsToRemap[key]; ok {
+			continue // Published on IPv4 and IPv6 alike, which moves as one
+		}
+		newPort, err := s.allocateRandomPortOn(s.remapHostIP(mapping.HostIP), []string{mapping.Protocol})
+		if err != nil {
+			for _, claimed := range portsToRemap {
+				s.releasePortString(claimed)
+			}
+			return nil, err
 		}
+		portsToRemap[key] = strconv.Itoa(newPort)
+		remapReasons[key] = reasonForced
+	}
+
+	var blocks map[string]bool
+	if s.keepRanges {
+		blocks = s.keepRangesTogether(container.ID, mappingRanges(container.PortMappings), portsToRemap, remapReasons)
+	}
 
-		// Get ports
-		ports, ok := serviceConfig["ports"].([]interface{})
+	var moves []portMove
+	for _, mapping := range container.PortMappings {
+		key := fmt.Sprintf("%s/%s", mapping.ContainerPort, mapping.Protocol)
+		newPort, ok := portsToRemap[key]
 		if !ok {
 			continue
 		}
+		delete(portsToRemap, key)
+		moves = append(moves, portMove{
+			ContainerPort: mapping.ContainerPort,
+			Protocol:      mapping.Protocol,
+			HostIP:        mapping.HostIP,
+			OldHostPort:   mapping.HostPort,
+			NewHostPort:   newPort,
+			Reason:        remapReasons[key],
+			Fixed:         blocks[key],
+		})
+	}
+	if len(moves) == 0 {
+		return nil, fmt.Errorf("%w for the ports of %s", errPortExhausted, container.Names)
+	}
+	return moves, nil
+}
 
-		// Replace the port in each mapping
-		for i, portMapping := range ports {
-			switch pm := portMapping.(type) {
-			case string:
-				// Format: "8080:80" or "8080:80/tcp"
-				if strings.HasPrefix(pm, oldPort+":") {
-					// Replace the host port
-					parts := strings.Split(pm, ":")
-					if len(parts) == 2 {
-						ports[i] = newPort + ":" + parts[1]
-					}
-				}
-			case map[string]interface{}:
-				// Format: {published: 8080, target: 80, protocol: tcp}
-				publishedStr, ok := pm["published"].(string)
-				if ok && publishedStr == oldPort {
-					pm["published"] = newPort
-				}
-				publishedInt, ok := pm["published"].(int)
-				if ok && strconv.Itoa(publishedInt) == oldPort {
-					newPortInt, _ := strconv.Atoi(newPort)
-					pm["published"] = newPortInt
-				}
+// resolveContainerRef expands a container given by name, as well as by a unique ID
+// prefix as for ResolveContainerID, to its full ID
+func (s *ContainerStore) resolveContainerRef(ref string) (string, error) {
+	fullID, err := s.ResolveContainerID(ref)
+	if errors.Is(err, errContainerNotFound) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		for id, container := range s.containers {
+			if container.Names == strings.TrimPrefix(ref, "/") {
+				return id, nil
 			}
 		}
-
-		// Update the service config
-		serviceConfig["ports"] = ports
-		services[serviceName] = serviceConfig
 	}
+	return fullID, err
+}
 
-	// Update the compose config
-	composeConfig["services"] = services
-
-	// Generate the new YAML
-	newContent, err := yaml.Marshal(composeConfig)
-	if err != nil {
-		return "", fmt.Errorf("failed to generate updated compose file: %v", err)
-	}
+// Errors returned by ForceRemap when a container may not be remapped
+var (
+	errContainerNotFound = errors.New("container not found")
+	errRemapDisabled     = errors.New("remapping is disabled in read-only and plan-only modes")
+	errContainerExcluded = errors.New("container is excluded from management")
+	errAmbiguousID       = errors.New("ambiguous container ID")
+	errNothingToRestore  = errors.New("container has no remapped ports to restore")
+)
 
-	// Create a temporary file for the new compose config
-	tmpFile, err := os.CreateTemp("", "dynamic-port-mapper-compose-*.yml")
+// ResolveContainerID expands a user-typed container ID, which may be a short prefix,
+// to the full ID of a known container. An ambiguous prefix is an error listing the
+// containers it matches.
+func (s *ContainerStore) ResolveContainerID(id string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	
+	if _, exists := s.containers[id]; exists {
+		return id, nil
+	}
+	if id == "" {
+		return "", errContainerNotFound
+	}
+	
+	var candidates []string
+	for fullID := range s.containers {
+		if strings.HasPrefix(fullID, id) {
+			candidates = append(candidates, fullID)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return "", errContainerNotFound
+	case 1:
+		return candidates[0], nil
+	}
+	
+	sort.Strings(candidates)
+	for i, candidate := range candidates {
+		if len(candidate) > 12 {
+			candidate = candidate[:12]
+		}
+		candidates[i] = fmt.Sprintf("%s (%s)", candidate, s.containers[candidates[i]].Names)
+	}
+	return "", fmt.Errorf("%w %q matches %d containers: %s", errAmbiguousID, id, len(candidates), strings.Join(candidates, ", "))
+}
+
+// Forget drops a container from the store without touching Docker, for containers
+// that linger after an event about them was missed. The container may be given by a
+// unique ID prefix; the forgotten container is returned. If it does still exist, the
+// next refresh picks it up again.
+func (s *ContainerStore) Forget(containerID string) (Container, error) {
+	fullID, err := s.ResolveContainerID(containerID)
+	if err != nil {
+		return Container{}, err
+	}
+	s.mu.RLock()
+	container := s.containers[fullID]
+	s.mu.RUnlock()
+	s.forgetContainer(fullID)
+	s.saveState()
+	log.Printf("Forgot container %s (%s) on request", fullID, container.Names)
+	return container, nil
+}
+
+// ForceRemap moves every published port of a container to a newly allocated port,
+// whether or not it conflicts, and returns the recreated container. The container
+// may be given by a unique ID prefix.
+func (s *ContainerStore) ForceRemap(containerID string) (Container, error) {
+	if s.readOnly || s.planOnly {
+		return Container{}, errRemapDisabled
+	}
+	
+	container, err := s.forceRemapTarget(containerID)
+	if err != nil {
+		return Container{}, err
+	}
+	containerID = container.ID
+	
+	// Move every port in a single recreation, so a failure rolls all of them back
+	moves, err := s.forceRemapMoves(container)
+	if err != nil {
+		return Container{}, err
+	}
+	currentID, err := s.remapContainerPorts(containerID, moves)
+	if err != nil {
+		return Container{}, err
+	}
+	for _, move := range moves {
+		s.recordPortReason(currentID, move.ContainerPort, move.Protocol, move.Reason)
+	}
+	
+	if err := s.refreshContainers(); err != nil {
+		return Container{}, err
+	}
+	
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	container, exists := s.containers[currentID]
+	if !exists {
+		return Container{}, fmt.Errorf("remapped container %s is no longer running", currentID)
+	}
+	return container, nil
+}
+
+// RestoreOriginal undoes the remaps of a container by recreating it with its ports on
+// their original host ports. It clears the container's processed state, but marks it as
+// restored so it is only remapped again on request. The container may be given by its name or a unique ID
+// prefix. Nothing is recreated unless every original port is free.
+func (s *ContainerStore) RestoreOriginal(containerID string) (Container, error) {
+	if s.readOnly || s.planOnly {
+		return Container{}, errRemapDisabled
+	}
+	
+	fullID, err := s.resolveContainerRef(containerID)
+	if err != nil {
+		return Container{}, err
+	}
+	
+	s.mu.RLock()
+	container := s.containers[fullID]
+	s.mu.RUnlock()
+	if !s.shouldManage(container.ID, container.Names, container.ComposeProject) {
+		return Container{}, errContainerExcluded
+	}
+	if s.noRecreateImages.Matches(container.Image) {
+		return Container{}, fmt.Errorf("%w: image %s is listed in -no-recreate-images", errContainerExcluded, container.Image)
+	}
+	
+	// The host IPs the ports were originally published on, if they were specific ones
+	labels, err := containerLabels(s.context(), fullID)
+	if err != nil {
+		return Container{}, err
+	}
+	
+	// Check and claim every original port first, so the container is either fully
+	// restored or left alone
+	var moves []portMove
+	restoring := make(map[string]bool)
+	for _, mapping := range container.PortMappings {
+		key := fmt.Sprintf("%s/%s", mapping.ContainerPort, mapping.Protocol)
+		if mapping.OriginalPort == "" || mapping.OriginalPort == mapping.HostPort || restoring[key] {
+			continue
+		}
+		restoring[key] = true
+		port, err := strconv.Atoi(mapping.OriginalPort)
+		if err != nil {
+			return Container{}, fmt.Errorf("invalid original port %q of %s/%s", mapping.OriginalPort, mapping.ContainerPort, mapping.Protocol)
+		}
+		hostIP := labels[originalHostIPLabel(mapping.ContainerPort, mapping.Protocol)]
+		if s.isHostPortInUse(hostIP, port, mapping.Protocol) || !s.claimPort(port) {
+			for _, claimed := range moves {
+				s.releasePortString(claimed.NewHostPort)
+			}
+			return Container{}, fmt.Errorf("original port %d/%s of %s is in use", port, mapping.Protocol, container.Names)
+		}
+		moves = append(moves, portMove{
+			ContainerPort: mapping.ContainerPort,
+			Protocol:      mapping.Protocol,
+			HostIP:        hostIP,
+			OldHostPort:   mapping.HostPort,
+			NewHostPort:   mapping.OriginalPort,
+			Reason:        reasonRestoredOriginal,
+		})
+	}
+	if len(moves) == 0 {
+		return Container{}, errNothingToRestore
+	}
+	
+	// Restore every port in a single recreation, so a failure rolls all of them back
+	currentID, err := s.recreateContainerPorts(fullID, moves, true)
+	if err != nil {
+		return Container{}, err
+	}
+	log.Printf("Restored container %s to its original host ports: %s", container.Names, describePortMoves(moves))
+	
+	s.mu.Lock()
+	delete(s.processedContainers, currentID)
+	s.mu.Unlock()
+	s.saveState()
+	
+	if err := s.refreshContainers(); err != nil {
+		return Container{}, err
+	}
+	
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	restored, exists := s.containers[currentID]
+	if !exists {
+		return Container{}, fmt.Errorf("restored container %s is no longer running", currentID)
+	}
+	return restored, nil
+}
+
+// recordConflict checks whether a container's host port is also used by another container
+// and remembers the result so it can be displayed. It returns true on conflict.
+func (s *ContainerStore) recordConflict(containerID, hostPort, containerPort, protocol string) bool {
+	portInt, err := strconv.Atoi(hostPort)
+	if err != nil {
+		return false
+	}
+	key := fmt.Sprintf("%s/%s", containerPort, protocol)
+	conflict := s.isPortUsedByOtherContainer(containerID, portInt, protocol)
+	
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	if conflict {
+		if s.conflicts[containerID] == nil {
+			s.conflicts[containerID] = make(map[string]bool)
+		}
+		s.conflicts[containerID][key] = true
+	} else if s.conflicts[containerID] != nil {
+		delete(s.conflicts[containerID], key)
+	}
+	return conflict
+}
+
+// forgetContainer removes a stopped or removed container from all state maps
+func (s *ContainerStore) forgetContainer(containerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.portMappings, containerID)
+	delete(s.containers, containerID)
+	delete(s.processedContainers, containerID)
+	delete(s.conflicts, containerID)
+	delete(s.portReasons, containerID)
+	// The container's ports may be free again, so allow allocating from the range
+	s.rangeExhausted = false
+}
+
+// handleContainerStop processes a container stop event
+func (s *ContainerStore) handleContainerStop(containerID string) {
+	log.Printf("Container stop/remove event for: %s", containerID)
+	
+	// First check if container still exists before doing cleanup
+	// This helps distinguish between stop (container still exists) and remove (container gone)
+	checkCmd := exec.CommandContext(s.context(), "docker", "inspect", "--format", "{{.ID}}", containerID)
+	containerExists := checkCmd.Run() == nil
+	
+	// Removing container from all maps immediately
+	s.forgetContainer(containerID)
+	
+	// If the container still exists (just stopped), we'll pick it up again in refresh
+	// If it's gone (removed), we've already deleted it from our state
+	
+	// Always refresh containers to update our state with what Docker now has
+	if err := s.refreshContainers(); err != nil {
+		log.Printf("Error refreshing containers: %v", err)
+	}
+	
+	// If container was actually removed, log a confirmation of cleanup
+	if !containerExists {
+		s.mu.Lock()
+		delete(s.portlessContainers, containerID)
+		s.mu.Unlock()
+		log.Printf("Container %s was removed, cleaned up from all state maps", containerID)
+	}
+}
+
+// GetContainers returns a copy of all containers
+func (s *ContainerStore) GetContainers() []Container {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	containers := make([]Container, 0, len(s.containers))
+	for _, c := range s.containers {
+		containers = append(containers, c)
+	}
+
+	return containers
+}
+
+// containerProject returns the Docker Compose project of a container: the project from
+// its labels, else one inferred from a name following the docker-compose pattern
+// project_service_1, else "standalone"
+func containerProject(container Container) string {
+	if container.ComposeProject != "" && container.ComposeProject != "<no value>" {
+		return container.ComposeProject
+	}
+	if projectName := inferComposeProject(container.Names, container.ComposeService); projectName != "" {
+		return projectName
+	}
+	return "standalone"
+}
+
+// GetContainersByComposeProject groups containers by their Docker Compose project
+func (s *ContainerStore) GetContainersByComposeProject() map[string][]Container {
+	return groupByComposeProject(s.GetContainers())
+}
+
+// groupByComposeProject groups containers by their Docker Compose project
+func groupByComposeProject(containers []Container) map[string][]Container {
+	projects := make(map[string][]Container)
+	for _, container := range containers {
+		projectName := containerProject(container)
+		projects[projectName] = append(projects[projectName], container)
+	}
+	return projects
+}
+
+// ContainerSnapshot is the container list and its grouping by Compose project, taken
+// at the same moment so the two always agree
+type ContainerSnapshot struct {
+	Containers []Container
+	ByProject  map[string][]Container
+}
+
+// Snapshot returns the containers and their grouping by Compose project from a single
+// read of the store, so a refresh landing in between can't make them disagree
+func (s *ContainerStore) Snapshot() ContainerSnapshot {
+	containers := s.GetContainers()
+	return ContainerSnapshot{
+		Containers: containers,
+		ByProject:  groupByComposeProject(containers),
+	}
+}
+
+// GetContainersForProject returns the containers of one Docker Compose project, matched
+// the same way GetContainersByComposeProject groups them
+func (s *ContainerStore) GetContainersForProject(name string) []Container {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	
+	var containers []Container
+	for _, container := range s.containers {
+		if containerProject(container) == name {
+			containers = append(containers, container)
+		}
+	}
+	
+	return containers
+}
+
+// Healthy reports whether the store can currently talk to Docker, returning the
+// error from the most recent refresh if it failed
+func (s *ContainerStore) Healthy() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastRefreshErr
+}
+
+// sortedContainers returns containers ordered by name, then ID, for stable output
+func sortedContainers(containers []Container) []Container {
+	sort.Slice(containers, func(i, j int) bool {
+		if containers[i].Names != containers[j].Names {
+			return containers[i].Names < containers[j].Names
+		}
+		return containers[i].ID < containers[j].ID
+	})
+	return containers
+}
+
+// parseContainerTimes parses the creation and start times printed by docker inspect
+// as "{{.Created}} {{.State.StartedAt}}". Times that can't be parsed are left zero.
+func parseContainerTimes(output string) (time.Time, time.Time) {
+	fields := strings.Fields(output)
+	var times [2]time.Time
+	for i := 0; i < len(fields) && i < len(times); i++ {
+		times[i], _ = time.Parse(time.RFC3339Nano, fields[i])
+	}
+	return times[0], times[1]
+}
+
+// parseRestartCount parses the restart count docker inspect prints after the times, as
+// in "{{.Created}} {{.State.StartedAt}} {{.RestartCount}}", returning 0 if it's missing
+func parseRestartCount(output string) int {
+	fields := strings.Fields(output)
+	if len(fields) < 3 {
+		return 0
+	}
+	count, _ := strconv.Atoi(fields[2])
+	return count
+}
+
+// sortContainers orders containers by name, or by creation time for "newest"
+func sortContainers(containers []Container, sortBy string) []Container {
+	if sortBy == "newest" {
+		return newestContainersFirst(containers)
+	}
+	return sortedContainers(containers)
+}
+
+// newestContainersFirst sorts containers by creation time, newest first, falling back
+// to the name order of sortedContainers for containers created at the same time
+func newestContainersFirst(containers []Container) []Container {
+	sort.SliceStable(sortedContainers(containers), func(i, j int) bool {
+		return containers[i].CreatedAt.After(containers[j].CreatedAt)
+	})
+	return containers
+}
+
+// parseSince parses the window of a since filter such as "10m". An empty value
+// means no filter and is returned as 0.
+func parseSince(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		return 0, fmt.Errorf("invalid since %q, must be a positive duration such as 10m or 2h", value)
+	}
+	return window, nil
+}
+
+// startedWithin returns the containers started within window before now. A window of 0
+// keeps every container. Containers whose start time is unknown are left out.
+func startedWithin(containers []Container, window time.Duration, now time.Time) []Container {
+	if window <= 0 {
+		return containers
+	}
+	var recent []Container
+	for _, container := range containers {
+		if !container.StartedAt.IsZero() && now.Sub(container.StartedAt) <= window {
+			recent = append(recent, container)
+		}
+	}
+	return recent
+}
+
+// ContainerGroup is a named group of containers, such as a compose project
+type ContainerGroup struct {
+	Name       string      `json:"name" yaml:"name"`
+	Containers []Container `json:"containers" yaml:"containers"`
+}
+
+// SortedGroups orders groups alphabetically by name and the containers within
+// each group by name, so repeated renders are stable
+func SortedGroups(groups map[string][]Container) []ContainerGroup {
+	sorted := make([]ContainerGroup, 0, len(groups))
+	for name, containers := range groups {
+		sorted = append(sorted, ContainerGroup{
+			Name:       name,
+			Containers: sortedContainers(containers),
+		})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// sortGroups reorders groups already sorted by name for the dashboard's sort option:
+// projects-by-count puts the groups with the most containers first and
+// projects-by-remapped those with the most remapped ports. Ties keep name order.
+func sortGroups(groups []ContainerGroup, sortBy string) []ContainerGroup {
+	var weight func(group ContainerGroup) int
+	switch sortBy {
+	case "projects-by-count":
+		weight = func(group ContainerGroup) int { return len(group.Containers) }
+	case "projects-by-remapped":
+		weight = remappedPortCount
+	default:
+		return groups
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return weight(groups[i]) > weight(groups[j])
+	})
+	return groups
+}
+
+// remappedPortCount counts the port mappings of a group that were moved off their
+// original host port
+func remappedPortCount(group ContainerGroup) int {
+	count := 0
+	for _, container := range group.Containers {
+		for _, mapping := range container.PortMappings {
+			if mapping.OriginalPort != "" && mapping.HostPort != mapping.OriginalPort {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// GetContainersByImage groups containers by the image they were started from
+func (s *ContainerStore) GetContainersByImage() map[string][]Container {
+	return groupByImage(s.GetContainers())
+}
+
+// groupByImage groups containers by the image they were started from
+func groupByImage(containers []Container) map[string][]Container {
+	images := make(map[string][]Container)
+	for _, container := range containers {
+		images[container.Image] = append(images[container.Image], container)
+	}
+	return images
+}
+
+// GetContainersByNetwork groups containers by the networks they are attached to.
+// A container attached to several networks appears in each of their groups.
+func (s *ContainerStore) GetContainersByNetwork() map[string][]Container {
+	return groupByNetwork(s.GetContainers())
+}
+
+// groupByNetwork groups containers by the networks they are attached to, as
+// GetContainersByNetwork does
+func groupByNetwork(containers []Container) map[string][]Container {
+	networks := make(map[string][]Container)
+	for _, container := range containers {
+		attached := false
+		for _, network := range strings.Split(container.Networks, ",") {
+			network = strings.TrimSpace(network)
+			if network == "" {
+				continue
+			}
+			networks[network] = append(networks[network], container)
+			attached = true
+		}
+		
+		// Containers without networks (e.g. --network none) get their own group
+		if !attached {
+			networks["none"] = append(networks["none"], container)
+		}
+	}
+	
+	return networks
+}
+
+// RefreshContainers forces a refresh of all containers
+func (s *ContainerStore) RefreshContainers() error {
+	return s.refreshContainers()
+}
+
+// Stop stops listening for Docker events and cancels the docker commands the store
+// is waiting on. It is safe to call more than once, and before Start.
+func (s *ContainerStore) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		s.releaseAllPorts()
+		s.mu.RLock()
+		cancel := s.cancel
+		s.mu.RUnlock()
+		if cancel != nil {
+			cancel()
+		}
+	})
+}
+
+// context returns the context docker commands run under, which is cancelled when
+// the store stops. Stores that were never started use a background context.
+func (s *ContainerStore) context() context.Context {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// composeProfileArgs builds the global docker-compose flags that activate the given profiles
+func composeProfileArgs(profiles []string) []string {
+	var args []string
+	for _, profile := range profiles {
+		args = append(args, "--profile", profile)
+	}
+	return args
+}
+
+// CheckComposePortConflicts checks for port conflicts within a Docker Compose project
+// before containers are started, so we can remap them proactively. Only services that
+// are enabled by default or by one of the given profiles are considered.
+func (s *ContainerStore) CheckComposePortConflicts(composeFile string, profiles []string) (map[string]string, error) {
+	// Parse the compose file to extract port mappings
+	services, err := loadComposeServices(composeFile, profiles, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Map to store port remappings: "service:port" -> "new port"
+	portRemappings := make(map[string]string)
+
+	// Check each service for port mappings
+	for serviceName, serviceConfig := range services {
+		serviceMap, ok := serviceConfig.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		ports, ok := serviceMap["ports"].([]interface{})
+		if !ok {
+			continue
+		}
+
+		// Read any allocation overrides declared by the service
+		policy := composeServicePolicy(serviceName, serviceMap)
+
+		// Collect the protocols published on each host port. A port published for
+		// both tcp and udp (e.g. DNS) is remapped as a pair to the same new port.
+		// Ports are checked on the interface they are published on, or on all of them
+		// if the same host port is published on several.
+		var hostPorts []string
+		protocolsByPort := make(map[string][]string)
+		hostIPByPort := make(map[string]string)
+		for _, portMapping := range ports {
+			hostPort, _, protocol, ok := parseComposePort(portMapping)
+			if !ok {
+				continue
+			}
+			hostIP := composePortHostIP(portMapping)
+			if _, seen := protocolsByPort[hostPort]; !seen {
+				hostPorts = append(hostPorts, hostPort)
+				hostIPByPort[hostPort] = hostIP
+			} else if hostIPByPort[hostPort] != hostIP {
+				hostIPByPort[hostPort] = ""
+			}
+			protocolsByPort[hostPort] = append(protocolsByPort[hostPort], protocol)
+		}
+
+		// Check each host port
+		for _, hostPort := range hostPorts {
+			protocols := protocolsByPort[hostPort]
+			hostIP := hostIPByPort[hostPort]
+
+			// Check for collisions. A published range such as "8000-8005" is checked
+			// port by port and moved as a whole to a free block of the same size.
+			start, end, err := parseHostPorts(hostPort)
+			if err != nil {
+				continue
+			}
+
+			// Check if this port is already in use under any of its protocols, and
+			// stays in use rather than being released by a container shutting down.
+			// Dry runs only report, so they don't wait for that.
+			portInUse := func() bool {
+				for port := start; port <= end; port++ {
+					for _, protocol := range protocols {
+						if s.isHostPortInUse(hostIP, port, protocol) {
+							return true
+						}
+					}
+				}
+				return false
+			}
+			inUse := portInUse() && (s.dryRun || s.conflictPersists("port "+hostPort, portInUse))
+
+			// If port is in use, allocate a new one free for all of its protocols
+			if inUse {
+				// Keep the new port in the original's band if asked to, unless the
+				// service declares where its ports go
+				portPolicy := policy
+				if s.allocateFromComposeRange && policy.RangeMin == 0 && policy.FixedPort == 0 {
+					portPolicy.RangeMin, portPolicy.RangeMax = portBand(start)
+				}
+				
+				var newPort string
+				if end > start {
+					blockStart, err := s.allocateServicePortBlock(portPolicy, hostIP, end-start+1, protocols)
+					if errors.Is(err, errPortExhausted) && portPolicy != policy {
+						log.Printf("No free block of %d ports in %d-%d for service %s, using the dynamic range", 
+							end-start+1, portPolicy.RangeMin, portPolicy.RangeMax, serviceName)
+						blockStart, err = s.allocateServicePortBlock(policy, hostIP, end-start+1, protocols)
+					}
+					if err != nil {
+						s.releaseComposePorts(portRemappings)
+						return nil, fmt.Errorf("can't remap ports %s of service %s: %w", hostPort, serviceName, err)
+					}
+					newPort = fmt.Sprintf("%d-%d", blockStart, blockStart+end-start)
+				} else {
+					port, err := s.allocateServicePort(portPolicy, hostIP, protocols)
+					if errors.Is(err, errPortExhausted) && portPolicy != policy {
+						log.Printf("No free port in %d-%d for service %s, using the dynamic range", 
+							portPolicy.RangeMin, portPolicy.RangeMax, serviceName)
+						port, err = s.allocateServicePort(policy, hostIP, protocols)
+					}
+					if err != nil {
+						s.releaseComposePorts(portRemappings)
+						return nil, fmt.Errorf("can't remap port %s of service %s: %w", hostPort, serviceName, err)
+					}
+					newPort = strconv.Itoa(port)
+				}
+				portRemappings[fmt.Sprintf("%s:%s", serviceName, hostPort)] = newPort
+				if len(protocols) > 1 {
+					log.Printf("Port conflict detected for service %s: %s (%s) -> %s", 
+						serviceName, hostPort, strings.Join(protocols, "+"), newPort)
+				} else {
+					log.Printf("Port conflict detected for service %s: %s -> %s", 
+						serviceName, hostPort, newPort)
+				}
+			}
+		}
+	}
+
+	return portRemappings, nil
+}
+
+// portBand returns the band of ports sharing a port's leading digit at its order of
+// magnitude, e.g. 8000-8999 for 8080 and 10000-19999 for 18080, for keeping remapped
+// ports close to the ones a compose file's author picked
+func portBand(port int) (int, int) {
+	size := 1
+	for size*10 <= port {
+		size *= 10
+	}
+	bandMin := port / size * size
+	bandMax := bandMin + size - 1
+	if bandMax > 65535 {
+		bandMax = 65535
+	}
+	return bandMin, bandMax
+}
+
+// resolveComposeConfig returns the compose configuration as printed by docker-compose
+// config, with extends, include, interpolation and profiles already applied
+func resolveComposeConfig(composeFile string, profiles []string) ([]byte, error) {
+	output, err := composeCommand(composeFile, composeProfileArgs(profiles), "config").Output()
 	if err != nil {
-		return "", fmt.Errorf("failed to create temporary file: %v", err)
+		return nil, fmt.Errorf("%w: %v", errComposeParse, err)
+	}
+	return output, nil
+}
+
+// errNoComposeServices is returned for compose files that parse but define no services
+var errNoComposeServices = errors.New("compose file defines no services")
+
+// composeServices returns the services section of a parsed compose file. An empty
+// file, or a missing, null or empty services section, is reported as having no
+// services, while a services section that isn't a mapping is a format error.
+// Null service entries are kept and skipped by callers like any other non-mapping.
+func composeServices(composeConfig map[string]interface{}) (map[string]interface{}, error) {
+	value, exists := composeConfig["services"]
+	if !exists || value == nil {
+		return nil, errNoComposeServices
+	}
+	services, ok := value.(map[string]interface{})
+	if !ok {
+		kind := fmt.Sprintf("%T", value)
+		if _, isList := value.([]interface{}); isList {
+			kind = "a list"
+		}
+		return nil, fmt.Errorf("%w: services must be a mapping of service names, got %s", errComposeParse, kind)
+	}
+	if len(services) == 0 {
+		return nil, errNoComposeServices
+	}
+	return services, nil
+}
+
+// loadComposeServices returns the services section of a compose file. Normally the file
+// is resolved through "docker-compose config" so interpolation, profiles and extends are
+// applied. In offline mode the file is read directly, which works without Docker but only
+// applies profile filtering.
+func loadComposeServices(composeFile string, profiles []string, offline bool) (map[string]interface{}, error) {
+	var output []byte
+	var err error
+	if offline {
+		output, err = os.ReadFile(composeFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read compose file: %v", err)
+		}
+	} else {
+		output, err = resolveComposeConfig(composeFile, profiles)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Parse YAML output
+	var composeConfig map[string]interface{}
+	if err := yaml.Unmarshal(output, &composeConfig); err != nil {
+		return nil, fmt.Errorf("%w: %v", errComposeParse, err)
+	}
+
+	// Extract services
+	services, err := composeServices(composeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// docker-compose config already drops services whose profiles aren't active
+	if offline {
+		active := make(map[string]bool)
+		for _, profile := range profiles {
+			active[profile] = true
+		}
+		for serviceName, serviceConfig := range services {
+			serviceMap, ok := serviceConfig.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			serviceProfiles, ok := serviceMap["profiles"].([]interface{})
+			if !ok || len(serviceProfiles) == 0 {
+				continue
+			}
+			enabled := false
+			for _, profile := range serviceProfiles {
+				if active[fmt.Sprint(profile)] {
+					enabled = true
+					break
+				}
+			}
+			if !enabled {
+				delete(services, serviceName)
+			}
+		}
+	}
+
+	return services, nil
+}
+
+// parseComposePort extracts the host port, container port and protocol from an entry
+// of a service's ports list, returning false if the entry doesn't publish a host port
+func parseComposePort(portMapping interface{}) (string, string, string, bool) {
+	var hostPort, containerPort, protocol string
+
+	// Handle different port mapping formats
+	switch pm := portMapping.(type) {
+	case string:
+		// Format: "8080:80", "8080:80/tcp" or "127.0.0.1:8080:80"
+		_, hostPort, containerPort, protocol = splitComposePort(pm)
+	case map[string]interface{}:
+		// Format: {published: 8080, target: 80, protocol: tcp}. Older files may use
+		// other key names, and put the interface into published ("127.0.0.1:8080").
+		if published, ok := composePublishedPort(composePortField(pm, "published", "host_port", "host")); ok {
+			hostPort = published
+		}
+
+		if target, ok := composePortNumber(composePortField(pm, "target", "container_port", "container")); ok {
+			containerPort = target
+		}
+
+		protocol = "tcp" // Default protocol
+		if proto, ok := composePortField(pm, "protocol", "proto").(string); ok && proto != "" {
+			protocol = strings.ToLower(proto)
+		}
+	}
+
+	if hostPort == "" || containerPort == "" {
+		return "", "", "", false
+	}
+	return hostPort, containerPort, protocol, true
+}
+
+// composePortHostIP returns the host IP an entry of a service's ports list publishes
+// on, or "" for all interfaces
+func composePortHostIP(portMapping interface{}) string {
+	switch pm := portMapping.(type) {
+	case string:
+		hostIP, _, _, _ := splitComposePort(pm)
+		return hostIP
+	case map[string]interface{}:
+		if hostIP, ok := composePortField(pm, "host_ip").(string); ok {
+			return strings.Trim(hostIP, "[]")
+		}
+		// Older files may put the interface into published ("127.0.0.1:8080")
+		if published, ok := composePortField(pm, "published", "host_port", "host").(string); ok {
+			if i := strings.LastIndex(published, ":"); i >= 0 {
+				return strings.Trim(published[:i], "[]")
+			}
+		}
+	}
+	return ""
+}
+
+// LintIssue describes a host port in a compose file that would conflict
+type LintIssue struct {
+	Service  string `json:"service" yaml:"service"`
+	HostPort string `json:"hostPort" yaml:"hostPort"`
+	Protocol string `json:"protocol" yaml:"protocol"`
+	Reason   string `json:"reason" yaml:"reason"`
+}
+
+// LintComposePorts checks a compose file's published host ports against a list of ports
+// that are already in use, and against each other, without needing a running daemon
+func LintComposePorts(composeFile string, usedPorts []int, profiles []string, offline bool) ([]LintIssue, error) {
+	services, err := loadComposeServices(composeFile, profiles, offline)
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[int]bool)
+	for _, port := range usedPorts {
+		used[port] = true
+	}
+
+	// Iterate services in a stable order so reports are reproducible
+	serviceNames := make([]string, 0, len(services))
+	for serviceName := range services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+
+	var issues []LintIssue
+	claimedBy := make(map[string]string) // "port/protocol" -> service that declared it first
+	for _, serviceName := range serviceNames {
+		serviceMap, ok := services[serviceName].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ports, ok := serviceMap["ports"].([]interface{})
+		if !ok {
+			continue
+		}
+
+		for _, portMapping := range ports {
+			hostPort, _, protocol, ok := parseComposePort(portMapping)
+			if !ok {
+				continue
+			}
+			portInt, err := strconv.Atoi(hostPort)
+			if err != nil {
+				continue
+			}
+
+			if used[portInt] {
+				issues = append(issues, LintIssue{
+					Service:  serviceName,
+					HostPort: hostPort,
+					Protocol: protocol,
+					Reason:   "port is already in use",
+				})
+			}
+
+			key := fmt.Sprintf("%s/%s", hostPort, protocol)
+			if other, exists := claimedBy[key]; exists {
+				issues = append(issues, LintIssue{
+					Service:  serviceName,
+					HostPort: hostPort,
+					Protocol: protocol,
+					Reason:   fmt.Sprintf("port is also published by service %s", other),
+				})
+			} else {
+				claimedBy[key] = serviceName
+			}
+		}
+	}
+
+	return issues, nil
+}
+
+// splitComposePort splits a short-syntax port entry such as "127.0.0.1:8080:80/udp"
+// into its host IP, host port, container port and protocol. The IP may be an IPv6
+// address in brackets, and the protocol defaults to tcp.
+func splitComposePort(entry string) (string, string, string, string) {
+	entry = cleanComposePort(entry)
+	protocol := "tcp"
+	if i := strings.LastIndex(entry, "/"); i >= 0 {
+		protocol = strings.ToLower(entry[i+1:])
+		entry = entry[:i]
+	}
+
+	var hostIP string
+	if strings.HasPrefix(entry, "[") {
+		end := strings.Index(entry, "]:")
+		if end < 0 {
+			return "", "", "", protocol
+		}
+		hostIP, entry = entry[1:end], entry[end+2:]
+	}
+
+	parts := strings.Split(entry, ":")
+	switch {
+	case len(parts) == 2:
+		return hostIP, parts[0], parts[1], protocol
+	case len(parts) == 3 && hostIP == "":
+		return parts[0], parts[1], parts[2], protocol
+	}
+	return "", "", "", protocol
+}
+
+// cleanComposePort strips the whitespace and stray quotes that interpolation can leave
+// in a port string, e.g. " 8080 : 80 " or "'8080:80'", so it parses as "8080:80".
+// Neither can be part of a valid port entry.
+func cleanComposePort(value string) string {
+	return strings.Trim(strings.Join(strings.Fields(value), ""), `'"`)
+}
+
+// composePortField returns the first of the given keys that is set in a long-syntax
+// port entry, to accept key names used by older compose schemas
+func composePortField(entry map[string]interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		if value, ok := entry[key]; ok && value != nil {
+			return value
+		}
+	}
+	return nil
+}
+
+// composePortNumber coerces a port value from a compose file into a bare port number.
+// The value may be an int, float or string, and may carry an interface prefix such
+// as "127.0.0.1:8080".
+func composePortNumber(value interface{}) (string, bool) {
+	port, ok := portValueString(value)
+	if !ok {
+		return "", false
+	}
+	if i := strings.LastIndex(port, ":"); i >= 0 {
+		port = port[i+1:]
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return "", false
+	}
+	return port, true
+}
+
+// composePublishedPort coerces a published port like composePortNumber, but also
+// accepts a range such as "8000-8005", which is returned as is
+func composePublishedPort(value interface{}) (string, bool) {
+	if port, ok := composePortNumber(value); ok {
+		return port, true
+	}
+	port, ok := portValueString(value)
+	if !ok {
+		return "", false
+	}
+	if i := strings.LastIndex(port, ":"); i >= 0 {
+		port = port[i+1:]
+	}
+	if _, _, err := parseHostPorts(port); err != nil {
+		return "", false
+	}
+	return port, true
+}
+
+// parseHostPorts parses a host port that is either a single port or a range such as
+// "8000-8005", returning its inclusive bounds
+func parseHostPorts(hostPort string) (int, int, error) {
+	if port, err := strconv.Atoi(hostPort); err == nil {
+		return port, port, nil
+	}
+	return parsePortRange(hostPort)
+}
+
+// portValueString coerces a port number decoded from YAML into its string form.
+// Depending on quoting and interpolation, yaml.v3 yields an int, float64 or string.
+func portValueString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	case float64:
+		// Only whole numbers are valid ports
+		if v != float64(int(v)) {
+			return "", false
+		}
+		return strconv.Itoa(int(v)), true
+	case string:
+		v = cleanComposePort(v)
+		if v == "" {
+			return "", false
+		}
+		return v, true
+	}
+	return "", false
+}
+
+// servicePortPolicy holds per-service allocation overrides declared in a compose file
+type servicePortPolicy struct {
+	RangeMin  int // Lower bound of the preferred range, 0 if unset
+	RangeMax  int // Upper bound of the preferred range, 0 if unset
+	FixedPort int // Preferred host port to use when remapping, 0 if unset
+}
+
+// composeServicePolicy reads allocation overrides for a service from either an
+// x-dynamic-port-mapper extension block or com.dynamic-port-mapper.* labels:
+//
+//	x-dynamic-port-mapper:
+//	  range: "20000-20100"
+//	  port: 20005
+//
+//	labels:
+//	  com.dynamic-port-mapper.range: "20000-20100"
+//	  com.dynamic-port-mapper.port: "20005"
+func composeServicePolicy(serviceName string, serviceMap map[string]interface{}) servicePortPolicy {
+	var rangeValue, portValue string
+
+	// Labels may be written as a map or as a list of key=value strings
+	switch labels := serviceMap["labels"].(type) {
+	case map[string]interface{}:
+		rangeValue = fmt.Sprint(labels["com.dynamic-port-mapper.range"])
+		portValue = fmt.Sprint(labels["com.dynamic-port-mapper.port"])
+	case []interface{}:
+		for _, label := range labels {
+			key, value, found := strings.Cut(fmt.Sprint(label), "=")
+			if !found {
+				continue
+			}
+			switch key {
+			case "com.dynamic-port-mapper.range":
+				rangeValue = value
+			case "com.dynamic-port-mapper.port":
+				portValue = value
+			}
+		}
+	}
+
+	// The extension block takes precedence over labels
+	if ext, ok := serviceMap["x-dynamic-port-mapper"].(map[string]interface{}); ok {
+		if r, ok := ext["range"]; ok {
+			rangeValue = fmt.Sprint(r)
+		}
+		if p, ok := ext["port"]; ok {
+			portValue = fmt.Sprint(p)
+		}
+	}
+
+	var policy servicePortPolicy
+	if rangeValue != "" && rangeValue != "<nil>" {
+		minPort, maxPort, err := parsePortRange(rangeValue)
+		if err != nil {
+			log.Printf("Ignoring invalid port range %q for service %s: %v", rangeValue, serviceName, err)
+		} else {
+			policy.RangeMin = minPort
+			policy.RangeMax = maxPort
+		}
+	}
+	if portValue != "" && portValue != "<nil>" {
+		port, err := strconv.Atoi(portValue)
+		if err != nil || port < 1 || port > 65535 {
+			log.Printf("Ignoring invalid preferred port %q for service %s", portValue, serviceName)
+		} else {
+			policy.FixedPort = port
+		}
+	}
+	return policy
+}
+
+// parsePortRange parses a range in the form "MIN-MAX"
+func parsePortRange(value string) (int, int, error) {
+	minStr, maxStr, found := strings.Cut(strings.TrimSpace(value), "-")
+	if !found {
+		return 0, 0, fmt.Errorf("expected MIN-MAX")
+	}
+	minPort, err := strconv.Atoi(strings.TrimSpace(minStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid minimum port: %v", err)
+	}
+	maxPort, err := strconv.Atoi(strings.TrimSpace(maxStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid maximum port: %v", err)
+	}
+	if minPort < 1 || maxPort > 65535 || minPort > maxPort {
+		return 0, 0, fmt.Errorf("range must be within 1-65535 with MIN <= MAX")
+	}
+	return minPort, maxPort, nil
+}
+
+// allocateServicePort allocates a port for a compose service, honoring its
+// declared fixed port and range before falling back to the global range. The port
+// only needs to be free on the host IP it will be published on, but under every
+// protocol it will be published for.
+func (s *ContainerStore) allocateServicePort(policy servicePortPolicy, hostIP string, protocols []string) (int, error) {
+	if policy.FixedPort > 0 && s.isPortAvailableFor(hostIP, policy.FixedPort, protocols) && s.claimPort(policy.FixedPort) {
+		s.recordAllocation(policy.FixedPort, policy.FixedPort, policy.FixedPort, "fixed")
+		return policy.FixedPort, nil
+	}
+	if policy.RangeMin > 0 {
+		return s.allocatePortInRange(hostIP, protocols, policy.RangeMin, policy.RangeMax)
+	}
+	return s.allocateRandomPortOn(hostIP, protocols)
+}
+
+// isHostPortInUse checks whether a tracked container publishes a host port under the
+// given protocol, or a non-Docker process has it bound, where it would clash with
+// publishing the port on hostIP ("" for all interfaces)
+func (s *ContainerStore) isHostPortInUse(hostIP string, port int, protocol string) bool {
+	if s.reservedPorts[port] {
+		return true
+	}
+	
+	if s.isPortPublished(hostIP, port, protocol) {
+		return true
+	}
+	
+	if protocol == "udp" {
+		return !s.remoteDocker && !isHostUDPPortAvailable(hostIP, port)
+	}
+	return !s.isHostPortFree(hostIP, port)
+}
+
+// isPortPublished reports whether a tracked container publishes a host port on a host
+// IP overlapping the given one, under the given protocol or, for "", any protocol
+func (s *ContainerStore) isPortPublished(hostIP string, port int, protocol string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, container := range s.containers {
+		for _, mapping := range container.PortMappings {
+			existingPort, _ := strconv.Atoi(mapping.HostPort)
+			if existingPort == port && (protocol == "" || mapping.Protocol == protocol) && hostIPsOverlap(mapping.HostIP, hostIP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isHostUDPPortAvailable checks if a UDP port can be bound on the host IP, or on all
+// interfaces for ""
+func isHostUDPPortAvailable(hostIP string, port int) bool {
+	conn, err := net.ListenPacket("udp", bindAddress(hostIP, port))
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// allocateServicePortBlock finds size consecutive host ports for a service that are
+// free under every protocol they will be published for, within the service's declared
+// range or else the global one, and returns the first of them
+func (s *ContainerStore) allocateServicePortBlock(policy servicePortPolicy, hostIP string, size int, protocols []string) (int, error) {
+	minPort, maxPort := s.portRangeMin, s.portRangeMax
+	if policy.RangeMin > 0 {
+		minPort, maxPort = policy.RangeMin, policy.RangeMax
+	}
+	lastStart := maxPort - size + 1
+	if lastStart < minPort {
+		return 0, fmt.Errorf("%w: range %d-%d is smaller than %d ports", errPortExhausted, minPort, maxPort, size)
+	}
+
+	// A free block is claimed as a whole, or not at all
+	blockFree := func(start int) bool {
+		for port := start; port < start+size; port++ {
+			if !s.isPortAvailableFor(hostIP, port, protocols) {
+				return false
+			}
+		}
+		for port := start; port < start+size; port++ {
+			if !s.claimPort(port) {
+				for claimed := start; claimed < port; claimed++ {
+					s.releasePort(claimed)
+				}
+				return false
+			}
+		}
+		s.recordAllocation(start, minPort, maxPort, fmt.Sprintf("block of %d", size))
+		return true
+	}
+
+	for i := 0; i < 100; i++ { // Try up to 100 random blocks first, as for single ports
+		start := rand.Intn(lastStart-minPort+1) + minPort
+		if blockFree(start) {
+			return start, nil
+		}
+	}
+	for start := minPort; start <= lastStart; start++ {
+		if blockFree(start) {
+			return start, nil
+		}
+	}
+	return 0, fmt.Errorf("%w for a block of %d in range %d-%d", errPortExhausted, size, minPort, maxPort)
+}
+
+// GenerateRemappedComposeFile creates a new Docker Compose file with remapped ports.
+// It rewrites the resolved configuration rather than the original file, so ports that
+// services get through extends or included files are remapped too. docker-compose
+// config drops the comments and layout of the original file, so the output only keeps
+// the order of the resolved configuration; the rewrite works on its YAML node tree to
+// note the original host port next to every port it changes, e.g. "10034:80" # dpm: was 8080.
+func (s *ContainerStore) GenerateRemappedComposeFile(composeFile string, profiles []string, remappings map[string]string) (string, error) {
+	// Read the resolved compose configuration
+	origContent, err := resolveComposeConfig(composeFile, profiles)
+	if err != nil {
+		return "", err
 	}
 
-	// Write the new content
-	if _, err := tmpFile.Write(newContent); err != nil {
-		tmpFile.Close()
-		os.Remove(tmpFile.Name())
+	// Parse YAML, checking its services the same way as everywhere else
+	var composeConfig map[string]interface{}
+	if err := yaml.Unmarshal(origContent, &composeConfig); err != nil {
+		return "", fmt.Errorf("%w: %v", errComposeParse, err)
+	}
+	if _, err := composeServices(composeConfig); err != nil {
+		return "", err
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(origContent, &document); err != nil {
+		return "", fmt.Errorf("%w: %v", errComposeParse, err)
+	}
+	if len(document.Content) == 0 {
+		return "", errNoComposeServices
+	}
+	services := yamlMappingValue(document.Content[0], "services")
+
+	// Apply port remappings
+	remapComposePorts(services, remappings)
+
+	// Generate the new YAML
+	newContent, err := yaml.Marshal(&document)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate updated compose file: %v", err)
+	}
+
+	// Write the new compose config to this run's temporary directory
+	remappedFile, err := remappedComposePath(composeFile)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(remappedFile, newContent, 0o600); err != nil {
+		os.Remove(remappedFile)
 		return "", fmt.Errorf("failed to write updated compose file: %v", err)
 	}
+	return remappedFile, nil
+}
+
+// remapComposePorts applies remappings, keyed service:oldHostPort, to the services
+// node of a compose file, leaving a comment with the original host port on every
+// port it changes
+func remapComposePorts(services *yaml.Node, remappings map[string]string) {
+	for servicePortKey, newPort := range remappings {
+		parts := strings.Split(servicePortKey, ":")
+		if len(parts) != 2 {
+			continue
+		}
+		serviceName := parts[0]
+		oldPort := parts[1]
+		comment := "# dpm: was " + oldPort
+
+		// Get the service's ports
+		ports := yamlMappingValue(yamlMappingValue(services, serviceName), "ports")
+		if ports == nil || ports.Kind != yaml.SequenceNode {
+			continue
+		}
+
+		// Replace the port in each mapping
+		for _, portMapping := range ports.Content {
+			switch portMapping.Kind {
+			case yaml.ScalarNode:
+				// Format: "8080:80", "8080:80/tcp" or "127.0.0.1:8080:80", keeping
+				// everything but the host port as it was
+				pm := cleanComposePort(portMapping.Value)
+				if _, hostPort, _, _ := splitComposePort(pm); hostPort == oldPort {
+					value := pm
+					if strings.HasPrefix(pm, oldPort+":") {
+						value = newPort + strings.TrimPrefix(pm, oldPort)
+					} else if at := strings.Index(pm, ":"+oldPort+":"); at >= 0 {
+						value = pm[:at+1] + newPort + pm[at+1+len(oldPort):]
+					}
+					if value != pm {
+						portMapping.Value = value
+						portMapping.LineComment = comment
+					}
+				}
+			case yaml.MappingNode:
+				// Format: {published: 8080, target: 80, protocol: tcp}, or one of the
+				// older key names, possibly with an interface prefix
+				for _, key := range []string{"published", "host_port", "host"} {
+					valueNode := yamlMappingValue(portMapping, key)
+					if valueNode == nil {
+						continue
+					}
+					var value interface{}
+					if err := valueNode.Decode(&value); err != nil {
+						break
+					}
+					if published, ok := composePublishedPort(value); ok && published == oldPort {
+						// Keep quoted values quoted, everything numeric becomes an int
+						if str, isString := value.(string); isString {
+							valueNode.Value = strings.TrimSuffix(cleanComposePort(str), oldPort) + newPort
+						} else {
+							valueNode.Value = newPort
+							valueNode.Tag = "!!int"
+						}
+						valueNode.LineComment = comment
+					}
+					break
+				}
+			}
+		}
+	}
+}
 
-	tmpFile.Close()
-	return tmpFile.Name(), nil
-} 
+// yamlMappingValue returns the value node of a key in a YAML mapping node, or nil if
+// the node isn't a mapping or doesn't have the key
+func yamlMappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,2586 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestStartStopIdempotent(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	if calls := docker.calls(); len(calls) != 0 {
+		t.Fatalf("NewContainerStore ran docker %v, want it to wait for Start", calls)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Start(context.Background()); err != nil {
+			t.Fatalf("Start #%d failed: %v", i+1, err)
+		}
+	}
+	if containers := s.GetContainers(); len(containers) != 1 || containers[0].ID != "aaaa" {
+		t.Errorf("store holds %+v after Start, want the running container", containers)
+	}
+
+	s.Stop()
+	s.Stop()
+	select {
+	case <-s.context().Done():
+	default:
+		t.Error("the context docker commands run under is still live after Stop")
+	}
+}
+
+func TestStopInterruptsRemap(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	docker.hangStops()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.ForceRemap("aaaa")
+		errs <- err
+	}()
+	waitFor(t, "docker stop to be run", func() bool {
+		return len(docker.changes()) > 0
+	})
+	s.Stop()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("ForceRemap returned %v, want it interrupted by Stop", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop didn't interrupt the hanging docker stop")
+	}
+	if got, want := callNames(docker.changes()), []string{"stop"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("docker was called with %v, want the remap abandoned after the stop", got)
+	}
+}
+
+func TestStartAfterStop(t *testing.T) {
+	s := NewContainerStore(StoreOptions{})
+	s.Stop()
+	if err := s.Start(context.Background()); !errors.Is(err, errStoreStopped) {
+		t.Fatalf("Start after Stop returned %v, want errStoreStopped", err)
+	}
+}
+
+func TestRecreateWithNullInspectFields(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{
+		ID:         "aaaa",
+		Name:       "web",
+		Image:      "nginx",
+		Ports:      []string{"8080:80/tcp"},
+		Config:     map[string]interface{}{"Env": nil, "Cmd": nil, "Entrypoint": nil, "Labels": nil, "User": nil, "WorkingDir": nil},
+		HostConfig: map[string]interface{}{"NetworkMode": nil, "RestartPolicy": nil, "Binds": nil, "ExtraHosts": nil},
+	})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+
+	s.evaluateContainer("aaaa")
+
+	changes := docker.changes()
+	if got, want := callNames(changes), []string{"stop", "rename", "run", "rm"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("docker was called with %v, want %v", got, want)
+	}
+	if run := changes[2]; run[len(run)-1] != "nginx" {
+		t.Errorf("recreated container runs %v, want the nginx image", run)
+	}
+}
+
+func TestFirstPortBinding(t *testing.T) {
+	tests := []struct {
+		name     string
+		bindings interface{}
+		wantIP   string
+		wantPort string
+		wantOK   bool
+	}{
+		{"null", nil, "", "", false},
+		{"empty", []interface{}{}, "", "", false},
+		{"not an object", []interface{}{"8080"}, "", "", false},
+		{"no host port", []interface{}{map[string]interface{}{"HostIp": ""}}, "", "", false},
+		{"host port", []interface{}{map[string]interface{}{"HostIp": "127.0.0.1", "HostPort": "8080"}}, "127.0.0.1", "8080", true},
+	}
+	for _, tt := range tests {
+		ip, port, ok := firstPortBinding(tt.bindings)
+		if ip != tt.wantIP || port != tt.wantPort || ok != tt.wantOK {
+			t.Errorf("%s: firstPortBinding = %q, %q, %v, want %q, %q, %v", tt.name, ip, port, ok, tt.wantIP, tt.wantPort, tt.wantOK)
+		}
+	}
+}
+
+func TestGenerateRemappedComposeFileExtends(t *testing.T) {
+	docker := newFakeDocker(t)
+	dir := t.TempDir()
+	composeFile := filepath.Join(dir, "docker-compose.yml")
+	if err := os.WriteFile(filepath.Join(dir, "base.yml"), []byte("services:\n  base:\n    image: nginx\n    ports:\n      - \"8080:80\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(composeFile, []byte("services:\n  web:\n    extends:\n      file: base.yml\n      service: base\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The port only shows up once Compose resolves extends
+	docker.setComposeConfig(`name: app
+services:
+  web:
+    image: nginx
+    ports:
+      - mode: ingress
+        target: 80
+        published: "8080"
+        protocol: tcp
+`)
+	s := NewContainerStore(StoreOptions{})
+
+	remapped, err := s.GenerateRemappedComposeFile(composeFile, nil, map[string]string{"web:8080": "20000"})
+	if err != nil {
+		t.Fatalf("GenerateRemappedComposeFile failed: %v", err)
+	}
+	data, err := os.ReadFile(remapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config struct {
+		Services map[string]struct {
+			Ports []map[string]interface{} `yaml:"ports"`
+		} `yaml:"services"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		t.Fatalf("invalid remapped file: %v\n%s", err, data)
+	}
+	ports := config.Services["web"].Ports
+	if len(ports) != 1 || fmt.Sprint(ports[0]["published"]) != "20000" {
+		t.Errorf("web publishes %v, want the inherited port moved to 20000:\n%s", ports, data)
+	}
+}
+
+func TestGenerateRemappedComposeFileComments(t *testing.T) {
+	newFakeDocker(t)
+	composeFile := filepath.Join(t.TempDir(), "docker-compose.yml")
+	const compose = `services:
+  web:
+    image: nginx
+    ports:
+      - "8080:80"
+      - "9090:90"
+`
+	if err := os.WriteFile(composeFile, []byte(compose), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewContainerStore(StoreOptions{})
+
+	remapped, err := s.GenerateRemappedComposeFile(composeFile, nil, map[string]string{"web:8080": "10034"})
+	if err != nil {
+		t.Fatalf("GenerateRemappedComposeFile failed: %v", err)
+	}
+	data, err := os.ReadFile(remapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"10034:80" # dpm: was 8080`) {
+		t.Errorf("remapped port isn't commented:\n%s", data)
+	}
+	if strings.Count(string(data), "# dpm:") != 1 {
+		t.Errorf("the unchanged port is commented too:\n%s", data)
+	}
+}
+
+func TestRemapComposePortsComments(t *testing.T) {
+	const compose = `services:
+  web:
+    ports:
+      - "8080:80"
+      - "9090:90"
+  db:
+    ports:
+      - published: 5432
+        target: 5432
+`
+	var document yaml.Node
+	if err := yaml.Unmarshal([]byte(compose), &document); err != nil {
+		t.Fatal(err)
+	}
+	remapComposePorts(yamlMappingValue(document.Content[0], "services"), map[string]string{
+		"web:8080": "10034",
+		"db:5432":  "10035",
+	})
+	out, err := yaml.Marshal(&document)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{`"10034:80" # dpm: was 8080`, `published: 10035 # dpm: was 5432`} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("remapped file lacks %s:\n%s", want, out)
+		}
+	}
+	if strings.Count(string(out), "# dpm:") != 2 {
+		t.Errorf("unchanged ports are commented too:\n%s", out)
+	}
+}
+
+func TestParseComposePort(t *testing.T) {
+	tests := []struct {
+		entry    string
+		hostPort string
+	}{
+		{"{published: 8080, target: 80}", "8080"},
+		{"{published: 8080.0, target: 80}", "8080"},
+		{`{published: "8080", target: 80}`, "8080"},
+	}
+	for _, tt := range tests {
+		var entry interface{}
+		if err := yaml.Unmarshal([]byte(tt.entry), &entry); err != nil {
+			t.Fatal(err)
+		}
+		hostPort, containerPort, protocol, ok := parseComposePort(entry)
+		if !ok || hostPort != tt.hostPort || containerPort != "80" || protocol != "tcp" {
+			t.Errorf("parseComposePort(%s) = %q, %q, %q, %v, want %q, 80, tcp, true", tt.entry, hostPort, containerPort, protocol, ok, tt.hostPort)
+		}
+	}
+}
+
+func TestParseComposePortWhitespace(t *testing.T) {
+	tests := []struct {
+		entry    string
+		hostPort string
+		protocol string
+	}{
+		{`" 8080 : 80 "`, "8080", "tcp"},
+		{`'8080:80'`, "8080", "tcp"},
+		{`"8080 :80/udp"`, "8080", "udp"},
+		{`" 127.0.0.1 : 8080 : 80 "`, "8080", "tcp"},
+	}
+	for _, tt := range tests {
+		var entry interface{}
+		if err := yaml.Unmarshal([]byte(tt.entry), &entry); err != nil {
+			t.Fatal(err)
+		}
+		hostPort, containerPort, protocol, ok := parseComposePort(entry)
+		if !ok || hostPort != tt.hostPort || containerPort != "80" || protocol != tt.protocol {
+			t.Errorf("parseComposePort(%s) = %q, %q, %q, %v, want %q, 80, %s, true", tt.entry, hostPort, containerPort, protocol, ok, tt.hostPort, tt.protocol)
+		}
+	}
+}
+
+func TestRemapComposePortWithWhitespace(t *testing.T) {
+	newFakeDocker(t)
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	port := strconv.Itoa(busy.Addr().(*net.TCPAddr).Port)
+
+	composeFile := filepath.Join(t.TempDir(), "docker-compose.yml")
+	compose := "services:\n  web:\n    image: nginx\n    ports:\n      - \" " + port + " : 80 \"\n"
+	if err := os.WriteFile(composeFile, []byte(compose), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	remappings, err := s.CheckComposePortConflicts(composeFile, nil)
+	if err != nil {
+		t.Fatalf("CheckComposePortConflicts failed: %v", err)
+	}
+	newPort, remapped := remappings["web:"+port]
+	if !remapped {
+		t.Fatalf("remapped %v, want the busy port %s with whitespace around it moved", remappings, port)
+	}
+
+	remappedFile, err := s.GenerateRemappedComposeFile(composeFile, nil, remappings)
+	if err != nil {
+		t.Fatalf("GenerateRemappedComposeFile failed: %v", err)
+	}
+	defer os.Remove(remappedFile)
+	services, err := loadComposeServices(remappedFile, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := services["web"].(map[string]interface{})["ports"].([]interface{})[0]
+	if hostPort, containerPort, _, ok := parseComposePort(entry); !ok || hostPort != newPort || containerPort != "80" {
+		t.Errorf("remapped file publishes %v, want %s:80", entry, newPort)
+	}
+}
+
+func TestParseComposePortMapVariants(t *testing.T) {
+	tests := []struct {
+		entry    string
+		hostPort string
+		protocol string
+	}{
+		{`{published: "127.0.0.1:8080", target: 80}`, "8080", "tcp"},
+		{`{published: 8080, target: "80", protocol: udp}`, "8080", "udp"},
+		{`{published: 8080, target: 80.0}`, "8080", "tcp"},
+		{`{host_port: 8080, container_port: 80}`, "8080", "tcp"},
+		{`{host: "8080", container: "80"}`, "8080", "tcp"},
+		{`{published: "8000-8005", target: 80}`, "8000-8005", "tcp"},
+	}
+	for _, tt := range tests {
+		var entry interface{}
+		if err := yaml.Unmarshal([]byte(tt.entry), &entry); err != nil {
+			t.Fatal(err)
+		}
+		hostPort, containerPort, protocol, ok := parseComposePort(entry)
+		if !ok || hostPort != tt.hostPort || containerPort != "80" || protocol != tt.protocol {
+			t.Errorf("parseComposePort(%s) = %q, %q, %q, %v, want %q, 80, %q, true", tt.entry, hostPort, containerPort, protocol, ok, tt.hostPort, tt.protocol)
+		}
+	}
+
+	for _, invalid := range []string{`{target: 80}`, `{published: web, target: 80}`, `{published: 8080, target: http}`} {
+		var entry interface{}
+		if err := yaml.Unmarshal([]byte(invalid), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, ok := parseComposePort(entry); ok {
+			t.Errorf("parseComposePort(%s) accepted an invalid entry", invalid)
+		}
+	}
+}
+
+func TestRemapComposePortsOlderKeys(t *testing.T) {
+	const compose = `services:
+  web:
+    ports:
+      - host_port: "127.0.0.1:8080"
+        container_port: 80
+  api:
+    ports:
+      - host: 8081
+        container: 80
+`
+	var document yaml.Node
+	if err := yaml.Unmarshal([]byte(compose), &document); err != nil {
+		t.Fatal(err)
+	}
+	remapComposePorts(yamlMappingValue(document.Content[0], "services"), map[string]string{
+		"web:8080": "10034",
+		"api:8081": "10035",
+	})
+	out, err := yaml.Marshal(&document)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{`host_port: "127.0.0.1:10034" # dpm: was 8080`, `host: 10035 # dpm: was 8081`} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("remapped file lacks %s:\n%s", want, out)
+		}
+	}
+}
+
+func TestRemapComposePortsFloatAndString(t *testing.T) {
+	const compose = `services:
+  web:
+    ports:
+      - published: 8080.0
+        target: 80
+  api:
+    ports:
+      - published: "8081"
+        target: 80
+`
+	var document yaml.Node
+	if err := yaml.Unmarshal([]byte(compose), &document); err != nil {
+		t.Fatal(err)
+	}
+	remapComposePorts(yamlMappingValue(document.Content[0], "services"), map[string]string{
+		"web:8080": "10034",
+		"api:8081": "10035",
+	})
+	out, err := yaml.Marshal(&document)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{`published: 10034 # dpm: was 8080`, `published: "10035" # dpm: was 8081`} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("remapped file lacks %s:\n%s", want, out)
+		}
+	}
+}
+
+func TestAllocateSkipsWebServerPort(t *testing.T) {
+	// The web server's port sits in the middle of the range
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20002, ReservedPorts: []int{20001}})
+	var allocated []int
+	for {
+		port, err := s.allocateRandomPort()
+		if err != nil {
+			if !errors.Is(err, errPortExhausted) {
+				t.Fatalf("allocateRandomPort failed: %v", err)
+			}
+			break
+		}
+		allocated = append(allocated, port)
+	}
+	sort.Ints(allocated)
+	if want := []int{20000, 20002}; !reflect.DeepEqual(allocated, want) {
+		t.Errorf("allocated %v before the range ran out, want %v", allocated, want)
+	}
+}
+
+func TestAllocateSkipsBlocklist(t *testing.T) {
+	blocked, err := parsePortList("20001, 20003-20004")
+	if err != nil {
+		t.Fatalf("parsePortList failed: %v", err)
+	}
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20005, ReservedPorts: blocked})
+	for _, port := range blocked {
+		if s.isPortAvailable(port) {
+			t.Errorf("blocklisted port %d is available", port)
+		}
+	}
+
+	var allocated []int
+	for {
+		port, err := s.allocateRandomPort()
+		if err != nil {
+			break
+		}
+		allocated = append(allocated, port)
+	}
+	sort.Ints(allocated)
+	if want := []int{20000, 20002, 20005}; !reflect.DeepEqual(allocated, want) {
+		t.Errorf("allocated %v before the range ran out, want %v", allocated, want)
+	}
+}
+
+func TestAllocatePrefersPreferredPorts(t *testing.T) {
+	// 20999 is outside the range, and 20020 is used by a container
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20100, PreferredPorts: []int{20999, 20020, 20010, 20030}})
+	s.containers["a"] = Container{ID: "a", Names: "web", PortMappings: []PortMapping{
+		{ContainerPort: "80", HostPort: "20020", Protocol: "tcp"},
+	}}
+
+	var allocated []int
+	for i := 0; i < 3; i++ {
+		port, err := s.allocateRandomPort()
+		if err != nil {
+			t.Fatalf("allocateRandomPort failed: %v", err)
+		}
+		allocated = append(allocated, port)
+	}
+	if allocated[0] != 20010 || allocated[1] != 20030 {
+		t.Errorf("allocated %v, want the free preferred ports 20010 and 20030 first", allocated)
+	}
+	if port := allocated[2]; port < 20000 || port > 20100 || port == 20010 || port == 20020 || port == 20030 {
+		t.Errorf("once the preferred ports ran out, allocated %d, want another port in the range", port)
+	}
+}
+
+func TestIsHostPortFreeProbeDial(t *testing.T) {
+	// A listener on 127.0.0.1 doesn't stop a bind on 127.0.0.2, but it does accept
+	// connections, which only the probe notices
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+	if !isHostPortAvailable("127.0.0.2", port) {
+		t.Skip("127.0.0.2 can't be bound on this host")
+	}
+
+	for _, probe := range []bool{false, true} {
+		s := NewContainerStore(StoreOptions{ProbeDial: probe})
+		if free := s.isHostPortFree("127.0.0.2", port); free == probe {
+			t.Errorf("with probing %v, port %d used on another interface is free: %v", probe, port, free)
+		}
+	}
+}
+
+func TestPortAvailableOnOtherInterface(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	s := NewContainerStore(StoreOptions{})
+	s.containers["a"] = Container{ID: "a", Names: "web", PortMappings: []PortMapping{
+		{ContainerPort: "80", HostIP: "127.0.0.1", HostPort: "10500", Protocol: "tcp"},
+	}}
+	tests := []struct {
+		hostIP string
+		port   int
+		want   bool
+	}{
+		{"127.0.0.1", port, false},
+		{"", port, false},
+		{"127.0.0.2", port, true},
+		{"127.0.0.1", 10500, false},
+		{"0.0.0.0", 10500, false},
+		{"127.0.0.2", 10500, true},
+	}
+	for _, tt := range tests {
+		if got := s.isPortAvailableOn(tt.hostIP, tt.port); got != tt.want {
+			t.Errorf("isPortAvailableOn(%q, %d) = %v, want %v", tt.hostIP, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestOtherContainerUsingPortHostIP(t *testing.T) {
+	s := NewContainerStore(StoreOptions{})
+	s.containers["a"] = Container{ID: "a", Names: "web", PortMappings: []PortMapping{
+		{ContainerPort: "80", HostIP: "127.0.0.1", HostPort: "10500", Protocol: "tcp"},
+	}}
+
+	tests := []struct {
+		hostIP string
+		want   bool
+	}{
+		{"127.0.0.1", true},
+		{"", true},
+		{"0.0.0.0", true},
+		{"127.0.0.2", false},
+	}
+	for _, tt := range tests {
+		if _, used := s.otherContainerUsingPort("b", tt.hostIP, 10500, "tcp"); used != tt.want {
+			t.Errorf("otherContainerUsingPort on %q = %v, want %v", tt.hostIP, used, tt.want)
+		}
+	}
+
+	// Another address doesn't collide, so the port is kept
+	needsRemap, newPort, reason := s.checkPortCollision("b", "127.0.0.2", "10500", "tcp", false)
+	if needsRemap || newPort != "10500" || reason != reasonUnchanged {
+		t.Errorf("checkPortCollision on another address = %v, %s, %q, want the port kept", needsRemap, newPort, reason)
+	}
+}
+
+func TestEvaluateContainerNeedsRemap(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+
+	s.evaluateContainer("aaaa")
+
+	changes := docker.changes()
+	if got, want := callNames(changes), []string{"stop", "rename", "run", "rm"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("docker was called with %v, want %v", got, want)
+	}
+	run := changes[2]
+	if names := flagValues(run, "--name"); !reflect.DeepEqual(names, []string{"web"}) {
+		t.Errorf("recreated container named %v, want web", names)
+	}
+	if labels := flagValues(run, "--label"); !contains(labels, "com.dynamic-port-mapper.original-port.80-tcp=8080") {
+		t.Errorf("recreated container lacks the original port label: %v", labels)
+	}
+
+	containers := s.GetContainers()
+	if len(containers) != 1 || len(containers[0].PortMappings) != 1 {
+		t.Fatalf("store holds %+v, want the recreated container", containers)
+	}
+	mapping := containers[0].PortMappings[0]
+	port, _ := strconv.Atoi(mapping.HostPort)
+	if port < 20000 || port > 20999 || mapping.OriginalPort != "8080" {
+		t.Errorf("port 80 is published on %s (originally %s), want a port in 20000-20999 (originally 8080)", mapping.HostPort, mapping.OriginalPort)
+	}
+	if publish := flagValues(run, "-p"); !reflect.DeepEqual(publish, []string{mapping.HostPort + ":80/tcp"}) {
+		t.Errorf("recreated container publishes %v, want %s:80/tcp", publish, mapping.HostPort)
+	}
+}
+
+func TestEvaluateContainerAlreadyProcessed(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{
+		ID:     "aaaa",
+		Name:   "web",
+		Ports:  []string{"8080:80/tcp"},
+		Labels: map[string]string{"com.dynamic-port-mapper.has-dynamic-ports": "true"},
+	})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+
+	s.evaluateContainer("aaaa")
+
+	if changes := docker.changes(); len(changes) != 0 {
+		t.Fatalf("docker was called with %v, want no changes", changes)
+	}
+	containers := s.GetContainers()
+	if len(containers) != 1 || containers[0].ID != "aaaa" || containers[0].PortMappings[0].HostPort != "8080" {
+		t.Errorf("store holds %+v, want the container unchanged on 8080", containers)
+	}
+}
+
+// contains reports whether a list holds a value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRestoreOriginal(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	s.evaluateContainer("aaaa")
+	containers := s.GetContainers()
+	if len(containers) != 1 || containers[0].ID == "aaaa" {
+		t.Fatalf("store holds %+v, want the remapped container", containers)
+	}
+
+	restored, err := s.RestoreOriginal(containers[0].ID)
+	if err != nil {
+		t.Fatalf("RestoreOriginal failed: %v", err)
+	}
+	changes := docker.changes()
+	run := changes[len(changes)-2]
+	if run[0] != "run" {
+		t.Fatalf("docker was called with %v, want the container recreated", changes)
+	}
+	if publish := flagValues(run, "-p"); !reflect.DeepEqual(publish, []string{"8080:80/tcp"}) {
+		t.Errorf("restored container publishes %v, want 8080:80/tcp", publish)
+	}
+	for _, label := range flagValues(run, "--label") {
+		if strings.HasPrefix(label, "com.dynamic-port-mapper.") && label != restoredLabel+"=true" {
+			t.Errorf("restored container keeps the label %s", label)
+		}
+	}
+	if !contains(flagValues(run, "--label"), restoredLabel+"=true") {
+		t.Errorf("restored container has labels %v, want it marked as restored", flagValues(run, "--label"))
+	}
+	if len(restored.PortMappings) != 1 || restored.PortMappings[0].HostPort != "8080" {
+		t.Errorf("restored container has %+v, want port 80 back on 8080", restored.PortMappings)
+	}
+	s.mu.RLock()
+	processed := s.processedContainers[restored.ID]
+	s.mu.RUnlock()
+	if processed {
+		t.Error("restored container is still marked as processed")
+	}
+}
+
+func TestRestoredContainerIsLeftAlone(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	s.evaluateContainer("aaaa")
+	restored, err := s.RestoreOriginal(s.GetContainers()[0].ID)
+	if err != nil {
+		t.Fatalf("RestoreOriginal failed: %v", err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer s.Stop()
+	before := len(docker.changes())
+
+	// The running store sees the restored container start, and looks at it
+	s.processEvents(strings.NewReader(fmt.Sprintf(`{"status":"start","id":"%s","Type":"container","Action":"start","timeNano":1}`+"\n", restored.ID)))
+	evaluated := func() bool {
+		inspected := false
+		for _, args := range docker.calls() {
+			if reflect.DeepEqual(args, []string{"inspect", "--format", "{{json .}}", restored.ID}) {
+				inspected = true
+			} else if inspected && args[0] == "ps" {
+				return true
+			}
+		}
+		return false
+	}
+	waitFor(t, "the restored container to be evaluated", evaluated)
+
+	if changes := docker.changes()[before:]; len(changes) > 0 {
+		t.Errorf("restored container was changed with %v", callNames(changes))
+	}
+	if containers := s.GetContainers(); len(containers) != 1 || containers[0].PortMappings[0].HostPort != "8080" {
+		t.Errorf("store holds %+v, want the container kept on 8080", containers)
+	}
+}
+
+func TestRestoreOriginalSkipsExcludedContainer(t *testing.T) {
+	docker := newFakeDocker(t)
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, ExcludedProjects: map[string]bool{"shop": true}})
+	s.containers["aaaa"] = Container{ID: "aaaa", Names: "shop-web-1", ComposeProject: "shop", PortMappings: []PortMapping{
+		{ContainerPort: "80", Protocol: "tcp", HostPort: "20005", OriginalPort: "8080"},
+	}}
+
+	if _, err := s.RestoreOriginal("aaaa"); !errors.Is(err, errContainerExcluded) {
+		t.Errorf("RestoreOriginal = %v, want %v", err, errContainerExcluded)
+	}
+	if changes := docker.changes(); len(changes) > 0 {
+		t.Errorf("excluded container was changed with %v", changes)
+	}
+}
+
+func TestRemapUsesBindHostIP(t *testing.T) {
+	docker := newFakeDocker(t)
+	// A port on all interfaces and one already bound to another address both move
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp", "10.0.0.5:8443:443/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, BindHostIP: "127.0.0.1"})
+
+	s.evaluateContainer("aaaa")
+
+	for _, args := range docker.changes() {
+		if args[0] != "run" {
+			continue
+		}
+		publish := flagValues(args, "-p")
+		if len(publish) != 2 {
+			t.Fatalf("recreated container publishes %v, want both ports", publish)
+		}
+		for _, spec := range publish {
+			if !strings.HasPrefix(spec, "127.0.0.1:") || strings.Contains(spec, ":8080:") || strings.Contains(spec, ":8443:") {
+				t.Errorf("recreated container publishes %s, want a new port on 127.0.0.1", spec)
+			}
+		}
+		return
+	}
+	t.Fatal("container wasn't recreated")
+}
+
+func TestRemapKeepsHostIP(t *testing.T) {
+	for _, tc := range []struct{ hostIP, publish string }{
+		{"127.0.0.1", "127.0.0.1"},
+		{"::1", "[::1]"},
+	} {
+		t.Run(tc.hostIP, func(t *testing.T) {
+			docker := newFakeDocker(t)
+			docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{tc.publish + ":8080:80/tcp"}})
+			s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+
+			s.evaluateContainer("aaaa")
+
+			changes := docker.changes()
+			if got, want := callNames(changes), []string{"stop", "rename", "run", "rm"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("docker was called with %v, want %v", got, want)
+			}
+			containers := s.GetContainers()
+			if len(containers) != 1 || len(containers[0].PortMappings) != 1 {
+				t.Fatalf("store holds %+v, want the recreated container", containers)
+			}
+			mapping := containers[0].PortMappings[0]
+			if publish := flagValues(changes[2], "-p"); !reflect.DeepEqual(publish, []string{tc.publish + ":" + mapping.HostPort + ":80/tcp"}) {
+				t.Errorf("recreated container publishes %v, want %s:%s:80/tcp", publish, tc.publish, mapping.HostPort)
+			}
+			if labels := flagValues(changes[2], "--label"); !contains(labels, "com.dynamic-port-mapper.original-host-ip.80-tcp="+tc.hostIP) {
+				t.Errorf("recreated container lacks the original host IP label: %v", labels)
+			}
+
+			restored, err := s.RestoreOriginal(containers[0].ID)
+			if err != nil {
+				t.Fatalf("RestoreOriginal failed: %v", err)
+			}
+			changes = docker.changes()
+			run := changes[len(changes)-2]
+			if publish := flagValues(run, "-p"); !reflect.DeepEqual(publish, []string{tc.publish + ":8080:80/tcp"}) {
+				t.Errorf("restored container publishes %v, want %s:8080:80/tcp", publish, tc.publish)
+			}
+			for _, label := range flagValues(run, "--label") {
+				if strings.HasPrefix(label, "com.dynamic-port-mapper.original-host-ip.") {
+					t.Errorf("restored container keeps the original host IP label %s", label)
+				}
+			}
+			if len(restored.PortMappings) != 1 || restored.PortMappings[0].HostPort != "8080" {
+				t.Errorf("restored container has %+v, want port 80 back on 8080", restored.PortMappings)
+			}
+		})
+	}
+}
+
+func TestParseRestartCount(t *testing.T) {
+	tests := []struct {
+		output string
+		want   int
+	}{
+		{"2024-05-01T12:00:00.123456789Z 2024-05-01T12:05:00.5Z 3\n", 3},
+		{"2024-05-01T12:00:00Z 2024-05-01T12:05:00Z 0", 0},
+		{"2024-05-01T12:00:00Z 2024-05-01T12:05:00Z", 0},
+		{"2024-05-01T12:00:00Z 2024-05-01T12:05:00Z <no value>", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRestartCount(tt.output); got != tt.want {
+			t.Errorf("parseRestartCount(%q) = %d, want %d", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestRefreshRestartCount(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}, RestartCount: 4})
+	s := NewContainerStore(StoreOptions{})
+
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	containers := s.GetContainers()
+	if len(containers) != 1 {
+		t.Fatalf("store holds %+v, want one container", containers)
+	}
+	if containers[0].RestartCount != 4 {
+		t.Errorf("container has restart count %d, want 4", containers[0].RestartCount)
+	}
+	if containers[0].StartedAt.IsZero() {
+		t.Errorf("container has no start time")
+	}
+}
+
+func TestCheckComposePortConflictsEmptyServices(t *testing.T) {
+	newFakeDocker(t)
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	busyPort := strconv.Itoa(busy.Addr().(*net.TCPAddr).Port)
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	tests := []struct {
+		name    string
+		compose string
+		want    error
+	}{
+		{"empty file", "", errNoComposeServices},
+		{"null services", "services:\n", errNoComposeServices},
+		{"empty services", "services: {}\n", errNoComposeServices},
+		{"list of services", "services:\n  - web\n", errComposeParse},
+		{"null service", "services:\n  web:\n  api:\n    ports: [\"" + busyPort + ":80\"]\n", nil},
+	}
+	for _, tt := range tests {
+		composeFile := filepath.Join(t.TempDir(), "docker-compose.yml")
+		if err := os.WriteFile(composeFile, []byte(tt.compose), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		remappings, err := s.CheckComposePortConflicts(composeFile, nil)
+		if !errors.Is(err, tt.want) || (tt.want == nil) != (err == nil) {
+			t.Errorf("%s: CheckComposePortConflicts returned %v, want %v", tt.name, err, tt.want)
+			continue
+		}
+		if tt.want == nil {
+			if _, remapped := remappings["api:"+busyPort]; !remapped || len(remappings) != 1 {
+				t.Errorf("%s: remapped %v, want api's port with the null service skipped", tt.name, remappings)
+			}
+		}
+	}
+}
+
+func TestCheckComposePortConflictsReleasesOnError(t *testing.T) {
+	newFakeDocker(t)
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	port := busy.Addr().(*net.TCPAddr).Port
+
+	// The single port takes the only free one, then the range has nowhere to go
+	composeFile := filepath.Join(t.TempDir(), "docker-compose.yml")
+	compose := fmt.Sprintf("services:\n  web:\n    image: nginx\n    ports:\n      - \"%d:80\"\n      - \"%d-%d:8000-8001\"\n",
+		port, port, port+1)
+	if err := os.WriteFile(composeFile, []byte(compose), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20000})
+	if _, err := s.CheckComposePortConflicts(composeFile, nil); !errors.Is(err, errPortExhausted) {
+		t.Fatalf("CheckComposePortConflicts returned %v, want %v", err, errPortExhausted)
+	}
+	s.claimMu.Lock()
+	defer s.claimMu.Unlock()
+	if len(s.portClaims) > 0 {
+		t.Errorf("ports %v are still claimed after the check failed", s.portClaims)
+	}
+}
+
+func TestPortBand(t *testing.T) {
+	for port, want := range map[int][2]int{
+		8080:  {8000, 8999},
+		443:   {400, 499},
+		18080: {10000, 19999},
+		65000: {60000, 65535},
+		7:     {7, 7},
+	} {
+		if low, high := portBand(port); low != want[0] || high != want[1] {
+			t.Errorf("portBand(%d) = %d-%d, want %d-%d", port, low, high, want[0], want[1])
+		}
+	}
+}
+
+func TestAllocateFromComposeRange(t *testing.T) {
+	newFakeDocker(t)
+	// Occupy a port in the 8000s, as another service would
+	var busy net.Listener
+	for port := 8000; port <= 8999 && busy == nil; port++ {
+		busy, _ = net.Listen("tcp", fmt.Sprintf(":%d", port))
+	}
+	if busy == nil {
+		t.Skip("no free port in 8000-8999")
+	}
+	defer busy.Close()
+	port := strconv.Itoa(busy.Addr().(*net.TCPAddr).Port)
+
+	composeFile := filepath.Join(t.TempDir(), "docker-compose.yml")
+	compose := "services:\n  web:\n    image: nginx\n    ports:\n      - \"" + port + ":80\"\n"
+	if err := os.WriteFile(composeFile, []byte(compose), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fromComposeRange := range []bool{false, true} {
+		s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, AllocateFromComposeRange: fromComposeRange})
+		remappings, err := s.CheckComposePortConflicts(composeFile, nil)
+		if err != nil {
+			t.Fatalf("CheckComposePortConflicts failed: %v", err)
+		}
+		newPort, err := strconv.Atoi(remappings["web:"+port])
+		if err != nil {
+			t.Fatalf("remapped %v, want web:%s moved", remappings, port)
+		}
+		low, high := 20000, 20999
+		if fromComposeRange {
+			low, high = 8000, 8999
+		}
+		if newPort < low || newPort > high || strconv.Itoa(newPort) == port {
+			t.Errorf("with allocate from compose range %v, %s was remapped to %d, want another port in %d-%d", fromComposeRange, port, newPort, low, high)
+		}
+	}
+}
+
+func TestCheckComposePortConflictsTCPAndUDP(t *testing.T) {
+	newFakeDocker(t)
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	port := strconv.Itoa(busy.Addr().(*net.TCPAddr).Port)
+
+	composeFile := filepath.Join(t.TempDir(), "docker-compose.yml")
+	compose := "services:\n" +
+		"  dns:\n    image: dns\n    ports:\n      - \"" + port + ":53/tcp\"\n      - \"" + port + ":53/udp\"\n"
+	if err := os.WriteFile(composeFile, []byte(compose), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	remappings, err := s.CheckComposePortConflicts(composeFile, nil)
+	if err != nil {
+		t.Fatalf("CheckComposePortConflicts failed: %v", err)
+	}
+	newPort, remapped := remappings["dns:"+port]
+	if !remapped || len(remappings) != 1 {
+		t.Fatalf("remapped %v, want the tcp and udp port moved as one", remappings)
+	}
+
+	remappedFile, err := s.GenerateRemappedComposeFile(composeFile, nil, remappings)
+	if err != nil {
+		t.Fatalf("GenerateRemappedComposeFile failed: %v", err)
+	}
+	defer os.Remove(remappedFile)
+	services, err := loadComposeServices(remappedFile, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range services["dns"].(map[string]interface{})["ports"].([]interface{}) {
+		hostPort, _, protocol, _ := parseComposePort(entry)
+		got = append(got, hostPort+"/"+protocol)
+	}
+	if want := []string{newPort + "/tcp", newPort + "/udp"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("remapped file publishes %v, want %v", got, want)
+	}
+}
+
+func TestCheckComposePortConflictsProtocol(t *testing.T) {
+	newFakeDocker(t)
+
+	// One port busy for TCP only, one busy for UDP only
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcpPort := strconv.Itoa(tcp.Addr().(*net.TCPAddr).Port)
+	udpPort := strconv.Itoa(udp.LocalAddr().(*net.UDPAddr).Port)
+
+	composeFile := filepath.Join(t.TempDir(), "docker-compose.yml")
+	compose := "services:\n" +
+		"  dns:\n    image: dns\n    ports:\n      - \"127.0.0.1:" + tcpPort + ":53/udp\"\n" +
+		"  web:\n    image: nginx\n    ports:\n      - \"127.0.0.1:" + tcpPort + ":80\"\n" +
+		"  syslog:\n    image: syslog\n    ports:\n      - \"127.0.0.1:" + udpPort + ":514/udp\"\n"
+	if err := os.WriteFile(composeFile, []byte(compose), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	remappings, err := s.CheckComposePortConflicts(composeFile, nil)
+	if err != nil {
+		t.Fatalf("CheckComposePortConflicts failed: %v", err)
+	}
+	if _, remapped := remappings["dns:"+tcpPort]; remapped {
+		t.Errorf("UDP port %s was remapped although only TCP uses it: %v", tcpPort, remappings)
+	}
+	if _, remapped := remappings["web:"+tcpPort]; !remapped {
+		t.Errorf("TCP port %s in use for TCP wasn't remapped: %v", tcpPort, remappings)
+	}
+	if _, remapped := remappings["syslog:"+udpPort]; !remapped {
+		t.Errorf("UDP port %s in use for UDP wasn't remapped: %v", udpPort, remappings)
+	}
+}
+
+func TestGroupByComposeProject(t *testing.T) {
+	containers := []Container{
+		{ID: "a", Names: "web", ComposeProject: "app1"},
+		{ID: "b", Names: "app2_db_1"},
+		{ID: "c", Names: "redis"},
+		{ID: "d", Names: "worker", ComposeProject: "<no value>"},
+		{ID: "e", Names: "api", ComposeProject: "app1"},
+	}
+	want := map[string][]string{"app1": {"a", "e"}, "app2": {"b"}, "standalone": {"c", "d"}}
+	if got := groupIDs(groupByComposeProject(containers)); !reflect.DeepEqual(got, want) {
+		t.Errorf("groupByComposeProject grouped %v, want %v", got, want)
+	}
+}
+
+// groupIDs returns the IDs of the containers in each group
+func groupIDs(groups map[string][]Container) map[string][]string {
+	ids := make(map[string][]string)
+	for name, members := range groups {
+		for _, container := range members {
+			ids[name] = append(ids[name], container.ID)
+		}
+	}
+	return ids
+}
+
+func TestGroupByImage(t *testing.T) {
+	containers := []Container{
+		{ID: "a", Image: "nginx:latest"},
+		{ID: "b", Image: "redis:7"},
+		{ID: "c", Image: "nginx:latest"},
+	}
+	want := map[string][]string{"nginx:latest": {"a", "c"}, "redis:7": {"b"}}
+	if got := groupIDs(groupByImage(containers)); !reflect.DeepEqual(got, want) {
+		t.Errorf("groupByImage grouped %v, want %v", got, want)
+	}
+}
+
+func TestGroupByNetwork(t *testing.T) {
+	containers := []Container{
+		{ID: "a", Networks: "frontend"},
+		{ID: "b", Networks: "frontend, backend"},
+		{ID: "c", Networks: ""},
+	}
+	want := map[string][]string{"frontend": {"a", "b"}, "backend": {"b"}, "none": {"c"}}
+	if got := groupIDs(groupByNetwork(containers)); !reflect.DeepEqual(got, want) {
+		t.Errorf("groupByNetwork grouped %v, want %v", got, want)
+	}
+}
+
+func TestStartedWithin(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	containers := []Container{
+		{ID: "new", StartedAt: now.Add(-time.Minute)},
+		{ID: "edge", StartedAt: now.Add(-10 * time.Minute)},
+		{ID: "old", StartedAt: now.Add(-2 * time.Hour)},
+		{ID: "unknown"},
+	}
+	tests := []struct {
+		since string
+		want  []string
+	}{
+		{"", []string{"new", "edge", "old", "unknown"}},
+		{"10m", []string{"new", "edge"}},
+		{"30s", nil},
+		{"3h", []string{"new", "edge", "old"}},
+	}
+	for _, tt := range tests {
+		window, err := parseSince(tt.since)
+		if err != nil {
+			t.Fatalf("parseSince(%q) failed: %v", tt.since, err)
+		}
+		var got []string
+		for _, container := range startedWithin(containers, window, now) {
+			got = append(got, container.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("since %q keeps %v, want %v", tt.since, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{"10", "-5m", "0s", "soon"} {
+		if _, err := parseSince(invalid); err == nil {
+			t.Errorf("parseSince(%q) accepted an invalid window", invalid)
+		}
+	}
+}
+
+func TestNewestContainersFirst(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	// Sorting the display strings would put "9 minutes ago" before "10 hours ago"
+	containers := []Container{
+		{ID: "a", Names: "old", Created: "10 hours ago", CreatedAt: now.Add(-10 * time.Hour)},
+		{ID: "b", Names: "new", Created: "9 minutes ago", CreatedAt: now.Add(-9 * time.Minute)},
+		{ID: "c", Names: "older", Created: "2 days ago", CreatedAt: now.Add(-48 * time.Hour)},
+		{ID: "d", Names: "alsonew", Created: "9 minutes ago", CreatedAt: now.Add(-9 * time.Minute)},
+	}
+
+	var got []string
+	for _, container := range sortContainers(containers, "newest") {
+		got = append(got, container.Names)
+	}
+	if want := []string{"alsonew", "new", "old", "older"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("newest first sorted as %v, want %v", got, want)
+	}
+}
+
+func TestParseContainerTimes(t *testing.T) {
+	created, started := parseContainerTimes("2024-05-01T10:00:00.123456789Z 2024-05-01T11:30:00Z 2")
+	if want := time.Date(2024, 5, 1, 10, 0, 0, 123456789, time.UTC); !created.Equal(want) {
+		t.Errorf("created = %v, want %v", created, want)
+	}
+	if want := time.Date(2024, 5, 1, 11, 30, 0, 0, time.UTC); !started.Equal(want) {
+		t.Errorf("started = %v, want %v", started, want)
+	}
+	if created, started := parseContainerTimes("garbage"); !created.IsZero() || !started.IsZero() {
+		t.Errorf("unparseable times gave %v and %v, want zero times", created, started)
+	}
+}
+
+func TestContainerWithTwoNames(t *testing.T) {
+	// A linked container is also listed under its alias, e.g. "app/db", and the alias
+	// may come first
+	const names = "app/db,shop_db_1"
+	if got := primaryContainerName(names); got != "app/db" {
+		t.Errorf("primaryContainerName(%q) = %q, want the first name", names, got)
+	}
+	if got := inferComposeProject(names, "db"); got != "shop" {
+		t.Errorf("inferComposeProject(%q) = %q, want shop from the second name", names, got)
+	}
+	if got := inferComposeService(names, "shop"); got != "db" {
+		t.Errorf("inferComposeService(%q) = %q, want db", names, got)
+	}
+
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "/shop_db_1,app/db", Ports: []string{"25432:5432/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 29999})
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+	containers := s.GetContainers()
+	if len(containers) != 1 {
+		t.Fatalf("got %d containers, want 1", len(containers))
+	}
+	if c := containers[0]; c.Names != "shop_db_1" || c.ComposeProject != "shop" || c.ComposeService != "db" {
+		t.Errorf("container shows as %q in project %q service %q, want shop_db_1 in shop/db", c.Names, c.ComposeProject, c.ComposeService)
+	}
+}
+
+func TestSplitComposeName(t *testing.T) {
+	tests := []struct {
+		name, project, service string
+		wantProject            string
+		wantService            string
+	}{
+		{"shop_web_1", "", "", "shop", "web"},
+		{"shop-web-2", "", "", "shop", "web"},
+		{"my-shop-web-1", "", "web", "my-shop", "web"},
+		{"my_shop_web_1", "my_shop", "", "my_shop", "web"},
+		// Names set with container_name don't end in a container number
+		{"legacy_report_db", "", "", "", ""},
+		{"billing_api_v2", "", "api", "", ""},
+		// A known part that doesn't match means it's not a generated name
+		{"shop_web_1", "", "api", "", ""},
+	}
+	for _, tt := range tests {
+		project, service, ok := splitComposeName(tt.name, tt.project, tt.service)
+		if project != tt.wantProject || service != tt.wantService || ok != (tt.wantProject != "") {
+			t.Errorf("splitComposeName(%q, %q, %q) = %q, %q, %v, want %q, %q", tt.name, tt.project, tt.service, project, service, ok, tt.wantProject, tt.wantService)
+		}
+	}
+}
+
+func TestContainerNameIsNotSplitIntoProject(t *testing.T) {
+	docker := newFakeDocker(t)
+	// Both set container_name, but only the first kept its compose labels
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "billing_api_v2", Ports: []string{"25001:80/tcp"},
+		Labels: map[string]string{"com.docker.compose.project": "shop", "com.docker.compose.service": "api"}})
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "legacy_report_db", Ports: []string{"25002:5432/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 29999})
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	want := map[string][2]string{"billing_api_v2": {"shop", "api"}, "legacy_report_db": {"", ""}}
+	for _, c := range s.GetContainers() {
+		if got := [2]string{c.ComposeProject, c.ComposeService}; got != want[c.Names] {
+			t.Errorf("%s is in project/service %q, want %q", c.Names, got, want[c.Names])
+		}
+	}
+}
+
+func TestSortedGroupsOrder(t *testing.T) {
+	s := NewContainerStore(StoreOptions{})
+	for _, c := range []Container{
+		{ID: "a", Names: "web", ComposeProject: "shop"},
+		{ID: "b", Names: "redis"},
+		{ID: "c", Names: "api", ComposeProject: "shop"},
+		{ID: "d", Names: "db", ComposeProject: "blog"},
+		{ID: "e", Names: "cache", ComposeProject: "shop"},
+		{ID: "f", Names: "web", ComposeProject: "blog"},
+	} {
+		s.containers[c.ID] = c
+	}
+
+	want := []string{"blog: d f", "shop: c e a", "standalone: b"}
+	for i := 0; i < 20; i++ {
+		var got []string
+		for _, group := range SortedGroups(s.GetContainersByComposeProject()) {
+			ids := group.Name + ":"
+			for _, container := range group.Containers {
+				ids += " " + container.ID
+			}
+			got = append(got, ids)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("groups are ordered %q, want %q", got, want)
+		}
+	}
+}
+
+func TestSortGroups(t *testing.T) {
+	remapped := []PortMapping{{ContainerPort: "80", HostPort: "20001", Protocol: "tcp", OriginalPort: "8080"}}
+	kept := []PortMapping{{ContainerPort: "80", HostPort: "8080", Protocol: "tcp", OriginalPort: "8080"}}
+	groups := func() []ContainerGroup {
+		return []ContainerGroup{
+			{Name: "blog", Containers: []Container{{ID: "a", PortMappings: remapped}}},
+			{Name: "shop", Containers: []Container{{ID: "b"}, {ID: "c", PortMappings: kept}, {ID: "d"}}},
+			{Name: "wiki", Containers: []Container{{ID: "e", PortMappings: remapped}, {ID: "f", PortMappings: remapped}}},
+			{Name: "zoo", Containers: []Container{{ID: "g"}, {ID: "h"}}},
+		}
+	}
+	tests := []struct {
+		sortBy string
+		want   []string
+	}{
+		{"name", []string{"blog", "shop", "wiki", "zoo"}},
+		{"newest", []string{"blog", "shop", "wiki", "zoo"}},
+		{"projects-by-count", []string{"shop", "wiki", "zoo", "blog"}},
+		{"projects-by-remapped", []string{"wiki", "blog", "shop", "zoo"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, group := range sortGroups(groups(), tt.sortBy) {
+			got = append(got, group.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sorted by %s: %v, want %v", tt.sortBy, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshotDuringConcurrentRefreshes(t *testing.T) {
+	s := NewContainerStore(StoreOptions{})
+	// Each refresh swaps in a whole new generation of containers, as refreshContainers does
+	refresh := func(generation int) {
+		containers := make(map[string]Container)
+		for i := 0; i < 1+generation%5; i++ {
+			id := fmt.Sprintf("%d-%d", generation, i)
+			containers[id] = Container{ID: id, Names: id, ComposeProject: fmt.Sprintf("gen%d", generation)}
+		}
+		s.mu.Lock()
+		s.containers = containers
+		s.mu.Unlock()
+	}
+	refresh(0)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for generation := 1; generation <= 2000; generation++ {
+			refresh(generation)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		snapshot := s.Snapshot()
+		if len(snapshot.ByProject) != 1 {
+			t.Fatalf("snapshot groups projects %v, want the single project of one refresh", groupIDs(snapshot.ByProject))
+		}
+		for project, members := range snapshot.ByProject {
+			if len(members) != len(snapshot.Containers) {
+				t.Fatalf("snapshot lists %d containers but groups %d", len(snapshot.Containers), len(members))
+			}
+			for _, container := range snapshot.Containers {
+				if container.ComposeProject != project {
+					t.Fatalf("snapshot mixes containers of %s and %s", container.ComposeProject, project)
+				}
+			}
+		}
+	}
+}
+
+func TestGetContainersForProject(t *testing.T) {
+	s := NewContainerStore(StoreOptions{})
+	for _, c := range []Container{
+		{ID: "a", Names: "shop-web-1", ComposeProject: "shop", ComposeService: "web"}, // Labelled
+		{ID: "b", Names: "shop_db_1"}, // Inferred from its name
+		{ID: "c", Names: "blog_web_1", ComposeProject: "blog"},
+		{ID: "d", Names: "shopfront"},
+		{ID: "e", Names: "legacy", ComposeProject: "<no value>"},
+	} {
+		s.containers[c.ID] = c
+	}
+
+	tests := []struct {
+		project string
+		want    []string
+	}{
+		{"shop", []string{"a", "b"}},
+		{"blog", []string{"c"}},
+		{"standalone", []string{"d", "e"}},
+		{"wiki", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, container := range s.GetContainersForProject(tt.project) {
+			got = append(got, container.ID)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GetContainersForProject(%q) = %v, want %v", tt.project, got, tt.want)
+		}
+		// The groups of the dashboard agree
+		grouped := groupIDs(s.GetContainersByComposeProject())[tt.project]
+		sort.Strings(grouped)
+		if !reflect.DeepEqual(grouped, tt.want) {
+			t.Errorf("project %s groups %v, want %v", tt.project, grouped, tt.want)
+		}
+	}
+}
+
+func TestSnapshotGroupsItsOwnContainers(t *testing.T) {
+	s := NewContainerStore(StoreOptions{})
+	s.containers["a"] = Container{ID: "a", Names: "web", ComposeProject: "app1"}
+	s.containers["b"] = Container{ID: "b", Names: "redis"}
+	snapshot := s.Snapshot()
+
+	// A refresh after the snapshot was taken doesn't change it
+	s.containers["c"] = Container{ID: "c", Names: "api", ComposeProject: "app1"}
+	delete(s.containers, "b")
+
+	grouped := 0
+	for _, members := range snapshot.ByProject {
+		grouped += len(members)
+	}
+	if len(snapshot.Containers) != 2 || grouped != 2 {
+		t.Errorf("snapshot lists %d containers and groups %d, want 2 of each", len(snapshot.Containers), grouped)
+	}
+	if len(snapshot.ByProject["app1"]) != 1 || len(snapshot.ByProject["standalone"]) != 1 {
+		t.Errorf("snapshot groups %v, want one container each in app1 and standalone", snapshot.ByProject)
+	}
+}
+
+func TestResolveContainerID(t *testing.T) {
+	s := NewContainerStore(StoreOptions{})
+	for _, id := range []string{"abc123aaaaaaaaaa", "abc123bbbbbbbbbb", "def456cccccccccc"} {
+		s.containers[id] = Container{ID: id}
+	}
+
+	for ref, want := range map[string]string{
+		"abc123aaaaaaaaaa": "abc123aaaaaaaaaa",
+		"abc123b":          "abc123bbbbbbbbbb",
+		"d":                "def456cccccccccc",
+	} {
+		if got, err := s.ResolveContainerID(ref); err != nil || got != want {
+			t.Errorf("ResolveContainerID(%q) = %q, %v, want %q", ref, got, err, want)
+		}
+	}
+
+	_, err := s.ResolveContainerID("abc")
+	if !errors.Is(err, errAmbiguousID) {
+		t.Fatalf("ambiguous prefix returned %v, want %v", err, errAmbiguousID)
+	}
+	for _, candidate := range []string{"abc123aaaaaa", "abc123bbbbbb"} {
+		if !strings.Contains(err.Error(), candidate) {
+			t.Errorf("error %q doesn't list candidate %s", err, candidate)
+		}
+	}
+	if _, err := s.ResolveContainerID("fff"); !errors.Is(err, errContainerNotFound) {
+		t.Errorf("unknown prefix returned %v, want %v", err, errContainerNotFound)
+	}
+}
+
+func TestPlanForceRemapDryRun(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"20005:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	containerID, err := s.resolveContainerRef("web")
+	if err != nil {
+		t.Fatalf("resolveContainerRef failed: %v", err)
+	}
+	plan, err := s.PlanForceRemap(containerID)
+	if err != nil {
+		t.Fatalf("PlanForceRemap failed: %v", err)
+	}
+	if len(plan) != 1 || plan[0].ContainerPort != "80" || plan[0].HostPort != "20005" {
+		t.Fatalf("planned %+v, want port 80 moved off 20005", plan)
+	}
+	port, err := strconv.Atoi(plan[0].NewHostPort)
+	if err != nil || port < 20000 || port > 20999 || port == 20005 {
+		t.Errorf("proposed port %s, want another port in 20000-20999", plan[0].NewHostPort)
+	}
+
+	if changes := docker.changes(); len(changes) != 0 {
+		t.Errorf("dry run called docker with %v", callNames(changes))
+	}
+	if !s.claimPort(port) {
+		t.Errorf("proposed port %d is still claimed after the dry run", port)
+	}
+}
+
+func TestEvaluateContainerPublishAll(t *testing.T) {
+	// Docker picked 20005, inside the dynamic range, which must not be taken as ours
+	publishAll := fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"20005:80/tcp"}, PublishAll: true}
+
+	t.Run("left alone", func(t *testing.T) {
+		docker := newFakeDocker(t)
+		docker.addContainer(publishAll)
+		s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+
+		s.evaluateContainer("aaaa")
+
+		if changes := docker.changes(); len(changes) != 0 {
+			t.Fatalf("docker was called with %v", callNames(changes))
+		}
+		containers := s.GetContainers()
+		if len(containers) != 1 || containers[0].DynamicPorts {
+			t.Errorf("store holds %+v, want the container with ports not marked as ours", containers)
+		}
+	})
+
+	t.Run("pinned", func(t *testing.T) {
+		docker := newFakeDocker(t)
+		docker.addContainer(publishAll)
+		s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, ManagePublishAll: true})
+
+		s.evaluateContainer("aaaa")
+
+		changes := docker.changes()
+		if got, want := callNames(changes), []string{"stop", "rename", "run", "rm"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("docker was called with %v, want %v", got, want)
+		}
+		if publish := flagValues(changes[2], "-p"); !reflect.DeepEqual(publish, []string{"20005:80/tcp"}) {
+			t.Errorf("recreated container publishes %v, want the Docker-assigned port pinned as 20005:80/tcp", publish)
+		}
+		containers := s.GetContainers()
+		if len(containers) != 1 || len(containers[0].PortMappings) != 1 || containers[0].PortMappings[0].Reason != reasonPublishAllPinned {
+			t.Errorf("store holds %+v, want port 80 pinned", containers)
+		}
+	})
+}
+
+func TestRemapReportsContainerNeverReady(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	docker.exitRuns()
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, ReadyTimeout: time.Second})
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	_, err := s.ForceRemap("aaaa")
+	if err == nil || !strings.Contains(err.Error(), "not ready") || !strings.Contains(err.Error(), "exited") {
+		t.Fatalf("ForceRemap returned %v, want an error reporting the exited replacement", err)
+	}
+
+	// The replacement is removed and the original brought back
+	changes := docker.changes()
+	if got, want := callNames(changes), []string{"stop", "rename", "run", "rm", "rename", "start"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("docker was called with %v, want %v", got, want)
+	}
+	if replacement := changes[3][len(changes[3])-1]; s.isContainerProcessed(replacement) {
+		t.Errorf("removed replacement %s is still tracked as processed", replacement)
+	}
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+	containers := s.GetContainers()
+	if len(containers) != 1 || containers[0].ID != "aaaa" || containers[0].Names != "web" || containers[0].PortMappings[0].HostPort != "8080" {
+		t.Errorf("store holds %+v, want the original container back on 8080", containers)
+	}
+}
+
+func TestComposeServicePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		want    servicePortPolicy
+	}{
+		{"none", "image: nginx", servicePortPolicy{}},
+		{"extension block", "x-dynamic-port-mapper:\n  range: \"30000-30100\"\n  port: 30005", servicePortPolicy{RangeMin: 30000, RangeMax: 30100, FixedPort: 30005}},
+		{"label map", "labels:\n  com.dynamic-port-mapper.range: \"30000-30100\"", servicePortPolicy{RangeMin: 30000, RangeMax: 30100}},
+		{"label list", "labels:\n  - com.dynamic-port-mapper.port=30005", servicePortPolicy{FixedPort: 30005}},
+		{"extension over labels", "labels:\n  com.dynamic-port-mapper.range: \"30000-30100\"\nx-dynamic-port-mapper:\n  range: \"31000-31100\"", servicePortPolicy{RangeMin: 31000, RangeMax: 31100}},
+		{"invalid", "x-dynamic-port-mapper:\n  range: \"30100-30000\"\n  port: 70000", servicePortPolicy{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var service map[string]interface{}
+			if err := yaml.Unmarshal([]byte(tt.service), &service); err != nil {
+				t.Fatal(err)
+			}
+			if got := composeServicePolicy("web", service); got != tt.want {
+				t.Errorf("composeServicePolicy = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckComposePortConflictsServiceRange(t *testing.T) {
+	newFakeDocker(t)
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	busyPort := strconv.Itoa(busy.Addr().(*net.TCPAddr).Port)
+
+	composeFile := filepath.Join(t.TempDir(), "docker-compose.yml")
+	compose := "services:\n" +
+		"  web:\n    image: nginx\n    ports:\n      - \"127.0.0.1:" + busyPort + ":80\"\n" +
+		"    x-dynamic-port-mapper:\n      range: \"30000-30009\"\n" +
+		"  api:\n    image: api\n    ports:\n      - \"127.0.0.1:" + busyPort + ":8080\"\n" +
+		"    labels:\n      com.dynamic-port-mapper.port: \"30020\"\n"
+	if err := os.WriteFile(composeFile, []byte(compose), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	remappings, err := s.CheckComposePortConflicts(composeFile, nil)
+	if err != nil {
+		t.Fatalf("CheckComposePortConflicts failed: %v", err)
+	}
+	if port, _ := strconv.Atoi(remappings["web:"+busyPort]); port < 30000 || port > 30009 {
+		t.Errorf("web was remapped to %q, want a port in its declared range 30000-30009", remappings["web:"+busyPort])
+	}
+	if remappings["api:"+busyPort] != "30020" {
+		t.Errorf("api was remapped to %q, want its declared port 30020", remappings["api:"+busyPort])
+	}
+}
+
+func TestCheckComposePortConflictsHostModeRange(t *testing.T) {
+	newFakeDocker(t)
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	first := busy.Addr().(*net.TCPAddr).Port
+	published := fmt.Sprintf("%d-%d", first, first+2)
+
+	composeFile := filepath.Join(t.TempDir(), "docker-compose.yml")
+	compose := "services:\n" +
+		"  web:\n    image: nginx\n    ports:\n" +
+		"      - target: 80\n        published: \"" + published + "\"\n        protocol: tcp\n        mode: host\n"
+	if err := os.WriteFile(composeFile, []byte(compose), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	remappings, err := s.CheckComposePortConflicts(composeFile, nil)
+	if err != nil {
+		t.Fatalf("CheckComposePortConflicts failed: %v", err)
+	}
+	newRange := remappings["web:"+published]
+	low, high, err := parsePortRange(newRange)
+	if err != nil || high-low != 2 || low < 20000 || high > 20999 {
+		t.Fatalf("remapped %v, want the range moved as a block of 3 ports into 20000-20999", remappings)
+	}
+
+	remappedFile, err := s.GenerateRemappedComposeFile(composeFile, nil, remappings)
+	if err != nil {
+		t.Fatalf("GenerateRemappedComposeFile failed: %v", err)
+	}
+	defer os.Remove(remappedFile)
+	services, err := loadComposeServices(remappedFile, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := services["web"].(map[string]interface{})["ports"].([]interface{})[0].(map[string]interface{})
+	if port["published"] != newRange || port["mode"] != "host" || port["target"] != 80 {
+		t.Errorf("remapped file publishes %v, want %s in host mode", port, newRange)
+	}
+}
+
+func TestRefreshRestoresStoredPortMappings(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp", "8443:443/tcp"}})
+	s := NewContainerStore(StoreOptions{})
+
+	// A previous refresh recorded port 80 on another host port
+	s.portMappings["aaaa"] = map[string]string{portMappingKey("0.0.0.0", "80", "tcp"): "20005"}
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	containers := s.GetContainers()
+	if len(containers) != 1 || !containers[0].DynamicPorts {
+		t.Fatalf("store holds %+v, want the container with dynamic ports", containers)
+	}
+	got := make(map[string]string)
+	for _, mapping := range containers[0].PortMappings {
+		got[mapping.ContainerPort] = mapping.OriginalPort + "->" + mapping.HostPort
+	}
+	if want := map[string]string{"80": "8080->20005", "443": "8443->8443"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("refresh restored %v, want %v", got, want)
+	}
+}
+
+func TestRefreshRestoresEachBindingOfAPort(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"127.0.0.1:8080:80/tcp", "127.0.0.2:9090:80/tcp"}})
+	s := NewContainerStore(StoreOptions{})
+
+	// Container port 80 is published on two interfaces, each recorded on its own
+	s.portMappings["aaaa"] = map[string]string{
+		portMappingKey("127.0.0.1", "80", "tcp"): "20005",
+		portMappingKey("127.0.0.2", "80", "tcp"): "20006",
+	}
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	containers := s.GetContainers()
+	if len(containers) != 1 {
+		t.Fatalf("store holds %+v, want one container", containers)
+	}
+	got := make(map[string]string)
+	for _, mapping := range containers[0].PortMappings {
+		got[mapping.HostIP] = mapping.OriginalPort + "->" + mapping.HostPort
+	}
+	if want := map[string]string{"127.0.0.1": "8080->20005", "127.0.0.2": "9090->20006"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("refresh restored %v, want %v", got, want)
+	}
+}
+
+func TestRestartedStoreRecoversOriginalPortFromLabels(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	s.evaluateContainer("aaaa")
+	s.Stop()
+
+	// A new store knows nothing of the remap but what the recreated container carries
+	restarted := NewContainerStore(StoreOptions{})
+	if err := restarted.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+	containers := restarted.GetContainers()
+	if len(containers) != 1 || len(containers[0].PortMappings) != 1 {
+		t.Fatalf("store holds %+v, want the recreated container", containers)
+	}
+	mapping := containers[0].PortMappings[0]
+	if mapping.HostPort == "8080" || mapping.OriginalPort != "8080" {
+		t.Errorf("restarted store shows %s (was %s), want a remapped port that was 8080", mapping.HostPort, mapping.OriginalPort)
+	}
+}
+
+// BenchmarkRefreshContainers refreshes 100 containers that were seen before, whose
+// previous mappings are looked up one by one rather than copied up front
+func BenchmarkRefreshContainers(b *testing.B) {
+	docker := newFakeDocker(b)
+	for i := 0; i < 100; i++ {
+		docker.addContainer(fakeContainer{
+			ID:    fmt.Sprintf("%064x", i),
+			Name:  fmt.Sprintf("web%d", i),
+			Ports: []string{fmt.Sprintf("%d:80/tcp", 10000+2*i), fmt.Sprintf("%d:443/tcp", 10001+2*i)},
+		})
+	}
+	s := NewContainerStore(StoreOptions{})
+	if err := s.refreshContainers(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.refreshContainers(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLintComposePorts(t *testing.T) {
+	composeFile := filepath.Join(t.TempDir(), "docker-compose.yml")
+	compose := "services:\n" +
+		"  web:\n    ports: [\"8080:80\", \"9090:90\"]\n" +
+		"  db:\n    ports:\n      - published: 5432\n        target: 5432\n" +
+		"  cache:\n    ports: [\"8080:81\", \"9090:90/udp\"]\n"
+	if err := os.WriteFile(composeFile, []byte(compose), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	issues, err := LintComposePorts(composeFile, []int{8080, 5432}, nil, true)
+	if err != nil {
+		t.Fatalf("LintComposePorts failed: %v", err)
+	}
+	want := []LintIssue{
+		{Service: "cache", HostPort: "8080", Protocol: "tcp", Reason: "port is already in use"},
+		{Service: "db", HostPort: "5432", Protocol: "tcp", Reason: "port is already in use"},
+		{Service: "web", HostPort: "8080", Protocol: "tcp", Reason: "port is already in use"},
+		{Service: "web", HostPort: "8080", Protocol: "tcp", Reason: "port is also published by service cache"},
+	}
+	if !reflect.DeepEqual(issues, want) {
+		t.Errorf("LintComposePorts = %+v, want %+v", issues, want)
+	}
+}
+
+func TestLoadComposeServicesProfiles(t *testing.T) {
+	docker := newFakeDocker(t)
+	composeFile := filepath.Join(t.TempDir(), "docker-compose.yml")
+	compose := "services:\n" +
+		"  web:\n    image: nginx\n" +
+		"  debug:\n    image: busybox\n    profiles: [debug]\n"
+	if err := os.WriteFile(composeFile, []byte(compose), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Offline, the profiles are applied here
+	for _, tt := range []struct {
+		profiles []string
+		want     []string
+	}{
+		{nil, []string{"web"}},
+		{[]string{"tools"}, []string{"web"}},
+		{[]string{"debug"}, []string{"debug", "web"}},
+	} {
+		services, err := loadComposeServices(composeFile, tt.profiles, true)
+		if err != nil {
+			t.Fatalf("loadComposeServices failed: %v", err)
+		}
+		var names []string
+		for name := range services {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("with profiles %q, services %q are considered, want %q", tt.profiles, names, tt.want)
+		}
+	}
+
+	// Otherwise docker-compose config applies them
+	if _, err := loadComposeServices(composeFile, []string{"debug"}, false); err != nil {
+		t.Fatalf("loadComposeServices failed: %v", err)
+	}
+	calls := docker.calls()
+	if want := []string{"compose", "--profile", "debug", "-f", "docker-compose.yml", "config"}; len(calls) != 1 || !reflect.DeepEqual(calls[0], want) {
+		t.Errorf("docker was called with %q, want %q", calls, want)
+	}
+}
+
+func TestPlanRemaps(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "api", Ports: []string{"20005:8080/tcp"}})
+	docker.addContainer(fakeContainer{ID: "cccc", Name: "dns", Ports: []string{"20006:53/udp", "5353:5353/udp"}})
+	docker.addContainer(fakeContainer{
+		ID:     "dddd",
+		Name:   "db",
+		Ports:  []string{"5432:5432/tcp"},
+		Labels: map[string]string{"com.dynamic-port-mapper.has-dynamic-ports": "true"},
+	})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	plan := s.PlanRemaps()
+
+	// Only the ports outside the range of containers not yet managed move
+	var got []string
+	for _, remap := range plan {
+		got = append(got, fmt.Sprintf("%s %s/%s %s", remap.ContainerName, remap.ContainerPort, remap.Protocol, remap.HostPort))
+		port, _ := strconv.Atoi(remap.NewHostPort)
+		if port < 20000 || port > 20999 {
+			t.Errorf("%s %s/%s would move to %s, want a port in 20000-20999", remap.ContainerName, remap.ContainerPort, remap.Protocol, remap.NewHostPort)
+		}
+		if !s.claimPort(port) {
+			t.Errorf("proposed port %d is still claimed after planning", port)
+		}
+	}
+	if want := []string{"dns 5353/udp 5353", "web 80/tcp 8080"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("plan lists %q, want %q", got, want)
+	}
+	if changes := docker.changes(); len(changes) != 0 {
+		t.Errorf("planning called docker with %v", callNames(changes))
+	}
+}
+
+func TestWithPortSuffix(t *testing.T) {
+	tests := []struct {
+		name, hostPort, want string
+	}{
+		{"web", "10342", "web-dpm10342"},
+		{"web-dpm10342", "10342", "web-dpm10342"},
+		{"web-dpm10342", "10500", "web-dpm10500"},
+		{"shop-dpm-web", "10342", "shop-dpm-web-dpm10342"},
+	}
+	for _, tt := range tests {
+		if got := withPortSuffix(tt.name, tt.hostPort); got != tt.want {
+			t.Errorf("withPortSuffix(%q, %q) = %q, want %q", tt.name, tt.hostPort, got, tt.want)
+		}
+	}
+}
+
+func TestRecreateWithNameSuffix(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, NameSuffix: true})
+
+	s.evaluateContainer("aaaa")
+
+	containers := s.GetContainers()
+	if len(containers) != 1 {
+		t.Fatalf("store holds %+v, want the recreated container", containers)
+	}
+	if want := "web-dpm" + containers[0].PortMappings[0].HostPort; containers[0].Names != want {
+		t.Errorf("recreated container is named %s, want %s", containers[0].Names, want)
+	}
+}
+
+func TestRecreatePreservesHostGateway(t *testing.T) {
+	docker := newFakeDocker(t)
+	extraHosts := []string{"host.docker.internal:host-gateway", "db.internal:10.0.0.2"}
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"},
+		HostConfig: map[string]interface{}{"ExtraHosts": extraHosts}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+
+	s.evaluateContainer("aaaa")
+
+	for _, args := range docker.changes() {
+		if args[0] != "run" {
+			continue
+		}
+		if got := flagValues(args, "--add-host"); !reflect.DeepEqual(got, extraHosts) {
+			t.Errorf("recreated container runs with --add-host %q, want %q", got, extraHosts)
+		}
+		return
+	}
+	t.Fatal("container wasn't recreated")
+}
+
+func TestRecreatePreservesNetworkAliases(t *testing.T) {
+	docker := newFakeDocker(t)
+	const id = "aaaaaaaaaaaa0123456789"
+	docker.addContainer(fakeContainer{ID: id, Name: "shop-web-1", Ports: []string{"8080:80/tcp"},
+		HostConfig: map[string]interface{}{"NetworkMode": "shop_default"},
+		Networks: map[string]interface{}{
+			// Docker adds the short container ID as an alias of its own
+			"shop_default": map[string]interface{}{"Aliases": []interface{}{"shop-web-1", "web", id[:12]}},
+			"backend":      map[string]interface{}{"Aliases": []interface{}{"web"}},
+		}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+
+	s.evaluateContainer(id)
+
+	var run, connect []string
+	for _, args := range docker.changes() {
+		switch args[0] {
+		case "run":
+			run = args
+		case "network":
+			connect = args
+		}
+	}
+	if run == nil {
+		t.Fatal("container wasn't recreated")
+	}
+	if got := flagValues(run, "--network"); !reflect.DeepEqual(got, []string{"shop_default"}) {
+		t.Errorf("recreated container runs on networks %q, want shop_default", got)
+	}
+	if got, want := flagValues(run, "--network-alias"), []string{"shop-web-1", "web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recreated container runs with aliases %q, want %q", got, want)
+	}
+	recreated := fmt.Sprintf("%064x", 0xf00001)
+	if want := []string{"network", "connect", "--alias", "web", "backend", recreated}; !reflect.DeepEqual(connect, want) {
+		t.Errorf("recreated container was connected with %q, want %q", connect, want)
+	}
+}
+
+func TestRecreatePreservesRuntimeFlags(t *testing.T) {
+	runtimeFlags := []string{"--init", "--read-only", "-t", "-i"}
+	tests := []struct {
+		name       string
+		config     map[string]interface{}
+		hostConfig map[string]interface{}
+		want       []string
+	}{
+		{"set", map[string]interface{}{"Tty": true, "OpenStdin": true}, map[string]interface{}{"Init": true, "ReadonlyRootfs": true}, runtimeFlags},
+		{"unset", map[string]interface{}{"Tty": false, "OpenStdin": false}, map[string]interface{}{"Init": nil, "ReadonlyRootfs": false}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docker := newFakeDocker(t)
+			docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}, Config: tt.config, HostConfig: tt.hostConfig})
+			s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+
+			s.evaluateContainer("aaaa")
+
+			changes := docker.changes()
+			if got := callNames(changes); len(got) != 4 || got[2] != "run" {
+				t.Fatalf("docker was called with %v, want one recreation", got)
+			}
+			var got []string
+			for _, flag := range runtimeFlags {
+				if contains(changes[2], flag) {
+					got = append(got, flag)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("recreated container runs with %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenForEventsResumesAfterReconnect(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	started := time.Now().Add(-time.Minute).UnixNano()
+	docker.addEvent("start", "aaaa", started)
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	defer s.Stop()
+	recreated := func(name string) int {
+		count := 0
+		for _, args := range docker.changes() {
+			if args[0] == "run" && contains(flagValues(args, "--name"), name) {
+				count++
+			}
+		}
+		return count
+	}
+
+	streams := func() [][]string {
+		var streams [][]string
+		for _, args := range docker.calls() {
+			if args[0] == "events" {
+				streams = append(streams, args)
+			}
+		}
+		return streams
+	}
+
+	// The first stream reports web's start and is held open until it has been handled
+	docker.holdEvents()
+	s.listenForEvents()
+	waitFor(t, "the first stream to report its events", docker.eventsHeld)
+	waitFor(t, "web to be remapped", func() bool { return recreated("web") == 1 })
+
+	// api starts before the stream ends, so only a stream resumed from web's start reports it
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "api", Ports: []string{"8081:80/tcp"}})
+	docker.addEvent("start", "bbbb", started+int64(time.Second))
+	docker.releaseEvents()
+	waitFor(t, "the stream to reconnect", func() bool { return len(streams()) >= 2 })
+	waitFor(t, "api to be remapped after the reconnect", func() bool { return recreated("api") == 1 })
+	// Let the remap finish before the fake docker goes away with the test
+	waitFor(t, "api's remap to finish", func() bool {
+		for _, container := range s.GetContainers() {
+			if container.Names == "api" {
+				return container.PortMappings[0].HostPort != "8081"
+			}
+		}
+		return false
+	})
+	want := fmt.Sprintf("%d.%09d", started/int64(time.Second), started%int64(time.Second))
+	if streams := streams(); !reflect.DeepEqual(flagValues(streams[1], "--since"), []string{want}) {
+		t.Errorf("docker events was run as %q, want a restart with --since %s", streams, want)
+	}
+	if n := recreated("web"); n != 1 {
+		t.Errorf("web was recreated %d times, want once", n)
+	}
+}
+
+func TestRecordEventSkipsReplays(t *testing.T) {
+	s := NewContainerStore(StoreOptions{})
+	start := DockerEvent{ID: "aaaa", Action: "start", TimeNano: 2000}
+	if !s.recordEvent(start) {
+		t.Fatal("first event was skipped")
+	}
+	if s.recordEvent(start) {
+		t.Error("replayed event wasn't skipped")
+	}
+	if !s.recordEvent(DockerEvent{ID: "aaaa", Action: "die", TimeNano: 2000}) {
+		t.Error("another action of the same container at the same time was skipped")
+	}
+	if !s.recordEvent(DockerEvent{ID: "aaaa", Action: "start", Time: 3}) {
+		t.Error("a later start with second precision was skipped")
+	}
+	if s.lastEventTime != 3*int64(time.Second) {
+		t.Errorf("resume timestamp is %d, want %d", s.lastEventTime, 3*int64(time.Second))
+	}
+}
+
+func TestReadOnlyOnlyFlagsConflicts(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "api", Ports: []string{"8080:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, ReadOnly: true})
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	s.evaluateContainer("bbbb")
+
+	if changes := docker.changes(); len(changes) != 0 {
+		t.Errorf("read-only mode called docker with %v", callNames(changes))
+	}
+	for _, container := range s.GetContainers() {
+		if container.ID == "bbbb" && (len(container.PortMappings) != 1 || !container.PortMappings[0].ConflictDetected) {
+			t.Errorf("api shows %+v, want its port flagged as conflicting", container.PortMappings)
+		}
+	}
+}
+
+func TestReadOnlyRefreshFlagsConflicts(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "api", Ports: []string{"8080:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, ReadOnly: true})
+	// Each container's ports are checked against the previous listing, so the
+	// conflicts show from the second refresh on
+	for i := 0; i < 2; i++ {
+		if err := s.refreshContainers(); err != nil {
+			t.Fatalf("refreshContainers failed: %v", err)
+		}
+	}
+
+	if changes := docker.changes(); len(changes) != 0 {
+		t.Errorf("read-only mode called docker with %v", callNames(changes))
+	}
+	for _, container := range s.GetContainers() {
+		if len(container.PortMappings) != 1 || !container.PortMappings[0].ConflictDetected {
+			t.Errorf("%s shows %+v, want its port flagged as conflicting", container.Names, container.PortMappings)
+		}
+	}
+}
+
+func TestNoLabelTracksProcessedInStateFile(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, NoLabel: true, StateFile: stateFile})
+
+	s.evaluateContainer("aaaa")
+
+	changes := docker.changes()
+	if got := callNames(changes); len(got) != 4 || got[2] != "run" {
+		t.Fatalf("docker was called with %v, want only the recreation", got)
+	}
+	for _, label := range flagValues(changes[2], "--label") {
+		if strings.HasPrefix(label, "com.dynamic-port-mapper.has-dynamic-ports=") {
+			t.Errorf("recreated container got tracking label %s", label)
+		}
+	}
+
+	// A restarted store knows the recreated container from the state file alone
+	recreated := fmt.Sprintf("%064x", 0xf00001)
+	restarted := NewContainerStore(StoreOptions{NoLabel: true, StateFile: stateFile})
+	if err := restarted.loadState(); err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+	if !restarted.isContainerProcessed(recreated) {
+		t.Error("recreated container isn't known as processed after a restart")
+	}
+	if restarted.isContainerProcessed("aaaa") {
+		t.Error("removed container is still known as processed")
+	}
+}
+
+func TestPlanOnlyRecordsIntents(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, PlanOnly: true, StateFile: stateFile})
+
+	s.evaluateContainer("aaaa")
+
+	if changes := docker.changes(); len(changes) != 0 {
+		t.Errorf("plan-only mode called docker with %v", callNames(changes))
+	}
+	intents := s.GetRemapIntents()
+	if len(intents) != 1 {
+		t.Fatalf("recorded intents %+v, want one", intents)
+	}
+	intent := intents[0]
+	newPort, _ := strconv.Atoi(intent.NewHostPort)
+	if intent.ContainerID != "aaaa" || intent.ContainerPort != "80" || intent.HostPort != "8080" || newPort < 20000 || newPort > 20999 {
+		t.Errorf("recorded intent %+v, want port 80 moving from 8080 into the range", intent.PlannedRemap)
+	}
+	if !s.claimPort(newPort) {
+		t.Errorf("recorded port %d is still claimed", newPort)
+	}
+
+	// The intents are kept in the state file
+	restarted := NewContainerStore(StoreOptions{StateFile: stateFile})
+	if err := restarted.loadState(); err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+	if saved := restarted.GetRemapIntents(); len(saved) != 1 || saved[0].PlannedRemap != intent.PlannedRemap {
+		t.Errorf("state file holds intents %+v, want %+v", saved, intent)
+	}
+}
+
+func TestExhaustedRangeSkipsRemaps(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "one", Ports: []string{"20000:80/tcp"}})
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "two", Ports: []string{"20001:80/tcp"}})
+	docker.addContainer(fakeContainer{ID: "cccc", Name: "web", Ports: []string{"8080:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20001})
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	s.evaluateContainer("cccc")
+	if !s.RangeExhausted() {
+		t.Error("full range isn't reported as exhausted")
+	}
+	s.evaluateContainer("cccc")
+	for _, args := range docker.changes() {
+		if args[0] == "run" {
+			t.Fatalf("a container was recreated while the range is full: %q", args)
+		}
+	}
+
+	// A container going away may free ports in the range
+	s.forgetContainer("aaaa")
+	if s.RangeExhausted() {
+		t.Error("range is still reported as exhausted after a container went away")
+	}
+}
+
+func TestRemapRecordsPhaseTimings(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+
+	s.evaluateContainer("aaaa")
+
+	timings := s.SlowestRemaps(0)
+	if len(timings) != 1 {
+		t.Fatalf("recorded timings %+v, want one", timings)
+	}
+	timing := timings[0]
+	if timing.ContainerID != "aaaa" || timing.OldHostPort != "8080" || !timing.Completed {
+		t.Errorf("recorded %+v, want the completed remap of aaaa from 8080", timing)
+	}
+	phases := []int64{timing.StopMs, timing.RemoveMs, timing.CreateMs, timing.StartMs}
+	sum := int64(0)
+	for _, ms := range phases {
+		if ms < 0 {
+			t.Errorf("phase timings %v include a negative one", phases)
+		}
+		sum += ms
+	}
+	if timing.TotalMs < sum {
+		t.Errorf("remap took %dms in total, less than its phases %v", timing.TotalMs, phases)
+	}
+}
+
+func TestSlowestRemaps(t *testing.T) {
+	s := NewContainerStore(StoreOptions{})
+	for _, c := range []struct {
+		id  string
+		ago time.Duration
+	}{{"fast", time.Second}, {"slowest", 5 * time.Second}, {"slow", 3 * time.Second}} {
+		s.recordRemapTiming(RemapTiming{ContainerID: c.id, StartedAt: time.Now().Add(-c.ago)})
+	}
+
+	var got []string
+	for _, timing := range s.SlowestRemaps(2) {
+		got = append(got, timing.ContainerID)
+	}
+	if want := []string{"slowest", "slow"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SlowestRemaps(2) = %v, want %v", got, want)
+	}
+}
+
+func TestExcludedProjectIsNeverRemapped(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "grafana", Ports: []string{"8080:80/tcp"},
+		Labels: map[string]string{"com.docker.compose.project": "monitoring"}})
+	// Without a project label, the project is inferred from the name
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "monitoring-prometheus-1", Ports: []string{"8080:80/tcp"}})
+	docker.addContainer(fakeContainer{ID: "cccc", Name: "api", Ports: []string{"8080:80/tcp"},
+		Labels: map[string]string{"com.docker.compose.project": "shop"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, ExcludedProjects: map[string]bool{"monitoring": true}})
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	for _, id := range []string{"aaaa", "bbbb", "cccc"} {
+		s.evaluateContainer(id)
+	}
+
+	var recreated []string
+	for _, args := range docker.changes() {
+		if args[0] == "run" {
+			recreated = append(recreated, flagValues(args, "--name")...)
+		}
+	}
+	if !reflect.DeepEqual(recreated, []string{"api"}) {
+		t.Errorf("recreated %q, want only api outside the excluded project", recreated)
+	}
+	if n := len(s.GetContainers()); n != 3 {
+		t.Errorf("store shows %d containers, want excluded ones displayed too", n)
+	}
+}
+
+func TestRemapRollsBackOnCreateFailure(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	docker.failRuns()
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+
+	s.evaluateContainer("aaaa")
+
+	var renames [][]string
+	for _, args := range docker.changes() {
+		if args[0] == "rename" {
+			renames = append(renames, args[1:])
+		}
+	}
+	want := [][]string{{"aaaa", "web-dpm-old"}, {"aaaa", "web"}}
+	if !reflect.DeepEqual(renames, want) {
+		t.Errorf("renamed %q, want the original moved aside and back %q", renames, want)
+	}
+	containers := s.GetContainers()
+	if len(containers) != 1 || containers[0].ID != "aaaa" || containers[0].Names != "web" {
+		t.Fatalf("store holds %+v, want the original container back under its name", containers)
+	}
+	if containers[0].PortMappings[0].HostPort != "8080" {
+		t.Errorf("original container publishes %+v, want 8080 unchanged", containers[0].PortMappings)
+	}
+}
+
+func TestRollbackKeepsContainerHoldingTheName(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	// Someone else's container already has the name the replacement would get
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "web-dpm20000"})
+	docker.failRuns()
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20000, NameSuffix: true})
+
+	s.evaluateContainer("aaaa")
+
+	for _, args := range docker.changes() {
+		if args[0] == "rm" {
+			t.Errorf("rolling back the failed recreation ran docker %q", args)
+		}
+	}
+	names := make(map[string]string)
+	for _, container := range s.GetContainers() {
+		names[container.ID] = container.Names
+	}
+	if want := map[string]string{"aaaa": "web", "bbbb": "web-dpm20000"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("store holds containers %v, want both back under their names %v", names, want)
+	}
+}
+
+func TestNameSuffixAvoidsTakenName(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	// A stale container from an earlier remap already has the suffixed name
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "web-dpm20000"})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20000, NameSuffix: true})
+
+	s.evaluateContainer("aaaa")
+
+	changes := docker.changes()
+	if got, want := callNames(changes), []string{"stop", "rename", "run", "rm"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("docker was called with %v, want %v", got, want)
+	}
+	if name := flagValues(changes[2], "--name"); !reflect.DeepEqual(name, []string{"web"}) {
+		t.Errorf("recreated container is named %v, want it to keep the name web", name)
+	}
+	if removed := changes[3][len(changes[3])-1]; removed != "aaaa" {
+		t.Errorf("removed %s, want only the original container", removed)
+	}
+}
+
+func TestCheckPortCollisionReasons(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "api", Ports: []string{"20010:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	tests := []struct {
+		hostPort string
+		remap    bool
+		reason   string
+	}{
+		{"20500", false, reasonUnchanged},
+		{"8080", true, reasonOutOfRange},
+		{"20010", true, "remapped (collision with api)"},
+	}
+	for _, tt := range tests {
+		remap, _, reason := s.checkPortCollision("aaaa", "", tt.hostPort, "tcp", false)
+		if remap != tt.remap || reason != tt.reason {
+			t.Errorf("port %s: remap %v with reason %q, want %v with %q", tt.hostPort, remap, reason, tt.remap, tt.reason)
+		}
+	}
+}
+
+func TestApplyPortReasons(t *testing.T) {
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	s.recordPortReason("aaaa", "80", "tcp", reasonForced)
+	mappings := []PortMapping{
+		{ContainerPort: "80", Protocol: "tcp", HostPort: "20001", OriginalPort: "8080"},
+		{ContainerPort: "81", Protocol: "tcp", HostPort: "20002", OriginalPort: "8081"},
+		{ContainerPort: "82", Protocol: "tcp", HostPort: "20003", OriginalPort: "20003"},
+		{ContainerPort: "83", Protocol: "tcp", HostPort: "8083", OriginalPort: "8083"},
+	}
+
+	s.applyPortReasons("aaaa", mappings)
+
+	var got []string
+	for _, mapping := range mappings {
+		got = append(got, mapping.Reason)
+	}
+	want := []string{reasonForced, reasonRestored, reasonUnchanged, reasonUnmanaged}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reasons are %q, want %q", got, want)
+	}
+}
+
+func TestLabelFailuresAreDetectedOnce(t *testing.T) {
+	// The fake docker CLI can't change labels of existing containers
+	docker := newFakeDocker(t)
+	ids := []string{"aaaa", "bbbb", "cccc"}
+	for i, id := range ids {
+		docker.addContainer(fakeContainer{ID: id, Name: fmt.Sprintf("web%d", i), Ports: []string{fmt.Sprintf("%d:80/tcp", 20000+i)}})
+	}
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+
+	for _, id := range ids {
+		s.addDynamicPortLabel(id)
+	}
+
+	for _, id := range ids {
+		if !s.isContainerProcessed(id) {
+			t.Errorf("container %s isn't tracked as processed", id)
+		}
+	}
+	var labelCalls int
+	for _, args := range docker.calls() {
+		if args[0] == "container" {
+			labelCalls++
+		}
+	}
+	if labelCalls != 2 {
+		t.Errorf("docker container was run %d times, want only the two checks for label support", labelCalls)
+	}
+	if n := strings.Count(logs.String(), "can't add labels"); n != 1 {
+		t.Errorf("missing label support was logged %d times, want once:\n%s", n, logs.String())
+	}
+}
+
+func TestStartRemapsExistingContainers(t *testing.T) {
+	for _, remapOnStart := range []bool{false, true} {
+		docker := newFakeDocker(t)
+		docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+		s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, RemapOnStart: remapOnStart})
+		if err := s.Start(context.Background()); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		s.Stop()
+
+		recreated := false
+		for _, args := range docker.changes() {
+			recreated = recreated || args[0] == "run"
+		}
+		if recreated != remapOnStart {
+			t.Errorf("with remap on start %v, the out-of-range container was recreated: %v", remapOnStart, recreated)
+		}
+	}
+}
+
+func TestPollerHandlesNewContainers(t *testing.T) {
+	docker := newFakeDocker(t)
+	if NewContainerStore(StoreOptions{}).fallBackToPolling() {
+		t.Error("fell back to polling with polling disabled")
+	}
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, PollInterval: 100 * time.Millisecond})
+	defer s.Stop()
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	// Without events, a container started later is found by the poller
+	if !s.fallBackToPolling() {
+		t.Fatal("didn't fall back to polling")
+	}
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	waitFor(t, "web to be remapped", func() bool {
+		containers := s.GetContainers()
+		return len(containers) == 1 && containers[0].PortMappings[0].HostPort != "8080"
+	})
+}
+
+func TestObserverMakesNoChanges(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "api", Ports: []string{"8080:80/tcp"}})
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	// The options -observer selects
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, ReadOnly: true, DryRun: true, StateFile: stateFile})
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	s.evaluateContainer("aaaa")
+	s.evaluateContainer("bbbb")
+	s.addDynamicPortLabel("bbbb")
+	if _, err := s.ForceRemap("bbbb"); !errors.Is(err, errRemapDisabled) {
+		t.Errorf("ForceRemap = %v, want %v", err, errRemapDisabled)
+	}
+	if _, err := s.RestoreOriginal("bbbb"); !errors.Is(err, errRemapDisabled) {
+		t.Errorf("RestoreOriginal = %v, want %v", err, errRemapDisabled)
+	}
+
+	if changes := docker.changes(); len(changes) != 0 {
+		t.Errorf("observer called docker with %v", callNames(changes))
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("observer wrote the state file: %v", err)
+	}
+}
+
+func TestPortlessContainerIsInspectedOnce(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "worker"})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+
+	inspections := func() int {
+		n := 0
+		for _, args := range docker.calls() {
+			if args[0] == "inspect" && contains(args, "aaaa") {
+				n++
+			}
+		}
+		return n
+	}
+	s.evaluateContainer("aaaa")
+	first := inspections()
+	if first == 0 {
+		t.Fatal("portless container wasn't inspected at all")
+	}
+	s.evaluateContainer("aaaa")
+	if n := inspections(); n != first {
+		t.Errorf("restarting the portless container inspected it %d more times", n-first)
+	}
+
+	// Recreated with a binding, it has a new ID and is picked up as usual
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "worker2", Ports: []string{"8080:80/tcp"}})
+	s.evaluateContainer("bbbb")
+	recreated := false
+	for _, args := range docker.changes() {
+		recreated = recreated || args[0] == "run"
+	}
+	if !recreated {
+		t.Errorf("container with a binding wasn't remapped, docker was called with %v", callNames(docker.changes()))
+	}
+}
+
+func TestRefreshPrunesStaleProcessedContainers(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"20005:80/tcp"}})
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, StateFile: stateFile})
+	// The stop event of gone was missed
+	s.processedContainers["aaaa"] = true
+	s.processedContainers["gone"] = true
+	s.portMappings["gone"] = map[string]string{portMappingKey("", "80", "tcp"): "20006"}
+
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	if !s.isContainerProcessed("aaaa") {
+		t.Error("running container was pruned")
+	}
+	_, processed := s.processedContainers["gone"]
+	_, mapped := s.portMappings["gone"]
+	if processed || mapped {
+		t.Errorf("container missing from docker ps is still processed %v, mapped %v", processed, mapped)
+	}
+
+	restarted := NewContainerStore(StoreOptions{StateFile: stateFile})
+	if err := restarted.loadState(); err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+	if restarted.processedContainers["gone"] || !restarted.processedContainers["aaaa"] {
+		t.Errorf("state file holds %v, want only aaaa", restarted.processedContainers)
+	}
+}
+
+func TestRefreshKeepsContainersProcessedDuringListing(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"20005:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	s.processedContainers["aaaa"] = true
+
+	docker.holdListing()
+	refreshed := make(chan error, 1)
+	go func() { refreshed <- s.refreshContainers() }()
+	waitFor(t, "docker ps to list the containers", docker.listingHeld)
+	// While the listing is held, web is recreated as a container docker ps didn't
+	// see, and the old one is gone before it can be inspected
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "web", Ports: []string{"20006:80/tcp"}})
+	docker.removeContainer("aaaa")
+	s.mu.Lock()
+	s.processedContainers["bbbb"] = true
+	s.mu.Unlock()
+	docker.releaseListing()
+	if err := <-refreshed; err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	if !s.processedContainers["bbbb"] {
+		t.Error("container remapped during the refresh was pruned")
+	}
+	if !s.processedContainers["aaaa"] {
+		t.Error("listed container whose inspect failed was pruned")
+	}
+}
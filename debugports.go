@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxRecentAllocations is how many recent port allocations are kept for debugging
+const maxRecentAllocations = 50
+
+// PortAllocation records a host port handed out by the allocator and how it was found
+type PortAllocation struct {
+	Port   int       `json:"port"`
+	Range  string    `json:"range"`  // The range it was allocated from, e.g. 10000-65000
+	Method string    `json:"method"` // preferred, random, scan, fixed or block
+	At     time.Time `json:"at"`
+}
+
+// AllocatorState is the allocator's view of the host ports, as served by
+// GET /api/debug/ports
+type AllocatorState struct {
+	RangeMin          int              `json:"rangeMin"`
+	RangeMax          int              `json:"rangeMax"`
+	AvoidMin          int              `json:"avoidMin,omitempty"`
+	AvoidMax          int              `json:"avoidMax,omitempty"`
+	ReservedPorts     []int            `json:"reservedPorts"`
+	UsedPorts         []int            `json:"usedPorts"`    // Host ports published by tracked containers
+	ClaimedPorts      []int            `json:"claimedPorts"` // Allocated ports whose remap hasn't finished yet
+	FreeInRange       int              `json:"freeInRange"`
+	RangeExhausted    bool             `json:"rangeExhausted"`
+	RecentAllocations []PortAllocation `json:"recentAllocations"`
+}
+
+// recordAllocation keeps a port the allocator handed out among the most recent ones
+func (s *ContainerStore) recordAllocation(port, minPort, maxPort int, method string) {
+	s.claimMu.Lock()
+	defer s.claimMu.Unlock()
+	s.allocations = append(s.allocations, PortAllocation{
+		Port:   port,
+		Range:  fmt.Sprintf("%d-%d", minPort, maxPort),
+		Method: method,
+		At:     time.Now(),
+	})
+	if len(s.allocations) > maxRecentAllocations {
+		s.allocations = s.allocations[len(s.allocations)-maxRecentAllocations:]
+	}
+}
+
+// AllocatorState returns the allocator's view of the host ports. Counting the free
+// ports bind-tests every port in the range, so this is meant for debugging only.
+func (s *ContainerStore) AllocatorState() AllocatorState {
+	state := AllocatorState{
+		RangeMin:       s.portRangeMin,
+		RangeMax:       s.portRangeMax,
+		AvoidMin:       s.avoidMin,
+		AvoidMax:       s.avoidMax,
+		ReservedPorts:  []int{},
+		UsedPorts:      []int{},
+		ClaimedPorts:   []int{},
+		RangeExhausted: s.RangeExhausted(),
+	}
+
+	used := make(map[int]bool)
+	s.mu.RLock()
+	for port := range s.reservedPorts {
+		state.ReservedPorts = append(state.ReservedPorts, port)
+	}
+	for _, container := range s.containers {
+		for _, mapping := range container.PortMappings {
+			if port, err := strconv.Atoi(mapping.HostPort); err == nil && !used[port] {
+				used[port] = true
+				state.UsedPorts = append(state.UsedPorts, port)
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	claimed := make(map[int]bool)
+	s.claimMu.Lock()
+	for port, claimedAt := range s.portClaims {
+		if time.Since(claimedAt) < portClaimTTL {
+			claimed[port] = true
+			state.ClaimedPorts = append(state.ClaimedPorts, port)
+		}
+	}
+	state.RecentAllocations = append([]PortAllocation{}, s.allocations...)
+	s.claimMu.Unlock()
+
+	sort.Ints(state.ReservedPorts)
+	sort.Ints(state.UsedPorts)
+	sort.Ints(state.ClaimedPorts)
+
+	for port := s.portRangeMin; port <= s.portRangeMax; port++ {
+		if s.reservedPorts[port] || used[port] || claimed[port] {
+			continue
+		}
+		if s.avoidMax > 0 && port >= s.avoidMin && port <= s.avoidMax {
+			continue
+		}
+		if s.isHostPortFree("", port) {
+			state.FreeInRange++
+		}
+	}
+	return state
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// configureDockerHost points every docker and docker-compose command we spawn at the
+// given daemon by setting DOCKER_HOST, which child processes inherit. A socket path
+// is shorthand for a unix:// host. It returns the effective host, which is the
+// inherited DOCKER_HOST when neither is given.
+func configureDockerHost(host, socket string) (string, error) {
+	if host != "" && socket != "" {
+		return "", fmt.Errorf("-docker-host and -docker-socket can't be used together")
+	}
+	if socket != "" {
+		host = "unix://" + socket
+	}
+	if host == "" {
+		return os.Getenv("DOCKER_HOST"), nil
+	}
+	if err := os.Setenv("DOCKER_HOST", host); err != nil {
+		return "", err
+	}
+	return host, nil
+}
+
+// isRemoteDockerHost reports whether a DOCKER_HOST value refers to a daemon on another
+// machine, where containers publish ports on that machine rather than this one
+func isRemoteDockerHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "unix", "npipe", "fd":
+		return false
+	}
+
+	hostname := u.Hostname()
+	if hostname == "" || strings.EqualFold(hostname, "localhost") {
+		return false
+	}
+	if ip := net.ParseIP(hostname); ip != nil && ip.IsLoopback() {
+		return false
+	}
+	return true
+}
+
+// checkDockerAccess makes sure the Docker daemon can be reached, turning the most
+// common first-run failures into errors that say how to fix them
+func checkDockerAccess(ctx context.Context) error {
+	output, err := exec.CommandContext(ctx, "docker", "version", "--format", "{{.Server.Version}}").CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	return dockerAccessError(string(output), err)
+}
+
+// dockerAccessError explains why a docker command failed, based on its output
+func dockerAccessError(output string, err error) error {
+	message := strings.TrimSpace(output)
+	switch {
+	case strings.Contains(strings.ToLower(message), "permission denied"):
+		return fmt.Errorf("%w: permission denied accessing the Docker socket; add your user to the docker group or run with sudo (%s)", errDockerUnavailable, message)
+	case strings.Contains(message, "Cannot connect to the Docker daemon"):
+		return fmt.Errorf("%w: can't connect to the Docker daemon; make sure it is running, or point -docker-host at it (%s)", errDockerUnavailable, message)
+	case errors.Is(err, exec.ErrNotFound):
+		return fmt.Errorf("%w: the docker CLI was not found in PATH; install it to use dynamic-port-mapper", errDockerUnavailable)
+	case message != "":
+		return fmt.Errorf("%w: %s", errDockerUnavailable, message)
+	default:
+		return fmt.Errorf("%w: %v", errDockerUnavailable, err)
+	}
+}
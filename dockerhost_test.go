@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigureDockerHostPropagates(t *testing.T) {
+	// A docker CLI that records the daemon docker version was pointed at, ignoring
+	// commands run by stores that outlived their tests
+	dir := t.TempDir()
+	seen := filepath.Join(dir, "seen")
+	script := "#!/bin/sh\n[ \"$1\" = version ] && echo \"$DOCKER_HOST\" > '" + seen + "'\nexit 0\n"
+	if err := os.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	tests := []struct {
+		host, socket string
+		want         string
+	}{
+		{"tcp://10.0.0.5:2375", "", "tcp://10.0.0.5:2375"},
+		{"", "/run/user/1000/docker.sock", "unix:///run/user/1000/docker.sock"},
+	}
+	for _, tt := range tests {
+		t.Setenv("DOCKER_HOST", "")
+		host, err := configureDockerHost(tt.host, tt.socket)
+		if err != nil || host != tt.want {
+			t.Errorf("configureDockerHost(%q, %q) = %q, %v, want %q", tt.host, tt.socket, host, err, tt.want)
+			continue
+		}
+		if err := checkDockerAccess(context.Background()); err != nil {
+			t.Fatalf("checkDockerAccess failed: %v", err)
+		}
+		data, err := os.ReadFile(seen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(data)); got != tt.want {
+			t.Errorf("docker ran against %q, want %q", got, tt.want)
+		}
+	}
+
+	if _, err := configureDockerHost("tcp://10.0.0.5:2375", "/var/run/docker.sock"); err == nil {
+		t.Error("both -docker-host and -docker-socket were accepted")
+	}
+}
+
+func TestIsRemoteDockerHost(t *testing.T) {
+	for host, want := range map[string]bool{
+		"":                            false,
+		"unix:///var/run/docker.sock": false,
+		"npipe:////./pipe/docker":     false,
+		"tcp://localhost:2375":        false,
+		"tcp://127.0.0.1:2375":        false,
+		"tcp://[::1]:2375":            false,
+		"tcp://10.0.0.5:2375":         true,
+		"ssh://user@build-host":       true,
+	} {
+		if got := isRemoteDockerHost(host); got != want {
+			t.Errorf("isRemoteDockerHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestRemoteDockerSkipsLocalBindTest(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	if NewContainerStore(StoreOptions{}).isHostPortFree("", port) {
+		t.Errorf("port %d bound here is free for a local daemon", port)
+	}
+	if !NewContainerStore(StoreOptions{RemoteDocker: true}).isHostPortFree("", port) {
+		t.Errorf("port %d bound here isn't free for a remote daemon", port)
+	}
+}
+
+func TestCheckDockerAccessPermissionDenied(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\n" +
+		"echo 'permission denied while trying to connect to the Docker daemon socket at unix:///var/run/docker.sock' >&2\n" +
+		"exit 1\n"
+	if err := os.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	err := checkDockerAccess(context.Background())
+	if !errors.Is(err, errDockerUnavailable) || !strings.Contains(err.Error(), "add your user to the docker group") {
+		t.Errorf("checkDockerAccess returned %v, want advice on socket permissions", err)
+	}
+}
+
+func TestDockerAccessError(t *testing.T) {
+	tests := []struct {
+		output string
+		err    error
+		want   string
+	}{
+		{"Cannot connect to the Docker daemon at unix:///var/run/docker.sock. Is the docker daemon running?", errors.New("exit status 1"), "make sure it is running"},
+		{"", exec.ErrNotFound, "docker CLI was not found"},
+		{"Error response from daemon: boom", errors.New("exit status 1"), "boom"},
+	}
+	for _, tt := range tests {
+		err := dockerAccessError(tt.output, tt.err)
+		if !errors.Is(err, errDockerUnavailable) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("dockerAccessError(%q, %v) = %v, want it to mention %q", tt.output, tt.err, err, tt.want)
+		}
+	}
+}
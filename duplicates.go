@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+)
+
+// portCollision is a host port published by two running containers. Move is the one
+// started last, which gets a new host port for Mapping; Keep stays as it is.
+type portCollision struct {
+	Keep    Container
+	Move    Container
+	Mapping PortMapping
+}
+
+// findPortCollisions finds host ports published by more than one of the running
+// containers on overlapping interfaces, as the allocation race between concurrent
+// remaps can leave behind. Containers in other states, listed with -states, are left
+// alone. At most one collision is returned per container to move, since moving it
+// recreates the container and the rest are found again afterwards.
+func findPortCollisions(containers []Container) []portCollision {
+	// Older containers keep their ports, so look at them first
+	var sorted []Container
+	for _, container := range containers {
+		if container.Running() {
+			sorted = append(sorted, container)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].StartedAt.Equal(sorted[j].StartedAt) {
+			return sorted[i].StartedAt.Before(sorted[j].StartedAt)
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	type publisher struct {
+		container Container
+		hostIP    string
+	}
+	owners := make(map[string][]publisher) // hostPort/protocol -> containers publishing it
+	moving := make(map[string]bool)
+	var collisions []portCollision
+	for _, container := range sorted {
+		for _, mapping := range container.PortMappings {
+			if mapping.HostPort == "" {
+				continue
+			}
+			key := mapping.HostPort + "/" + mapping.Protocol
+			for _, owner := range owners[key] {
+				if owner.container.ID == container.ID || !hostIPsOverlap(owner.hostIP, mapping.HostIP) {
+					continue
+				}
+				if !moving[container.ID] {
+					moving[container.ID] = true
+					collisions = append(collisions, portCollision{Keep: owner.container, Move: container, Mapping: mapping})
+				}
+				break
+			}
+			owners[key] = append(owners[key], publisher{container: container, hostIP: mapping.HostIP})
+		}
+	}
+	return collisions
+}
+
+// resolveDuplicatePorts moves containers off host ports that another running container
+// also publishes. It is a safety net run after refreshes, independent of the checks
+// made when a container starts, and does nothing unless the store is managing
+// containers.
+func (s *ContainerStore) resolveDuplicatePorts() {
+	if s.dryRun || s.readOnly || s.planOnly || s.Paused() {
+		return
+	}
+
+	// Remapping refreshes the containers again, which must not start another pass
+	s.mu.Lock()
+	if s.resolvingDuplicates {
+		s.mu.Unlock()
+		return
+	}
+	s.resolvingDuplicates = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.resolvingDuplicates = false
+		s.mu.Unlock()
+	}()
+
+	for _, collision := range findPortCollisions(s.GetContainers()) {
+		move, mapping := collision.Move, collision.Mapping
+		log.Printf("Containers %s and %s both publish host port %s/%s",
+			collision.Keep.Names, move.Names, mapping.HostPort, mapping.Protocol)
+		if !s.shouldManage(move.ID, move.Names, move.ComposeProject) || s.noRecreateImages.Matches(move.Image) || s.isRestored(move.ID) {
+			log.Printf("Container %s is not managed, leaving the duplicate port %s as it is", move.Names, mapping.HostPort)
+			continue
+		}
+
+		newPort, err := s.allocateRandomPortOn(s.remapHostIP(mapping.HostIP), []string{mapping.Protocol})
+		if err != nil {
+			log.Printf("Can't resolve the duplicate port %s of container %s: %v", mapping.HostPort, move.Names, err)
+			return
+		}
+		reason := reasonCollision(collision.Keep.Names)
+		newID, err := s.remapContainerPort(move.ID, mapping.HostIP, mapping.HostPort, strconv.Itoa(newPort), mapping.ContainerPort, mapping.Protocol, reason)
+		if err != nil {
+			log.Printf("Failed to move container %s off the duplicate port %s: %v", move.Names, mapping.HostPort, err)
+			continue
+		}
+		s.recordPortReason(newID, mapping.ContainerPort, mapping.Protocol, reason)
+	}
+}
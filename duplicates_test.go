@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFindPortCollisions(t *testing.T) {
+	started := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	container := func(id, status, hostIP string, age time.Duration) Container {
+		return Container{
+			ID:        id,
+			Names:     id,
+			Status:    status,
+			StartedAt: started.Add(-age),
+			PortMappings: []PortMapping{
+				{ContainerPort: "80", HostIP: hostIP, HostPort: "10500", Protocol: "tcp"},
+			},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		containers []Container
+		wantKeep   string
+		wantMove   string
+	}{
+		{"newer moves", []Container{
+			container("new", "Up 1 minute", "", time.Minute),
+			container("old", "Up 1 hour", "", time.Hour),
+		}, "old", "new"},
+		{"stopped containers hold no ports", []Container{
+			container("old", "Up 1 hour", "", time.Hour),
+			container("exited", "Exited (0) 5 minutes ago", "", time.Minute),
+		}, "", ""},
+		{"paused containers are left alone", []Container{
+			container("old", "Up 1 hour", "", time.Hour),
+			container("paused", "Up 1 minute (Paused)", "", time.Minute),
+		}, "", ""},
+		{"distinct addresses", []Container{
+			container("old", "Up 1 hour", "127.0.0.1", time.Hour),
+			container("new", "Up 1 minute", "127.0.0.2", time.Minute),
+		}, "", ""},
+		{"address within all interfaces", []Container{
+			container("old", "Up 1 hour", "", time.Hour),
+			container("new", "Up 1 minute", "127.0.0.1", time.Minute),
+		}, "old", "new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collisions := findPortCollisions(tt.containers)
+			if tt.wantMove == "" {
+				if len(collisions) != 0 {
+					t.Fatalf("found collisions %+v, want none", collisions)
+				}
+				return
+			}
+			if len(collisions) != 1 || collisions[0].Keep.ID != tt.wantKeep || collisions[0].Move.ID != tt.wantMove {
+				t.Fatalf("found collisions %+v, want %s kept and %s moved", collisions, tt.wantKeep, tt.wantMove)
+			}
+		})
+	}
+}
+
+func TestResolveDuplicatePortsMovesOne(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"20500:80/tcp"}})
+	time.Sleep(10 * time.Millisecond) // api is the newer of the two
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "api", Ports: []string{"20500:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	s.resolveDuplicatePorts()
+
+	var runs [][]string
+	for _, args := range docker.changes() {
+		if args[0] == "run" {
+			runs = append(runs, args)
+		}
+	}
+	if len(runs) != 1 || flagValues(runs[0], "--name")[0] != "api" {
+		t.Fatalf("recreated %q, want only api", runs)
+	}
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+	ports := make(map[string]string)
+	for _, container := range s.GetContainers() {
+		ports[container.Names] = container.PortMappings[0].HostPort
+	}
+	if ports["web"] != "20500" || ports["api"] == "" || ports["api"] == "20500" {
+		t.Errorf("containers publish %v, want web kept on 20500 and api moved", ports)
+	}
+}
+
+func TestResolveDuplicatePortsDuringRefresh(t *testing.T) {
+	// Meant for -race: the port moved to is checked against the tracked containers
+	// again after waiting for the rate limit, while refreshes replace them
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"20500:80/tcp"}})
+	time.Sleep(10 * time.Millisecond) // api is the newer of the two
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "api", Ports: []string{"20500:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, MaxRemapsPerMinute: 60})
+	defer s.Stop()
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+	// Use up the burst, so moving api waits a second for a token
+	s.remapLimiter.tokens, s.remapLimiter.last = 0, time.Now()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.resolveDuplicatePorts()
+	}()
+	for refreshing := true; refreshing; {
+		select {
+		case <-done:
+			refreshing = false
+		default:
+			if err := s.refreshContainers(); err != nil {
+				t.Errorf("refreshContainers failed: %v", err)
+			}
+		}
+	}
+
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+	ports := make(map[string]string)
+	for _, container := range s.GetContainers() {
+		ports[container.Names] = container.PortMappings[0].HostPort
+	}
+	if ports["web"] != "20500" || ports["api"] == "" || ports["api"] == "20500" {
+		t.Errorf("containers publish %v, want web kept on 20500 and api moved", ports)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ephemeralPortRangeFile is where Linux exposes net.ipv4.ip_local_port_range
+const ephemeralPortRangeFile = "/proc/sys/net/ipv4/ip_local_port_range"
+
+// readEphemeralPortRange returns the range the kernel hands out ephemeral ports from.
+// It fails on systems without the Linux sysctl, so callers should fall back to defaults.
+func readEphemeralPortRange() (int, int, error) {
+	data, err := os.ReadFile(ephemeralPortRangeFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseEphemeralPortRange(string(data))
+}
+
+// parseEphemeralPortRange parses the sysctl value, which is two whitespace separated
+// ports such as "32768\t60999"
+func parseEphemeralPortRange(value string) (int, int, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("invalid ephemeral port range %q", strings.TrimSpace(value))
+	}
+
+	minPort, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid ephemeral port range %q: %v", strings.TrimSpace(value), err)
+	}
+	maxPort, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid ephemeral port range %q: %v", strings.TrimSpace(value), err)
+	}
+
+	if minPort < 1 || maxPort > 65535 || minPort > maxPort {
+		return 0, 0, fmt.Errorf("invalid ephemeral port range %d-%d", minPort, maxPort)
+	}
+	return minPort, maxPort, nil
+}
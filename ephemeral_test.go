@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestParseEphemeralPortRange(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max int
+		wantErr  bool
+	}{
+		{"32768\t60999\n", 32768, 60999, false},
+		{"1024 65535", 1024, 65535, false},
+		{"32768", 0, 0, true},
+		{"32768 60999 61000", 0, 0, true},
+		{"low 60999", 0, 0, true},
+		{"60999 32768", 0, 0, true},
+		{"0 60999", 0, 0, true},
+		{"32768 70000", 0, 0, true},
+	}
+	for _, tt := range tests {
+		minPort, maxPort, err := parseEphemeralPortRange(tt.value)
+		if (err != nil) != tt.wantErr || minPort != tt.min || maxPort != tt.max {
+			t.Errorf("parseEphemeralPortRange(%q) = %d, %d, %v, want %d, %d, error %v",
+				tt.value, minPort, maxPort, err, tt.min, tt.max, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,686 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// The fake docker CLI is the test binary itself: newFakeDocker puts a docker script
+// first on PATH that runs it again with fakeDockerRunEnv set, and TestMain then acts
+// as docker instead of running the tests. A docker-compose script next to it runs
+// it as docker compose. Containers are kept as inspect JSON files
+// in the directory named by fakeDockerDirEnv, and every invocation is recorded there.
+const (
+	fakeDockerRunEnv = "DPM_FAKE_DOCKER_RUN"
+	fakeDockerDirEnv = "DPM_FAKE_DOCKER_DIR"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeDockerRunEnv) == "1" {
+		os.Exit(runFakeDocker(os.Getenv(fakeDockerDirEnv), os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// fakeDocker is the docker CLI a test runs against
+type fakeDocker struct {
+	t   testing.TB
+	dir string
+}
+
+// fakeContainer describes a container to start out with
+type fakeContainer struct {
+	ID     string
+	Name   string
+	Image  string
+	Labels map[string]string
+	Ports  []string // As given to docker run -p, e.g. "8080:80/tcp" or "127.0.0.1:8080:80/tcp"
+
+	PublishAll   bool // Started with --publish-all, so Ports were picked by Docker
+	RestartCount int
+
+	// Further inspect fields, merged into the Config and HostConfig sections
+	Config     map[string]interface{}
+	HostConfig map[string]interface{}
+	Networks   map[string]interface{} // Endpoint settings by network, as in NetworkSettings.Networks
+}
+
+// newFakeDocker puts a fake docker CLI first on PATH for the rest of the test
+func newFakeDocker(t testing.TB) *fakeDocker {
+	t.Helper()
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "containers"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, prefix := range map[string]string{"docker": "", "docker-compose": "compose "} {
+		// Under -race, every exit would otherwise wait a second for late reports
+		script := fmt.Sprintf("#!/bin/sh\nGORACE=\"$GORACE atexit_sleep_ms=0\" %s=1 exec '%s' %s\"$@\"\n", fakeDockerRunEnv, executable, prefix)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv(fakeDockerDirEnv, dir)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return &fakeDocker{t: t, dir: dir}
+}
+
+// addContainer adds a running container
+func (f *fakeDocker) addContainer(c fakeContainer) {
+	f.t.Helper()
+	if c.Image == "" {
+		c.Image = "nginx:latest"
+	}
+	if err := saveFakeContainer(f.dir, newFakeInspect(c)); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// removeContainer removes a container as docker rm -f would
+func (f *fakeDocker) removeContainer(id string) {
+	f.t.Helper()
+	if err := os.Remove(filepath.Join(f.dir, "containers", id+".json")); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// holdListing makes docker ps wait after printing its listing until releaseListing
+// is called, so a test can act while a refresh is underway
+func (f *fakeDocker) holdListing() {
+	f.t.Helper()
+	if err := os.WriteFile(filepath.Join(f.dir, "hold-ps"), nil, 0o644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// listingHeld reports whether a docker ps has printed its listing and is waiting
+// for releaseListing
+func (f *fakeDocker) listingHeld() bool {
+	_, err := os.Stat(filepath.Join(f.dir, "ps-held"))
+	return err == nil
+}
+
+// releaseListing lets a held docker ps exit
+func (f *fakeDocker) releaseListing() {
+	f.t.Helper()
+	if err := os.Remove(filepath.Join(f.dir, "hold-ps")); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// holdEvents makes docker events stay open after reporting its events until
+// releaseEvents is called, rather than ending right away
+func (f *fakeDocker) holdEvents() {
+	f.t.Helper()
+	if err := os.WriteFile(filepath.Join(f.dir, "hold-events"), nil, 0o644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// eventsHeld reports whether a docker events has reported its events and is waiting
+// for releaseEvents
+func (f *fakeDocker) eventsHeld() bool {
+	_, err := os.Stat(filepath.Join(f.dir, "events-held"))
+	return err == nil
+}
+
+// releaseEvents lets a held docker events end
+func (f *fakeDocker) releaseEvents() {
+	f.t.Helper()
+	if err := os.Remove(filepath.Join(f.dir, "hold-events")); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// failRuns makes docker run fail from now on
+func (f *fakeDocker) failRuns() {
+	f.t.Helper()
+	if err := os.WriteFile(filepath.Join(f.dir, "fail-run"), nil, 0o644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// exitRuns makes the containers docker run creates from now on exit right away
+func (f *fakeDocker) exitRuns() {
+	f.t.Helper()
+	if err := os.WriteFile(filepath.Join(f.dir, "exit-run"), nil, 0o644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// hangStops makes docker stop hang until it is killed from now on, so a test can
+// stop the store in the middle of a remap
+func (f *fakeDocker) hangStops() {
+	f.t.Helper()
+	if err := os.WriteFile(filepath.Join(f.dir, "hang-stop"), nil, 0o644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// addEvent adds a container event to the ones docker events reports
+func (f *fakeDocker) addEvent(action, id string, timeNano int64) {
+	f.t.Helper()
+	line, err := json.Marshal(DockerEvent{Status: action, ID: id, Type: "container", Action: action, TimeNano: timeNano})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	events, err := os.OpenFile(filepath.Join(f.dir, "events"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	defer events.Close()
+	if _, err := fmt.Fprintf(events, "%s\n", line); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// calls returns the arguments of every docker invocation so far, in order
+func (f *fakeDocker) calls() [][]string {
+	f.t.Helper()
+	data, err := os.ReadFile(filepath.Join(f.dir, "calls"))
+	if err != nil && !os.IsNotExist(err) {
+		f.t.Fatal(err)
+	}
+	var calls [][]string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var args []string
+		if err := json.Unmarshal([]byte(line), &args); err != nil {
+			f.t.Fatal(err)
+		}
+		calls = append(calls, args)
+	}
+	return calls
+}
+
+// changes returns the invocations that change containers, leaving out the ones that
+// only look at them
+func (f *fakeDocker) changes() [][]string {
+	var changes [][]string
+	for _, args := range f.calls() {
+		switch {
+		case len(args) == 0, args[0] == "ps", args[0] == "inspect", args[0] == "image", args[0] == "version":
+		case args[0] == "container" && args[len(args)-1] == "--help":
+		case args[0] == "compose" && args[len(args)-1] == "config", args[0] == "events":
+		default:
+			changes = append(changes, args)
+		}
+	}
+	return changes
+}
+
+// removeImage makes an image missing locally until it is pulled
+func (f *fakeDocker) removeImage(image string) {
+	f.t.Helper()
+	missing := filepath.Join(f.dir, "missing-images")
+	if err := os.MkdirAll(missing, 0o755); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(missing, url.PathEscape(image)), nil, 0o644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// fakeImageMissing reports whether an image was removed with removeImage
+func fakeImageMissing(dir, image string) bool {
+	_, err := os.Stat(filepath.Join(dir, "missing-images", url.PathEscape(image)))
+	return err == nil
+}
+
+// composeDirs returns the working directories compose subcommands other than config
+// were run in
+func (f *fakeDocker) composeDirs() []string {
+	f.t.Helper()
+	data, err := os.ReadFile(filepath.Join(f.dir, "compose-dirs"))
+	if err != nil && !os.IsNotExist(err) {
+		f.t.Fatal(err)
+	}
+	return strings.Fields(string(data))
+}
+
+// setComposeConfig makes docker compose config print the given configuration, as
+// Compose would after resolving extends and includes, instead of the compose file
+func (f *fakeDocker) setComposeConfig(config string) {
+	f.t.Helper()
+	if err := os.WriteFile(filepath.Join(f.dir, "compose-config"), []byte(config), 0o644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// callNames returns the docker subcommands of the given invocations
+func callNames(calls [][]string) []string {
+	names := []string{}
+	for _, args := range calls {
+		names = append(names, args[0])
+	}
+	return names
+}
+
+// flagValues returns the values given for a flag in a docker invocation
+func flagValues(args []string, flag string) []string {
+	var values []string
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == flag {
+			values = append(values, args[i+1])
+		}
+	}
+	return values
+}
+
+// newFakeInspect builds the docker inspect document of a running container
+func newFakeInspect(c fakeContainer) map[string]interface{} {
+	labels := make(map[string]interface{})
+	for key, value := range c.Labels {
+		labels[key] = value
+	}
+	bindings := make(map[string]interface{})
+	for _, spec := range c.Ports {
+		key, hostIP, hostPort := parseFakePublish(spec)
+		existing, _ := bindings[key].([]interface{})
+		bindings[key] = append(existing, map[string]interface{}{"HostIp": hostIP, "HostPort": hostPort})
+	}
+	// Ports Docker picks for --publish-all are only listed among the published ones
+	portBindings := bindings
+	if c.PublishAll {
+		portBindings = map[string]interface{}{}
+	}
+	config := map[string]interface{}{"Image": c.Image, "Labels": labels, "Env": []interface{}{}}
+	for key, value := range c.Config {
+		config[key] = value
+	}
+	hostConfig := map[string]interface{}{
+		"NetworkMode":     "default",
+		"PortBindings":    portBindings,
+		"PublishAllPorts": c.PublishAll,
+	}
+	for key, value := range c.HostConfig {
+		hostConfig[key] = value
+	}
+	networks := map[string]interface{}{}
+	for name, endpoint := range c.Networks {
+		networks[name] = endpoint
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	return map[string]interface{}{
+		"Id":              c.ID,
+		"Name":            "/" + c.Name,
+		"Created":         now,
+		"RestartCount":    c.RestartCount,
+		"State":           map[string]interface{}{"Status": "running", "Running": true, "StartedAt": now},
+		"Config":          config,
+		"HostConfig":      hostConfig,
+		"NetworkSettings": map[string]interface{}{"Networks": networks, "Ports": bindings},
+		"Mounts":          []interface{}{},
+	}
+}
+
+// parseFakePublish splits a docker run -p value into its containerPort/protocol,
+// host IP and host port
+func parseFakePublish(spec string) (string, string, string) {
+	at := strings.LastIndex(spec, ":")
+	key, rest := spec[at+1:], spec[:at]
+	if !strings.Contains(key, "/") {
+		key += "/tcp"
+	}
+	at = strings.LastIndex(rest, ":")
+	if at < 0 {
+		return key, "", rest
+	}
+	return key, strings.Trim(rest[:at], "[]"), rest[at+1:]
+}
+
+func saveFakeContainer(dir string, doc map[string]interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "containers", doc["Id"].(string)+".json"), data, 0o644)
+}
+
+// loadFakeContainers returns the inspect documents of all containers, by ID
+func loadFakeContainers(dir string) map[string]map[string]interface{} {
+	containers := make(map[string]map[string]interface{})
+	files, _ := filepath.Glob(filepath.Join(dir, "containers", "*.json"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var doc map[string]interface{}
+		if json.Unmarshal(data, &doc) == nil {
+			containers[doc["Id"].(string)] = doc
+		}
+	}
+	return containers
+}
+
+// findFakeContainer looks a container up by ID, unique ID prefix or name
+func findFakeContainer(dir, ref string) (map[string]interface{}, bool) {
+	var match map[string]interface{}
+	for id, doc := range loadFakeContainers(dir) {
+		if id == ref || doc["Name"] == "/"+strings.TrimPrefix(ref, "/") {
+			return doc, true
+		}
+		if strings.HasPrefix(id, ref) {
+			if match != nil {
+				return nil, false
+			}
+			match = doc
+		}
+	}
+	return match, match != nil
+}
+
+// runFakeDocker handles one docker invocation, returning its exit status
+func runFakeDocker(dir string, args []string) int {
+	if line, err := json.Marshal(args); err == nil {
+		if log, err := os.OpenFile(filepath.Join(dir, "calls"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644); err == nil {
+			fmt.Fprintf(log, "%s\n", line)
+			log.Close()
+		}
+	}
+	if len(args) == 0 {
+		return 1
+	}
+
+	switch args[0] {
+	case "ps":
+		containers := loadFakeContainers(dir)
+		ids := make([]string, 0, len(containers))
+		for id := range containers {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			doc := containers[id]
+			state := doc["State"].(map[string]interface{})
+			if running, _ := state["Running"].(bool); !running {
+				continue
+			}
+			line, _ := json.Marshal(map[string]string{
+				"ID":         id,
+				"Image":      doc["Config"].(map[string]interface{})["Image"].(string),
+				"Names":      strings.TrimPrefix(doc["Name"].(string), "/"),
+				"Status":     "Up 1 minute",
+				"RunningFor": "1 minute ago",
+				"Ports":      fakePsPorts(doc),
+			})
+			fmt.Printf("%s\n", line)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "hold-ps")); err == nil {
+			os.WriteFile(filepath.Join(dir, "ps-held"), nil, 0o644)
+			for err == nil {
+				time.Sleep(10 * time.Millisecond)
+				_, err = os.Stat(filepath.Join(dir, "hold-ps"))
+			}
+			os.Remove(filepath.Join(dir, "ps-held"))
+		}
+		return 0
+
+	case "inspect":
+		refs, format := args[1:], ""
+		if len(refs) >= 2 && refs[0] == "--format" {
+			format, refs = refs[1], refs[2:]
+		}
+		var docs []interface{}
+		for _, ref := range refs {
+			doc, ok := findFakeContainer(dir, ref)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "Error: No such object: %s\n", ref)
+				return 1
+			}
+			docs = append(docs, doc)
+		}
+		if format == "" {
+			data, _ := json.Marshal(docs)
+			fmt.Printf("%s\n", data)
+			return 0
+		}
+		tmpl, err := template.New("format").Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				data, err := json.Marshal(v)
+				return string(data), err
+			},
+		}).Parse(format)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "template parsing error: %v\n", err)
+			return 1
+		}
+		for _, doc := range docs {
+			if err := tmpl.Execute(os.Stdout, doc); err != nil {
+				fmt.Fprintf(os.Stderr, "template: %v\n", err)
+				return 1
+			}
+			fmt.Println()
+		}
+		return 0
+
+	case "stop", "kill", "start":
+		doc, ok := findFakeContainer(dir, args[len(args)-1])
+		if !ok {
+			return 1
+		}
+		if _, err := os.Stat(filepath.Join(dir, "hang-stop")); err == nil && args[0] == "stop" {
+			time.Sleep(time.Hour)
+		}
+		running := args[0] == "start"
+		status := "exited"
+		if running {
+			status = "running"
+		}
+		state := doc["State"].(map[string]interface{})
+		state["Running"], state["Status"] = running, status
+		return exitStatus(saveFakeContainer(dir, doc))
+
+	case "rename":
+		if len(args) != 3 {
+			return 1
+		}
+		doc, ok := findFakeContainer(dir, args[1])
+		if !ok {
+			return 1
+		}
+		doc["Name"] = "/" + args[2]
+		return exitStatus(saveFakeContainer(dir, doc))
+
+	case "rm":
+		doc, ok := findFakeContainer(dir, args[len(args)-1])
+		if !ok {
+			return 1
+		}
+		return exitStatus(os.Remove(filepath.Join(dir, "containers", doc["Id"].(string)+".json")))
+
+	case "run":
+		return runFakeContainer(dir, args[1:])
+
+	case "container":
+		// Labels can't be changed on existing containers, so tracking stays in memory
+		if args[len(args)-1] == "--help" {
+			return 1
+		}
+		return 0
+
+	case "version":
+		fmt.Println("25.0.0")
+		return 0
+
+	case "events":
+		// Reports the events added so far, from --since on, and then ends as if the
+		// daemon went away, once released if held
+		var since int64
+		if values := flagValues(args, "--since"); len(values) > 0 {
+			seconds, nanos, _ := strings.Cut(values[0], ".")
+			s, _ := strconv.ParseInt(seconds, 10, 64)
+			n, _ := strconv.ParseInt(nanos, 10, 64)
+			since = s*int64(time.Second) + n
+		}
+		data, _ := os.ReadFile(filepath.Join(dir, "events"))
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var event DockerEvent
+			if json.Unmarshal([]byte(line), &event) == nil && event.TimeNano >= since {
+				fmt.Println(line)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dir, "hold-events")); err == nil {
+			os.WriteFile(filepath.Join(dir, "events-held"), nil, 0o644)
+			for err == nil {
+				time.Sleep(10 * time.Millisecond)
+				_, err = os.Stat(filepath.Join(dir, "hold-events"))
+			}
+			os.Remove(filepath.Join(dir, "events-held"))
+		}
+		return 0
+
+	case "image":
+		// Images are present unless removed with removeImage
+		if len(args) > 2 && args[1] == "inspect" && fakeImageMissing(dir, args[2]) {
+			fmt.Fprintf(os.Stderr, "Error: No such image: %s\n", args[2])
+			return 1
+		}
+		return 0
+
+	case "pull":
+		if len(args) > 1 {
+			os.Remove(filepath.Join(dir, "missing-images", url.PathEscape(args[1])))
+		}
+		return 0
+
+	case "compose":
+		// Only config is supported, printing the compose file as it is or the
+		// configuration given to setComposeConfig. Other subcommands just record the
+		// directory they were run in.
+		files := flagValues(args, "-f")
+		if args[len(args)-1] != "config" || len(files) == 0 {
+			if wd, err := os.Getwd(); err == nil {
+				if dirs, err := os.OpenFile(filepath.Join(dir, "compose-dirs"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644); err == nil {
+					fmt.Fprintln(dirs, wd)
+					dirs.Close()
+				}
+			}
+			return 0
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "compose-config")); err == nil {
+			os.Stdout.Write(data)
+			return 0
+		}
+		data, err := os.ReadFile(files[len(files)-1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		os.Stdout.Write(data)
+		return 0
+	}
+	return 0
+}
+
+// runFakeContainer handles docker run, creating a running container and printing its ID
+func runFakeContainer(dir string, args []string) int {
+	if _, err := os.Stat(filepath.Join(dir, "fail-run")); err == nil {
+		fmt.Fprintln(os.Stderr, "docker: Error response from daemon: driver failed programming external connectivity")
+		return 125
+	}
+
+	valueFlags := map[string]bool{
+		"--name": true, "--network": true, "--network-alias": true, "--restart": true,
+		"--add-host": true, "-v": true, "-p": true, "-e": true, "--label": true, "--cidfile": true,
+	}
+	c := fakeContainer{Labels: make(map[string]string)}
+	var cidFile string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			c.Image = arg
+			break
+		}
+		if arg == "-P" || arg == "--publish-all" {
+			c.PublishAll = true
+		}
+		if !valueFlags[arg] || i+1 == len(args) {
+			continue
+		}
+		i++
+		switch arg {
+		case "--name":
+			c.Name = args[i]
+		case "--cidfile":
+			cidFile = args[i]
+		case "-p":
+			c.Ports = append(c.Ports, args[i])
+		case "--label":
+			key, value, _ := strings.Cut(args[i], "=")
+			c.Labels[key] = value
+		}
+	}
+	if _, exists := findFakeContainer(dir, c.Name); exists {
+		fmt.Fprintf(os.Stderr, "docker: Error response from daemon: Conflict. The container name \"/%s\" is already in use\n", c.Name)
+		return 125
+	}
+
+	next := 1
+	if data, err := os.ReadFile(filepath.Join(dir, "next")); err == nil {
+		next, _ = strconv.Atoi(string(data))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "next"), []byte(strconv.Itoa(next+1)), 0o644); err != nil {
+		return 1
+	}
+	c.ID = fmt.Sprintf("%064x", 0xf00000+next)
+	doc := newFakeInspect(c)
+	if _, err := os.Stat(filepath.Join(dir, "exit-run")); err == nil {
+		doc["State"] = map[string]interface{}{"Status": "exited", "Running": false, "ExitCode": 1}
+	}
+	if err := saveFakeContainer(dir, doc); err != nil {
+		return 1
+	}
+	if cidFile != "" {
+		if err := os.WriteFile(cidFile, []byte(c.ID), 0o644); err != nil {
+			return 1
+		}
+	}
+	fmt.Println(c.ID)
+	return 0
+}
+
+// fakePsPorts renders a container's published ports as docker ps shows them
+func fakePsPorts(doc map[string]interface{}) string {
+	bindings, _ := doc["NetworkSettings"].(map[string]interface{})["Ports"].(map[string]interface{})
+	var ports []string
+	for key, value := range bindings {
+		list, _ := value.([]interface{})
+		for _, b := range list {
+			binding, _ := b.(map[string]interface{})
+			hostIP, _ := binding["HostIp"].(string)
+			switch {
+			case hostIP == "":
+				hostIP = "0.0.0.0"
+			case strings.Contains(hostIP, ":"):
+				hostIP = "[" + hostIP + "]"
+			}
+			ports = append(ports, fmt.Sprintf("%s:%s->%s", hostIP, binding["HostPort"], key))
+		}
+	}
+	sort.Strings(ports)
+	return strings.Join(ports, ", ")
+}
+
+func exitStatus(err error) int {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
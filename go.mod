@@ -4,4 +4,4 @@ go 1.22.0
 
 // No external dependencies needed as we're using exec to call Docker CLI
 
-require gopkg.in/yaml.v3 v3.0.1 // indirect
+require gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"gzip, deflate, br", true},
+		{"deflate, GZIP;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip;q=0.0, deflate", false},
+		{"br", false},
+		{"x-gzip", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+		if got := acceptsGzip(r); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+func TestGzipHandler(t *testing.T) {
+	body := `{"containers":[` + strings.Repeat(`{"id":"abc","ports":"8080->80/tcp"},`, 100) + `{}]}`
+	handler := gzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: {}\n\n")
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, body)
+		}
+	}))
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// A gzip-capable client receives the compressed body
+	w := get("/api/containers", "gzip")
+	if encoding := w.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", encoding)
+	}
+	if w.Body.Len() >= len(body) {
+		t.Errorf("compressed body has %d bytes, the plain one %d", w.Body.Len(), len(body))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("body isn't gzip: %v", err)
+	}
+	plain, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("body doesn't decompress: %v", err)
+	}
+	if string(plain) != body {
+		t.Errorf("body decompresses to %q, want %q", plain, body)
+	}
+	if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", vary)
+	}
+
+	// Other clients, event streams and empty responses are passed through
+	for _, tt := range []struct{ path, acceptEncoding, want string }{
+		{"/api/containers", "", body},
+		{"/api/containers", "gzip;q=0", body},
+		{"/api/events", "gzip", "data: {}\n\n"},
+		{"/empty", "gzip", ""},
+	} {
+		w := get(tt.path, tt.acceptEncoding)
+		if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+			t.Errorf("GET %s with Accept-Encoding %q is encoded as %s", tt.path, tt.acceptEncoding, encoding)
+		}
+		if w.Body.String() != tt.want {
+			t.Errorf("GET %s with Accept-Encoding %q returned %q, want %q", tt.path, tt.acceptEncoding, w.Body.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// errImageMissing is returned when a container can't be recreated because its image
+// is no longer present locally
+var errImageMissing = errors.New("image not present locally")
+
+// imagePatterns is a list of image name patterns, such as postgres* or
+// bitnami/mysql:8*, as used by -no-recreate-images
+type imagePatterns []string
+
+// parseImagePatterns parses a comma-separated list of image name patterns
+func parseImagePatterns(value string) imagePatterns {
+	var patterns imagePatterns
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// Matches reports whether an image matches any of the patterns. Patterns are matched
+// against the full image reference and against its last path element, so postgres*
+// also matches docker.io/library/postgres:16 and bitnami/postgresql.
+func (p imagePatterns) Matches(image string) bool {
+	if image == "" {
+		return false
+	}
+	base := image[strings.LastIndex(image, "/")+1:]
+	for _, pattern := range p {
+		if matched, _ := path.Match(pattern, image); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, base); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureImage checks that an image is present locally before a container is torn down
+// to be recreated from it. A missing image is pulled when pull is set, as with
+// -pull-on-recreate; otherwise the remap is refused, leaving the container untouched.
+func ensureImage(ctx context.Context, image string, pull bool) error {
+	if exec.CommandContext(ctx, "docker", "image", "inspect", image).Run() == nil {
+		return nil
+	}
+	if !pull {
+		return fmt.Errorf("%w: %s (pass -pull-on-recreate to pull it)", errImageMissing, image)
+	}
+	log.Printf("Image %s is not present locally, pulling it", image)
+	if output, err := exec.CommandContext(ctx, "docker", "pull", image).CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s could not be pulled: %v, output: %s", errImageMissing, image, err, string(output))
+	}
+	return nil
+}
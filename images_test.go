@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestImagePatternsMatches(t *testing.T) {
+	patterns := parseImagePatterns("postgres*, bitnami/mysql:8*,")
+	tests := []struct {
+		image string
+		want  bool
+	}{
+		{"postgres", true},
+		{"postgres:16", true},
+		{"docker.io/library/postgres:16", true},
+		{"bitnami/postgresql", true},
+		{"bitnami/mysql:8.0", true},
+		{"bitnami/mysql:5.7", false},
+		{"mysql:8.0", false},
+		{"nginx:latest", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := patterns.Matches(tt.image); got != tt.want {
+			t.Errorf("Matches(%q) = %v, want %v", tt.image, got, tt.want)
+		}
+	}
+}
+
+func TestNoRecreateImagesSkipsMatchingImages(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "db", Image: "postgres:16", Ports: []string{"5432:5432/tcp"}})
+	docker.addContainer(fakeContainer{ID: "bbbb", Name: "web", Image: "nginx:latest", Ports: []string{"8080:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, NoRecreateImages: parseImagePatterns("postgres*")})
+
+	s.evaluateContainer("aaaa")
+	s.evaluateContainer("bbbb")
+
+	var recreated []string
+	for _, args := range docker.changes() {
+		switch args[0] {
+		case "stop", "rm":
+			if args[len(args)-1] == "aaaa" {
+				t.Errorf("postgres container was touched: %q", args)
+			}
+		case "run":
+			recreated = append(recreated, args[len(args)-1])
+		}
+	}
+	if len(recreated) != 1 || recreated[0] != "nginx:latest" {
+		t.Errorf("recreated images %q, want only nginx:latest", recreated)
+	}
+}
+
+func TestRecreateWithMissingImage(t *testing.T) {
+	for _, pull := range []bool{false, true} {
+		docker := newFakeDocker(t)
+		docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Image: "example/web:1.2", Ports: []string{"8080:80/tcp"}})
+		docker.removeImage("example/web:1.2")
+		if err := ensureImage(context.Background(), "example/web:1.2", false); !errors.Is(err, errImageMissing) {
+			t.Fatalf("ensureImage = %v, want %v", err, errImageMissing)
+		}
+		s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, PullOnRecreate: pull})
+
+		s.evaluateContainer("aaaa")
+
+		got := callNames(docker.changes())
+		want := []string{}
+		if pull {
+			want = []string{"pull", "stop", "rename", "run", "rm"}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("with pull on recreate %v, docker was called with %v, want %v", pull, got, want)
+		}
+	}
+}
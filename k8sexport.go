@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Kubernetes' default NodePort range, outside of which Services are rejected unless
+// the cluster is configured otherwise
+const (
+	nodePortMin = 30000
+	nodePortMax = 32767
+)
+
+// k8sService is the subset of a Kubernetes Service manifest export-k8s produces
+type k8sService struct {
+	APIVersion string         `yaml:"apiVersion"`
+	Kind       string         `yaml:"kind"`
+	Metadata   k8sMetadata    `yaml:"metadata"`
+	Spec       k8sServiceSpec `yaml:"spec"`
+}
+
+type k8sMetadata struct {
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+type k8sServiceSpec struct {
+	Type     string            `yaml:"type"`
+	Selector map[string]string `yaml:"selector"`
+	Ports    []k8sServicePort  `yaml:"ports"`
+}
+
+type k8sServicePort struct {
+	Name       string `yaml:"name"`
+	Protocol   string `yaml:"protocol"`
+	Port       int    `yaml:"port"`
+	TargetPort int    `yaml:"targetPort"`
+	NodePort   int    `yaml:"nodePort"`
+}
+
+// k8sNameInvalid matches the characters not allowed in Kubernetes resource names
+var k8sNameInvalid = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// k8sName turns a compose name into a valid Kubernetes resource name
+func k8sName(name string) string {
+	name = k8sNameInvalid.ReplaceAllString(strings.ToLower(name), "-")
+	name = strings.Trim(name, "-")
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-")
+	}
+	return name
+}
+
+// k8sServices builds one NodePort Service per compose service of a project, exposing
+// each published container port on the host port it currently has. Only ports are
+// translated; the selectors assume pods labelled app.kubernetes.io/name=<service>.
+func k8sServices(project string, containers []Container) []k8sService {
+	byService := make(map[string]map[string]k8sServicePort)
+	for _, container := range containers {
+		service := container.ComposeService
+		if service == "" {
+			service = container.Names
+		}
+		for _, mapping := range container.PortMappings {
+			containerPort, err := strconv.Atoi(mapping.ContainerPort)
+			if err != nil {
+				continue
+			}
+			hostPort, err := strconv.Atoi(mapping.HostPort)
+			if err != nil {
+				continue
+			}
+			if byService[service] == nil {
+				byService[service] = make(map[string]k8sServicePort)
+			}
+			// Docker lists a port once per address family; it is one Service port
+			key := mapping.ContainerPort + "/" + mapping.Protocol
+			byService[service][key] = k8sServicePort{
+				Name:       fmt.Sprintf("%s-%s", mapping.ContainerPort, mapping.Protocol),
+				Protocol:   strings.ToUpper(mapping.Protocol),
+				Port:       containerPort,
+				TargetPort: containerPort,
+				NodePort:   hostPort,
+			}
+		}
+	}
+
+	serviceNames := make([]string, 0, len(byService))
+	for service := range byService {
+		serviceNames = append(serviceNames, service)
+	}
+	sort.Strings(serviceNames)
+
+	var manifests []k8sService
+	for _, service := range serviceNames {
+		ports := make([]k8sServicePort, 0, len(byService[service]))
+		for _, port := range byService[service] {
+			ports = append(ports, port)
+		}
+		sort.Slice(ports, func(i, j int) bool {
+			if ports[i].Port != ports[j].Port {
+				return ports[i].Port < ports[j].Port
+			}
+			return ports[i].Protocol < ports[j].Protocol
+		})
+
+		name := k8sName(service)
+		manifests = append(manifests, k8sService{
+			APIVersion: "v1",
+			Kind:       "Service",
+			Metadata: k8sMetadata{
+				Name: name,
+				Labels: map[string]string{
+					"app.kubernetes.io/name":    name,
+					"app.kubernetes.io/part-of": k8sName(project),
+				},
+			},
+			Spec: k8sServiceSpec{
+				Type:     "NodePort",
+				Selector: map[string]string{"app.kubernetes.io/name": name},
+				Ports:    ports,
+			},
+		})
+	}
+	return manifests
+}
+
+// runExportK8sCommand prints Kubernetes NodePort Service manifests for the containers
+// of a compose project, keeping the host ports they currently have,
+// e.g. dynamic-port-mapper export-k8s app1 > app1-services.yaml
+func runExportK8sCommand(store *ContainerStore, args []string) error {
+	exportFlags := flag.NewFlagSet("export-k8s", flag.ExitOnError)
+	exportFlags.Parse(args)
+	project := exportFlags.Arg(0)
+	if project == "" {
+		return fmt.Errorf("missing project. Usage: dynamic-port-mapper export-k8s <project>")
+	}
+
+	if err := store.refreshContainers(); err != nil {
+		return err
+	}
+	containers := store.GetContainersForProject(project)
+	if len(containers) == 0 {
+		return fmt.Errorf("no running containers found for project %s", project)
+	}
+
+	manifests := k8sServices(project, containers)
+	if len(manifests) == 0 {
+		return fmt.Errorf("project %s publishes no ports", project)
+	}
+
+	var out bytes.Buffer
+	for i, manifest := range manifests {
+		for _, port := range manifest.Spec.Ports {
+			if port.NodePort < nodePortMin || port.NodePort > nodePortMax {
+				log.Printf("Warning: nodePort %d of %s is outside Kubernetes' default NodePort range %d-%d",
+					port.NodePort, manifest.Metadata.Name, nodePortMin, nodePortMax)
+			}
+		}
+		if i > 0 {
+			out.WriteString("---\n")
+		}
+		data, err := yaml.Marshal(manifest)
+		if err != nil {
+			return fmt.Errorf("failed to generate manifest for %s: %v", manifest.Metadata.Name, err)
+		}
+		out.Write(data)
+	}
+	_, err := os.Stdout.Write(out.Bytes())
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestK8sServices(t *testing.T) {
+	containers := []Container{
+		{Names: "shop_web_1", ComposeService: "web", PortMappings: []PortMapping{
+			{ContainerPort: "80", HostPort: "30080", Protocol: "tcp"},
+			{ContainerPort: "80", HostPort: "30080", Protocol: "tcp", HostIP: "::"},
+			{ContainerPort: "53", HostPort: "30053", Protocol: "udp"},
+		}},
+		{Names: "shop_Admin_UI_1", ComposeService: "Admin_UI", PortMappings: []PortMapping{
+			{ContainerPort: "3000", HostPort: "30300", Protocol: "tcp"},
+		}},
+		{Names: "shop_worker_1", ComposeService: "worker"},
+	}
+
+	manifests := k8sServices("My_Shop", containers)
+	if len(manifests) != 2 {
+		t.Fatalf("got %d manifests, want one per service with ports: %+v", len(manifests), manifests)
+	}
+	admin, web := manifests[0], manifests[1]
+	if admin.Metadata.Name != "admin-ui" || web.Metadata.Name != "web" {
+		t.Errorf("services are named %q and %q, want admin-ui and web", admin.Metadata.Name, web.Metadata.Name)
+	}
+	wantPorts := []k8sServicePort{
+		{Name: "53-udp", Protocol: "UDP", Port: 53, TargetPort: 53, NodePort: 30053},
+		{Name: "80-tcp", Protocol: "TCP", Port: 80, TargetPort: 80, NodePort: 30080},
+	}
+	if !reflect.DeepEqual(web.Spec.Ports, wantPorts) {
+		t.Errorf("web exposes %+v, want %+v", web.Spec.Ports, wantPorts)
+	}
+
+	data, err := yaml.Marshal(web)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest map[string]interface{}
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata": map[string]interface{}{
+			"name":   "web",
+			"labels": map[string]interface{}{"app.kubernetes.io/name": "web", "app.kubernetes.io/part-of": "my-shop"},
+		},
+		"spec": map[string]interface{}{
+			"type":     "NodePort",
+			"selector": map[string]interface{}{"app.kubernetes.io/name": "web"},
+			"ports": []interface{}{
+				map[string]interface{}{"name": "53-udp", "protocol": "UDP", "port": 53, "targetPort": 53, "nodePort": 30053},
+				map[string]interface{}{"name": "80-tcp", "protocol": "TCP", "port": 80, "targetPort": 80, "nodePort": 30080},
+			},
+		},
+	}
+	if !reflect.DeepEqual(manifest, want) {
+		t.Errorf("manifest is\n%s\nwant the structure %v", data, want)
+	}
+}
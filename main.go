@@ -1,61 +1,122 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // Container represents a Docker container
 type Container struct {
-	ID              string
-	Image           string
-	Command         string
-	Created         string
-	Status          string
-	Ports           string
-	Names           string
-	ComposeProject  string
-	ComposeService  string
-	PortMappings    []PortMapping // Detailed port mapping information
-	DynamicPorts    bool          // Whether this container has dynamically remapped ports
+	ID              string        `json:"id" yaml:"id"`
+	Image           string        `json:"image" yaml:"image"`
+	Command         string        `json:"command" yaml:"command"`
+	Created         string        `json:"created" yaml:"created"`             // How long ago the container was created, for display
+	CreatedAt       time.Time     `json:"createdAt" yaml:"createdAt"`         // When the container was created, from docker inspect
+	Status          string        `json:"status" yaml:"status"`
+	Ports           string        `json:"ports" yaml:"ports"`
+	Names           string        `json:"names" yaml:"names"`
+	ComposeProject  string        `json:"composeProject" yaml:"composeProject"`
+	ComposeService  string        `json:"composeService" yaml:"composeService"`
+	Networks        string        `json:"networks" yaml:"networks"`           // Comma-separated list of networks the container is attached to
+	PortMappings    []PortMapping `json:"portMappings" yaml:"portMappings"`   // Detailed port mapping information
+	DynamicPorts    bool          `json:"dynamicPorts" yaml:"dynamicPorts"`   // Whether this container has dynamically remapped ports
+	StartedAt       time.Time     `json:"startedAt" yaml:"startedAt"`         // When the container was last started, from docker inspect
+	RestartCount    int           `json:"restartCount" yaml:"restartCount"`   // How often Docker restarted the container after it exited, from docker inspect
+}
+
+// Uptime returns how long the container has been running, e.g. "3h12m", or "" if
+// its start time is unknown
+func (c Container) Uptime() string {
+	if c.StartedAt.IsZero() {
+		return ""
+	}
+	uptime := time.Since(c.StartedAt)
+	if uptime < time.Minute {
+		return uptime.Round(time.Second).String()
+	}
+	return strings.TrimSuffix(uptime.Round(time.Minute).String(), "0s")
+}
+
+// Running reports whether the container is running, from its docker ps status such
+// as "Up 5 minutes". Paused containers show as "Up 5 minutes (Paused)" and aren't.
+func (c Container) Running() bool {
+	return strings.HasPrefix(c.Status, "Up") && !strings.HasSuffix(c.Status, "(Paused)")
 }
 
 // PortMapping represents a Docker port mapping
 type PortMapping struct {
-	ContainerPort string
-	HostPort      string
-	Protocol      string
-	OriginalPort  string // The original host port before remapping
+	ContainerPort    string `json:"containerPort" yaml:"containerPort"`
+	HostPort         string `json:"hostPort" yaml:"hostPort"`
+	HostIP           string `json:"hostIp,omitempty" yaml:"hostIp,omitempty"` // The interface the host port is bound on, if not all of them
+	Protocol         string `json:"protocol" yaml:"protocol"`
+	OriginalPort     string `json:"originalPort" yaml:"originalPort"`         // The original host port before remapping
+	ConflictDetected bool   `json:"conflictDetected" yaml:"conflictDetected"` // Whether another container uses the same host port (read-only mode)
+	Reason           string `json:"reason,omitempty" yaml:"reason,omitempty"` // Why the host port was or wasn't remapped
 }
 
 // Application holds the application state
 type Application struct {
 	containerStore *ContainerStore
 	tmpl           *template.Template
+	basePath       string // URL prefix the UI is served under, always with leading and trailing slash
+	authToken      string // Token required by endpoints that change containers, if set
+	debug          bool   // Whether debugging endpoints such as api/debug/ports are served
+	noGzip         bool   // Whether to never gzip the dashboard and API responses
 }
 
-// NewApplication creates a new application instance
-func NewApplication() (*Application, error) {
-	// Initialize container store
-	containerStore, err := NewContainerStore()
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize container store: %v", err)
-	}
-
+// NewApplication creates a new application instance backed by the given container store
+func NewApplication(containerStore *ContainerStore, basePath string) (*Application, error) {
 	// Parse HTML template
 	tmpl := template.Must(template.New("containers").Parse(`
 <!DOCTYPE html>
 <html>
 <head>
     <title>Dynamic Port Mapper</title>
+    <base href="{{.BasePath}}">
+    <script>window.BASE_PATH = {{.BasePath}};</script>
+    <script>
+        // Recreate a container with new host ports, asking for the auth token if one is required
+        function remapContainer(id, name) {
+            if (!confirm('Remap ' + name + '? This stops and recreates the container with new host ports.')) {
+                return;
+            }
+            var headers = {};
+            var token = sessionStorage.getItem('dpm-auth-token');
+            if (token) {
+                headers['Authorization'] = 'Bearer ' + token;
+            }
+            fetch(window.BASE_PATH + 'api/container/' + encodeURIComponent(id) + '/remap', {method: 'POST', headers: headers})
+                .then(function(response) {
+                    if (response.status === 401) {
+                        var newToken = prompt('Auth token:');
+                        if (newToken) {
+                            sessionStorage.setItem('dpm-auth-token', newToken);
+                            remapContainer(id, name);
+                        }
+                        return;
+                    }
+                    return response.json().then(function(body) {
+                        if (!response.ok) {
+                            alert('Remap failed: ' + body.error);
+                        }
+                        location.reload();
+                    });
+                });
+        }
+    </script>
     <style>
         body {
             font-family: Arial, sans-serif;
@@ -161,11 +222,57 @@ func NewApplication() (*Application, error) {
             display: block;
             margin: 5px 0;
         }
+        .group-by {
+            text-align: center;
+            font-size: 14px;
+            color: #7f8c8d;
+        }
+        .group-by a {
+            color: #3498db;
+            margin: 0 5px;
+        }
+        .group-by a.active {
+            font-weight: bold;
+            color: #2c3e50;
+        }
+        .conflict {
+            color: #e74c3c;
+            font-weight: bold;
+            font-size: 0.85em;
+        }
+        .remap-btn {
+            padding: 4px 10px;
+            background-color: #e67e22;
+            color: white;
+            border: none;
+            border-radius: 4px;
+            cursor: pointer;
+        }
+        .remap-btn:hover {
+            background-color: #d35400;
+        }
         .original-port {
             text-decoration: line-through;
             color: #e74c3c;
             font-size: 0.85em;
         }
+        .view-toggle {
+            text-align: center;
+            font-size: 14px;
+        }
+        .view-toggle a {
+            color: #3498db;
+        }
+        table.compact {
+            margin-top: 10px;
+            font-size: 13px;
+        }
+        table.compact th, table.compact td {
+            padding: 4px 8px;
+        }
+        table.compact .port-mapping {
+            margin: 0;
+        }
     </style>
 </head>
 <body>
@@ -176,41 +283,72 @@ func NewApplication() (*Application, error) {
     {{else}}
         <div class="container-count">Total containers: {{len .Containers}}</div>
         <div class="last-updated">Containers are monitored in real-time</div>
+        {{if .Paused}}
+            <p class="error">Management is paused: started containers are not remapped until it is resumed.</p>
+        {{end}}
+        <div class="view-toggle">
+            {{if eq .View "compact"}}<a href="?group={{.Group}}&sort={{.Sort}}{{if .Since}}&since={{.Since}}{{end}}">Full view</a>{{else}}<a href="?view=compact&sort={{.Sort}}{{if .Since}}&since={{.Since}}{{end}}">Compact view</a>{{end}}
+        </div>
+        <div class="group-by">
+            Sort by:
+            {{range .SortOptions}}
+                <a href="?view={{$.View}}&group={{$.Group}}&sort={{.}}{{if $.Since}}&since={{$.Since}}{{end}}"{{if eq . $.Sort}} class="active"{{end}}>{{.}}</a>
+            {{end}}
+        </div>
+        {{if .Since}}
+            <div class="last-updated">Showing containers started in the last {{.Since}}. <a href="?view={{.View}}&group={{.Group}}&sort={{.Sort}}">Show all</a></div>
+        {{end}}
+        {{if eq .View "compact"}}
+            {{template "compact" .}}
+        {{else}}
+        <div class="group-by">
+            Group by:
+            {{range .GroupOptions}}
+                <a href="?group={{.}}&sort={{$.Sort}}{{if $.Since}}&since={{$.Since}}{{end}}"{{if eq . $.Group}} class="active"{{end}}>{{.}}</a>
+            {{end}}
+        </div>
         
-        {{if .Projects}}
-            {{range $project, $containers := .Projects}}
+        {{if .Groups}}
+            {{range .Groups}}
                 <div class="project-section">
-                    <h2>Project: {{$project}}</h2>
+                    <h2>{{$.GroupLabel}}: {{.Name}}</h2>
                     <table>
                         <tr>
                             <th>Container</th>
                             <th>Image</th>
                             <th>Service</th>
                             <th>Status</th>
+                            <th>Uptime</th>
+                            <th>Restarts</th>
                             <th>Port Mappings</th>
+                            {{if $.CanRemap}}<th></th>{{end}}
                         </tr>
-                        {{range $containers}}
+                        {{range .Containers}}
                         <tr>
                             <td>{{.Names}}</td>
                             <td>{{.Image}}</td>
                             <td>{{.ComposeService}}</td>
                             <td>{{.Status}}</td>
+                            <td>{{.Uptime}}</td>
+                            <td>{{.RestartCount}}</td>
                             <td>
                                 {{if .PortMappings}}
                                     {{range .PortMappings}}
-                                        <span class="port-mapping">
+                                        <span class="port-mapping" title="{{.Reason}}">
                                             {{if ne .HostPort .OriginalPort}}
                                                 <span class="remapped">{{.HostPort}}</span>:<span class="port-details">{{.ContainerPort}}/{{.Protocol}}</span>
                                                 <span class="original-port">(was {{.OriginalPort}})</span>
                                             {{else}}
                                                 {{.HostPort}}:{{.ContainerPort}}/{{.Protocol}}
                                             {{end}}
+                                            {{if .ConflictDetected}}<span class="conflict">(conflict)</span>{{end}}
                                         </span>
                                     {{end}}
                                 {{else}}
                                     {{.Ports}}
                                 {{end}}
                             </td>
+                            {{if $.CanRemap}}<td>{{if .PortMappings}}<button class="remap-btn" onclick="remapContainer({{.ID}}, {{.Names}})">Remap</button>{{end}}</td>{{end}}
                         </tr>
                         {{end}}
                     </table>
@@ -225,8 +363,11 @@ func NewApplication() (*Application, error) {
                         <th>Command</th>
                         <th>Created</th>
                         <th>Status</th>
+                        <th>Uptime</th>
+                        <th>Restarts</th>
                         <th>Ports</th>
                         <th>Names</th>
+                        {{if $.CanRemap}}<th></th>{{end}}
                     </tr>
                     {{range .Containers}}
                     <tr>
@@ -235,16 +376,19 @@ func NewApplication() (*Application, error) {
                         <td>{{.Command}}</td>
                         <td>{{.Created}}</td>
                         <td>{{.Status}}</td>
+                        <td>{{.Uptime}}</td>
+                        <td>{{.RestartCount}}</td>
                         <td>
                             {{if .PortMappings}}
                                 {{range .PortMappings}}
-                                    <span class="port-mapping">
+                                    <span class="port-mapping" title="{{.Reason}}">
                                         {{if ne .HostPort .OriginalPort}}
                                             <span class="remapped">{{.HostPort}}</span>:<span class="port-details">{{.ContainerPort}}/{{.Protocol}}</span>
                                             <span class="original-port">(was {{.OriginalPort}})</span>
                                         {{else}}
                                             {{.HostPort}}:{{.ContainerPort}}/{{.Protocol}}
                                         {{end}}
+                                        {{if .ConflictDetected}}<span class="conflict">(conflict)</span>{{end}}
                                     </span>
                                 {{end}}
                             {{else}}
@@ -252,6 +396,7 @@ func NewApplication() (*Application, error) {
                             {{end}}
                         </td>
                         <td>{{.Names}}</td>
+                        {{if $.CanRemap}}<td>{{if .PortMappings}}<button class="remap-btn" onclick="remapContainer({{.ID}}, {{.Names}})">Remap</button>{{end}}</td>{{end}}
                     </tr>
                     {{end}}
                 </table>
@@ -259,41 +404,201 @@ func NewApplication() (*Application, error) {
                 <p>No containers are currently running.</p>
             {{end}}
         {{end}}
+        {{end}}
     {{end}}
     <button class="refresh-btn" onclick="location.reload()">Refresh</button>
+    {{if .RangeExhausted}}
+        <p class="error">The dynamic port range {{.PortRangeMin}}-{{.PortRangeMax}} is exhausted. Remapping is paused until ports free up.</p>
+    {{end}}
     <div class="version-info">Dynamic Port Mapper v1.0.0 - Automatically resolves port conflicts for Docker Compose projects</div>
 </body>
 </html>
+{{define "compact"}}
+    {{if .Containers}}
+        <table class="compact">
+            <tr>
+                <th>Name</th>
+                <th>Service</th>
+                <th>Ports</th>
+                <th>Status</th>
+                <th>Restarts</th>
+            </tr>
+            {{range .Containers}}
+            <tr>
+                <td>{{.Names}}</td>
+                <td>{{.ComposeService}}</td>
+                <td>
+                    {{range .PortMappings}}
+                        <span class="port-mapping" title="{{.Reason}}">{{if ne .HostPort .OriginalPort}}<span class="remapped">{{.HostPort}}</span>{{else}}{{.HostPort}}{{end}}&rarr;{{.ContainerPort}}/{{.Protocol}}{{if .ConflictDetected}} <span class="conflict">(conflict)</span>{{end}}</span>
+                    {{else}}
+                        {{.Ports}}
+                    {{end}}
+                </td>
+                <td>{{.Status}}</td>
+                <td>{{.RestartCount}}</td>
+            </tr>
+            {{end}}
+        </table>
+    {{else}}
+        <p>No containers are currently running.</p>
+    {{end}}
+{{end}}
 `))
 
 	return &Application{
 		containerStore: containerStore,
 		tmpl:           tmpl,
+		basePath:       normalizeBasePath(basePath),
 	}, nil
 }
 
+// normalizeBasePath turns a user supplied prefix such as "dpm", "/dpm" or "/dpm/"
+// into the canonical "/dpm/" form used for routing
+func normalizeBasePath(basePath string) string {
+	basePath = strings.Trim(strings.TrimSpace(basePath), "/")
+	if basePath == "" {
+		return "/"
+	}
+	return "/" + basePath + "/"
+}
+
+// registerRoutes registers the application's handlers under its base path
+func (app *Application) registerRoutes(mux *http.ServeMux) {
+	// The dashboard and the API are compressed for clients that accept it, the
+	// health check is kept as simple as possible for probes
+	compressed := func(handler http.HandlerFunc) http.Handler {
+		if app.noGzip {
+			return handler
+		}
+		return gzipHandler(handler)
+	}
+	mux.Handle(app.basePath, compressed(app.indexHandler))
+	mux.Handle(app.basePath+"api/check", compressed(app.apiCheckHandler))
+	mux.Handle(app.basePath+"api/containers", compressed(app.apiContainersHandler))
+	mux.Handle(app.basePath+"api/remaps/slowest", compressed(app.apiSlowRemapsHandler))
+	mux.Handle(app.basePath+"api/wait", compressed(app.apiWaitHandler))
+	mux.Handle(app.basePath+"api/history", compressed(app.apiHistoryHandler))
+	mux.Handle("POST "+app.basePath+"api/container/{id}/remap", compressed(app.apiRemapHandler))
+	mux.Handle("POST "+app.basePath+"api/container/{id}/forget", compressed(app.apiForgetHandler))
+	mux.Handle("POST "+app.basePath+"api/pause", compressed(app.apiPauseHandler))
+	mux.Handle("POST "+app.basePath+"api/resume", compressed(app.apiResumeHandler))
+	mux.HandleFunc(app.basePath+"healthz", app.healthzHandler)
+	if app.debug {
+		mux.Handle("GET "+app.basePath+"api/debug/ports", compressed(app.apiDebugPortsHandler))
+	}
+	
+	// Redirect the prefix without a trailing slash to the canonical path
+	if app.basePath != "/" {
+		mux.Handle(strings.TrimSuffix(app.basePath, "/"), http.RedirectHandler(app.basePath, http.StatusMovedPermanently))
+	}
+}
+
 // indexHandler handles requests to the root path
 func (app *Application) indexHandler(w http.ResponseWriter, r *http.Request) {
-	// Only respond to the root path
-	if r.URL.Path != "/" {
+	// Only respond to the root of the base path
+	if r.URL.Path != app.basePath {
 		http.NotFound(w, r)
 		return
 	}
 
-	// Get containers from the store
-	containers := app.containerStore.GetContainers()
+	// Only show recently started containers when asked to, e.g. ?since=10m
+	since, err := parseSince(r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+
+	// Get containers from the store, by name or newest first. The projects-by-* options
+	// order the sections instead, keeping containers by name within them.
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "name"
+	}
+	switch sortBy {
+	case "name", "newest", "projects-by-count", "projects-by-remapped":
+	default:
+		http.Error(w, "Invalid sort, must be one of name, newest, projects-by-count or projects-by-remapped", http.StatusBadRequest)
+		return
+	}
+	// Take the list and its groups from one snapshot, so a refresh can't land in between
+	snapshot := app.containerStore.Snapshot()
+	containers := sortContainers(startedWithin(snapshot.Containers, since, now), sortBy)
+	
+	// Get containers organized by the requested grouping
+	group := r.URL.Query().Get("group")
+	if group == "" {
+		group = "project"
+	}
+	var groupsByName map[string][]Container
+	var groupLabel string
+	switch group {
+	case "project":
+		groupsByName = snapshot.ByProject
+		groupLabel = "Project"
+	case "image":
+		groupsByName = groupByImage(snapshot.Containers)
+		groupLabel = "Image"
+	case "network":
+		groupsByName = groupByNetwork(snapshot.Containers)
+		groupLabel = "Network"
+	case "none":
+		// Render a single flat table
+	default:
+		http.Error(w, "Invalid group, must be one of project, image, network or none", http.StatusBadRequest)
+		return
+	}
+	for name, groupContainers := range groupsByName {
+		if groupsByName[name] = startedWithin(groupContainers, since, now); len(groupsByName[name]) == 0 {
+			delete(groupsByName, name)
+		}
+	}
+	groups := sortGroups(SortedGroups(groupsByName), sortBy)
+	for i := range groups {
+		groups[i].Containers = sortContainers(groups[i].Containers, sortBy)
+	}
 	
-	// Get containers organized by project
-	projects := app.containerStore.GetContainersByComposeProject()
+	// The compact view is a single dense table for status screens, ignoring grouping
+	view := r.URL.Query().Get("view")
+	if view != "" && view != "full" && view != "compact" {
+		http.Error(w, "Invalid view, must be full or compact", http.StatusBadRequest)
+		return
+	}
 
 	// Prepare template data
 	data := struct {
-		Containers []Container
-		Projects   map[string][]Container
-		Error      string
+		Containers     []Container
+		Groups         []ContainerGroup
+		Group          string
+		GroupLabel     string
+		GroupOptions   []string
+		Error          string
+		BasePath       string
+		RangeExhausted bool
+		Paused         bool
+		PortRangeMin   int
+		PortRangeMax   int
+		CanRemap       bool
+		View           string
+		Since          string
+		Sort           string
+		SortOptions    []string
 	}{
-		Containers: containers,
-		Projects:   projects,
+		Containers:     containers,
+		Groups:         groups,
+		Group:          group,
+		GroupLabel:     groupLabel,
+		GroupOptions:   []string{"project", "image", "network", "none"},
+		BasePath:       app.basePath,
+		RangeExhausted: app.containerStore.RangeExhausted(),
+		Paused:         app.containerStore.Paused(),
+		PortRangeMin:   app.containerStore.portRangeMin,
+		PortRangeMax:   app.containerStore.portRangeMax,
+		CanRemap:       !app.containerStore.readOnly && !app.containerStore.planOnly,
+		View:           view,
+		Since:          r.URL.Query().Get("since"),
+		Sort:           sortBy,
+		SortOptions:    []string{"name", "newest", "projects-by-count", "projects-by-remapped"},
 	}
 
 	// Render template
@@ -306,36 +611,147 @@ func (app *Application) indexHandler(w http.ResponseWriter, r *http.Request) {
 
 // Close gracefully shuts down the application
 func (app *Application) Close() {
-	app.containerStore.Close()
+	app.containerStore.Stop()
+}
+
+// parseComposeArgs finds the compose file among the compose subcommand's arguments and
+// returns it along with every other argument, unchanged and in order, so global flags,
+// subcommands and their flags (e.g. "up --build -d") pass straight through to docker-compose.
+// The file may be given as -f/--file (with a space or =) or, whatever its name, as the
+// first argument, as it always could. Later on, a bare argument before the subcommand
+// is taken for the file if it names a YAML file.
+func parseComposeArgs(args []string) (string, []string) {
+	var composeFile string
+	var passthrough []string
+	seenSubcommand := false
+	
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case composeFile == "" && (arg == "-f" || arg == "--file") && i+1 < len(args):
+			composeFile = args[i+1]
+			i++
+		case composeFile == "" && (strings.HasPrefix(arg, "-f=") || strings.HasPrefix(arg, "--file=")):
+			composeFile = arg[strings.Index(arg, "=")+1:]
+		case composeFile == "" && i == 0 && !strings.HasPrefix(arg, "-"):
+			composeFile = arg
+		case composeFile == "" && !seenSubcommand && !strings.HasPrefix(arg, "-") &&
+			(strings.HasSuffix(arg, ".yml") || strings.HasSuffix(arg, ".yaml")):
+			composeFile = arg
+		default:
+			// The first bare argument that isn't the file is the compose subcommand
+			if !strings.HasPrefix(arg, "-") {
+				seenSubcommand = true
+			}
+			passthrough = append(passthrough, arg)
+		}
+	}
+	
+	return composeFile, passthrough
+}
+
+// extractProfiles removes --profile flags from the compose arguments and returns
+// the requested profiles along with the remaining arguments. Profiles from the
+// COMPOSE_PROFILES environment variable are picked up by docker-compose itself.
+func extractProfiles(args []string) ([]string, []string) {
+	var profiles, remaining []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--profile" && i+1 < len(args):
+			profiles = append(profiles, args[i+1])
+			i++
+		case strings.HasPrefix(arg, "--profile="):
+			profiles = append(profiles, strings.TrimPrefix(arg, "--profile="))
+		default:
+			remaining = append(remaining, arg)
+		}
+	}
+	return profiles, remaining
+}
+
+// hasProjectNameArg reports whether the global docker-compose flags, the ones before
+// the subcommand, name the project with -p/--project-name
+func hasProjectNameArg(args []string) bool {
+	for _, arg := range args {
+		switch {
+		case arg == "-p" || arg == "--project-name":
+			return true
+		case strings.HasPrefix(arg, "-p=") || strings.HasPrefix(arg, "--project-name="):
+			return true
+		case !strings.HasPrefix(arg, "-"):
+			return false
+		}
+	}
+	return false
+}
+
+// composeExec returns a docker-compose command with the given arguments. Where there
+// is no standalone docker-compose, it runs through the docker compose plugin instead.
+func composeExec(args ...string) *exec.Cmd {
+	if _, err := exec.LookPath("docker-compose"); err != nil {
+		if _, err := exec.LookPath("docker"); err == nil {
+			return exec.Command("docker", append([]string{"compose"}, args...)...)
+		}
+	}
+	return exec.Command("docker-compose", args...)
+}
+
+// composeCommand returns a docker-compose command for a compose file that runs in the
+// file's directory, so relative build contexts, env_files and .env resolve as they do
+// when docker-compose is run next to the file. The file is passed by its base name.
+func composeCommand(composeFile string, globalArgs []string, args ...string) *exec.Cmd {
+	dir, file := filepath.Split(composeFile)
+	cmdArgs := append(append(append([]string{}, globalArgs...), "-f", file), args...)
+	cmd := composeExec(cmdArgs...)
+	if dir != "" {
+		cmd.Dir = dir
+	}
+	return cmd
 }
 
 // runComposeCommand runs a Docker Compose project with dynamically allocated ports
 func runComposeCommand(containerStore *ContainerStore, composeFile string, args []string) error {
 	log.Printf("Checking for port conflicts in Compose file: %s", composeFile)
 	
+	// Profiles are global docker-compose flags, so they must come before the subcommand
+	profiles, args := extractProfiles(args)
+	if len(profiles) > 0 {
+		log.Printf("Active compose profiles: %s", strings.Join(profiles, ", "))
+	}
+	
+	// --report and --no-summary are ours, so they must not be passed on to docker-compose
+	reportPath, args := extractReportPath(args)
+	noSummary, args := extractNoSummary(args)
+	
 	// Check for port conflicts
-	remappings, err := containerStore.CheckComposePortConflicts(composeFile)
+	remappings, err := containerStore.CheckComposePortConflicts(composeFile, profiles)
 	if err != nil {
 		return fmt.Errorf("failed to check for port conflicts: %v", err)
 	}
+	// The new ports are bound by the time docker-compose returns, or not at all
+	defer containerStore.releaseComposePorts(remappings)
 	
 	// If there are no conflicts, run the compose command directly
 	if len(remappings) == 0 {
 		log.Println("No port conflicts detected, running docker-compose directly")
 		
-		cmd := exec.Command("docker-compose", append([]string{"-f", composeFile}, args...)...)
+		cmd := composeCommand(composeFile, composeProfileArgs(profiles), args...)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
-		return cmd.Run()
+		if err := cmd.Run(); err != nil {
+			return err
+		}
+		return finishComposeRun(composeFile, profiles, args, remappings, reportPath, noSummary)
 	}
 	
 	// Generate a new compose file with remapped ports
 	log.Printf("Found %d port conflicts, generating remapped compose file", len(remappings))
-	remappedFile, err := containerStore.GenerateRemappedComposeFile(composeFile, remappings)
+	remappedFile, err := containerStore.GenerateRemappedComposeFile(composeFile, profiles, remappings)
 	if err != nil {
 		return fmt.Errorf("failed to generate remapped compose file: %v", err)
 	}
-	defer os.Remove(remappedFile) // Clean up the temporary file
+	defer removeRunTempDir() // Clean up the temporary file
 	
 	// Print the remappings for the user
 	log.Println("Port remappings:")
@@ -348,10 +764,40 @@ func runComposeCommand(containerStore *ContainerStore, composeFile string, args
 	
 	// Run docker-compose with the new file
 	log.Printf("Running docker-compose with remapped ports")
-	cmd := exec.Command("docker-compose", append([]string{"-f", remappedFile}, args...)...)
+	// The remapped file lives in a temporary directory, but relative paths in it still
+	// belong to the original file's directory
+	remappedFile, err = filepath.Abs(remappedFile)
+	if err != nil {
+		return fmt.Errorf("failed to locate remapped compose file: %v", err)
+	}
+	cmdArgs := append(composeProfileArgs(profiles), "-f", remappedFile)
+	// docker-compose v1 would name the project after the temporary directory, so
+	// name it as a run on the original file would
+	if !hasProjectNameArg(args) {
+		cmdArgs = append(cmdArgs, "-p", remappedProjectName(composeFile, remappedFile))
+	}
+	cmd := composeExec(append(cmdArgs, args...)...)
+	cmd.Dir = filepath.Dir(composeFile)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	return finishComposeRun(composeFile, profiles, args, remappings, reportPath, noSummary)
+}
+
+// checkWebPortRange reports a web server port inside the dynamic port range. The port
+// is never allocated either way, but a range that includes it is most likely a
+// mistake, so it is an error under -strict and a warning otherwise.
+func checkWebPortRange(port, minPort, maxPort int, strict bool) error {
+	if port < minPort || port > maxPort {
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("web server port %d is inside the dynamic port range %d-%d; pick another -port or adjust -min/-max", port, minPort, maxPort)
+	}
+	log.Printf("Warning: web server port %d is inside the dynamic port range %d-%d. It is never allocated, but consider another -port or adjusting -min/-max", port, minPort, maxPort)
+	return nil
 }
 
 // printUsage prints the usage instructions
@@ -360,18 +806,71 @@ func printUsage() {
 	fmt.Println()
 	fmt.Println("Usage:")
 	fmt.Println("  dynamic-port-mapper [flags]                    - Run the web interface")
-	fmt.Println("  dynamic-port-mapper compose [file] [commands]  - Run a Docker Compose project with automatic port remapping")
+	for _, command := range subcommands {
+		fmt.Printf("  %-46s - %s\n", strings.TrimSpace(programName+" "+command.Name+" "+command.Args), command.Description)
+	}
 	fmt.Println()
 	fmt.Println("Flags:")
 	fmt.Println("  -port int    Port to run the web server on (default 5000)")
 	fmt.Println("  -min  int    Minimum port number for dynamic allocation (default 10000)")
 	fmt.Println("  -max  int    Maximum port number for dynamic allocation (default 65000)")
+	fmt.Println("  -manage-publish-all  Bring containers started with --publish-all (-P) under stable management")
+	fmt.Println("  -strict              Refuse to start with questionable configuration, e.g. -port inside the dynamic range")
+	fmt.Println("  -read-timeout dur    Maximum time to read a request to the web server, 0 to disable (default 15s)")
+	fmt.Println("  -write-timeout dur   Maximum time to write a response of the web server, 0 to disable (default 30s)")
+	fmt.Println("  -idle-timeout dur    How long idle keep-alive connections are kept open, 0 to disable (default 2m)")
+	fmt.Println("  -shutdown-timeout dur  How long requests in flight get to finish when shutting down (default 10s)")
+	fmt.Println("  -ready-timeout dur   How long to wait for a recreated container to be running/healthy (default 30s)")
+	fmt.Println("  -base-path string    URL prefix to serve the web interface under, e.g. /dpm/ (default /)")
+	fmt.Println("  -probe-dial          Also try connecting to a port before treating it as free (default bind test only)")
+	fmt.Println("  -read-only           Only detect and display port conflicts, never stop or recreate containers")
+	fmt.Println("  -observer            Like -read-only, but never label containers or write the state file either")
+	fmt.Println("  -state-file path     Persist tracking state to this file across restarts")
+	fmt.Println("  -no-label            Don't add tracking labels to containers, rely on the state file instead")
+	fmt.Println("  -preferred list      Ports to try first when remapping, e.g. 10000,10010,10020")
+	fmt.Println("  -plan-only           Log and record intended remaps in the state file, but never recreate containers")
+	fmt.Println("  -use-ephemeral       Allocate from the OS ephemeral port range (Linux) instead of -min/-max")
+	fmt.Println("  -avoid-ephemeral     Never allocate ports from the OS ephemeral port range (Linux)")
+	fmt.Println("  -slow-remap dur      Warn when a remap takes longer than this, 0 to disable (default 30s)")
+	fmt.Println("  -conflict-grace dur  Only remap a conflicting port if it is still in use after this long, e.g. 2s (default 0)")
+	fmt.Println("  -allocate-from-compose-range  Remap compose ports within the band of the original, e.g. 8080 within 8000-8999")
+	fmt.Println("  -no-recreate-images list  Image patterns whose containers are never recreated, only warned about, e.g. postgres*,mysql*")
+	fmt.Println("  -snapshot path       Keep a JSON snapshot of the containers in this file, as returned by /api/containers")
+	fmt.Println("  -snapshot-interval dur  How often to rewrite the -snapshot file (default 30s)")
+	fmt.Println("  -bind-host-ip ip     Publish remapped ports on this host IP only, e.g. 127.0.0.1 (default the IP each port had)")
+	fmt.Println("  -pull-on-recreate    Pull a container's image if it's no longer present locally when recreating it")
+	fmt.Println("  -exclude-project list  Compose projects to display but never remap, e.g. monitoring,db")
+	fmt.Println("  -auth-token string   Require this Bearer token for API endpoints that change containers")
+	fmt.Println("  -blocklist list      Ports or ranges never to allocate, even when free, e.g. 10250,30000-32767")
+	fmt.Println("  -selector labels     Only manage containers with these labels (key=value or key, comma-separated)")
+	fmt.Println("  -show-unselected     Display containers not matching -selector, read-only")
+	fmt.Println("  -states list         Container states to display and manage, e.g. running,paused,restarting or running,healthy (default running)")
+	fmt.Println("  -remap-on-start      Also remap conflicting containers that were running before startup")
+	fmt.Println("  -lock-dir path       Claim allocated ports in this directory so instances sharing it never pick the same one")
+	fmt.Println("  -no-gzip             Never gzip dashboard and API responses, even for clients that accept it")
+	fmt.Println("  -debug               Serve the allocator's internal state at /api/debug/ports")
+	fmt.Println("  -max-remaps-per-minute n  Recreate at most n containers a minute, delaying the rest (default 0, unlimited)")
+	fmt.Println("  -keep-ranges         Remap a container's published port ranges as whole blocks, or leave them alone")
+	fmt.Println("  -remap-delay dur     Wait until a Compose project has had no new starts for this long before remapping it (default 0)")
+	fmt.Println("  -compose-delegate    Recreate Compose-managed containers with docker-compose up so they stay in their project")
+	fmt.Println("  -name-suffix         Append the new host port to the names of recreated containers, e.g. web-dpm10342")
+	fmt.Println("  -poll-interval dur   Poll for container changes this often if docker events is unavailable, 0 to disable (default 30s)")
+	fmt.Println("  -docker-host url     Docker daemon to manage, e.g. tcp://10.0.0.5:2375 (default $DOCKER_HOST)")
+	fmt.Println("  -docker-socket path  Path of the Docker daemon socket, if not the default")
+	fmt.Println("  -help-json           Print the flags and subcommands as JSON")
 	fmt.Println()
 	fmt.Println("Examples:")
 	fmt.Println("  dynamic-port-mapper")
 	fmt.Println("  dynamic-port-mapper -port 8080")
 	fmt.Println("  dynamic-port-mapper compose docker-compose.yml up -d")
 	fmt.Println("  dynamic-port-mapper compose -f custom-compose.yml up")
+	fmt.Println("  dynamic-port-mapper compose docker-compose.yml --profile debug up -d")
+	fmt.Println("  dynamic-port-mapper compose -f docker-compose.yml up --build --scale web=2 -d")
+	fmt.Println("  dynamic-port-mapper -min 20000 -max 30000 plan")
+	fmt.Println("  dynamic-port-mapper list --output json")
+	fmt.Println("  dynamic-port-mapper restore app1_web_1")
+	fmt.Println("  dynamic-port-mapper lint docker-compose.yml --used 8080,5432 --offline")
+	fmt.Println("  source <(dynamic-port-mapper completion bash)")
 }
 
 func main() {
@@ -379,7 +878,51 @@ func main() {
 	port := flag.Int("port", 5000, "Port to run the web server on")
 	minPort := flag.Int("min", 10000, "Minimum port number for dynamic allocation")
 	maxPort := flag.Int("max", 65000, "Maximum port number for dynamic allocation")
+	managePublishAll := flag.Bool("manage-publish-all", false, "Pin ports of containers started with --publish-all under stable management")
+	strict := flag.Bool("strict", false, "Treat questionable configuration, such as a web server port inside the dynamic range, as an error")
+	readTimeout := flag.Duration("read-timeout", 15*time.Second, "Maximum time to read a request to the web server (0 disables)")
+	writeTimeout := flag.Duration("write-timeout", 30*time.Second, "Maximum time to write a response of the web server (0 disables)")
+	idleTimeout := flag.Duration("idle-timeout", 120*time.Second, "How long idle keep-alive connections to the web server are kept open (0 disables)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long requests in flight get to finish when shutting down")
+	readyTimeout := flag.Duration("ready-timeout", 30*time.Second, "How long to wait for a recreated container to become ready")
+	basePath := flag.String("base-path", "/", "URL prefix to serve the web interface under (e.g. /dpm/)")
+	probeDial := flag.Bool("probe-dial", false, "Also try connecting to a port before considering it free")
+	readOnly := flag.Bool("read-only", false, "Only detect and display port conflicts, never recreate containers")
+	observer := flag.Bool("observer", false, "Only observe the Docker host: never recreate, label or record containers")
+	stateFile := flag.String("state-file", "", "File to persist tracking state to (default: keep in memory only)")
+	noLabel := flag.Bool("no-label", false, "Track processed containers in the state file only, never add labels to containers")
+	preferred := flag.String("preferred", "", "Comma-separated ports or ranges to try, in order, before random allocation")
+	planOnly := flag.Bool("plan-only", false, "Log and record intended remaps to the state file instead of recreating containers")
+	useEphemeral := flag.Bool("use-ephemeral", false, "Allocate from the OS ephemeral port range instead of -min/-max")
+	avoidEphemeral := flag.Bool("avoid-ephemeral", false, "Never allocate ports from the OS ephemeral port range")
+	slowRemap := flag.Duration("slow-remap", 30*time.Second, "Log a warning when a remap takes longer than this (0 disables)")
+	conflictGrace := flag.Duration("conflict-grace", 0, "Only remap a conflicting port if it is still in use after this long (0 disables)")
+	allocateFromComposeRange := flag.Bool("allocate-from-compose-range", false, "Remap compose ports within the band of the original port, e.g. 8080 to another port in 8000-8999")
+	noRecreateImages := flag.String("no-recreate-images", "", "Comma-separated image patterns whose containers are never recreated, e.g. postgres*,mysql*")
+	bindHostIP := flag.String("bind-host-ip", "", "Host IP to publish remapped ports on, e.g. 127.0.0.1 (default the IP each port had)")
+	pullOnRecreate := flag.Bool("pull-on-recreate", false, "Pull a container's image if it's no longer present locally when recreating it")
+	excludeProject := flag.String("exclude-project", "", "Comma-separated Compose projects whose containers are never remapped")
+	snapshotFile := flag.String("snapshot", "", "File to keep a JSON snapshot of the containers in, as returned by /api/containers")
+	snapshotInterval := flag.Duration("snapshot-interval", 30*time.Second, "How often to rewrite the -snapshot file")
+	authToken := flag.String("auth-token", "", "Token required as a Bearer token by API endpoints that change containers")
+	dockerHost := flag.String("docker-host", "", "Docker daemon to connect to, e.g. tcp://10.0.0.5:2375 (default $DOCKER_HOST)")
+	dockerSocket := flag.String("docker-socket", "", "Path of the Docker daemon socket, e.g. /run/user/1000/docker.sock")
+	blocklist := flag.String("blocklist", "", "Comma-separated ports or ranges that are never allocated, e.g. 10250,30000-32767")
+	selectorFlag := flag.String("selector", "", "Only manage containers with these labels, e.g. com.mycorp.managed=true,com.mycorp.team")
+	showUnselected := flag.Bool("show-unselected", false, "Display containers not matching -selector, without managing them")
+	statesFlag := flag.String("states", "running", "Container states to display and manage, e.g. running,paused,restarting")
+	remapOnStart := flag.Bool("remap-on-start", false, "Remap conflicting containers that are already running at startup")
+	lockDir := flag.String("lock-dir", "", "Directory to claim allocated ports in, shared by instances managing the same host")
+	noGzip := flag.Bool("no-gzip", false, "Never gzip dashboard and API responses, e.g. when a reverse proxy compresses them")
+	debug := flag.Bool("debug", false, "Serve debugging endpoints such as /api/debug/ports")
+	keepRanges := flag.Bool("keep-ranges", false, "Remap a published port range as a whole block or leave all of it alone, never partially")
+	remapDelay := flag.Duration("remap-delay", 0, "Wait until a Compose project has had no new starts for this long before remapping its containers (0 remaps right away)")
+	maxRemapsPerMinute := flag.Int("max-remaps-per-minute", 0, "Recreate at most this many containers a minute, delaying the rest (0 is unlimited)")
+	composeDelegate := flag.Bool("compose-delegate", false, "Recreate Compose-managed containers through docker-compose instead of docker run")
+	nameSuffix := flag.Bool("name-suffix", false, "Append the new host port to the names of recreated containers")
+	pollInterval := flag.Duration("poll-interval", 30*time.Second, "Poll for container changes this often when docker events is unavailable (0 disables)")
 	help := flag.Bool("help", false, "Show help")
+	helpJSON := flag.Bool("help-json", false, "Print the flags and subcommands as JSON")
 	
 	// Parse flags
 	flag.Parse()
@@ -389,35 +932,219 @@ func main() {
 		printUsage()
 		return
 	}
+	if *helpJSON {
+		if err := printHelpJSON(flag.CommandLine); err != nil {
+			log.Fatalf("Error printing help: %v", err)
+		}
+		return
+	}
+	if flag.NArg() > 0 && flag.Arg(0) == "completion" {
+		if err := runCompletionCommand(flag.CommandLine, flag.Args()[1:]); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
 	
-	// Initialize the container store
-	containerStore, err := NewContainerStore()
+	preferredPorts, err := parsePortList(*preferred)
 	if err != nil {
-		log.Fatalf("Failed to initialize container store: %v", err)
+		log.Fatalf("Invalid -preferred value: %v", err)
+	}
+	blockedPorts, err := parsePortList(*blocklist)
+	if err != nil {
+		log.Fatalf("Invalid -blocklist value: %v", err)
+	}
+	selector, err := parseLabelSelector(*selectorFlag)
+	if err != nil {
+		log.Fatalf("Invalid -selector value: %v", err)
+	}
+	states, err := parseContainerStates(*statesFlag)
+	if err != nil {
+		log.Fatalf("Invalid -states value: %v", err)
+	}
+	if *bindHostIP != "" && net.ParseIP(*bindHostIP) == nil {
+		log.Fatalf("Invalid -bind-host-ip value: %q is not an IP address", *bindHostIP)
+	}
+	
+	// Every docker command we run talks to the configured daemon
+	effectiveDockerHost, err := configureDockerHost(*dockerHost, *dockerSocket)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	remoteDocker := isRemoteDockerHost(effectiveDockerHost)
+	if remoteDocker {
+		log.Printf("Docker daemon %s is remote, skipping local port checks", effectiveDockerHost)
 	}
 	
-	// Set port range
-	containerStore.portRangeMin = *minPort
-	containerStore.portRangeMax = *maxPort
+	if *useEphemeral && *avoidEphemeral {
+		log.Fatal("Error: -use-ephemeral and -avoid-ephemeral can't be used together")
+	}
 	
-	// Check if we're running a docker-compose command
+	// Read the kernel's ephemeral range when either ephemeral option needs it,
+	// keeping the default range on systems that don't expose it
+	ephemeralMin, ephemeralMax := 0, 0
+	if *useEphemeral || *avoidEphemeral {
+		ephemeralMin, ephemeralMax, err = readEphemeralPortRange()
+		if err != nil {
+			log.Printf("Warning: can't read the ephemeral port range, ignoring -use-ephemeral/-avoid-ephemeral: %v", err)
+		} else if *useEphemeral {
+			log.Printf("Using ephemeral port range %d-%d for dynamic allocation", ephemeralMin, ephemeralMax)
+			*minPort, *maxPort = ephemeralMin, ephemeralMax
+		}
+	}
+	
+	// Only the daemon runs the web server, subcommands don't
+	if flag.NArg() == 0 {
+		if err := checkWebPortRange(*port, *minPort, *maxPort, *strict); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	
+	// The container store configuration from the command line. Never hand out the
+	// web server's own port, or ports other infrastructure has claimed.
+	storeOptions := StoreOptions{
+		PortRangeMin:             *minPort,
+		PortRangeMax:             *maxPort,
+		ManagePublishAll:         *managePublishAll,
+		ReadyTimeout:             *readyTimeout,
+		ProbeDial:                *probeDial,
+		ReadOnly:                 *readOnly,
+		StateFile:                *stateFile,
+		NoLabel:                  *noLabel,
+		PreferredPorts:           preferredPorts,
+		PlanOnly:                 *planOnly,
+		SlowRemapThreshold:       *slowRemap,
+		ExcludedProjects:         parseNameSet(*excludeProject),
+		NoRecreateImages:         parseImagePatterns(*noRecreateImages),
+		PullOnRecreate:           *pullOnRecreate,
+		BindHostIP:               *bindHostIP,
+		AllocateFromComposeRange: *allocateFromComposeRange,
+		ConflictGrace:            *conflictGrace,
+		RemoteDocker:             remoteDocker,
+		Selector:                 selector,
+		States:                   states,
+		ShowUnselected:           *showUnselected,
+		RemapOnStart:             *remapOnStart,
+		PollInterval:             *pollInterval,
+		NameSuffix:               *nameSuffix,
+		LockDir:                  *lockDir,
+		ComposeDelegate:          *composeDelegate,
+		MaxRemapsPerMinute:       *maxRemapsPerMinute,
+		RemapDelay:               *remapDelay,
+		KeepRanges:               *keepRanges,
+		ReservedPorts:            append([]int{*port}, blockedPorts...),
+	}
+	if *avoidEphemeral {
+		storeOptions.AvoidMin, storeOptions.AvoidMax = ephemeralMin, ephemeralMax
+	}
+	if *lockDir != "" {
+		if err := os.MkdirAll(*lockDir, 0o755); err != nil {
+			log.Fatalf("Invalid -lock-dir value: %v", err)
+		}
+	}
+	if *observer {
+		// Like -read-only, but without labelling containers or writing the state
+		// file either, so it never interferes with the instance managing the host
+		storeOptions.ReadOnly = true
+		storeOptions.DryRun = true
+	}
+	
+	// Remove compose files generated by earlier runs that didn't get to clean up
+	cleanupStaleTempDirs()
+	
+	// The lint subcommand doesn't need a live daemon at all
 	args := flag.Args()
+	if len(args) > 0 && args[0] == "lint" {
+		if err := runLintCommand(args[1:]); errors.Is(err, errConflictsFound) {
+			// The conflicts are reported already, just fail the CI step
+			os.Exit(1)
+		} else if err != nil {
+			log.Fatalf("Error linting compose file: %v", err)
+		}
+		return
+	}
+	
+	// Reporting subcommands only inspect state, so they use a store that
+	// never listens for events or writes to Docker
+	reportCommands := map[string]func(*ContainerStore, []string) error{
+		"plan":       runPlanCommand,
+		"list":       runListCommand,
+		"status":     runStatusCommand,
+		"diff":       runDiffCommand,
+		"scan":       runScanCommand,
+		"export-k8s": runExportK8sCommand,
+		"snapshot":   runSnapshotCommand,
+	}
+	if len(args) > 0 && (args[0] == "pause" || args[0] == "resume") {
+		// Pausing is done by the running instance, so just ask it to
+		if err := runPauseCommand(*port, *basePath, *authToken, args[0] == "pause"); err != nil {
+			log.Fatalf("Error running %s: %v", args[0], err)
+		}
+		return
+	}
+	// Remapping and restoring from the command line don't load the state file, so they
+	// must not write it either, or they'd wipe the running instance's tracking state
+	commandOptions := storeOptions
+	commandOptions.KeepStateFile = true
+	if len(args) > 0 && args[0] == "remap" {
+		// Like restore, but a dry run only allocates ports to show them
+		if err := runRemapCommand(commandOptions, args[1:]); err != nil {
+			log.Fatalf("Error remapping container: %v", err)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "restore" {
+		// Restoring recreates containers, but like the reporting subcommands it
+		// doesn't listen for events
+		if err := runRestoreCommand(NewContainerStore(commandOptions), args[1:]); err != nil {
+			log.Fatalf("Error restoring container: %v", err)
+		}
+		return
+	}
+	if len(args) > 0 && reportCommands[args[0]] != nil {
+		reportOptions := storeOptions
+		reportOptions.DryRun = true
+		reportStore := NewContainerStore(reportOptions)
+		err := reportCommands[args[0]](reportStore, args[1:])
+		// Stopping releases the claims on ports allocated only to be shown
+		reportStore.Stop()
+		if errors.Is(err, errConflictsFound) {
+			os.Exit(1)
+		} else if err != nil {
+			log.Fatalf("Error running %s: %v", args[0], err)
+		}
+		return
+	}
+	
+	if *noLabel && *stateFile == "" {
+		log.Printf("Warning: -no-label without -state-file means processed containers are forgotten on restart")
+	}
+	if *planOnly && *stateFile == "" {
+		log.Printf("Warning: -plan-only without -state-file only logs intended remaps")
+	}
+	
+	// Find out now rather than on the first remap if Compose can't be delegated to
+	if *composeDelegate && !storeOptions.ReadOnly && !*planOnly {
+		if err := checkComposeOverrideSupport(); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	
+	// Initialize the container store
+	containerStore := NewContainerStore(storeOptions)
+	if err := containerStore.Start(context.Background()); err != nil {
+		log.Fatalf("Failed to initialize container store: %v", err)
+	}
+	
+	// Check if we're running a docker-compose command
 	if len(args) > 0 && args[0] == "compose" {
-		// We're running in docker-compose mode
-		if len(args) < 2 {
+		// We're running in docker-compose mode. Stopping ends the event watcher and
+		// releases the port claims made while checking the compose file.
+		defer containerStore.Stop()
+		composeFile, composeArgs := parseComposeArgs(args[1:])
+		if composeFile == "" {
 			log.Fatal("Error: Missing compose file. Usage: dynamic-port-mapper compose [file] [commands]")
 		}
 		
-		// Check if we have a -f flag
-		composeFile := args[1]
-		composeArgs := args[2:]
-		
-		// If the first compose arg is -f, use the next arg as the file
-		if composeFile == "-f" && len(args) >= 3 {
-			composeFile = args[2]
-			composeArgs = args[3:]
-		}
-		
 		// Make sure the compose file exists
 		if _, err := os.Stat(composeFile); os.IsNotExist(err) {
 			log.Fatalf("Error: Compose file not found: %s", composeFile)
@@ -425,6 +1152,8 @@ func main() {
 		
 		// Run the compose command
 		if err := runComposeCommand(containerStore, composeFile, composeArgs); err != nil {
+			// log.Fatalf skips deferred calls
+			containerStore.Stop()
 			log.Fatalf("Error running docker-compose: %v", err)
 		}
 		
@@ -432,32 +1161,50 @@ func main() {
 	}
 	
 	// Otherwise, we're running the web server
-	app, err := NewApplication()
+	app, err := NewApplication(containerStore, *basePath)
 	if err != nil {
 		log.Fatalf("Failed to initialize application: %v", err)
 	}
 	defer app.Close()
+	app.authToken = *authToken
+	app.debug = *debug
+	app.noGzip = *noGzip
 
-	// Handle signals for graceful shutdown
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigCh
-		log.Println("Received shutdown signal, gracefully shutting down...")
-		app.Close()
-		os.Exit(0)
-	}()
+	// Warn if a container already holds the port we're about to listen on
+	if status := containerStore.CheckPort(*port, "tcp"); status.Status == PortStatusContainer {
+		log.Printf("Warning: Port %d is already published by container %s (%s), the web server may fail to start",
+			*port, status.ContainerName, status.ContainerID)
+	}
+
+	// Tell systemd we're up and keep its watchdog fed while we're healthy
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+	go runWatchdog(containerStore)
+
+	// Keep a snapshot of the containers on disk for tools that don't use the API
+	if *snapshotFile != "" {
+		if *snapshotInterval <= 0 {
+			log.Fatalf("Error: -snapshot-interval must be positive")
+		}
+		go runSnapshotWriter(containerStore, *snapshotFile, *snapshotInterval)
+	}
 
-	// Register our handler
-	http.HandleFunc("/", app.indexHandler)
+	// Register our handlers
+	mux := http.NewServeMux()
+	app.registerRoutes(mux)
 
 	// Start the server
 	serverAddr := fmt.Sprintf(":%d", *port)
 	log.Printf("Starting Dynamic Port Mapper on port %d...", *port)
-	log.Printf("Open http://localhost:%d in your browser to view running Docker containers with remapped ports", *port)
+	log.Printf("Open http://localhost:%d%s in your browser to view running Docker containers with remapped ports", *port, app.basePath)
 	log.Printf("Port range for dynamic allocation: %d-%d", containerStore.portRangeMin, containerStore.portRangeMax)
 	log.Printf("To run a Docker Compose project with automatic port remapping, use: dynamic-port-mapper compose [file] [commands]")
-	if err := http.ListenAndServe(serverAddr, nil); err != nil {
+	server := newHTTPServer(serverAddr, mux, serverTimeouts{Read: *readTimeout, Write: *writeTimeout, Idle: *idleTimeout})
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+	if err := serveUntilDone(signalCtx, server, *shutdownTimeout); err != nil {
 		log.Fatalf("Server error: %v", err)
 	}
+	// The deferred app.Close stops the container store once requests have drained
 } 
\ No newline at end of file
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseComposeArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantFile string
+		wantArgs []string
+	}{
+		{"file first", []string{"docker-compose.yml", "up", "--build", "-d"}, "docker-compose.yml", []string{"up", "--build", "-d"}},
+		{"file flag", []string{"-f", "docker-compose.yml", "up", "--scale", "web=2"}, "docker-compose.yml", []string{"up", "--scale", "web=2"}},
+		{"file flag with equals", []string{"--file=stack.yaml", "up", "-d"}, "stack.yaml", []string{"up", "-d"}},
+		{"file without yaml suffix", []string{"compose.override", "up", "-d"}, "compose.override", []string{"up", "-d"}},
+		{"file flag without yaml suffix", []string{"-f", "compose.override", "up"}, "compose.override", []string{"up"}},
+		{"yaml argument of the subcommand", []string{"-f", "a.yml", "run", "web", "b.yml"}, "a.yml", []string{"run", "web", "b.yml"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, args := parseComposeArgs(tt.args)
+			if file != tt.wantFile || !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("parseComposeArgs(%q) = %q, %q, want %q, %q", tt.args, file, args, tt.wantFile, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestHasProjectNameArg(t *testing.T) {
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"up", "-d"}, false},
+		{[]string{"-p", "shop", "up"}, true},
+		{[]string{"--project-name=shop", "up"}, true},
+		{[]string{"run", "-p", "8080:80", "web"}, false},
+	}
+	for _, tt := range tests {
+		if got := hasProjectNameArg(tt.args); got != tt.want {
+			t.Errorf("hasProjectNameArg(%q) = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestComposeRunsInComposeFileDirectory(t *testing.T) {
+	docker := newFakeDocker(t)
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	dir := filepath.Join(t.TempDir(), "app")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	composeFile := filepath.Join(dir, "docker-compose.yml")
+	// Without conflicts the file is run as is, with one the remapped copy is
+	for _, hostPort := range []int{0, busy.Addr().(*net.TCPAddr).Port} {
+		compose := "services:\n  web:\n    build: ./web\n    image: web\n"
+		if hostPort != 0 {
+			compose += fmt.Sprintf("    ports:\n      - \"%d:80\"\n", hostPort)
+		}
+		if err := os.WriteFile(composeFile, []byte(compose), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		store := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+		if err := runComposeCommand(store, composeFile, []string{"up", "-d", "--no-summary"}); err != nil {
+			t.Fatalf("runComposeCommand failed: %v", err)
+		}
+	}
+
+	if got := docker.composeDirs(); !reflect.DeepEqual(got, []string{dir, dir}) {
+		t.Errorf("docker-compose ran in %q, want %s both times", got, dir)
+	}
+	var runs [][]string
+	for _, args := range docker.calls() {
+		if args[0] == "compose" && args[len(args)-1] == "-d" {
+			runs = append(runs, args)
+		}
+	}
+	if len(runs) != 2 {
+		t.Fatalf("docker-compose up ran %d times, want 2", len(runs))
+	}
+	if want := []string{"compose", "-f", "docker-compose.yml", "up", "-d"}; !reflect.DeepEqual(runs[0], want) {
+		t.Errorf("docker-compose was run with %q, want %q", runs[0], want)
+	}
+	if files := flagValues(runs[1], "-f"); len(files) != 1 || !strings.HasSuffix(files[0], ".remapped.yml") {
+		t.Errorf("conflicting run used compose files %q, want the remapped copy", files)
+	}
+}
+
+func TestNormalizeBasePath(t *testing.T) {
+	for basePath, want := range map[string]string{
+		"":             "/",
+		"/":            "/",
+		"dpm":          "/dpm/",
+		"/dpm":         "/dpm/",
+		"/dpm/":        "/dpm/",
+		" tools/dpm/ ": "/tools/dpm/",
+	} {
+		if got := normalizeBasePath(basePath); got != want {
+			t.Errorf("normalizeBasePath(%q) = %q, want %q", basePath, got, want)
+		}
+	}
+}
+
+func TestRoutesUnderBasePath(t *testing.T) {
+	app, err := NewApplication(NewContainerStore(StoreOptions{}), "dpm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	app.registerRoutes(mux)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/dpm/", http.StatusOK},
+		{"/dpm/api/containers", http.StatusOK},
+		{"/dpm/healthz", http.StatusOK},
+		{"/dpm", http.StatusMovedPermanently},
+		{"/", http.StatusNotFound},
+		{"/api/containers", http.StatusNotFound},
+		{"/dpm/missing", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("GET %s returned status %d, want %d", tt.path, w.Code, tt.status)
+		}
+	}
+
+	// Links in the page resolve under the prefix
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dpm/", nil))
+	if !strings.Contains(w.Body.String(), `<base href="/dpm/">`) {
+		t.Errorf("dashboard doesn't set its base to /dpm/")
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dpm", nil))
+	if location := w.Header().Get("Location"); location != "/dpm/" {
+		t.Errorf("GET /dpm redirects to %q, want /dpm/", location)
+	}
+}
+
+func TestExtractProfiles(t *testing.T) {
+	profiles, args := extractProfiles([]string{"--profile", "debug", "up", "--profile=tools", "-d"})
+	if want := []string{"debug", "tools"}; !reflect.DeepEqual(profiles, want) {
+		t.Errorf("extracted profiles %q, want %q", profiles, want)
+	}
+	if want := []string{"up", "-d"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("left arguments %q, want %q", args, want)
+	}
+}
+
+func TestIndexGroups(t *testing.T) {
+	store := NewContainerStore(StoreOptions{})
+	store.containers["a"] = Container{ID: "a", Names: "web", Image: "nginx:latest", Networks: "frontend", Status: "Up 1 minute"}
+	store.containers["b"] = Container{ID: "b", Names: "cache", Image: "redis:7", Networks: "backend", Status: "Up 1 minute"}
+	app, err := NewApplication(store, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		group  string
+		status int
+		shows  []string
+	}{
+		{"image", http.StatusOK, []string{"nginx:latest", "redis:7"}},
+		{"network", http.StatusOK, []string{"frontend", "backend"}},
+		{"none", http.StatusOK, []string{"web", "cache"}},
+		{"volume", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		app.indexHandler(w, httptest.NewRequest(http.MethodGet, "/?group="+tt.group, nil))
+		if w.Code != tt.status {
+			t.Errorf("GET /?group=%s returned status %d, want %d", tt.group, w.Code, tt.status)
+		}
+		for _, text := range tt.shows {
+			if !strings.Contains(w.Body.String(), text) {
+				t.Errorf("GET /?group=%s doesn't show %s", tt.group, text)
+			}
+		}
+	}
+}
+
+func TestIndexSortsProjects(t *testing.T) {
+	store := NewContainerStore(StoreOptions{})
+	store.containers["a"] = Container{ID: "a", Names: "blog_web_1", ComposeProject: "blog", Status: "Up 1 minute"}
+	store.containers["b"] = Container{ID: "b", Names: "shop_web_1", ComposeProject: "shop", Status: "Up 1 minute"}
+	store.containers["c"] = Container{ID: "c", Names: "shop_db_1", ComposeProject: "shop", Status: "Up 1 minute"}
+	app, err := NewApplication(store, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for sortBy, first := range map[string]string{"name": "blog", "projects-by-count": "shop"} {
+		w := httptest.NewRecorder()
+		app.indexHandler(w, httptest.NewRequest(http.MethodGet, "/?sort="+sortBy, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /?sort=%s returned status %d", sortBy, w.Code)
+		}
+		body := w.Body.String()
+		blog, shop := strings.Index(body, ": blog</h2>"), strings.Index(body, ": shop</h2>")
+		if blog < 0 || shop < 0 || (blog < shop) != (first == "blog") {
+			t.Errorf("GET /?sort=%s doesn't list %s first", sortBy, first)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	app.indexHandler(w, httptest.NewRequest(http.MethodGet, "/?sort=size", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("GET /?sort=size returned status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestIndexCompactView(t *testing.T) {
+	store := NewContainerStore(StoreOptions{})
+	store.containers["a"] = Container{ID: "a", Names: "web", ComposeProject: "shop", Status: "Up 1 minute"}
+	app, err := NewApplication(store, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		view    string
+		status  int
+		compact bool
+	}{
+		{"compact", http.StatusOK, true},
+		{"full", http.StatusOK, false},
+		{"", http.StatusOK, false},
+		{"tiny", http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		app.indexHandler(w, httptest.NewRequest(http.MethodGet, "/?view="+tt.view, nil))
+		if w.Code != tt.status {
+			t.Errorf("GET /?view=%s returned status %d, want %d", tt.view, w.Code, tt.status)
+			continue
+		}
+		body := w.Body.String()
+		if compact := strings.Contains(body, `<table class="compact">`); compact != tt.compact {
+			t.Errorf("GET /?view=%s renders the compact table: %v, want %v", tt.view, compact, tt.compact)
+		}
+		if tt.status == http.StatusOK && strings.Contains(body, "Group by:") == tt.compact {
+			t.Errorf("GET /?view=%s shows the grouping options: %v, want %v", tt.view, !tt.compact, !tt.compact)
+		}
+	}
+}
+
+func TestCheckWebPortRange(t *testing.T) {
+	tests := []struct {
+		port    int
+		inRange bool
+	}{
+		{5000, false},
+		{9999, false},
+		{10000, true},
+		{10050, true},
+		{65000, true},
+		{65001, false},
+	}
+	for _, tt := range tests {
+		if err := checkWebPortRange(tt.port, 10000, 65000, false); err != nil {
+			t.Errorf("checkWebPortRange(%d) without -strict failed: %v", tt.port, err)
+		}
+		if err := checkWebPortRange(tt.port, 10000, 65000, true); (err != nil) != tt.inRange {
+			t.Errorf("checkWebPortRange(%d) with -strict = %v, want an error: %v", tt.port, err, tt.inRange)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// networkAliases returns the user-defined networks a container is attached to, with
+// the DNS aliases it has on each. Compose gives every container its service name as
+// an alias, which other services resolve it by. The alias of the container's own ID,
+// which Docker adds by itself, is left out so the replacement gets its own.
+func networkAliases(containerInfo map[string]interface{}) map[string][]string {
+	containerID := inspectString(containerInfo, "Id")
+	networks := inspectSection(inspectSection(containerInfo, "NetworkSettings"), "Networks")
+
+	result := make(map[string][]string)
+	for name, settings := range networks {
+		// Aliases only exist on user-defined networks
+		if name == "bridge" || name == "host" || name == "none" {
+			continue
+		}
+		endpoint, _ := settings.(map[string]interface{})
+		aliasList, _ := endpoint["Aliases"].([]interface{})
+		aliases := []string{}
+		for _, a := range aliasList {
+			alias, ok := a.(string)
+			if !ok || alias == "" {
+				continue
+			}
+			if len(alias) >= 12 && strings.HasPrefix(containerID, alias) {
+				continue
+			}
+			aliases = append(aliases, alias)
+		}
+		result[name] = aliases
+	}
+	return result
+}
+
+// networkAliasArgs returns the docker run flags giving a container its aliases on the
+// network it is started on
+func networkAliasArgs(aliases []string) []string {
+	var args []string
+	for _, alias := range aliases {
+		args = append(args, "--network-alias", alias)
+	}
+	return args
+}
+
+// connectNetworks attaches a recreated container to the networks its original was on
+// besides the one it was started on, with the same aliases
+func connectNetworks(ctx context.Context, containerID, primaryNetwork string, networks map[string][]string) error {
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		if name != primaryNetwork {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		args := []string{"network", "connect"}
+		for _, alias := range networks[name] {
+			args = append(args, "--alias", alias)
+		}
+		args = append(args, name, containerID)
+		log.Printf("Reconnecting container %s to network %s with aliases %v", containerID, name, networks[name])
+		if output, err := exec.CommandContext(ctx, "docker", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to connect container %s to network %s: %v, output: %s",
+				containerID, name, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
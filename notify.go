@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state message such as "READY=1" to systemd over $NOTIFY_SOCKET.
+// It is a no-op when the process isn't running under a systemd notify service.
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+
+	// A leading @ denotes a socket in the abstract namespace
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often to ping the systemd watchdog, which is half
+// of WatchdogSec as recommended by sd_watchdog_enabled(3). It returns 0 when the
+// watchdog isn't enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	// The watchdog may be meant for a different process
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runWatchdog periodically pings the systemd watchdog for as long as the store is
+// healthy, so systemd restarts us if we hang or lose access to Docker
+func runWatchdog(store *ContainerStore) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	log.Printf("Systemd watchdog enabled, pinging every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-store.done:
+			return
+		case <-ticker.C:
+			if err := store.Healthy(); err != nil {
+				log.Printf("Skipping systemd watchdog ping, store is unhealthy: %v", err)
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				log.Printf("Failed to ping systemd watchdog: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Pause stops the store from reacting to container starts, e.g. during maintenance,
+// while the container list is still kept up to date. It returns false if management
+// was already paused.
+func (s *ContainerStore) Pause() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused {
+		return false
+	}
+	s.paused = true
+	log.Printf("Management paused: started containers are no longer remapped until resumed")
+	return true
+}
+
+// Resume undoes Pause. Containers started while paused are left as they are until
+// they start again. It returns false if management wasn't paused.
+func (s *ContainerStore) Resume() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.paused {
+		return false
+	}
+	s.paused = false
+	log.Printf("Management resumed")
+	return true
+}
+
+// Paused reports whether management is paused
+func (s *ContainerStore) Paused() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.paused
+}
+
+// pauseState is the response of the pause and resume endpoints
+type pauseState struct {
+	Paused bool `json:"paused"`
+}
+
+// runPauseCommand pauses or resumes management by the instance serving the web
+// interface on the given port, e.g. dynamic-port-mapper -port 5000 pause
+func runPauseCommand(port int, basePath, authToken string, pause bool) error {
+	action := "resume"
+	if pause {
+		action = "pause"
+	}
+	url := fmt.Sprintf("http://localhost:%d%sapi/%s", port, normalizeBasePath(basePath), action)
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	if authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("can't reach dynamic-port-mapper on port %d: %v", port, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("%s failed: %s %s", action, resp.Status, apiErr.Error)
+	}
+
+	var state pauseState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return fmt.Errorf("failed to parse response: %v", err)
+	}
+	if state.Paused {
+		fmt.Println("Management is paused")
+	} else {
+		fmt.Println("Management is running")
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor polls until done returns true, failing the test after a while
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestPausedStartsOnlyRefresh(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999})
+	startEvent := func(at int64) string {
+		return fmt.Sprintf(`{"status":"start","id":"aaaa","Type":"container","Action":"start","timeNano":%d}`+"\n", at)
+	}
+
+	// While paused, the started container shows up but keeps its port
+	s.Pause()
+	s.processEvents(strings.NewReader(startEvent(1)))
+	waitFor(t, "the container list to be refreshed", func() bool { return len(s.GetContainers()) == 1 })
+	time.Sleep(time.Second)
+	if changes := docker.changes(); len(changes) != 0 {
+		t.Fatalf("docker was called with %v while paused", callNames(changes))
+	}
+
+	// Once resumed, the next start is remapped again
+	s.Resume()
+	s.processEvents(strings.NewReader(startEvent(2)))
+	waitFor(t, "the container to be remapped", func() bool {
+		containers := s.GetContainers()
+		return len(containers) == 1 && len(containers[0].PortMappings) == 1 && containers[0].PortMappings[0].HostPort != "8080"
+	})
+	if got, want := callNames(docker.changes()), []string{"stop", "rename", "run", "rm"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("docker was called with %v after resuming, want %v", got, want)
+	}
+}
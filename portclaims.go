@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// portClaimTTL is how long an allocated port stays claimed if its claim is never
+// released, e.g. because the remap was only planned or the process died
+const portClaimTTL = 5 * time.Minute
+
+// claimPort claims a port the allocator picked, so it isn't handed out again before
+// the remap binds it. Claims are kept in memory and, with a lock directory, as files
+// that other instances sharing the directory respect. It returns false if the port
+// is already claimed.
+func (s *ContainerStore) claimPort(port int) bool {
+	s.claimMu.Lock()
+	defer s.claimMu.Unlock()
+
+	if claimedAt, ok := s.portClaims[port]; ok && time.Since(claimedAt) < portClaimTTL {
+		return false
+	}
+	if s.lockDir != "" && !claimPortFile(s.lockDir, port) {
+		return false
+	}
+	s.portClaims[port] = time.Now()
+	return true
+}
+
+// releasePort gives up the claim on a port once its remap is done or abandoned
+func (s *ContainerStore) releasePort(port int) {
+	s.claimMu.Lock()
+	defer s.claimMu.Unlock()
+
+	if _, ok := s.portClaims[port]; !ok {
+		return
+	}
+	delete(s.portClaims, port)
+	if s.lockDir != "" {
+		if err := os.Remove(portClaimPath(s.lockDir, port)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: Failed to release claim on port %d: %v", port, err)
+		}
+	}
+}
+
+// releasePortString releases a port given as a string, as remaps pass it around
+func (s *ContainerStore) releasePortString(port string) {
+	if portInt, err := strconv.Atoi(port); err == nil {
+		s.releasePort(portInt)
+	}
+}
+
+// releaseComposePorts releases the ports allocated for compose remappings, single
+// ports or ranges such as "10000-10005", once docker-compose has bound them or the
+// remappings were only reported
+func (s *ContainerStore) releaseComposePorts(remappings map[string]string) {
+	for _, newPort := range remappings {
+		start, end, err := parseHostPorts(newPort)
+		if err != nil {
+			continue
+		}
+		for port := start; port <= end; port++ {
+			s.releasePort(port)
+		}
+	}
+}
+
+// releaseAllPorts gives up every claim this store holds, when it stops
+func (s *ContainerStore) releaseAllPorts() {
+	s.claimMu.Lock()
+	ports := make([]int, 0, len(s.portClaims))
+	for port := range s.portClaims {
+		ports = append(ports, port)
+	}
+	s.claimMu.Unlock()
+	for _, port := range ports {
+		s.releasePort(port)
+	}
+}
+
+// portClaimPath is the file claiming a port in a lock directory
+func portClaimPath(lockDir string, port int) string {
+	return filepath.Join(lockDir, fmt.Sprintf("port-%d.lock", port))
+}
+
+// claimPortFile atomically creates the claim file for a port, holding our pid. A
+// claim left by a process that is gone, or older than portClaimTTL, is taken over.
+func claimPortFile(lockDir string, port int) bool {
+	path := portClaimPath(lockDir, port)
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			fmt.Fprintf(file, "%d\n", os.Getpid())
+			file.Close()
+			return true
+		}
+		if !errors.Is(err, os.ErrExist) {
+			log.Printf("Warning: Failed to claim port %d in %s: %v", port, lockDir, err)
+			return false
+		}
+		if !portClaimStale(path) {
+			return false
+		}
+		os.Remove(path)
+	}
+	return false
+}
+
+// portClaimStale reports whether a claim file was left by a process that is no
+// longer running, or has outlived portClaimTTL
+func portClaimStale(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if time.Since(info.ModTime()) > portClaimTTL {
+		return true
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		// Still being written, or not ours to judge
+		return false
+	}
+	return pid != os.Getpid() && !processAlive(pid)
+}
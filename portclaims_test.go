@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLockDirPreventsDoubleClaims(t *testing.T) {
+	lockDir := t.TempDir()
+	a := NewContainerStore(StoreOptions{LockDir: lockDir})
+	b := NewContainerStore(StoreOptions{LockDir: lockDir})
+	if !a.claimPort(20000) {
+		t.Fatal("first claim failed")
+	}
+	if b.claimPort(20000) {
+		t.Fatal("second store claimed a port the first one holds")
+	}
+	a.releasePort(20000)
+	if !b.claimPort(20000) {
+		t.Fatal("port still claimed after its release")
+	}
+}
+
+func TestReleaseComposePorts(t *testing.T) {
+	lockDir := t.TempDir()
+	s := NewContainerStore(StoreOptions{LockDir: lockDir})
+	for _, port := range []int{20000, 20001, 20002, 20010} {
+		if !s.claimPort(port) {
+			t.Fatalf("claiming port %d failed", port)
+		}
+	}
+	s.releaseComposePorts(map[string]string{"web:8000-8002": "20000-20002", "db:5432": "20010"})
+
+	entries, err := os.ReadDir(lockDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 || len(s.portClaims) != 0 {
+		t.Errorf("claims left after release: %d files, %v", len(entries), s.portClaims)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// reasonWithRange marks a port that didn't conflict itself, but was moved along with
+// the rest of its published range under -keep-ranges
+const reasonWithRange = "remapped (with its range)"
+
+// rangeBinding is a container port binding as seen when looking for published ranges
+type rangeBinding struct {
+	Key           string // containerPort/protocol, as in HostConfig.PortBindings
+	ContainerPort int
+	Protocol      string
+	HostIP        string
+	HostPort      int
+}
+
+// publishedRange is a run of two or more bindings whose container ports and host ports
+// are both consecutive, such as the ones -p 8000-8003:9000-9003 publishes
+type publishedRange struct {
+	Bindings []rangeBinding
+}
+
+// String describes the range for log messages, e.g. 8000-8003/tcp
+func (r publishedRange) String() string {
+	first, last := r.Bindings[0], r.Bindings[len(r.Bindings)-1]
+	return fmt.Sprintf("%d-%d/%s", first.HostPort, last.HostPort, first.Protocol)
+}
+
+// newRangeBinding parses a binding, returning false if its ports aren't numbers
+func newRangeBinding(containerPort, protocol, hostIP, hostPort string) (rangeBinding, bool) {
+	containerPortInt, err := strconv.Atoi(containerPort)
+	if err != nil {
+		return rangeBinding{}, false
+	}
+	hostPortInt, err := strconv.Atoi(hostPort)
+	if err != nil {
+		return rangeBinding{}, false
+	}
+	return rangeBinding{
+		Key:           fmt.Sprintf("%s/%s", containerPort, protocol),
+		ContainerPort: containerPortInt,
+		Protocol:      protocol,
+		HostIP:        hostIP,
+		HostPort:      hostPortInt,
+	}, true
+}
+
+// portBindingRanges returns the bindings of a container's HostConfig.PortBindings,
+// using the first binding of each port as remapping does
+func portBindingRanges(portBindings map[string]interface{}) []rangeBinding {
+	var bindings []rangeBinding
+	for containerPortProto, value := range portBindings {
+		hostIP, hostPort, ok := firstPortBinding(value)
+		parts := strings.Split(containerPortProto, "/")
+		if !ok || len(parts) != 2 {
+			continue
+		}
+		if b, ok := newRangeBinding(parts[0], parts[1], hostIP, hostPort); ok {
+			bindings = append(bindings, b)
+		}
+	}
+	return bindings
+}
+
+// mappingRanges returns the bindings of a tracked container's port mappings
+func mappingRanges(mappings []PortMapping) []rangeBinding {
+	var bindings []rangeBinding
+	seen := make(map[string]bool)
+	for _, mapping := range mappings {
+		b, ok := newRangeBinding(mapping.ContainerPort, mapping.Protocol, mapping.HostIP, mapping.HostPort)
+		if !ok || seen[b.Key] {
+			continue
+		}
+		seen[b.Key] = true
+		bindings = append(bindings, b)
+	}
+	return bindings
+}
+
+// publishedRanges finds the ranges among a container's bindings. Only bindings with the
+// same protocol and host IP can form a range.
+func publishedRanges(bindings []rangeBinding) []publishedRange {
+	sorted := append([]rangeBinding(nil), bindings...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Protocol != sorted[j].Protocol {
+			return sorted[i].Protocol < sorted[j].Protocol
+		}
+		if sorted[i].HostIP != sorted[j].HostIP {
+			return sorted[i].HostIP < sorted[j].HostIP
+		}
+		return sorted[i].ContainerPort < sorted[j].ContainerPort
+	})
+
+	var ranges []publishedRange
+	var run []rangeBinding
+	flush := func() {
+		if len(run) > 1 {
+			ranges = append(ranges, publishedRange{Bindings: run})
+		}
+		run = nil
+	}
+	for _, b := range sorted {
+		if len(run) > 0 {
+			last := run[len(run)-1]
+			if b.Protocol != last.Protocol || b.HostIP != last.HostIP ||
+				b.ContainerPort != last.ContainerPort+1 || b.HostPort != last.HostPort+1 {
+				flush()
+			}
+		}
+		run = append(run, b)
+	}
+	flush()
+	return ranges
+}
+
+// keepRangesTogether makes the remaps of a container, given as containerPort/protocol
+// -> new host port, move every published range as a whole. A range any of whose ports
+// is to be remapped gets a free block of the same size, and if there is none it is
+// left alone entirely, with its conflicts recorded for display. The single ports
+// already allocated for the range are released either way. It returns the ports now
+// moving as part of a block, by containerPort/protocol.
+func (s *ContainerStore) keepRangesTogether(containerID string, bindings []rangeBinding, portsToRemap, remapReasons map[string]string) map[string]bool {
+	blocks := make(map[string]bool)
+	for _, r := range publishedRanges(bindings) {
+		moving := 0
+		for _, b := range r.Bindings {
+			if _, ok := portsToRemap[b.Key]; ok {
+				moving++
+			}
+		}
+		if moving == 0 {
+			continue
+		}
+		for _, b := range r.Bindings {
+			if newPort, ok := portsToRemap[b.Key]; ok {
+				s.releasePortString(newPort)
+			}
+		}
+
+		first := r.Bindings[0]
+		start, err := s.allocateServicePortBlock(servicePortPolicy{}, first.HostIP, len(r.Bindings), []string{first.Protocol})
+		if err != nil {
+			log.Printf("Can't move range %s of container %s as a whole, leaving all of it alone: %v", r, containerID, err)
+			for _, b := range r.Bindings {
+				delete(portsToRemap, b.Key)
+				delete(remapReasons, b.Key)
+				s.recordConflict(containerID, strconv.Itoa(b.HostPort), strconv.Itoa(b.ContainerPort), b.Protocol)
+			}
+			continue
+		}
+
+		log.Printf("Moving range %s of container %s as a whole to %d-%d (%d of %d ports needed remapping)",
+			r, containerID, start, start+len(r.Bindings)-1, moving, len(r.Bindings))
+		for i, b := range r.Bindings {
+			if remapReasons[b.Key] == "" {
+				remapReasons[b.Key] = reasonWithRange
+			}
+			portsToRemap[b.Key] = strconv.Itoa(start + i)
+			blocks[b.Key] = true
+		}
+	}
+	return blocks
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestPublishedRanges(t *testing.T) {
+	binding := func(containerPort int, protocol, hostIP string, hostPort int) rangeBinding {
+		b, _ := newRangeBinding(strconv.Itoa(containerPort), protocol, hostIP, strconv.Itoa(hostPort))
+		return b
+	}
+	bindings := []rangeBinding{
+		binding(82, "tcp", "", 8002),
+		binding(80, "tcp", "", 8000),
+		binding(81, "tcp", "", 8001),
+		binding(90, "tcp", "", 9000),
+		binding(83, "udp", "", 8003),
+		binding(84, "udp", "", 8004),
+		binding(85, "udp", "127.0.0.1", 8005),
+	}
+
+	var got []string
+	for _, r := range publishedRanges(bindings) {
+		got = append(got, r.String())
+	}
+	want := []string{"8000-8002/tcp", "8003-8004/udp"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("publishedRanges found %v, want %v", got, want)
+	}
+}
+
+func TestEvaluateContainerMovesRangeOnce(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8000:80/tcp", "8001:81/tcp", "8002:82/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, KeepRanges: true})
+
+	s.evaluateContainer("aaaa")
+
+	changes := docker.changes()
+	if got, want := callNames(changes), []string{"stop", "rename", "run", "rm"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("docker was called with %v, want a single recreation %v", got, want)
+	}
+	var hostPorts []int
+	for _, spec := range flagValues(changes[2], "-p") {
+		_, _, hostPort := parseFakePublish(spec)
+		port, _ := strconv.Atoi(hostPort)
+		hostPorts = append(hostPorts, port)
+	}
+	sort.Ints(hostPorts)
+	if len(hostPorts) != 3 || hostPorts[1] != hostPorts[0]+1 || hostPorts[2] != hostPorts[0]+2 || hostPorts[0] < 20000 {
+		t.Errorf("range moved to %v, want a block of 3 in 20000-20999", hostPorts)
+	}
+}
+
+func TestEvaluateContainerRollsBackRange(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8000:80/tcp", "8001:81/tcp", "8002:82/tcp"}})
+	docker.failRuns()
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, KeepRanges: true})
+
+	s.evaluateContainer("aaaa")
+
+	changes := docker.changes()
+	if got, want := callNames(changes), []string{"stop", "rename", "run", "rename", "start"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("docker was called with %v, want one failed recreation rolled back %v", got, want)
+	}
+	containers := s.GetContainers()
+	if len(containers) != 1 || containers[0].ID != "aaaa" || containers[0].Names != "web" {
+		t.Fatalf("store holds %+v, want the original container back", containers)
+	}
+	var hostPorts []string
+	for _, mapping := range containers[0].PortMappings {
+		hostPorts = append(hostPorts, mapping.HostPort)
+	}
+	sort.Strings(hostPorts)
+	if !reflect.DeepEqual(hostPorts, []string{"8000", "8001", "8002"}) {
+		t.Errorf("original container publishes %v, want the whole range unchanged", hostPorts)
+	}
+}
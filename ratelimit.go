@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// remapLimiter is a token bucket bounding how many containers are recreated per
+// minute. It holds up to a minute's worth of tokens, so short bursts go through
+// at once while a sustained stream of remaps is spread out.
+type remapLimiter struct {
+	mu        sync.Mutex
+	perMinute int
+	tokens    float64   // Tokens left, negative when remaps are queued for future tokens
+	last      time.Time // When tokens was last refilled
+}
+
+// newRemapLimiter returns a limiter allowing perMinute remaps a minute, or nil if
+// perMinute is not positive, meaning remaps are not limited
+func newRemapLimiter(perMinute int) *remapLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &remapLimiter{perMinute: perMinute, tokens: float64(perMinute), last: time.Now()}
+}
+
+// reserve takes a token and returns how long to wait before it may be used. Tokens
+// are handed out in order, so remaps that have to wait run in the order they arrived.
+func (l *remapLimiter) reserve() time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	rate := float64(l.perMinute) / float64(time.Minute)
+	l.tokens += float64(now.Sub(l.last)) * rate
+	if l.tokens > float64(l.perMinute) {
+		l.tokens = float64(l.perMinute)
+	}
+	l.last = now
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / rate)
+}
+
+// waitForRemapSlot delays a remap until the -max-remaps-per-minute limit allows it.
+// Remaps over the limit are deferred rather than dropped; it only fails if the store
+// is stopped while waiting. It reports whether the remap had to wait.
+func (s *ContainerStore) waitForRemapSlot(containerID string) (bool, error) {
+	delay := s.remapLimiter.reserve()
+	if delay <= 0 {
+		return false, nil
+	}
+	log.Printf("Remap limit of %d per minute reached, delaying remap of container %s by %v",
+		s.remapLimiter.perMinute, containerID, delay.Round(time.Second))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true, nil
+	case <-s.context().Done():
+		return true, fmt.Errorf("remap of container %s cancelled while waiting for the rate limit", containerID)
+	}
+}
+
+// reclaimAfterWait checks that a host port allocated before its remap was delayed is
+// still free, since the claim may have expired and something else bound the port in
+// the meantime, and renews the claim. A port that was taken is replaced by another
+// one from the range, unless the port itself is required, as when restoring.
+func (s *ContainerStore) reclaimAfterWait(hostIP, port, protocol string, required bool) (string, error) {
+	portInt, err := strconv.Atoi(port)
+	if err != nil {
+		return "", fmt.Errorf("invalid host port %q", port)
+	}
+	s.releasePort(portInt)
+	if s.isPortAvailableFor(hostIP, portInt, []string{protocol}) && s.claimPort(portInt) {
+		return port, nil
+	}
+	if required {
+		return "", fmt.Errorf("host port %s/%s was taken while the remap was delayed", port, protocol)
+	}
+	newPort, err := s.allocateRandomPortOn(hostIP, []string{protocol})
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Host port %s/%s was taken while the remap was delayed, using %d instead", port, protocol, newPort)
+	return strconv.Itoa(newPort), nil
+}
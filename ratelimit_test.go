@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRemapLimiterReserve(t *testing.T) {
+	if newRemapLimiter(0) != nil {
+		t.Error("a limit of 0 isn't unlimited")
+	}
+	var unlimited *remapLimiter
+	if delay := unlimited.reserve(); delay != 0 {
+		t.Errorf("unlimited remaps were delayed by %v", delay)
+	}
+
+	// One token a second, with a minute's worth available up front
+	l := newRemapLimiter(60)
+	for i := 0; i < 60; i++ {
+		if delay := l.reserve(); delay != 0 {
+			t.Fatalf("remap %d within the burst was delayed by %v", i+1, delay)
+		}
+	}
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		delay := l.reserve()
+		if delay < want-100*time.Millisecond || delay > want {
+			t.Errorf("remap %d over the limit was delayed by %v, want about %v", i+1, delay, want)
+		}
+	}
+}
+
+func TestRemapOverLimitIsDelayedNotDropped(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{ID: "aaaa", Name: "web", Ports: []string{"8080:80/tcp"}})
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, MaxRemapsPerMinute: 60})
+	defer s.Stop()
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+	// Use up the burst, so the next remap waits a second for a token
+	s.remapLimiter.tokens = 0
+
+	done := make(chan struct{})
+	go func() {
+		s.evaluateContainer("aaaa")
+		close(done)
+	}()
+	// Don't leave the remap running past the test, even when it fails early
+	t.Cleanup(func() { <-done })
+	time.Sleep(500 * time.Millisecond)
+	if changes := docker.changes(); len(changes) != 0 {
+		t.Fatalf("docker was called with %v before the limit allowed a remap", callNames(changes))
+	}
+
+	<-done
+	recreated := false
+	for _, args := range docker.changes() {
+		recreated = recreated || args[0] == "run"
+	}
+	if !recreated {
+		t.Errorf("delayed remap was dropped, docker was called with %v", callNames(docker.changes()))
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// projectSettler holds back the evaluation of started Compose containers until their
+// project has had no new starts for a delay, so a project coming up isn't stopped
+// and recreated service by service while depends_on is still starting the rest
+type projectSettler struct {
+	mu      sync.Mutex
+	delay   time.Duration
+	pending map[string][]string    // Project -> containers started since it last settled, in start order
+	timers  map[string]*time.Timer // Project -> timer firing once it has settled
+}
+
+// newProjectSettler returns a settler waiting for delay, or nil if delay is not
+// positive, meaning started containers are evaluated right away
+func newProjectSettler(delay time.Duration) *projectSettler {
+	if delay <= 0 {
+		return nil
+	}
+	return &projectSettler{
+		delay:   delay,
+		pending: make(map[string][]string),
+		timers:  make(map[string]*time.Timer),
+	}
+}
+
+// add queues a started container of a project and restarts the project's delay.
+// settled is called with the queued containers once the delay passes without
+// another start.
+func (p *projectSettler) add(project, containerID string, settled func(containerIDs []string)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pending[project] = append(p.pending[project], containerID)
+	if timer, exists := p.timers[project]; exists {
+		timer.Stop()
+	}
+	p.timers[project] = time.AfterFunc(p.delay, func() {
+		p.mu.Lock()
+		containerIDs := p.pending[project]
+		delete(p.pending, project)
+		delete(p.timers, project)
+		p.mu.Unlock()
+		if len(containerIDs) > 0 {
+			settled(containerIDs)
+		}
+	})
+}
+
+// evaluateWhenSettled evaluates a started container once its Compose project has
+// settled, as set up by -remap-delay. It returns false if the container isn't held
+// back, because no delay is set or it doesn't belong to a project.
+func (s *ContainerStore) evaluateWhenSettled(containerID string) bool {
+	if s.projectSettler == nil {
+		return false
+	}
+	project := extractLabel(s.context(), containerID, "com.docker.compose.project")
+	if project == "" {
+		return false
+	}
+
+	log.Printf("Container %s of project %s started, waiting for the project to settle", containerID, project)
+	s.projectSettler.add(project, containerID, func(containerIDs []string) {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		if s.Paused() {
+			log.Printf("Management is paused, not checking %d started containers of project %s", len(containerIDs), project)
+			return
+		}
+		log.Printf("Project %s has settled, checking %d started containers", project, len(containerIDs))
+		for _, id := range containerIDs {
+			s.evaluateContainer(id)
+		}
+	})
+	return true
+}
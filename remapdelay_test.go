@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProjectSettler(t *testing.T) {
+	if newProjectSettler(0) != nil {
+		t.Errorf("newProjectSettler(0) should evaluate started containers right away")
+	}
+
+	const delay = 100 * time.Millisecond
+	p := newProjectSettler(delay)
+	app, other := make(chan []string, 1), make(chan []string, 1)
+
+	start := time.Now()
+	p.add("app", "a", func(containerIDs []string) { app <- containerIDs })
+	time.Sleep(delay / 2)
+	p.add("app", "b", func(containerIDs []string) { app <- containerIDs })
+	p.add("other", "c", func(containerIDs []string) { other <- containerIDs })
+
+	// The second start restarts the delay of its own project only
+	if got := <-app; !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("project app settled with %v, want [a b]", got)
+	}
+	if elapsed := time.Since(start); elapsed < delay+delay/2 {
+		t.Errorf("project app settled after %s, want at least %s after its first start", elapsed, delay+delay/2)
+	}
+	if got := <-other; !reflect.DeepEqual(got, []string{"c"}) {
+		t.Errorf("project other settled with %v, want [c]", got)
+	}
+
+	select {
+	case got := <-app:
+		t.Errorf("project app settled again with %v", got)
+	case <-time.After(2 * delay):
+	}
+}
+
+func TestEvaluateWhenSettledDefersRemap(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.addContainer(fakeContainer{
+		ID:     "aaaa",
+		Name:   "app-web-1",
+		Ports:  []string{"8080:80/tcp"},
+		Labels: map[string]string{"com.docker.compose.project": "app", "com.docker.compose.service": "web"},
+	})
+	const delay = 300 * time.Millisecond
+	s := NewContainerStore(StoreOptions{PortRangeMin: 20000, PortRangeMax: 20999, RemapDelay: delay})
+
+	if !s.evaluateWhenSettled("aaaa") {
+		t.Fatalf("container of project app wasn't held back")
+	}
+	time.Sleep(delay / 2)
+	if changes := docker.changes(); len(changes) != 0 {
+		t.Fatalf("docker was called with %v before the project settled", callNames(changes))
+	}
+
+	// Wait for the remap to finish, up to the refresh after the recreation
+	remapped := func() bool {
+		containers := s.GetContainers()
+		return len(containers) == 1 && len(containers[0].PortMappings) == 1 && containers[0].PortMappings[0].HostPort != "8080"
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for !remapped() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got, want := callNames(docker.changes()), []string{"stop", "rename", "run", "rm"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("docker was called with %v once the project settled, want %v", got, want)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// maxRemapEvents is how many recent remap events are kept for clients to catch up on
+const maxRemapEvents = 100
+
+// RemapEvent describes a completed remap. Seq increases by one with every event, so
+// clients can use the last one they saw as a cursor.
+type RemapEvent struct {
+	Seq            uint64    `json:"seq"`
+	Time           time.Time `json:"time"`
+	ContainerID    string    `json:"containerId"`
+	NewContainerID string    `json:"newContainerId"`
+	ContainerName  string    `json:"containerName"`
+	Service        string    `json:"service"` // Compose project/service, or the container name, see remapHistoryKey
+	ContainerPort  string    `json:"containerPort"`
+	Protocol       string    `json:"protocol"`
+	OldHostPort    string    `json:"oldHostPort"`
+	NewHostPort    string    `json:"newHostPort"`
+	Reason         string    `json:"reason,omitempty"`
+}
+
+// publishRemapEvent records a completed remap, adding it to the history of its
+// service, and wakes everyone waiting for one
+func (s *ContainerStore) publishRemapEvent(event RemapEvent) {
+	s.mu.Lock()
+	s.remapSeq++
+	event.Seq = s.remapSeq
+	event.Time = time.Now()
+	s.remapEvents = append(s.remapEvents, event)
+	if len(s.remapEvents) > maxRemapEvents {
+		s.remapEvents = s.remapEvents[len(s.remapEvents)-maxRemapEvents:]
+	}
+	s.recordRemapHistory(event)
+
+	// Closing the channel wakes every waiter at once; later waiters get a new one
+	close(s.remapNotify)
+	s.remapNotify = make(chan struct{})
+	s.mu.Unlock()
+
+	s.saveState()
+}
+
+// RemapCursor returns the sequence number of the latest remap event
+func (s *ContainerStore) RemapCursor() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.remapSeq
+}
+
+// remapEventsSince returns the retained events after a cursor, the cursor to continue
+// from, and a channel closed when the next event is published. A cursor from before
+// a restart, ahead of the latest event, starts over with all retained events.
+func (s *ContainerStore) remapEventsSince(cursor uint64) ([]RemapEvent, uint64, <-chan struct{}) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if cursor > s.remapSeq {
+		cursor = 0
+	}
+	var events []RemapEvent
+	for _, event := range s.remapEvents {
+		if event.Seq > cursor {
+			events = append(events, event)
+		}
+	}
+	return events, s.remapSeq, s.remapNotify
+}
+
+// WaitForRemaps returns the remap events after a cursor, blocking until there is at
+// least one or ctx is done. It also returns the cursor to pass on the next call.
+func (s *ContainerStore) WaitForRemaps(ctx context.Context, cursor uint64) ([]RemapEvent, uint64) {
+	for {
+		events, latest, notify := s.remapEventsSince(cursor)
+		if len(events) > 0 {
+			return events, latest
+		}
+		select {
+		case <-ctx.Done():
+			return []RemapEvent{}, latest
+		case <-notify:
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxRemapHistory is how many remaps are kept in the history of each service
+const maxRemapHistory = 100
+
+// RemapHistoryEntry records one remap in the history of a service
+type RemapHistoryEntry struct {
+	Time          time.Time `json:"time"`
+	Service       string    `json:"service"`
+	ContainerName string    `json:"containerName"`
+	ContainerPort string    `json:"containerPort"`
+	Protocol      string    `json:"protocol"`
+	From          string    `json:"from"`
+	To            string    `json:"to"`
+	Reason        string    `json:"reason,omitempty"`
+}
+
+// remapHistoryKey names the logical service a container belongs to, which outlives
+// the container IDs that change with every remap: project/service for Compose
+// containers, otherwise the container name without the port suffix of -name-suffix
+func remapHistoryKey(labels map[string]interface{}, containerName string) string {
+	project, _ := labels["com.docker.compose.project"].(string)
+	service, _ := labels["com.docker.compose.service"].(string)
+	if project != "" && service != "" {
+		return project + "/" + service
+	}
+	return portSuffixRegex.ReplaceAllString(strings.TrimPrefix(containerName, "/"), "")
+}
+
+// recordRemapHistory adds a completed remap to the history of its service. The
+// caller must hold s.mu.
+func (s *ContainerStore) recordRemapHistory(event RemapEvent) {
+	if event.Service == "" {
+		return
+	}
+	if s.remapHistory == nil {
+		s.remapHistory = make(map[string][]RemapHistoryEntry)
+	}
+	history := append(s.remapHistory[event.Service], RemapHistoryEntry{
+		Time:          event.Time,
+		Service:       event.Service,
+		ContainerName: event.ContainerName,
+		ContainerPort: event.ContainerPort,
+		Protocol:      event.Protocol,
+		From:          event.OldHostPort,
+		To:            event.NewHostPort,
+		Reason:        event.Reason,
+	})
+	if len(history) > maxRemapHistory {
+		history = history[len(history)-maxRemapHistory:]
+	}
+	s.remapHistory[event.Service] = history
+}
+
+// RemapHistory returns the remaps of a service in chronological order. The service is
+// matched against the container name of standalone containers and against both the
+// Compose service name and project/service, so web finds app1/web and app2/web while
+// app1/web finds only the former. An empty service returns the remaps of all services.
+func (s *ContainerStore) RemapHistory(service string) []RemapHistoryEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	history := []RemapHistoryEntry{}
+	for key, entries := range s.remapHistory {
+		if service == "" || key == service || strings.HasSuffix(key, "/"+service) {
+			history = append(history, entries...)
+		}
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Time.Before(history[j].Time)
+	})
+	return history
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// labelRequirement is one term of a label selector: either "key=value", or "key"
+// which only requires the label to be present
+type labelRequirement struct {
+	Key      string
+	Value    string
+	HasValue bool
+}
+
+// labelSelector selects containers whose labels satisfy all of its requirements
+type labelSelector []labelRequirement
+
+// parseLabelSelector parses a comma-separated selector such as
+// "com.mycorp.managed=true,com.mycorp.team"
+func parseLabelSelector(value string) (labelSelector, error) {
+	var selector labelSelector
+	for _, term := range strings.Split(value, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		key, val, hasValue := strings.Cut(term, "=")
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return nil, fmt.Errorf("invalid selector term %q: missing label key", term)
+		}
+		selector = append(selector, labelRequirement{
+			Key:      key,
+			Value:    strings.TrimSpace(val),
+			HasValue: hasValue,
+		})
+	}
+	return selector, nil
+}
+
+// Matches reports whether a container's labels satisfy the selector. An empty
+// selector matches every container.
+func (sel labelSelector) Matches(labels map[string]string) bool {
+	for _, req := range sel {
+		value, ok := labels[req.Key]
+		if !ok || (req.HasValue && value != req.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterArgs returns the docker ps filters that select the same containers
+func (sel labelSelector) filterArgs() []string {
+	var args []string
+	for _, req := range sel {
+		filter := "label=" + req.Key
+		if req.HasValue {
+			filter += "=" + req.Value
+		}
+		args = append(args, "--filter", filter)
+	}
+	return args
+}
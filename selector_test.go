@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLabelSelectorMatches(t *testing.T) {
+	labels := map[string]string{"com.mycorp.managed": "true", "com.mycorp.team": "web", "empty": ""}
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"", true},
+		{"com.mycorp.managed=true", true},
+		{"com.mycorp.managed=false", false},
+		{"com.mycorp.team", true},
+		{"com.mycorp.owner", false},
+		{"com.mycorp.managed=true, com.mycorp.team", true},
+		{"com.mycorp.managed=true,com.mycorp.owner", false},
+		{"empty=", true},
+		{"empty=x", false},
+	}
+	for _, tt := range tests {
+		selector, err := parseLabelSelector(tt.selector)
+		if err != nil {
+			t.Errorf("parseLabelSelector(%q) failed: %v", tt.selector, err)
+			continue
+		}
+		if got := selector.Matches(labels); got != tt.want {
+			t.Errorf("selector %q matches %v, want %v", tt.selector, got, tt.want)
+		}
+	}
+
+	if _, err := parseLabelSelector("=true"); err == nil {
+		t.Error("selector without a key was accepted")
+	}
+}
+
+func TestLabelSelectorFilterArgs(t *testing.T) {
+	selector, err := parseLabelSelector("com.mycorp.managed=true,com.mycorp.team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"--filter", "label=com.mycorp.managed=true", "--filter", "label=com.mycorp.team"}
+	if got := selector.filterArgs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("filterArgs() = %q, want %q", got, want)
+	}
+}
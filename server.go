@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serverTimeouts bounds how long the web server waits on clients, so slow or hung
+// connections can't tie it up. Zero disables a timeout.
+type serverTimeouts struct {
+	Read  time.Duration // Reading a whole request, headers included
+	Write time.Duration // Writing a response, from the end of the request headers
+	Idle  time.Duration // Waiting for the next request on a keep-alive connection
+}
+
+// newHTTPServer builds the web server with the given timeouts. Handlers that
+// legitimately take longer than the write timeout, such as long polls, extend
+// their own deadline.
+func newHTTPServer(addr string, handler http.Handler, timeouts serverTimeouts) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: timeouts.Read,
+		ReadTimeout:       timeouts.Read,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
+	}
+}
+
+// serveUntilDone runs the server until ctx is done, e.g. because a shutdown signal
+// arrived, then stops accepting connections and waits up to shutdownTimeout for
+// in-flight requests to finish before closing what is left. Long polls are ended
+// right away so they don't hold up the shutdown.
+func serveUntilDone(ctx context.Context, server *http.Server, shutdownTimeout time.Duration) error {
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	server.BaseContext = func(net.Listener) context.Context { return requestCtx }
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		// The server never got going, e.g. because the port is taken
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Received shutdown signal, gracefully shutting down...")
+	cancelRequests()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Requests still running after %v, closing their connections: %v", shutdownTimeout, err)
+		server.Close()
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
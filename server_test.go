@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewHTTPServerTimeouts(t *testing.T) {
+	timeouts := serverTimeouts{Read: 5 * time.Second, Write: 10 * time.Second, Idle: time.Minute}
+	server := newHTTPServer(":5000", http.NotFoundHandler(), timeouts)
+	if server.Addr != ":5000" {
+		t.Errorf("Addr = %q, want :5000", server.Addr)
+	}
+	if server.ReadHeaderTimeout != timeouts.Read || server.ReadTimeout != timeouts.Read {
+		t.Errorf("read timeouts = %v and %v, want %v", server.ReadHeaderTimeout, server.ReadTimeout, timeouts.Read)
+	}
+	if server.WriteTimeout != timeouts.Write || server.IdleTimeout != timeouts.Idle {
+		t.Errorf("write and idle timeouts = %v and %v, want %v and %v", server.WriteTimeout, server.IdleTimeout, timeouts.Write, timeouts.Idle)
+	}
+}
+
+func TestReadTimeoutDropsSlowClients(t *testing.T) {
+	server := newHTTPServer("", http.NotFoundHandler(), serverTimeouts{Read: 100 * time.Millisecond})
+	ts := httptest.NewUnstartedServer(server.Handler)
+	ts.Config = server
+	ts.Start()
+	defer ts.Close()
+
+	// A client that never finishes its headers is cut off
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("connection wasn't closed by the server: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("slow client was only dropped after %v", elapsed)
+	}
+}
+
+func TestServeUntilDoneDrainsRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(w, "done")
+	})
+	server := newHTTPServer(addr, mux, serverTimeouts{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- serveUntilDone(ctx, server, 5*time.Second)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	response := make(chan result, 1)
+	go func() {
+		var resp *http.Response
+		var err error
+		// The server may take a moment to start listening
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if resp, err = http.Get("http://" + addr + "/slow"); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			response <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		response <- result{string(body), err}
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("request never reached the server")
+	}
+	cancel()
+
+	got := <-response
+	if got.err != nil || got.body != "done" {
+		t.Errorf("in-flight request got %q, %v, want it to complete", got.body, got.err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serveUntilDone = %v, want a clean shutdown", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("server didn't shut down")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+// writeSnapshot writes the containers and their port mappings to path as the same JSON
+// GET /api/containers returns, so other tools can read it without the API. The file
+// is replaced atomically, so readers never see a partial snapshot.
+func writeSnapshot(store *ContainerStore, path string) error {
+	containers := sortContainers(store.GetContainers(), "name")
+	if containers == nil {
+		containers = []Container{}
+	}
+
+	var data bytes.Buffer
+	if err := json.NewEncoder(&data).Encode(containers); err != nil {
+		return fmt.Errorf("failed to encode snapshot: %v", err)
+	}
+	if err := writeFileAtomic(path, data.Bytes()); err != nil {
+		return fmt.Errorf("failed to write snapshot %s: %v", path, err)
+	}
+	return nil
+}
+
+// runSnapshotWriter rewrites the snapshot file every interval while the server runs,
+// as set up by -snapshot
+func runSnapshotWriter(store *ContainerStore, path string, interval time.Duration) {
+	log.Printf("Writing a snapshot of the containers to %s every %s", path, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := writeSnapshot(store, path); err != nil {
+			log.Printf("Error: %v", err)
+		}
+		select {
+		case <-store.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runSnapshotCommand writes a snapshot of the current containers once,
+// e.g. dynamic-port-mapper snapshot --out status.json
+func runSnapshotCommand(store *ContainerStore, args []string) error {
+	snapshotFlags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	out := snapshotFlags.String("out", "", "File to write the snapshot to")
+	snapshotFlags.Parse(args)
+	if *out == "" {
+		return fmt.Errorf("missing output file. Usage: dynamic-port-mapper snapshot --out <file>")
+	}
+
+	if err := store.refreshContainers(); err != nil {
+		return err
+	}
+	return writeSnapshot(store, *out)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteSnapshot(t *testing.T) {
+	store := NewContainerStore(StoreOptions{})
+	store.containers["b"] = Container{
+		ID:           "b",
+		Names:        "web",
+		Status:       "Up 1 minute",
+		PortMappings: []PortMapping{{ContainerPort: "80", HostPort: "20001", Protocol: "tcp", OriginalPort: "8080"}},
+		DynamicPorts: true,
+		StartedAt:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		RestartCount: 2,
+	}
+	store.containers["a"] = Container{ID: "a", Names: "db", Status: "Up 1 minute"}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "status.json")
+	if err := os.WriteFile(path, []byte("stale"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSnapshot(store, path); err != nil {
+		t.Fatalf("writeSnapshot failed: %v", err)
+	}
+
+	// The old file is replaced, without a temporary file left behind
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "status.json" {
+		t.Errorf("snapshot directory holds %v, want only status.json", files)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var containers []Container
+	if err := json.Unmarshal(data, &containers); err != nil {
+		t.Fatalf("snapshot isn't valid JSON: %v", err)
+	}
+	if want := sortContainers(store.GetContainers(), "name"); !reflect.DeepEqual(containers, want) {
+		t.Errorf("snapshot parses back to %+v, want %+v", containers, want)
+	}
+
+	// The snapshot is exactly what the API returns
+	w := httptest.NewRecorder()
+	app := &Application{containerStore: store}
+	app.apiContainersHandler(w, httptest.NewRequest(http.MethodGet, "/api/containers", nil))
+	if w.Body.String() != string(data) {
+		t.Errorf("snapshot is %s, but the API returns %s", data, w.Body.String())
+	}
+}
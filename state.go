@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// persistedState is the on-disk form of the tracking state kept in the state file
+type persistedState struct {
+	ProcessedContainers []string                       `json:"processedContainers"`
+	RemapIntents        []RemapIntent                  `json:"remapIntents,omitempty"` // Remaps recorded in plan-only mode
+	RemapHistory        map[string][]RemapHistoryEntry `json:"remapHistory,omitempty"` // Completed remaps of each service
+}
+
+// loadState restores the tracking state from the state file, if one is configured
+func (s *ContainerStore) loadState() error {
+	if s.stateFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.stateFile)
+	if os.IsNotExist(err) {
+		// Nothing saved yet
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse state file %s: %v", s.stateFile, err)
+	}
+
+	s.mu.Lock()
+	for _, id := range state.ProcessedContainers {
+		s.processedContainers[id] = true
+	}
+	s.remapIntents = state.RemapIntents
+	s.remapHistory = state.RemapHistory
+	s.mu.Unlock()
+
+	log.Printf("Loaded %d processed containers from state file %s", len(state.ProcessedContainers), s.stateFile)
+	return nil
+}
+
+// saveState writes the tracking state to the state file, if one is configured.
+// The file is replaced atomically so a crash never leaves it half written.
+func (s *ContainerStore) saveState() {
+	if s.stateFile == "" || s.dryRun || s.keepStateFile {
+		return
+	}
+
+	s.mu.RLock()
+	var state persistedState
+	for id, processed := range s.processedContainers {
+		if processed {
+			state.ProcessedContainers = append(state.ProcessedContainers, id)
+		}
+	}
+	state.RemapIntents = append(state.RemapIntents, s.remapIntents...)
+	if len(s.remapHistory) > 0 {
+		state.RemapHistory = make(map[string][]RemapHistoryEntry, len(s.remapHistory))
+		for service, history := range s.remapHistory {
+			state.RemapHistory[service] = append([]RemapHistoryEntry{}, history...)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Strings(state.ProcessedContainers)
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode state: %v", err)
+		return
+	}
+
+	if err := writeFileAtomic(s.stateFile, data); err != nil {
+		log.Printf("Failed to write state file %s: %v", s.stateFile, err)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it into place
+func writeFileAtomic(path string, data []byte) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
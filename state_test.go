@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeepStateFile(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	const daemonState = `{"processedContainers":["abc"]}`
+	if err := os.WriteFile(stateFile, []byte(daemonState), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewContainerStore(StoreOptions{StateFile: stateFile, KeepStateFile: true})
+	s.processedContainers["def"] = true
+	s.saveState()
+
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != daemonState {
+		t.Errorf("state file was rewritten to %s", data)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// containerStatuses are the container states docker ps can filter on
+var containerStatuses = map[string]bool{
+	"created":    true,
+	"restarting": true,
+	"running":    true,
+	"removing":   true,
+	"paused":     true,
+	"exited":     true,
+	"dead":       true,
+}
+
+// containerStates selects containers by state, such as "running,paused". The health
+// states "healthy" and "unhealthy" narrow the selection further instead of adding to it.
+type containerStates struct {
+	Statuses []string
+	Health   []string
+}
+
+// parseContainerStates parses a comma-separated list of container states
+func parseContainerStates(value string) (containerStates, error) {
+	var states containerStates
+	for _, state := range strings.Split(value, ",") {
+		state = strings.ToLower(strings.TrimSpace(state))
+		switch {
+		case state == "":
+			continue
+		case containerStatuses[state]:
+			states.Statuses = append(states.Statuses, state)
+		case state == "healthy" || state == "unhealthy" || state == "starting":
+			states.Health = append(states.Health, state)
+		default:
+			return containerStates{}, fmt.Errorf("unknown container state %q", state)
+		}
+	}
+	return states, nil
+}
+
+// filterArgs returns the docker ps filters that select containers in these states.
+// Docker ORs repeated filters of one kind and ANDs different kinds.
+func (states containerStates) filterArgs() []string {
+	var args []string
+	for _, status := range states.Statuses {
+		args = append(args, "--filter", "status="+status)
+	}
+	for _, health := range states.Health {
+		args = append(args, "--filter", "health="+health)
+	}
+	return args
+}
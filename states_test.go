@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestContainerStatesFilterArgs(t *testing.T) {
+	tests := []struct {
+		states string
+		want   []string
+	}{
+		{"", nil},
+		{"running", []string{"--filter", "status=running"}},
+		{"Running, paused,restarting", []string{"--filter", "status=running", "--filter", "status=paused", "--filter", "status=restarting"}},
+		{"running,healthy", []string{"--filter", "status=running", "--filter", "health=healthy"}},
+	}
+	for _, tt := range tests {
+		states, err := parseContainerStates(tt.states)
+		if err != nil {
+			t.Errorf("parseContainerStates(%q) failed: %v", tt.states, err)
+			continue
+		}
+		if got := states.filterArgs(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("states %q filter with %q, want %q", tt.states, got, tt.want)
+		}
+	}
+
+	if _, err := parseContainerStates("running,sleeping"); err == nil {
+		t.Error("unknown state was accepted")
+	}
+}
+
+func TestRefreshFiltersByStates(t *testing.T) {
+	fake := newFakeDocker(t)
+	states, err := parseContainerStates("running,paused")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewContainerStore(StoreOptions{States: states})
+	if err := s.refreshContainers(); err != nil {
+		t.Fatalf("refreshContainers failed: %v", err)
+	}
+
+	var filters []string
+	for _, args := range fake.calls() {
+		if args[0] == "ps" {
+			filters = append(filters, flagValues(args, "--filter")...)
+		}
+	}
+	if want := []string{"status=running", "status=paused"}; !reflect.DeepEqual(filters, want) {
+		t.Errorf("docker ps was filtered by %q, want %q", filters, want)
+	}
+}
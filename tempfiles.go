@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// tempRoot is the directory under the system temp dir holding one subdirectory of
+// generated files per running process, named after its pid
+func tempRoot() string {
+	return filepath.Join(os.TempDir(), "dynamic-port-mapper")
+}
+
+// runTempDir returns the directory for files generated by this process, creating it
+// if needed
+func runTempDir() (string, error) {
+	dir := filepath.Join(tempRoot(), strconv.Itoa(os.Getpid()))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	return dir, nil
+}
+
+// remappedComposePath returns where the remapped version of a compose file is written,
+// e.g. <tmp>/dynamic-port-mapper/<pid>/docker-compose.remapped.yml
+func remappedComposePath(composeFile string) (string, error) {
+	dir, err := runTempDir()
+	if err != nil {
+		return "", err
+	}
+	base := filepath.Base(composeFile)
+	ext := filepath.Ext(base)
+	if ext == "" {
+		ext = ".yml"
+	}
+	return filepath.Join(dir, strings.TrimSuffix(base, filepath.Ext(base))+".remapped"+ext), nil
+}
+
+// removeRunTempDir removes the files generated by this process
+func removeRunTempDir() {
+	dir := filepath.Join(tempRoot(), strconv.Itoa(os.Getpid()))
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Warning: Failed to remove temporary directory %s: %v", dir, err)
+	}
+}
+
+// cleanupStaleTempDirs removes the generated files of earlier runs whose process is
+// no longer running, e.g. because it crashed before cleaning up after itself
+func cleanupStaleTempDirs() {
+	entries, err := os.ReadDir(tempRoot())
+	if err != nil {
+		return // Nothing was ever generated
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() || pid == os.Getpid() || processAlive(pid) {
+			continue
+		}
+		dir := filepath.Join(tempRoot(), entry.Name())
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Warning: Failed to remove stale temporary directory %s: %v", dir, err)
+			continue
+		}
+		log.Printf("Removed temporary files left behind by process %d", pid)
+	}
+}
+
+// processAlive reports whether a process with the given pid exists
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	// EPERM means the process exists but belongs to another user
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
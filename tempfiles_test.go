@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestCleanupStaleTempDirs(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	// A process that has exited leaves a pid nothing runs under any more
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	deadPid := cmd.Process.Pid
+
+	dirs := map[string]bool{ // Whether each directory should survive
+		strconv.Itoa(deadPid):      false,
+		strconv.Itoa(os.Getpid()):  true,
+		strconv.Itoa(os.Getppid()): true,
+		"not-a-pid":                true,
+	}
+	for name := range dirs {
+		if err := os.MkdirAll(filepath.Join(tempRoot(), name), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(tempRoot(), name, "docker-compose.remapped.yml"), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cleanupStaleTempDirs()
+	for name, keep := range dirs {
+		_, err := os.Stat(filepath.Join(tempRoot(), name))
+		if exists := err == nil; exists != keep {
+			t.Errorf("directory %s exists = %v, want %v", name, exists, keep)
+		}
+	}
+}
+
+func TestRemappedComposePath(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	defer removeRunTempDir()
+
+	path, err := remappedComposePath("/srv/app/docker-compose.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(tempRoot(), strconv.Itoa(os.Getpid()), "docker-compose.remapped.yaml")
+	if path != want {
+		t.Errorf("remappedComposePath = %s, want %s", path, want)
+	}
+	if _, err := os.Stat(filepath.Dir(path)); err != nil {
+		t.Errorf("run directory wasn't created: %v", err)
+	}
+}